@@ -1,12 +1,24 @@
 package CA
 
 import (
+	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"CTngV2/util"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -153,3 +165,208 @@ func testTask(t *testing.T) {
 	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
 	StartCA(ctx)
 }
+
+// An STH of the logger signed with the first crypto config.
+func testSignedSTH(t *testing.T, configs []crypto.CryptoConfig, logger string, period string) definition.Gossip_object {
+	tree, _ := json.Marshal(definition.STH{Signer: logger, Period: period, RootHash: "\x01\x02", TreeSize: 64})
+	payload := [3]string{logger, string(tree), ""}
+	sig, err := configs[0].Sign([]byte(payload[0] + payload[1] + payload[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definition.Gossip_object{
+		Application:   definition.CTNG_APPLICATION,
+		Type:          definition.STH_INIT,
+		Period:        period,
+		Signer:        logger,
+		Signature:     [2]string{sig.String(), ""},
+		Crypto_Scheme: sig.Scheme,
+		Payload:       payload,
+	}
+}
+
+func TestInspectCTngextension(t *testing.T) {
+	configs, err := crypto.GenerateEntityCryptoConfigs([]crypto.CTngID{"localhost:9000", "localhost:9100"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sth := testSignedSTH(t, configs, "localhost:9000", "4")
+	payload := sth.Payload
+	forged := sth
+	forged.Payload[1] = strings.Replace(payload[1], "64", "65", 1)
+	poi := ProofOfInclusion{SiblingHashes: [][]byte{{0xaa}, {0xbb}, {0xcc}}, NeighborHash: []byte{0xdd}, LoggerID: "localhost:9000"}
+	ext := CTngExtension{SequenceNumber: SequenceNumber{RID: 7}, LoggerInformation: []LoggerInfo{{STH: sth, POI: poi}, {STH: forged, POI: poi}}}
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "localhost:9100"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: OIDCTngExtension, Value: EncodeCTngExtension(ext)}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	inspection, err := Inspect_CTngextension(cert, &configs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.RID != 7 || len(inspection.Loggers) != 2 || inspection.Encoding != "der" {
+		t.Fatalf("Unexpected inspection %+v", inspection)
+	}
+	first := inspection.Loggers[0]
+	if first.STH.Signer != "localhost:9000" || first.STH.Period != "4" || first.STH.TreeSize != 64 || first.STH.RootHash != "0102" || first.STH.Signature != STH_SIGNATURE_VALID {
+		t.Errorf("Unexpected STH %+v", first.STH)
+	}
+	if first.POI.Depth != 3 || first.POI.SiblingHashes[1] != "bb" || first.POI.NeighborHash != "dd" {
+		t.Errorf("Unexpected POI %+v", first.POI)
+	}
+	if inspection.Loggers[1].STH.Signature != STH_SIGNATURE_INVALID {
+		t.Error("Forged STH signature verified")
+	}
+	// without crypto config the signatures are not checked
+	inspection, _ = Inspect_CTngextension(cert, nil)
+	if inspection.Loggers[1].STH.Signature != STH_SIGNATURE_NOT_CHECKED {
+		t.Error("STH signature checked without crypto config")
+	}
+	var text strings.Builder
+	inspection.Write_text(&text)
+	if !strings.Contains(text.String(), "RID: 7") || !strings.Contains(text.String(), "sibling: cc") {
+		t.Errorf("Unexpected text:\n%s", text.String())
+	}
+}
+
+func TestCTngExtensionEncoding(t *testing.T) {
+	configs, err := crypto.GenerateEntityCryptoConfigs([]crypto.CTngID{"localhost:9000", "localhost:9001"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poi := ProofOfInclusion{SiblingHashes: [][]byte{{0xaa}, {0xbb}}, NeighborHash: []byte{0xcc}, LoggerID: "localhost:9000", SubjectKeyId: []byte{1}}
+	ext := CTngExtension{
+		SequenceNumber:    SequenceNumber{RID: 12},
+		LoggerInformation: []LoggerInfo{{STH: testSignedSTH(t, configs, "localhost:9000", "3"), POI: poi}, {STH: testSignedSTH(t, configs, "localhost:9000", "4"), POI: poi}},
+	}
+	der := EncodeCTngExtension(ext)
+	legacy := EncodeCTngExtensionJSON(ext)
+	if !Is_DER_CTngExtension(der) || Is_DER_CTngExtension(legacy) {
+		t.Fatal("Wrong encoding")
+	}
+	if len(der) >= len(legacy) {
+		t.Errorf("DER encoding of %d bytes not smaller than the legacy %d bytes", len(der), len(legacy))
+	}
+	// both encodings decode to the extension, the rebuilt STHs still verify
+	for _, encoded := range [][]byte{der, legacy} {
+		decoded, err := Decode_CTngExtension(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, ext) {
+			t.Fatalf("Decoded extension differs:\n%+v\n%+v", decoded, ext)
+		}
+		if err := decoded.LoggerInformation[1].STH.Verify(&configs[1]); err != nil {
+			t.Errorf("Rebuilt STH does not verify: %v", err)
+		}
+	}
+	// an STH which can not be rebuilt keeps the legacy encoding
+	ext.LoggerInformation[0].STH.Type = definition.STH_FULL
+	encoded := EncodeCTngExtension(ext)
+	if Is_DER_CTngExtension(encoded) {
+		t.Fatal("STH_FULL encoded as a reference")
+	}
+	if decoded := DecodeCTngExtension(encoded); !reflect.DeepEqual(decoded, ext) {
+		t.Error("Legacy fallback does not decode to the extension")
+	}
+	if _, err := Decode_CTngExtension([]byte{0x02, 0x01, 0x00}); err == nil {
+		t.Error("An INTEGER decoded as an extension")
+	}
+}
+
+// An ACC_FULL against the CA, threshold signed by the gossiper configs.
+func testSignedACC(t *testing.T, gossipers []crypto.CryptoConfig, ca string, period string) definition.Gossip_object {
+	payload := [3]string{ca, "", ""}
+	frags := make([]crypto.SigFragment, len(gossipers))
+	for i := range gossipers {
+		frag, err := gossipers[i].ThresholdSign(payload[0] + payload[1] + payload[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frags[i] = frag
+	}
+	sig, err := gossipers[0].ThresholdAggregate(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigstr, err := sig.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definition.Gossip_object{
+		Application: definition.CTNG_APPLICATION,
+		Type:        definition.ACC_FULL,
+		Period:      period,
+		Signature:   [2]string{sigstr, ""},
+		Payload:     payload,
+	}
+}
+
+func TestReceiveAccusation(t *testing.T) {
+	configs, err := crypto.GenerateEntityCryptoConfigs([]crypto.CTngID{"localhost:9000", "localhost:9001", "localhost:9002", "localhost:9003"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	disputes := []definition.Gossip_object{}
+	gossiper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dis definition.Gossip_object
+		json.NewDecoder(r.Body).Decode(&dis)
+		lock.Lock()
+		disputes = append(disputes, dis)
+		lock.Unlock()
+	}))
+	defer gossiper.Close()
+	ctx := &CAContext{
+		Client:            gossiper.Client(),
+		CA_private_config: &CA_private_config{Gossiperlist: []string{strings.TrimPrefix(gossiper.URL, PROTOCOL)}},
+		CA_crypto_config:  &configs[0],
+		REV_storage:       make(map[string]definition.Gossip_object),
+		Disputed_periods:  make(map[string]bool),
+		Dispute_lock:      &sync.Mutex{},
+		Metrics:           metrics.New_CTng_metrics(),
+	}
+	post := func(acc definition.Gossip_object) int {
+		body, _ := json.Marshal(acc)
+		w := httptest.NewRecorder()
+		receive_accusation(ctx, w, httptest.NewRequest("POST", "/ctng/v2/accusation", bytes.NewBuffer(body)))
+		return w.Code
+	}
+	acc := testSignedACC(t, configs[1:3], "localhost:9000", "3")
+	// every gossiper relays the ACC_FULL, the CA disputes it once
+	for i := 0; i < 3; i++ {
+		if code := post(acc); code != http.StatusOK {
+			t.Fatalf("Accusation rejected with %d", code)
+		}
+	}
+	if len(disputes) != 1 {
+		t.Fatalf("%d disputes sent for one accusation", len(disputes))
+	}
+	if disputes[0].Type != definition.DIS_INIT || disputes[0].Period != "3" {
+		t.Error("The dispute does not answer the accusation")
+	}
+	if err := disputes[0].Verify(&configs[1]); err != nil {
+		t.Error("The dispute does not verify:", err)
+	}
+	other := testSignedACC(t, configs[1:3], "localhost:9003", "4")
+	if code := post(other); code != http.StatusBadRequest {
+		t.Error("Disputed an accusation against another entity")
+	}
+	forged := testSignedACC(t, configs[1:3], "localhost:9000", "5")
+	forged.Payload[1] = "forged"
+	if code := post(forged); code != http.StatusBadRequest {
+		t.Error("Disputed an accusation without a threshold signature")
+	}
+	if len(disputes) != 1 {
+		t.Error("Rejected accusations were disputed")
+	}
+}
@@ -0,0 +1,268 @@
+package CA
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/definition"
+	"bytes"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The DER encoding of the CTng extension.
+// The embedded STHs are reduced to the fields the signature of the logger covers, the gossip object
+// and its JSON payload are rebuilt from them when the extension is decoded.
+//
+//	CTngExtension ::= SEQUENCE {
+//	    sequenceNumber     SequenceNumber,
+//	    loggerInformation  SEQUENCE OF LoggerInfo }
+//
+//	SequenceNumber ::= SEQUENCE {
+//	    rid  INTEGER }
+//
+//	LoggerInfo ::= SEQUENCE {
+//	    sth  STHReference,
+//	    poi  ProofOfInclusion }
+//
+//	STHReference ::= SEQUENCE {
+//	    logger        UTF8String,
+//	    period        UTF8String,
+//	    timestamp     UTF8String,
+//	    rootHash      OCTET STRING,
+//	    treeSize      INTEGER,
+//	    signature     Signature,
+//	    -- the fields of the signed STH, absent when equal to the ones of the reference
+//	    sthSigner     [0] EXPLICIT UTF8String OPTIONAL,
+//	    sthPeriod     [1] EXPLICIT UTF8String OPTIONAL,
+//	    sthTimestamp  [2] EXPLICIT UTF8String OPTIONAL }
+//
+//	Signature ::= SEQUENCE {
+//	    scheme   UTF8String,
+//	    value    OCTET STRING,
+//	    -- absent when the logger signed
+//	    signer   [0] EXPLICIT UTF8String OPTIONAL,
+//	    version  [1] EXPLICIT INTEGER OPTIONAL }
+//
+//	ProofOfInclusion ::= SEQUENCE {
+//	    loggerID       UTF8String,
+//	    subjectKeyId   OCTET STRING,
+//	    neighborHash   OCTET STRING,
+//	    siblingHashes  SEQUENCE OF OCTET STRING }
+//
+// The legacy encoding is the JSON of CTngExtension in an OCTET STRING, both are decoded during the migration.
+
+type asn1_CTng_extension struct {
+	SequenceNumber    asn1_sequence_number
+	LoggerInformation []asn1_logger_info
+}
+
+type asn1_sequence_number struct {
+	RID int
+}
+
+type asn1_logger_info struct {
+	STH asn1_STH_reference
+	POI asn1_POI
+}
+
+type asn1_STH_reference struct {
+	Logger        string `asn1:"utf8"`
+	Period        string `asn1:"utf8"`
+	Timestamp     string `asn1:"utf8"`
+	RootHash      []byte
+	TreeSize      int
+	Signature     asn1_signature
+	STH_signer    string `asn1:"optional,explicit,tag:0,utf8"`
+	STH_period    string `asn1:"optional,explicit,tag:1,utf8"`
+	STH_timestamp string `asn1:"optional,explicit,tag:2,utf8"`
+}
+
+type asn1_signature struct {
+	Scheme  string `asn1:"utf8"`
+	Value   []byte
+	Signer  string `asn1:"optional,explicit,tag:0,utf8"`
+	Version int    `asn1:"optional,explicit,tag:1"`
+}
+
+type asn1_POI struct {
+	LoggerID      string `asn1:"utf8"`
+	SubjectKeyId  []byte
+	NeighborHash  []byte
+	SiblingHashes [][]byte
+}
+
+// the field of the STH when it differs from the one of the reference
+func if_different(field string, reference string) string {
+	if field == reference {
+		return ""
+	}
+	return field
+}
+
+func or_default(field string, reference string) string {
+	if field == "" {
+		return reference
+	}
+	return field
+}
+
+func sth_reference(sth definition.Gossip_object) (asn1_STH_reference, error) {
+	var treeinfo definition.STH
+	err := json.Unmarshal([]byte(sth.Payload[1]), &treeinfo)
+	if err != nil {
+		return asn1_STH_reference{}, err
+	}
+	sig, err := crypto.SignatureFromString(sth.Signature[0])
+	if err != nil {
+		return asn1_STH_reference{}, err
+	}
+	logger := sth.Payload[0]
+	return asn1_STH_reference{
+		Logger:    logger,
+		Period:    sth.Period,
+		Timestamp: sth.Timestamp,
+		RootHash:  []byte(treeinfo.RootHash),
+		TreeSize:  treeinfo.TreeSize,
+		Signature: asn1_signature{
+			Scheme:  sig.Scheme,
+			Value:   sig.Sig,
+			Signer:  if_different(sig.ID.String(), logger),
+			Version: sig.Version,
+		},
+		STH_signer:    if_different(treeinfo.Signer, logger),
+		STH_period:    if_different(treeinfo.Period, sth.Period),
+		STH_timestamp: if_different(treeinfo.Timestamp, sth.Timestamp),
+	}, nil
+}
+
+// Rebuild the STH the logger signed and gossiped.
+func (r asn1_STH_reference) gossip_object() definition.Gossip_object {
+	treeinfo := definition.STH{
+		Signer:    or_default(r.STH_signer, r.Logger),
+		Timestamp: or_default(r.STH_timestamp, r.Timestamp),
+		Period:    or_default(r.STH_period, r.Period),
+		RootHash:  string(r.RootHash),
+		TreeSize:  r.TreeSize,
+	}
+	payload, _ := json.Marshal(treeinfo)
+	sig := crypto.Signature{
+		Scheme:  r.Signature.Scheme,
+		Sig:     r.Signature.Value,
+		ID:      crypto.CTngID(or_default(r.Signature.Signer, r.Logger)),
+		Version: r.Signature.Version,
+	}
+	return definition.Gossip_object{
+		Application:   definition.CTNG_APPLICATION,
+		Type:          definition.STH_INIT,
+		Period:        r.Period,
+		Signer:        r.Logger,
+		Signature:     [2]string{sig.String(), ""},
+		Timestamp:     r.Timestamp,
+		Crypto_Scheme: sig.Scheme,
+		Payload:       [3]string{r.Logger, string(payload), ""},
+	}
+}
+
+// DER encode the extension.
+// An extension whose STHs can not be rebuilt exactly from their reference is not encoded, the error says why.
+func Marshal_CTngExtension(ctngext CTngExtension) ([]byte, error) {
+	ext := asn1_CTng_extension{
+		SequenceNumber:    asn1_sequence_number{RID: ctngext.SequenceNumber.RID},
+		LoggerInformation: []asn1_logger_info{},
+	}
+	for _, loggerinfo := range ctngext.LoggerInformation {
+		reference, err := sth_reference(loggerinfo.STH)
+		if err != nil {
+			return nil, fmt.Errorf("STH of %s: %v", loggerinfo.STH.Signer, err)
+		}
+		poi := loggerinfo.POI
+		ext.LoggerInformation = append(ext.LoggerInformation, asn1_logger_info{
+			STH: reference,
+			POI: asn1_POI{LoggerID: poi.LoggerID, SubjectKeyId: poi.SubjectKeyId, NeighborHash: poi.NeighborHash, SiblingHashes: poi.SiblingHashes},
+		})
+	}
+	der, err := asn1.Marshal(ext)
+	if err != nil {
+		return nil, err
+	}
+	// the decoded extension must be the one encoded, signatures included
+	decoded, err := Unmarshal_CTngExtension(der)
+	if err != nil {
+		return nil, err
+	}
+	original, _ := json.Marshal(ctngext)
+	rebuilt, _ := json.Marshal(decoded)
+	if !bytes.Equal(original, rebuilt) {
+		return nil, errors.New("the STHs of the extension can not be rebuilt from the DER encoding")
+	}
+	return der, nil
+}
+
+func Unmarshal_CTngExtension(der []byte) (CTngExtension, error) {
+	var ext asn1_CTng_extension
+	rest, err := asn1.Unmarshal(der, &ext)
+	if err != nil {
+		return CTngExtension{}, err
+	}
+	if len(rest) > 0 {
+		return CTngExtension{}, errors.New("trailing data after the CTng extension")
+	}
+	ctngext := CTngExtension{SequenceNumber: SequenceNumber{RID: ext.SequenceNumber.RID}}
+	for _, loggerinfo := range ext.LoggerInformation {
+		poi := loggerinfo.POI
+		ctngext.LoggerInformation = append(ctngext.LoggerInformation, LoggerInfo{
+			STH: loggerinfo.STH.gossip_object(),
+			POI: ProofOfInclusion{SiblingHashes: poi.SiblingHashes, NeighborHash: poi.NeighborHash, LoggerID: poi.LoggerID, SubjectKeyId: poi.SubjectKeyId},
+		})
+	}
+	return ctngext, nil
+}
+
+// The legacy encoding, the JSON of the extension in an octet string.
+func EncodeCTngExtensionJSON(ctngext CTngExtension) []byte {
+	// encode the ctngext to bytes using json marshal
+	ctngextbytes, err := json.Marshal(ctngext)
+	if err != nil {
+		fmt.Println("Error in EncodeCTngExtension: ", err)
+	}
+	// encode the json bytes to asn1 bytes
+	OctectString := asn1.RawValue{
+		Tag:   asn1.TagOctetString,
+		Bytes: ctngextbytes,
+	}
+	ctngextasn1bytes, err := asn1.Marshal(OctectString)
+	if err != nil {
+		fmt.Println("Error in EncodeCTngExtension: ", err)
+	}
+	return ctngextasn1bytes
+}
+
+// Decode the CTng extension in either encoding: a SEQUENCE is the DER encoding,
+// an OCTET STRING holds the legacy JSON.
+func Decode_CTngExtension(ctngextasn1bytes []byte) (CTngExtension, error) {
+	var ctngext CTngExtension
+	var value asn1.RawValue
+	rest, err := asn1.Unmarshal(ctngextasn1bytes, &value)
+	if err != nil {
+		return ctngext, err
+	}
+	if len(rest) > 0 || value.Class != asn1.ClassUniversal {
+		return ctngext, errors.New("the CTng extension is neither a SEQUENCE nor an OCTET STRING")
+	}
+	switch value.Tag {
+	case asn1.TagSequence:
+		return Unmarshal_CTngExtension(ctngextasn1bytes)
+	case asn1.TagOctetString:
+		err = json.Unmarshal(value.Bytes, &ctngext)
+		return ctngext, err
+	}
+	return ctngext, errors.New("the CTng extension is neither a SEQUENCE nor an OCTET STRING")
+}
+
+// Whether the extension is DER encoded rather than legacy JSON.
+func Is_DER_CTngExtension(ctngextasn1bytes []byte) bool {
+	var value asn1.RawValue
+	_, err := asn1.Unmarshal(ctngextasn1bytes, &value)
+	return err == nil && value.Class == asn1.ClassUniversal && value.Tag == asn1.TagSequence
+}
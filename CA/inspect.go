@@ -0,0 +1,148 @@
+package CA
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/definition"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Inspection of the CTng extension of a certificate, for people debugging certificates rather than for clients:
+// every field is decoded and reported as it is, nothing is checked against the logs or the monitors.
+
+// The signature over an embedded STH
+const (
+	STH_SIGNATURE_VALID       = "valid"
+	STH_SIGNATURE_INVALID     = "invalid"
+	STH_SIGNATURE_NOT_CHECKED = "not checked"
+)
+
+type STH_inspection struct {
+	Signer    string
+	Period    string
+	Timestamp string
+	TreeSize  int
+	// hex encoded
+	RootHash  string
+	Signature string
+	Error     string `json:",omitempty"`
+}
+
+type POI_inspection struct {
+	LoggerID string
+	// the number of sibling hashes, the depth of the certificate in the tree
+	Depth int
+	// hex encoded
+	SiblingHashes []string
+	NeighborHash  string
+	SubjectKeyId  string
+}
+
+type Logger_inspection struct {
+	STH STH_inspection
+	POI POI_inspection
+}
+
+type CTng_inspection struct {
+	Subject  string
+	Issuer   string
+	Critical bool
+	// "der" or the legacy "json"
+	Encoding string
+	RID      int
+	Loggers  []Logger_inspection
+}
+
+func inspect_STH(sth definition.Gossip_object, c *crypto.CryptoConfig) STH_inspection {
+	inspection := STH_inspection{Signer: sth.Payload[0], Period: sth.Period, Signature: STH_SIGNATURE_NOT_CHECKED}
+	if c != nil {
+		inspection.Signature = STH_SIGNATURE_VALID
+		if err := sth.Verify(c); err != nil {
+			inspection.Signature, inspection.Error = STH_SIGNATURE_INVALID, err.Error()
+		}
+	}
+	var treeinfo definition.STH
+	if err := json.Unmarshal([]byte(sth.Payload[1]), &treeinfo); err != nil {
+		inspection.Error = "malformed STH: " + err.Error()
+		return inspection
+	}
+	inspection.Timestamp = treeinfo.Timestamp
+	inspection.TreeSize = treeinfo.TreeSize
+	inspection.RootHash = hex.EncodeToString([]byte(treeinfo.RootHash))
+	return inspection
+}
+
+func inspect_POI(poi ProofOfInclusion) POI_inspection {
+	inspection := POI_inspection{
+		LoggerID:      poi.LoggerID,
+		Depth:         len(poi.SiblingHashes),
+		SiblingHashes: []string{},
+		NeighborHash:  hex.EncodeToString(poi.NeighborHash),
+		SubjectKeyId:  hex.EncodeToString(poi.SubjectKeyId),
+	}
+	for _, sibling := range poi.SiblingHashes {
+		inspection.SiblingHashes = append(inspection.SiblingHashes, hex.EncodeToString(sibling))
+	}
+	return inspection
+}
+
+// Decode the CTng extension of a certificate.
+// The signatures over the embedded STHs are verified with the crypto config if it is not nil.
+func Inspect_CTngextension(cert *x509.Certificate, c *crypto.CryptoConfig) (*CTng_inspection, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDCTngExtension) {
+			continue
+		}
+		ctngext, err := Decode_CTngExtension(ext.Value)
+		if err != nil {
+			return nil, err
+		}
+		inspection := &CTng_inspection{
+			Subject:  cert.Subject.CommonName,
+			Issuer:   cert.Issuer.CommonName,
+			Critical: ext.Critical,
+			Encoding: "json",
+			RID:      ctngext.SequenceNumber.RID,
+			Loggers:  []Logger_inspection{},
+		}
+		if Is_DER_CTngExtension(ext.Value) {
+			inspection.Encoding = "der"
+		}
+		for _, loggerinfo := range ctngext.LoggerInformation {
+			inspection.Loggers = append(inspection.Loggers, Logger_inspection{
+				STH: inspect_STH(loggerinfo.STH, c),
+				POI: inspect_POI(loggerinfo.POI),
+			})
+		}
+		return inspection, nil
+	}
+	return nil, errors.New("the certificate has no CTng extension")
+}
+
+// Pretty print the inspection, one block per logger.
+func (i *CTng_inspection) Write_text(w io.Writer) {
+	fmt.Fprintln(w, "Certificate:", i.Subject, "issued by", i.Issuer)
+	fmt.Fprintln(w, "CTng extension", OIDCTngExtension.String(), "critical:", i.Critical, "encoding:", i.Encoding)
+	fmt.Fprintln(w, "RID:", i.RID)
+	fmt.Fprintln(w, "Logger infos:", len(i.Loggers))
+	for n, logger := range i.Loggers {
+		fmt.Fprintf(w, "[%d] STH of %s\n", n, logger.STH.Signer)
+		fmt.Fprintln(w, "    period:   ", logger.STH.Period)
+		fmt.Fprintln(w, "    timestamp:", logger.STH.Timestamp)
+		fmt.Fprintln(w, "    tree size:", logger.STH.TreeSize)
+		fmt.Fprintln(w, "    root hash:", logger.STH.RootHash)
+		fmt.Fprintln(w, "    signature:", logger.STH.Signature)
+		if logger.STH.Error != "" {
+			fmt.Fprintln(w, "    error:    ", logger.STH.Error)
+		}
+		fmt.Fprintln(w, "    POI of", logger.POI.LoggerID, "depth", logger.POI.Depth)
+		for _, sibling := range logger.POI.SiblingHashes {
+			fmt.Fprintln(w, "      sibling:", sibling)
+		}
+		fmt.Fprintln(w, "      neighbor:", logger.POI.NeighborHash)
+	}
+}
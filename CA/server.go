@@ -46,6 +46,11 @@ func handleCARequests(c *CAContext) {
 	gorillaRouter.HandleFunc("/CA/receive-poi", bindCAContext(c, receive_poi)).Methods("POST")
 	// receive get request from monitor
 	gorillaRouter.HandleFunc("/ctng/v2/get-revocation", bindCAContext(c, requestREV)).Methods("GET")
+	// receive key rotation request from monitor
+	gorillaRouter.HandleFunc("/ctng/v2/get-key-rotation", bindCAContext(c, requestKeyRotation)).Methods("GET")
+	// receive the accusations against the CA from the gossipers
+	gorillaRouter.HandleFunc("/ctng/v2/accusation", bindCAContext(c, receive_accusation)).Methods("POST")
+	gorillaRouter.HandleFunc("/metrics", c.Metrics.Handler()).Methods("GET")
 	// Start the HTTP server.
 	http.Handle("/", gorillaRouter)
 	// Listen on port set by config until server is stopped.
@@ -112,6 +117,114 @@ func requestREV(c *CAContext, w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Serves the announced key rotation, the body is empty if there is none.
+func requestKeyRotation(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	if c.Pending_key_rotation == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(c.Pending_key_rotation.KEY_INIT)
+}
+
+// Announce the signing key committed to for the next rotation, the revocations are signed with it from valid_from on.
+// The announcement commits to a new key with the given scheme for the rotation after it.
+// The X.509 certificates are still issued with the CA's RSA key.
+func Rotate_sign_key(c *CAContext, scheme string, valid_from int) error {
+	pending, err := definition.New_pending_key_rotation(c.CA_crypto_config, scheme, valid_from)
+	if err != nil {
+		return err
+	}
+	c.Pending_key_rotation = pending
+	fmt.Println(util.BLUE+"Announced key version", pending.Rotation.Version, "valid from period", valid_from, util.RESET)
+	return nil
+}
+
+// Answer the accusations against the CA for period with the REV it served in that period.
+// The dispute is signed by the CA and posted to its gossipers, which pass it on to the monitors.
+func Dispute_accusation(c *CAContext, period string, statement string) error {
+	var response *definition.Gossip_object
+	if rev, ok := c.REV_storage[period]; ok {
+		response = &rev
+	}
+	dispute, err := definition.Generate_DIS_INIT(c.CA_crypto_config, period, statement, response)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(dispute)
+	if err != nil {
+		return err
+	}
+	delivered := 0
+	for _, gossiper := range c.CA_private_config.Gossiperlist {
+		resp, err := c.Client.Post(PROTOCOL+gossiper+"/gossip/dis_init", "application/json", bytes.NewBuffer(msg))
+		if err != nil {
+			fmt.Println(util.RED+"Failed to send the dispute to gossiper "+gossiper+":", err, util.RESET)
+			c.Metrics.Send_failed(gossiper, definition.TypeString(dispute.Type))
+			continue
+		}
+		resp.Body.Close()
+		delivered++
+	}
+	if delivered == 0 {
+		return fmt.Errorf("No gossiper accepted the dispute for period %s", period)
+	}
+	return nil
+}
+
+// receive an ACC_FULL against the CA from a gossiper and dispute it
+// Every gossiper relays the ACC_FULL, the CA disputes each period once.
+func receive_accusation(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	var acc definition.Gossip_object
+	err := json.NewDecoder(r.Body).Decode(&acc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if acc.Type != definition.ACC_FULL || acc.Payload[0] != c.CA_crypto_config.SelfID.String() {
+		http.Error(w, "Not an accusation against this CA.", http.StatusBadRequest)
+		return
+	}
+	err = acc.Verify(c.CA_crypto_config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Dispute_lock.Lock()
+	defer c.Dispute_lock.Unlock()
+	if c.Disputed_periods[acc.Period] {
+		return
+	}
+	fmt.Println(util.BLUE+"Accused by the gossipers in period "+acc.Period+", disputing it.", util.RESET)
+	err = Dispute_accusation(c, acc.Period, "The CA served the attached revocation in period "+acc.Period+".")
+	if err != nil {
+		fmt.Println(util.RED+"Failed to dispute the accusation:", err, util.RESET)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	c.Disputed_periods[acc.Period] = true
+}
+
+// Switch to the announced key if the revocation for period is the first one to be signed with it.
+func install_rotated_key(c *CAContext, period int) {
+	if c.Pending_key_rotation == nil {
+		return
+	}
+	installed, err := c.Pending_key_rotation.Install(c.CA_crypto_config, period)
+	if err != nil {
+		fmt.Println(util.RED+"Failed to install the new signing key:", err, util.RESET)
+		return
+	}
+	if !installed {
+		return
+	}
+	c.Pending_key_rotation = nil
+	if c.Crypto_config_path != "" {
+		err = crypto.SaveKeyVersions(c.Crypto_config_path, c.CA_crypto_config, true)
+		if err != nil {
+			fmt.Println(util.RED+"Failed to save the new signing key:", err, util.RESET)
+		}
+	}
+}
+
 // receive STH from logger
 func receive_sth(c *CAContext, w http.ResponseWriter, r *http.Request) {
 	// Unmarshal the request body into a STH
@@ -123,7 +236,9 @@ func receive_sth(c *CAContext, w http.ResponseWriter, r *http.Request) {
 	}
 	//fmt.Println("STH received from logger: ", gossip_sth.Signer)
 	// Verify the STH
-	err = gossip_sth.Verify(c.CA_crypto_config)
+	err = c.Metrics.Verify(definition.TypeString(gossip_sth.Type), func() error {
+		return gossip_sth.Verify(c.CA_crypto_config)
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -143,6 +258,7 @@ func receive_poi(c *CAContext, w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 	fmt.Println("POI received: ", poi)
+	c.Metrics.Count_received("POI")
 	//fmt.Println("Logger ID in this poi: ", poi.LoggerID)
 	// Get the STH of the logger
 	sth := c.STH_storage[poi.LoggerID]
@@ -170,6 +286,8 @@ func Send_Signed_PreCert_To_Logger(c *CAContext, precert *x509.Certificate, logg
 	resp, err := c.Client.Post(PROTOCOL+logger+"/Logger/receive-precerts", "application/json", bytes.NewBuffer(precert_json))
 	if err != nil {
 		fmt.Println("Failed to send precert to loggers: ", err)
+		c.Metrics.Send_failed(logger, "PRECERT")
+		return
 	}
 	defer resp.Body.Close()
 }
@@ -184,6 +302,7 @@ func Send_Signed_PreCert_To_Loggers(c *CAContext, precert *x509.Certificate, log
 		resp, err := c.Client.Post(PROTOCOL+loggers[i]+"/Logger/receive-precerts", "application/json", bytes.NewBuffer(precert_json))
 		if err != nil {
 			fmt.Println("Failed to send precert to loggers: ", err)
+			c.Metrics.Send_failed(loggers[i], "PRECERT")
 		} else {
 			defer resp.Body.Close()
 		}
@@ -239,6 +358,7 @@ func PeriodicTask(ctx *CAContext) {
 	}
 	time.AfterFunc(time.Duration(ctx.CA_public_config.MMD)*time.Second, f)
 	fmt.Println("——————————————————————————————————CA Running Tasks at Period ", GetCurrentPeriod(), "——————————————————————————————————")
+	start := time.Now()
 	// wipe STH storage
 	wipeSTHstorage(ctx)
 	//Generate N signed pre-certificates
@@ -268,7 +388,14 @@ func PeriodicTask(ctx *CAContext) {
 		Send_Signed_PreCert_To_Loggers(ctx, certs[i], ctx.CA_private_config.Loggerlist)
 	}
 	fmt.Println("CA Finished Sending Pre-Certs to Loggers")
+	if ctx.Metrics != nil {
+		ctx.Metrics.Phase_seconds.Since(start, "precerts")
+	}
 	f1 := func() {
+		start := time.Now()
+		if ctx.Metrics != nil {
+			defer ctx.Metrics.Phase_seconds.Since(start, "revocation")
+		}
 		// want to see if the STHs and POIs are updated
 		var certlist []x509.Certificate
 		certlist = ctx.CurrentCertificatePool.GetCerts()
@@ -288,6 +415,7 @@ func PeriodicTask(ctx *CAContext) {
 		periodnum = periodnum + 1
 		// convert int to string
 		period = strconv.Itoa(periodnum)
+		install_rotated_key(ctx, periodnum)
 		rev := Generate_Revocation(ctx, period, 0)
 		fake_rev := Generate_Revocation(ctx, period, 1)
 		ctx.REV_storage[period] = rev
@@ -3,6 +3,7 @@ package CA
 import (
 	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"CTngV2/util"
 	"crypto/rand"
 	"crypto/rsa"
@@ -13,6 +14,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 )
@@ -41,6 +43,11 @@ type CAContext struct {
 	StoragePath2           string
 	STH_storage            map[string]definition.Gossip_object //store the STH by LID
 	Request_Count_lock     *sync.Mutex
+	Crypto_config_path     string
+	Pending_key_rotation   *definition.Pending_key_rotation //announced key rotation, until the new key is in use
+	Disputed_periods       map[string]bool                  //periods whose accusations were already disputed
+	Dispute_lock           *sync.Mutex
+	Metrics                *metrics.CTng_metrics
 }
 
 type CA_public_config struct {
@@ -90,34 +97,18 @@ type CTngCertPoolStorage struct {
 	Certpools map[string]crypto.CertPool
 }
 
+// DER encode the extension, see extension.go.
+// Extensions with STHs that can not be rebuilt from the DER encoding keep the legacy JSON encoding.
 func EncodeCTngExtension(ctngext CTngExtension) []byte {
-	// encode the ctngext to bytes using json marshal
-	ctngextbytes, err := json.Marshal(ctngext)
+	der, err := Marshal_CTngExtension(ctngext)
 	if err != nil {
-		fmt.Println("Error in EncodeCTngExtension: ", err)
+		return EncodeCTngExtensionJSON(ctngext)
 	}
-	// encode the json bytes to asn1 bytes
-	OctectString := asn1.RawValue{
-		Tag:   asn1.TagOctetString,
-		Bytes: ctngextbytes,
-	}
-	ctngextasn1bytes, err := asn1.Marshal(OctectString)
-	if err != nil {
-		fmt.Println("Error in EncodeCTngExtension: ", err)
-	}
-	return ctngextasn1bytes
+	return der
 }
 
 func DecodeCTngExtension(ctngextasn1bytes []byte) CTngExtension {
-	// decode the asn1 bytes to json bytes
-	var OctectString asn1.RawValue
-	_, err := asn1.Unmarshal(ctngextasn1bytes, &OctectString)
-	if err != nil {
-		fmt.Println("Error in DecodeCTngExtension: ", err)
-	}
-	var ctngext CTngExtension
-	// decode the json bytes to ctngext
-	err = json.Unmarshal(OctectString.Bytes, &ctngext)
+	ctngext, err := Decode_CTngExtension(ctngextasn1bytes)
 	if err != nil {
 		fmt.Println("Error in DecodeCTngExtension: ", err)
 	}
@@ -279,7 +270,16 @@ func (ctx *CAContext) SaveToStorage() {
 		data1 = append(data1, []any{data1_json})
 		rid := GetRIDfromCert(cert)
 		util.SaveCertificateToDisk(cert.Raw, cert.Subject.CommonName+"_RID_"+strconv.Itoa(rid)+".crt")
-		util.SaveKeyToDisk(ctx.CurrentKeyPool[cert.Subject.CommonName], cert.Subject.CommonName+"_RID_"+strconv.Itoa(rid)+".key")
+		key_path := cert.Subject.CommonName + "_RID_" + strconv.Itoa(rid) + ".key"
+		// Encrypt the subject keys at rest when a passphrase is configured
+		if passphrase, ok := os.LookupEnv(util.PASSPHRASE_ENV); ok {
+			err := util.SaveEncryptedKeyToDisk(ctx.CurrentKeyPool[cert.Subject.CommonName], key_path, passphrase)
+			if err != nil {
+				fmt.Println(err)
+			}
+		} else {
+			util.SaveKeyToDisk(ctx.CurrentKeyPool[cert.Subject.CommonName], key_path)
+		}
 	}
 	for _, cert := range certs {
 		tbscert := util.ParseTBSCertificate(&cert)
@@ -325,6 +325,10 @@ func InitializeCAContext(public_config_path string, private_config_file_path str
 		CertCounter:            0,
 		STH_storage:            make(map[string]definition.Gossip_object),
 		Request_Count_lock:     &sync.Mutex{},
+		Disputed_periods:       make(map[string]bool),
+		Dispute_lock:           &sync.Mutex{},
+		Crypto_config_path:     crypto_config_path,
+		Metrics:                metrics.New_CTng_metrics(),
 	}
 	// Initialize http client
 	tr := &http.Transport{}
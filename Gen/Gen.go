@@ -7,10 +7,15 @@ import (
 	"CTngV2/gossiper"
 	"CTngV2/monitor"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"time"
 )
 
 func GenerateCryptoconfig_map(Total int, Threshold int, entitytype string) map[string]crypto.StoredCryptoConfig {
@@ -272,7 +277,88 @@ func Update_crypto_config(crypto_config *crypto.StoredCryptoConfig, SignaturePub
 	crypto_config.ThresholdSecretKey = BLSPrivateMap[crypto_config.SelfID.String()]
 }
 
+// Sign_gen generates keys for a sign scheme, serialized the way StoredCryptoConfig stores them.
+// Stops at the first key that can not be generated or serialized.
+func Sign_gen(entity_list []string, sign_scheme string) (map[string][]byte, map[string][]byte, error) {
+	public_key_map := make(map[string][]byte)
+	private_key_map := make(map[string][]byte)
+	for i := 0; i < len(entity_list); i++ {
+		signer, err := crypto.NewSigner(sign_scheme)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generating the %s key pair of %s: %v", sign_scheme, entity_list[i], err)
+		}
+		pk, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			return nil, nil, fmt.Errorf("encoding the %s public key of %s: %v", sign_scheme, entity_list[i], err)
+		}
+		sk, err := crypto.MarshalSigner(signer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encoding the %s private key of %s: %v", sign_scheme, entity_list[i], err)
+		}
+		public_key_map[entity_list[i]] = pk
+		private_key_map[entity_list[i]] = sk
+	}
+	return public_key_map, private_key_map, nil
+}
+
+func Sign_gen_all(G_list []string, M_list []string, C_list []string, L_list []string, sign_scheme string) (map[string][]byte, map[string][]byte, error) {
+	entity_list := append([]string{}, G_list...)
+	entity_list = append(entity_list, M_list...)
+	entity_list = append(entity_list, C_list...)
+	entity_list = append(entity_list, L_list...)
+	return Sign_gen(entity_list, sign_scheme)
+}
+
+// Switch a crypto config to a non-RSA sign scheme. The RSA keys are left in place for X.509 issuance.
+func Update_sign_scheme(crypto_config *crypto.StoredCryptoConfig, sign_scheme string, SignPublicKeys map[string][]byte, SignPrivateMap map[string][]byte) {
+	if sign_scheme == crypto.RSA_SCHEME {
+		return
+	}
+	crypto_config.SignScheme = sign_scheme
+	crypto_config.SignPublicKeys = SignPublicKeys
+	crypto_config.SignKey = SignPrivateMap[crypto_config.SelfID.String()]
+}
+
+// Commit a crypto config to the first rotated key of every entity, see crypto/keyversion.go.
+// Every config holds the hashes of the public keys, each entity only its own private key.
+func Update_next_keys(crypto_config *crypto.StoredCryptoConfig, NextPublicKeys map[string][]byte, NextPrivateMap map[string][]byte) {
+	crypto_config.NextKeyHashes = make(map[string][]byte)
+	for id, pk := range NextPublicKeys {
+		hash := sha256.Sum256(pk)
+		crypto_config.NextKeyHashes[id] = hash[:]
+	}
+	crypto_config.NextSignKey = NextPrivateMap[crypto_config.SelfID.String()]
+}
+
 func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, num_cert int, MMD int, MRD int, config_path string) {
+	GenerateallWithScheme(num_gossiper, Threshold, num_logger, num_ca, num_cert, MMD, MRD, config_path, crypto.RSA_SCHEME)
+}
+
+// Same as Generateall, but every entity signs its gossip objects with sign_scheme.
+func GenerateallWithScheme(num_gossiper int, Threshold int, num_logger int, num_ca int, num_cert int, MMD int, MRD int, config_path string, sign_scheme string) {
+	err := GenerateallWithOptions(num_gossiper, Threshold, num_logger, num_ca, num_cert, MMD, MRD, config_path, Gen_options{Sign_scheme: sign_scheme})
+	if err != nil {
+		fmt.Println("Error generating the configs:", err)
+	}
+}
+
+type Gen_options struct {
+	Sign_scheme string // "rsa" if empty
+	// Leave the BLS threshold keys out of the configs: the gossipers generate them with a DKG on startup,
+	// and Update_threshold_public_map hands the public map they all signed to everyone else.
+	Use_DKG bool
+	// Keep the private keys in an encrypted key store next to each crypto config instead of the config itself.
+	// The entities read the passphrase from util.PASSPHRASE_ENV.
+	Key_passphrase string
+}
+
+// Fails if the sign keys can not be generated, before any config is written,
+// or if the private keys can not be moved to a key store, the configs written so far keep their keys then.
+func GenerateallWithOptions(num_gossiper int, Threshold int, num_logger int, num_ca int, num_cert int, MMD int, MRD int, config_path string, opts Gen_options) error {
+	sign_scheme := opts.Sign_scheme
+	if sign_scheme == "" {
+		sign_scheme = crypto.RSA_SCHEME
+	}
 	Total := num_gossiper
 	G_list, M_list, C_list, L_list := Generate_all_list(num_gossiper, num_ca, num_logger)
 	ca_private_config_map := make(map[string]CA.CA_private_config)
@@ -289,8 +375,25 @@ func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, nu
 	BLSPrivateMap := make(map[string][]byte)
 	// Generate RSA key pair
 	RSAPublicMap, RSAPrivateMap = RSA_gen_all(G_list, M_list, C_list, L_list)
-	// Generate BLS key pair
-	BLSPublicMap, BLSPrivateMap = BLS_gen_all(G_list)
+	// Generate BLS key pair, unless the gossipers run a DKG
+	if !opts.Use_DKG {
+		BLSPublicMap, BLSPrivateMap = BLS_gen_all(G_list)
+	}
+	// Generate keys for the sign scheme, if it is not RSA
+	SignPublicKeys := make(map[string][]byte)
+	SignPrivateMap := make(map[string][]byte)
+	if sign_scheme != crypto.RSA_SCHEME {
+		var err error
+		SignPublicKeys, SignPrivateMap, err = Sign_gen_all(G_list, M_list, C_list, L_list, sign_scheme)
+		if err != nil {
+			return err
+		}
+	}
+	// Generate the keys every entity commits to for its first key rotation
+	NextPublicKeys, NextPrivateMap, err := Sign_gen_all(G_list, M_list, C_list, L_list, sign_scheme)
+	if err != nil {
+		return err
+	}
 	// Generate CA public config map
 	ca_public_config := GenerateCA_public_config(L_list, C_list, MMD, MMD, []string{"1.1"})
 	// Generate CA private config map
@@ -319,9 +422,19 @@ func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, nu
 		crypto_config.SignPublicMap = RSAPublicMap
 		// update RSA Secret key
 		crypto_config.SignSecretKey = *RSAPrivateMap[C_list[i]]
+		// update the sign scheme keys
+		Update_sign_scheme(&crypto_config, sign_scheme, SignPublicKeys, SignPrivateMap)
+		// commit to the key of the first rotation
+		Update_next_keys(&crypto_config, NextPublicKeys, NextPrivateMap)
 		// update BLS Secret key with empty byte array
 		crypto_config.ThresholdSecretKey = []byte{}
 		write_all_configs_to_file(ca_public_config, ca_private_config_map[C_list[i]], crypto_config, filepath, "CA")
+		if opts.Key_passphrase != "" {
+			err := Move_keys_to_keystore(filepath+"CA_crypto_config.json", opts.Key_passphrase)
+			if err != nil {
+				return fmt.Errorf("moving the keys of %s to the key store: %v", filepath+"CA_crypto_config.json", err)
+			}
+		}
 	}
 	// write all Logger public config, private config, crypto config to file
 	for i := 0; i < num_logger; i++ {
@@ -335,9 +448,19 @@ func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, nu
 		crypto_config.SignPublicMap = RSAPublicMap
 		// update RSA Secret key
 		crypto_config.SignSecretKey = *RSAPrivateMap[L_list[i]]
+		// update the sign scheme keys
+		Update_sign_scheme(&crypto_config, sign_scheme, SignPublicKeys, SignPrivateMap)
+		// commit to the key of the first rotation
+		Update_next_keys(&crypto_config, NextPublicKeys, NextPrivateMap)
 		// update BLS Secret key with empty byte array
 		crypto_config.ThresholdSecretKey = []byte{}
 		write_all_configs_to_file(logger_public_config, logger_private_config_map[L_list[i]], crypto_config, filepath, "Logger")
+		if opts.Key_passphrase != "" {
+			err := Move_keys_to_keystore(filepath+"Logger_crypto_config.json", opts.Key_passphrase)
+			if err != nil {
+				return fmt.Errorf("moving the keys of %s to the key store: %v", filepath+"Logger_crypto_config.json", err)
+			}
+		}
 	}
 	// Generate Monitor public config map
 	monitor_public_config := GenerateMonitor_public_config(G_list, M_list, C_list, L_list, MMD, MMD, 5, []string{"1.1"})
@@ -361,9 +484,19 @@ func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, nu
 		crypto_config.SignPublicMap = RSAPublicMap
 		// update RSA Secret key
 		crypto_config.SignSecretKey = *RSAPrivateMap[M_list[i]]
+		// update the sign scheme keys
+		Update_sign_scheme(&crypto_config, sign_scheme, SignPublicKeys, SignPrivateMap)
+		// commit to the key of the first rotation
+		Update_next_keys(&crypto_config, NextPublicKeys, NextPrivateMap)
 		// update BLS Secret key with empty byte array
 		crypto_config.ThresholdSecretKey = []byte{}
 		write_all_configs_to_file(monitor_public_config, monitor_private_config, crypto_config, filepath, "Monitor")
+		if opts.Key_passphrase != "" {
+			err := Move_keys_to_keystore(filepath+"Monitor_crypto_config.json", opts.Key_passphrase)
+			if err != nil {
+				return fmt.Errorf("moving the keys of %s to the key store: %v", filepath+"Monitor_crypto_config.json", err)
+			}
+		}
 	}
 	// Generate Gossiper public config map
 	gossiper_public_config := GenerateGossiper_public_config(G_list, M_list, C_list, L_list, MMD, MMD, 5, 5, []string{"1.1"})
@@ -387,10 +520,160 @@ func Generateall(num_gossiper int, Threshold int, num_logger int, num_ca int, nu
 		crypto_config.SignPublicMap = RSAPublicMap
 		// update RSA Secret key
 		crypto_config.SignSecretKey = *RSAPrivateMap[G_list[i]]
+		// update the sign scheme keys
+		Update_sign_scheme(&crypto_config, sign_scheme, SignPublicKeys, SignPrivateMap)
+		// commit to the key of the first rotation
+		Update_next_keys(&crypto_config, NextPublicKeys, NextPrivateMap)
 		// update Threshold Secret key
 		crypto_config.ThresholdSecretKey = BLSPrivateMap[G_list[i]]
 		write_all_configs_to_file(gossiper_public_config, gossiper_private_config, crypto_config, filepath, "Gossiper")
+		if opts.Key_passphrase != "" {
+			err := Move_keys_to_keystore(filepath+"Gossiper_crypto_config.json", opts.Key_passphrase)
+			if err != nil {
+				return fmt.Errorf("moving the keys of %s to the key store: %v", filepath+"Gossiper_crypto_config.json", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Fetch the signed public map of the DKG from every gossiper, served on /gossip/dkg/public-map.
+func Fetch_threshold_public_maps(gossiper_urls []string) ([]gossiper.DKG_public_map, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	public_maps := make([]gossiper.DKG_public_map, 0, len(gossiper_urls))
+	for _, url := range gossiper_urls {
+		resp, err := client.Get("http://" + url + "/gossip/dkg/public-map")
+		if err != nil {
+			return nil, err
+		}
+		var public_map gossiper.DKG_public_map
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: %s", url, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&public_map)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		public_maps = append(public_maps, public_map)
+	}
+	return public_maps, nil
+}
+
+// Write the public map produced by a gossiper DKG into a crypto config file.
+// Every gossiper in the map must have signed the same map, and its key shares must lie on one polynomial
+// of the config's threshold, so neither a gossiper nor anyone on the way can hand out a map of their own.
+func Update_threshold_public_map(crypto_config_path string, public_maps []gossiper.DKG_public_map) error {
+	var crypto_config crypto.StoredCryptoConfig
+	bytes, err := ioutil.ReadFile(crypto_config_path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(bytes, &crypto_config)
+	if err != nil {
+		return err
+	}
+	if len(public_maps) == 0 {
+		return errors.New("No public map of the DKG")
+	}
+	verifier, err := crypto.NewVerifyOnlyCryptoConfig(&crypto_config)
+	if err != nil {
+		return err
+	}
+	agreed, err := json.Marshal(public_maps[0].Public_map)
+	if err != nil {
+		return err
+	}
+	signers := make(map[string]bool)
+	for _, public_map := range public_maps {
+		err = public_map.Verify(verifier)
+		if err != nil {
+			return fmt.Errorf("public map of %s: %v", public_map.Gossiper, err)
+		}
+		js, err := json.Marshal(public_map.Public_map)
+		if err != nil {
+			return err
+		}
+		if string(js) != string(agreed) {
+			return errors.New("The gossipers " + public_maps[0].Gossiper + " and " + public_map.Gossiper + " disagree on the public map")
+		}
+		signers[public_map.Gossiper] = true
+	}
+	if len(signers) != len(public_maps[0].Public_map) {
+		return fmt.Errorf("The public map has %d gossipers, %d signed it", len(public_maps[0].Public_map), len(signers))
+	}
+	for id := range public_maps[0].Public_map {
+		if !signers[id] {
+			return errors.New("The gossiper " + id + " did not sign the public map")
+		}
+	}
+	pubs := make(crypto.BlsPublicMap)
+	err = pubs.Deserialize(public_maps[0].Public_map)
+	if err != nil {
+		return err
+	}
+	err = crypto.CheckThresholdPublicMap(pubs, crypto_config.Threshold)
+	if err != nil {
+		return err
+	}
+	crypto_config.ThresholdPublicMap = public_maps[0].Public_map
+	crypto_config_json, err := json.MarshalIndent(crypto_config, " ", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(crypto_config_path, crypto_config_json, 0644)
+}
+
+// Move the private keys of a crypto config file into an encrypted key store in the same directory.
+func Move_keys_to_keystore(crypto_config_path string, passphrase string) error {
+	var stored crypto.StoredCryptoConfig
+	bytes, err := ioutil.ReadFile(crypto_config_path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(bytes, &stored)
+	if err != nil {
+		return err
+	}
+	crypto_config, err := crypto.NewCryptoConfig(&stored)
+	if err != nil {
+		return err
+	}
+	return crypto.SaveCryptoConfigWithKeyStore(crypto_config_path, crypto_config, "keystore.json", passphrase)
+}
+
+// Move a crypto config file to the epoch produced by a gossiper resharing.
+// The current public map is kept to verify the objects signed so far.
+func Advance_threshold_epoch(crypto_config_path string, public_map map[string][]byte, threshold int) error {
+	var crypto_config crypto.StoredCryptoConfig
+	bytes, err := ioutil.ReadFile(crypto_config_path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(bytes, &crypto_config)
+	if err != nil {
+		return err
+	}
+	if crypto_config.PastThresholdKeys == nil {
+		crypto_config.PastThresholdKeys = make(map[int]crypto.StoredThresholdEpochKeys)
+	}
+	crypto_config.PastThresholdKeys[crypto_config.ThresholdEpoch] = crypto.StoredThresholdEpochKeys{
+		Threshold: crypto_config.Threshold,
+		N:         crypto_config.N,
+		PublicMap: crypto_config.ThresholdPublicMap,
+	}
+	crypto_config.ThresholdEpoch++
+	crypto_config.ThresholdPublicMap = public_map
+	crypto_config.Threshold = threshold
+	crypto_config.N = len(public_map)
+	// A share of an earlier epoch must not be used again
+	crypto_config.ThresholdSecretKey = nil
+	crypto_config_json, err := json.MarshalIndent(crypto_config, " ", " ")
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(crypto_config_path, crypto_config_json, 0644)
 }
 
 // warning: Only use this function after generating all the config files in SAME directory
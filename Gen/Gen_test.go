@@ -6,6 +6,7 @@ import (
 	"CTngV2/crypto"
 	"CTngV2/gossiper"
 	"CTngV2/monitor"
+	"CTngV2/util"
 	"crypto/rsa"
 	"fmt"
 	"os"
@@ -176,3 +177,91 @@ func Test_gen_Monitor_Gossiper(t *testing.T) {
 		write_all_configs_to_file(gossiper_public_config, gossiper_private_config, crypto_config, filepath, "Gossiper")
 	}
 }
+
+func Test_sign_gen_error(t *testing.T) {
+	if _, _, err := Sign_gen([]string{"localhost:8080"}, "unknown"); err == nil {
+		t.Fatal("Generated keys for an unknown sign scheme")
+	}
+	dir := t.TempDir() + "/"
+	err := GenerateallWithOptions(4, 2, 2, 2, 4, 60, 60, dir, Gen_options{Sign_scheme: "unknown"})
+	if err == nil {
+		t.Fatal("Generated the configs for an unknown sign scheme")
+	}
+	if _, err := os.Stat(dir + "ca_testconfig/1/CA_crypto_config.json"); err == nil {
+		t.Fatal("Wrote a config without sign keys")
+	}
+}
+
+func Test_update_threshold_public_map(t *testing.T) {
+	ids := []crypto.CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(ids, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateEntityCryptoConfigs(ids, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/Monitor_crypto_config.json"
+	write_config := func() {
+		stored := crypto.NewStoredCryptoConfig(&configs[0])
+		stored.ThresholdPublicMap = nil
+		if err := util.WriteData(path, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign_maps := func() []gossiper.DKG_public_map {
+		maps := make([]gossiper.DKG_public_map, len(configs))
+		for i := range configs {
+			maps[i], err = gossiper.New_DKG_public_map(&configs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return maps
+	}
+	write_config()
+	maps := sign_maps()
+	if err := Update_threshold_public_map(path, maps); err != nil {
+		t.Fatal(err)
+	}
+	var stored crypto.StoredCryptoConfig
+	util.LoadConfiguration(&stored, path)
+	if fmt.Sprint(stored.ThresholdPublicMap) != fmt.Sprint(maps[0].Public_map) {
+		t.Fatal("The agreed public map was not written")
+	}
+	write_config()
+	// a gossiper hands out a map of its own
+	forged, err := gossiper.New_DKG_public_map(&other[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Gossiper = string(ids[2])
+	if err := Update_threshold_public_map(path, append(sign_maps()[:2], forged)); err == nil {
+		t.Fatal("Took a public map with a forged signature")
+	}
+	if err := Update_threshold_public_map(path, sign_maps()[:2]); err == nil {
+		t.Fatal("Took a public map one gossiper did not sign")
+	}
+	configs[2].ThresholdPublicMap = other[2].ThresholdPublicMap
+	if err := Update_threshold_public_map(path, sign_maps()); err == nil {
+		t.Fatal("Took a public map the gossipers disagree on")
+	}
+	// all gossipers agree on shares that are not on one polynomial
+	mixed := make(crypto.BlsPublicMap)
+	for id, pub := range configs[0].ThresholdPublicMap {
+		mixed[id] = pub
+	}
+	mixed[ids[0]] = other[0].ThresholdPublicMap[ids[0]]
+	for i := range configs {
+		configs[i].ThresholdPublicMap = mixed
+	}
+	if err := Update_threshold_public_map(path, sign_maps()); err == nil {
+		t.Fatal("Took a public map not on one polynomial")
+	}
+	var rejected crypto.StoredCryptoConfig
+	util.LoadConfiguration(&rejected, path)
+	if len(rejected.ThresholdPublicMap) != 0 {
+		t.Fatal("Wrote a rejected public map")
+	}
+}
@@ -3,6 +3,7 @@ package Logger
 import (
 	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"CTngV2/util"
 	"crypto/rsa"
 	"crypto/x509"
@@ -49,6 +50,11 @@ type LoggerContext struct {
 	StorageFile           string
 	Request_Count_lock    *sync.Mutex
 	StoragePath           string
+	Crypto_config_path    string
+	Pending_key_rotation  *definition.Pending_key_rotation // announced key rotation, until the new key is in use
+	Disputed_periods      map[string]bool                  // periods whose accusations were already disputed
+	Dispute_lock          *sync.Mutex
+	Metrics               *metrics.CTng_metrics
 }
 
 type PrecertStorage struct {
@@ -116,6 +122,10 @@ func InitializeLoggerContext(public_config_path string, private_config_file_path
 		STH_storage_fake:      make(map[string]definition.Gossip_object),
 		MisbehaviorInterval:   0,
 		Request_Count_lock:    &sync.Mutex{},
+		Disputed_periods:      make(map[string]bool),
+		Dispute_lock:          &sync.Mutex{},
+		Crypto_config_path:    crypto_config_path,
+		Metrics:               metrics.New_CTng_metrics(),
 	}
 	// Initialize http client
 	tr := &http.Transport{}
@@ -2,7 +2,6 @@ package Logger
 
 import (
 	"CTngV2/CA"
-	"CTngV2/crypto"
 	"CTngV2/definition"
 	"CTngV2/util"
 	"crypto/sha256"
@@ -75,7 +74,7 @@ func BuildMerkleTreeFromCerts(certs []x509.Certificate, ctx LoggerContext, perio
 	sth_payload, _ := json.Marshal(STH1)
 	payload1 := string(sth_payload)
 	payload2 := ""
-	signature, _ := crypto.RSASign([]byte(payload0+payload1+payload2), &ctx.PrivateKey, crypto.CTngID(ctx.Logger_private_config.Signer))
+	signature, _ := ctx.Logger_crypto_config.Sign([]byte(payload0 + payload1 + payload2))
 	gossipSTH := definition.Gossip_object{
 		Application:   "CTng",
 		Type:          definition.STH_INIT,
@@ -83,7 +82,7 @@ func BuildMerkleTreeFromCerts(certs []x509.Certificate, ctx LoggerContext, perio
 		Signer:        string(ctx.Logger_private_config.Signer),
 		Timestamp:     STH1.Timestamp,
 		Signature:     [2]string{signature.String(), ""},
-		Crypto_Scheme: "RSA",
+		Crypto_Scheme: signature.Scheme,
 		Payload:       [3]string{payload0, payload1, payload2},
 	}
 	addPOI(&root, nil, make([][]byte, 0))
@@ -36,6 +36,11 @@ func handleLoggerRequests(ctx *LoggerContext) {
 	gorillaRouter.HandleFunc("/Logger/receive-precerts", bindLoggerContext(ctx, receive_pre_cert)).Methods("POST")
 	// get sth request from Monitor
 	gorillaRouter.HandleFunc("/ctng/v2/get-sth", bindLoggerContext(ctx, requestSTH)).Methods("GET")
+	// get key rotation request from Monitor
+	gorillaRouter.HandleFunc("/ctng/v2/get-key-rotation", bindLoggerContext(ctx, requestKeyRotation)).Methods("GET")
+	// receive the accusations against the logger from the gossipers
+	gorillaRouter.HandleFunc("/ctng/v2/accusation", bindLoggerContext(ctx, receive_accusation)).Methods("POST")
+	gorillaRouter.HandleFunc("/metrics", ctx.Metrics.Handler()).Methods("GET")
 	//start the HTTP server
 	http.Handle("/", gorillaRouter)
 	// Listen on port set by config until server is stopped.
@@ -104,6 +109,114 @@ func requestSTH(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves the announced key rotation, the body is empty if there is none.
+func requestKeyRotation(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	if c.Pending_key_rotation == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(c.Pending_key_rotation.KEY_INIT)
+}
+
+// Announce the signing key committed to for the next rotation, the STHs are signed with it from valid_from on.
+// The announcement commits to a new key with the given scheme for the rotation after it.
+// The monitors pick the announcement up and hand it to their gossipers.
+func Rotate_sign_key(c *LoggerContext, scheme string, valid_from int) error {
+	pending, err := definition.New_pending_key_rotation(c.Logger_crypto_config, scheme, valid_from)
+	if err != nil {
+		return err
+	}
+	c.Pending_key_rotation = pending
+	fmt.Println(util.BLUE+"Announced key version", pending.Rotation.Version, "valid from period", valid_from, util.RESET)
+	return nil
+}
+
+// Switch to the announced key if the STH for period is the first one to be signed with it.
+func install_rotated_key(c *LoggerContext, period int) {
+	if c.Pending_key_rotation == nil {
+		return
+	}
+	installed, err := c.Pending_key_rotation.Install(c.Logger_crypto_config, period)
+	if err != nil {
+		fmt.Println(util.RED+"Failed to install the new signing key:", err, util.RESET)
+		return
+	}
+	if !installed {
+		return
+	}
+	c.Pending_key_rotation = nil
+	if c.Crypto_config_path != "" {
+		err = crypto.SaveKeyVersions(c.Crypto_config_path, c.Logger_crypto_config, true)
+		if err != nil {
+			fmt.Println(util.RED+"Failed to save the new signing key:", err, util.RESET)
+		}
+	}
+}
+
+// Answer the accusations against the logger for period with the STH it served in that period.
+// The dispute is signed by the logger and posted to its gossipers, which pass it on to the monitors.
+func Dispute_accusation(c *LoggerContext, period string, statement string) error {
+	var response *definition.Gossip_object
+	if sth, ok := c.STH_storage[period]; ok {
+		response = &sth
+	}
+	dispute, err := definition.Generate_DIS_INIT(c.Logger_crypto_config, period, statement, response)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(dispute)
+	if err != nil {
+		return err
+	}
+	delivered := 0
+	for _, gossiper := range c.Logger_private_config.Gossiperlist {
+		resp, err := c.Client.Post(PROTOCOL+gossiper+"/gossip/dis_init", "application/json", bytes.NewBuffer(msg))
+		if err != nil {
+			fmt.Println(util.RED+"Failed to send the dispute to gossiper "+gossiper+":", err, util.RESET)
+			c.Metrics.Send_failed(gossiper, definition.TypeString(dispute.Type))
+			continue
+		}
+		resp.Body.Close()
+		delivered++
+	}
+	if delivered == 0 {
+		return fmt.Errorf("No gossiper accepted the dispute for period %s", period)
+	}
+	return nil
+}
+
+// receive an ACC_FULL against the logger from a gossiper and dispute it
+// Every gossiper relays the ACC_FULL, the logger disputes each period once.
+func receive_accusation(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	var acc definition.Gossip_object
+	err := json.NewDecoder(r.Body).Decode(&acc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if acc.Type != definition.ACC_FULL || acc.Payload[0] != c.Logger_crypto_config.SelfID.String() {
+		http.Error(w, "Not an accusation against this logger.", http.StatusBadRequest)
+		return
+	}
+	err = acc.Verify(c.Logger_crypto_config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Dispute_lock.Lock()
+	defer c.Dispute_lock.Unlock()
+	if c.Disputed_periods[acc.Period] {
+		return
+	}
+	fmt.Println(util.BLUE+"Accused by the gossipers in period "+acc.Period+", disputing it.", util.RESET)
+	err = Dispute_accusation(c, acc.Period, "The logger served the attached STH in period "+acc.Period+".")
+	if err != nil {
+		fmt.Println(util.RED+"Failed to dispute the accusation:", err, util.RESET)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	c.Disputed_periods[acc.Period] = true
+}
+
 // receive precert from CA
 func receive_pre_cert(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
 	// Unmarshal the request body into a precert
@@ -113,6 +226,7 @@ func receive_pre_cert(c *LoggerContext, w http.ResponseWriter, r *http.Request)
 		fmt.Printf("Error: %s\n", err)
 		return
 	}
+	c.Metrics.Count_received("PRECERT")
 	// Parse the DER-encoded certificate
 	precert = CA.Unmarshall_Signed_PreCert(body)
 	fmt.Println(precert.SubjectKeyId)
@@ -134,6 +248,7 @@ func Send_STH_to_CA(c *LoggerContext, sth definition.Gossip_object, ca string) {
 	resp, err := c.Client.Post(PROTOCOL+ca+"/CA/receive-sth", "application/json", bytes.NewBuffer(sth_json))
 	if err != nil {
 		fmt.Println("Failed to send STH to CA: ", err)
+		c.Metrics.Send_failed(ca, definition.TypeString(sth.Type))
 	} else {
 		defer resp.Body.Close()
 	}
@@ -149,6 +264,8 @@ func Send_POI_to_CA(c *LoggerContext, poi CA.ProofOfInclusion, ca string) {
 	resp, err := c.Client.Post(PROTOCOL+ca+"/CA/receive-poi", "application/json", bytes.NewBuffer(poi_json))
 	if err != nil {
 		fmt.Println("Failed to send POI to CA: ", err)
+		c.Metrics.Send_failed(ca, "POI")
+		return
 	}
 	defer resp.Body.Close()
 }
@@ -217,6 +334,10 @@ func PeriodicTask(ctx *LoggerContext) {
 	time.AfterFunc(time.Duration(ctx.Logger_public_config.MMD)*time.Second, f)
 	fmt.Println("——————————————————————————————————Logger Running Tasks at Period ", GetCurrentPeriod(), "——————————————————————————————————")
 	f1 := func() {
+		start := time.Now()
+		if ctx.Metrics != nil {
+			defer ctx.Metrics.Phase_seconds.Since(start, "sth")
+		}
 		//fmt.Println(GerCurrentSecond())
 		// update online period
 		ctx.OnlinePeriod = ctx.OnlinePeriod + 1
@@ -228,6 +349,7 @@ func PeriodicTask(ctx *LoggerContext) {
 		}
 		periodint = periodint + 1
 		period = strconv.Itoa(periodint)
+		install_rotated_key(ctx, periodint)
 		// update STH
 		certlist := ctx.CurrentPrecertPool.GetCerts()
 		STH, sth, POIs := BuildMerkleTreeFromCerts(certlist, *ctx, periodint)
@@ -1,19 +1,17 @@
 package client
 
 import (
-	"CTngV2/CA"
-	"CTngV2/Logger"
 	"CTngV2/crypto"
 	"CTngV2/definition"
 	"CTngV2/monitor"
-	"CTngV2/util"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
+	"reflect"
+	"time"
 
 	"github.com/bits-and-blooms/bitset"
 )
@@ -32,6 +30,18 @@ func FetchClientUpdate(url string) (monitor.ClientUpdate, error) {
 	return data, err
 }
 
+// Fetch the bundle of all client updates since the given period from a monitor
+func FetchClientUpdateBundle(monitorURL string, since string) (monitor.ClientUpdateBundle, error) {
+	res, err := fetch(monitorURL + "/monitor/get-update?since=" + since)
+	if err != nil {
+		return monitor.ClientUpdateBundle{}, err
+	}
+
+	var data monitor.ClientUpdateBundle
+	err = json.Unmarshal(res, &data)
+	return data, err
+}
+
 // Fetch an entity from the given url and parse it as an array of gossip objects
 func FetchGossip(url string) (MonitorData, error) {
 	res, err := fetch(url)
@@ -80,11 +90,15 @@ func FetchCertificate(url string) (x509.Certificate, error) {
 	return *certificates[0], nil
 }
 
+// The client of the requests to the monitors, a monitor that does not answer in time counts as unreachable.
+var fetch_client = &http.Client{Timeout: 10 * time.Second}
+
 func fetch(url string) ([]byte, error) {
-	res, err := http.Get(url)
+	res, err := fetch_client.Get(url)
 	if err != nil {
 		return []byte{}, err
 	}
+	defer res.Body.Close()
 
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -100,7 +114,12 @@ func fetch(url string) ([]byte, error) {
 
 func (ctx *ClientContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID string, Period string) bool {
 	// find the corresponding CRV
-	CRV_old := ctx.CRV_database[CAID]
+	return ctx.verify_SRH(ctx.Crypto, srh, ctx.CRV_database[CAID], dCRV, Period)
+}
+
+// Verify an SRH against the CRV the CA had before the revocation, nil if the client has none.
+// c is the key set the SRH is checked with.
+func (ctx *ClientContext) verify_SRH(c *crypto.CryptoConfig, srh string, CRV_old *bitset.BitSet, dCRV *bitset.BitSet, Period string) bool {
 	if CRV_old == nil {
 		CRV_old = dCRV
 	}
@@ -113,12 +132,11 @@ func (ctx *ClientContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID string
 	localhash, _ := crypto.GenerateSHA256([]byte(Period + string(hash1) + string(hash2)))
 	// the localhash will be te message we used to verify the Signature on the SRH
 	// verify the signature
-	rsasig, err := crypto.RSASigFromString(srh)
+	sig, err := crypto.SignatureFromString(srh)
 	if err != nil {
-		fmt.Println("Fail to convert the signature from the SRH to RSA signature")
+		fmt.Println("Fail to convert the signature from the SRH")
 	}
-	ca_publickey := ctx.Crypto.SignPublicMap[rsasig.ID]
-	err = crypto.RSAVerify(localhash, rsasig, &ca_publickey)
+	err = definition.Verify_SignatureForPeriod(c, localhash, sig, Period)
 	if err != nil {
 		fmt.Println("Fail to verify the signature on the SRH")
 		return false
@@ -127,181 +145,171 @@ func (ctx *ClientContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID string
 	return true
 }
 
-func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool, newmonitor bool) bool {
-	ctx.CRV_DB_RWLock.Lock()
-	for _, rev := range update.REVs {
-		if verify {
-			err := rev.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("REV verification failed")
-				return false
-			}
-		}
-		SRH, DCRV := Get_SRH_and_DCRV(rev)
-		key := rev.Payload[0]
-		//verif REV_FULL
-		//verify SRH
-		if !ctx.VerifySRH(SRH, &DCRV, key, rev.Period) {
-			fmt.Println("SRH verification failed")
-			return false
-		}
-		//Update CRV
-		// look for CRV first
-		if _, ok := ctx.CRV_database[key]; !ok {
-			ctx.CRV_database[key] = &DCRV
-		} else {
-			ctx.CRV_database[key].SymmetricDifference(&DCRV)
-		}
+// Verify the signatures of every object in a client update.
+// The threshold signatures of the REVs, STHs, ACCs, CONs and KEYs are checked in one batch;
+// if the batch fails, every offending object is reported.
+// The signatures of the entities are checked with the key set the rotations of the update lead to.
+func (ctx *ClientContext) VerifyUpdateSignatures(update monitor.ClientUpdate, newmonitor bool) bool {
+	stage := new_update_stage()
+	ctx.stage_KEYs(stage, update.KEYs)
+	return ctx.verify_update_signatures(stage.Crypto, update, newmonitor)
+}
+
+func (ctx *ClientContext) verify_update_signatures(c *crypto.CryptoConfig, update monitor.ClientUpdate, newmonitor bool) bool {
+	if !verify_objects(c, update.REVs, update.STHs, update.ACCs, update.CONs, update.KEYs) {
+		return false
 	}
-	ctx.CRV_DB_RWLock.Unlock()
-	ctx.STH_DB_RWLock.Lock()
-	for _, sth := range update.STHs {
-		if verify {
-			err := sth.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("sth verification failed")
-				return false
-			}
-		}
-		var STH_def definition.STH
-		err := json.Unmarshal([]byte(sth.Payload[1]), &STH_def)
+	//fmt.Println("Verifying Monitor Integrity data signatures for period " + update.Period + " ...")
+	err := update.NUM.Verify(c)
+	if err != nil {
+		fmt.Println("NUM verification failed")
+		return false
+	}
+	if !newmonitor {
+		err := update.NUM_FULL.Verify(c)
 		if err != nil {
-			fmt.Println("sth unmarshal failed")
+			fmt.Println("NUM_FULL verification failed")
 			return false
 		}
-		newrecord := STH_def.RootHash
-		key := sth.Payload[0] + "@" + sth.Period
-		//verify STH_FULL
-		//Update STH
-		// look for STH first
-		ctx.STH_database[key] = newrecord
-	}
-	ctx.STH_DB_RWLock.Unlock()
-	ctx.D1_Blacklist_DB_RWLock.Lock()
-	for _, d1pom := range update.ACCs {
-		//verify D1POM_FULL
-		if verify {
-			err := d1pom.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("d1pom verification failed")
-				return false
-			}
-		}
-		//Update D1POM
-		// look for D1POM first
-		key := d1pom.Payload[0] + "@" + d1pom.Period
-		ctx.D1_Blacklist_database[key] = true
-	}
-	ctx.D1_Blacklist_DB_RWLock.Unlock()
-	ctx.D2_Blacklist_DB_RWLock.Lock()
-	for _, d2pom := range update.CONs {
-		//verify D2POM_FULL
-		if verify {
-			err := d2pom.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("d2pom verification failed")
-				return false
-			}
-		}
-		//Update D2POM
-		// look for D2POM first
-		key := d2pom.Payload[0]
-		if _, ok := ctx.D2_Blacklist_database[key]; !ok {
-			ctx.D2_Blacklist_database[key] = d2pom.Period
+	}
+	return true
+}
+
+// Batch verify the threshold signatures of the gossip objects of an update.
+func verify_objects(c *crypto.CryptoConfig, lists ...[]definition.Gossip_object) bool {
+	objs := []definition.Gossip_object{}
+	for _, list := range lists {
+		objs = append(objs, list...)
+	}
+	failed := definition.Verify_PayloadThreshold_Batch(objs, c)
+	for _, i := range failed {
+		fmt.Println(definition.TypeString(objs[i].Type), "verification failed for", objs[i].Payload[0], "at period", objs[i].Period)
+	}
+	return len(failed) == 0
+}
+
+// Apply a client update, either all of it or nothing: every object is checked before the databases change.
+func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool, newmonitor bool) bool {
+	// key rotations first, the SRHs of this period may already be signed with the new keys
+	stage := new_update_stage()
+	ctx.stage_KEYs(stage, update.KEYs)
+	if verify && !ctx.verify_update_signatures(stage.Crypto, update, newmonitor) {
+		return false
+	}
+	if !ctx.stage_REVs(stage, update.REVs) || !ctx.stage_STHs(stage, update.STHs) {
+		return false
+	}
+	ctx.stage_PoMs(stage, update.ACCs, update.CONs)
+	// the first NUM_FULL of a new monitor is not verified, it is not used
+	NUM_FULL := update.NUM_FULL
+	if newmonitor {
+		NUM_FULL = definition.PoM_Counter{}
+	}
+	if !ctx.check_monitor_integrity(stage, update.Period, update.NUM, NUM_FULL, verify) {
+		// only the evidence against the monitor is kept, not the counters of the update
+		ctx.save()
+		return false
+	}
+	stage.Last_update_period = update.Period
+	ctx.commit(stage)
+	ctx.save()
+	return true
+}
+
+// Stage the monitor integrity data, and the counters if they were verified: unverified counters are no evidence.
+func (ctx *ClientContext) check_monitor_integrity(stage *update_stage, Period string, NUM definition.PoM_Counter, NUM_FULL definition.PoM_Counter, verified bool) bool {
+	stage.Integrity[Period] = NUM.ACC_FULL_Counter + "@" + NUM.CON_FULL_Counter
+	if !verified {
+		return true
+	}
+	// verify the NUMs of every monitor for the previous period against the NUM_FULL received in this period
+	// if the verification fails for the monitor of the update, then the monitor is not honest
+	found, err := ctx.stage_counters(stage, NUM, NUM_FULL)
+	if err != nil {
+		fmt.Println("Monitor integrity check failed:", err)
+		return false
+	}
+	for _, evidence := range found {
+		if evidence.Monitor == NUM.Signer_Monitor {
+			return false
 		}
 	}
-	ctx.D2_Blacklist_DB_RWLock.Unlock()
-	// now verify and store monitor integrity data
-	// first verify the signature on the monitor integrity data
-	if verify {
-		//fmt.Println("Verifying Monitor Integrity data signatures for period " + update.Period + " ...")
-		err := update.NUM.Verify(ctx.Crypto)
+	return true
+}
+
+// Verify the signatures of every object and monitor counter in a bundle.
+// As with a single update, a new monitor has no NUM_FULL for its first period.
+func (ctx *ClientContext) VerifyBundleSignatures(bundle monitor.ClientUpdateBundle, newmonitor bool) bool {
+	stage := new_update_stage()
+	ctx.stage_KEYs(stage, bundle.KEYs)
+	return ctx.verify_bundle_signatures(stage.Crypto, bundle, newmonitor)
+}
+
+func (ctx *ClientContext) verify_bundle_signatures(c *crypto.CryptoConfig, bundle monitor.ClientUpdateBundle, newmonitor bool) bool {
+	if !verify_objects(c, bundle.REVs, bundle.STHs, bundle.ACCs, bundle.CONs, bundle.KEYs) {
+		return false
+	}
+	if len(bundle.NUMs) != len(bundle.NUM_FULLs) {
+		fmt.Println("Bundle has", len(bundle.NUMs), "NUMs but", len(bundle.NUM_FULLs), "NUM_FULLs")
+		return false
+	}
+	for i := range bundle.NUMs {
+		err := bundle.NUMs[i].Verify(c)
 		if err != nil {
-			fmt.Println("NUM verification failed")
+			fmt.Println("NUM verification failed for period", bundle.NUMs[i].Period)
 			return false
 		}
-		if !newmonitor {
-			err := update.NUM_FULL.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("NUM_FULL verification failed")
-				return false
-			}
+		if newmonitor && i == 0 {
+			continue
 		}
-	}
-	ctx.Monitor_Interity_database[update.Period] = update.NUM.ACC_FULL_Counter + "@" + update.NUM.CON_FULL_Counter
-	// verify the Monitor Integrity data for the previous period against the NUM_FULL received in this period
-	// if the verification fails, then the monitor is not honest
-	period_int, _ := strconv.Atoi(update.Period)
-	period_int_prev := strconv.Itoa(period_int - 1)
-	key := period_int_prev
-	old_data := ctx.Monitor_Interity_database[key]
-	if old_data != "" {
-		new_data := update.NUM_FULL.ACC_FULL_Counter + "@" + update.NUM_FULL.CON_FULL_Counter
-		if old_data != new_data {
-			// we should definitely do something else here, but for now we just print
-			fmt.Println("Monitor is not honest")
+		err = bundle.NUM_FULLs[i].Verify(c)
+		if err != nil {
+			fmt.Println("NUM_FULL verification failed for period", bundle.NUMs[i].Period)
 			return false
 		}
 	}
 	return true
 }
 
-func (ctx *ClientContext) VerifyCTngextension(cert *x509.Certificate) bool {
-	var CTngext CA.CTngExtension
-	CTngext = CA.ParseCTngextension(cert)
-	var total int
-	total = len(CTngext.LoggerInformation)
-	var faulty_logger int
-	faulty_logger = 0
-	Precert := util.ParseTBSCertificate(cert)
-	for _, loggerinfo := range CTngext.LoggerInformation {
-		err := loggerinfo.STH.Verify(ctx.Crypto)
-		if err != nil {
-			fmt.Println("Cert logger STH verification failed")
-			faulty_logger++
-		} else {
-			var treeinfo definition.STH
-			err := json.Unmarshal([]byte(loggerinfo.STH.Payload[1]), &treeinfo)
-			if err != nil {
-				fmt.Println("sth unmarshal failed")
-				faulty_logger++
-			} else {
-				roothash := ctx.STH_database[loggerinfo.STH.Payload[0]+"@"+loggerinfo.STH.Period]
-				if roothash != treeinfo.RootHash {
-					fmt.Println("STH from cert logger does not match with the one in the database")
-					fmt.Println("STH from cert logger : ", treeinfo.RootHash)
-					fmt.Println("STH from database : ", roothash)
-					faulty_logger++
-				} else {
-					//fmt.Println("Loggerinfo.POI: ", loggerinfo.POI)
-					pass := Logger.VerifyPOI(treeinfo, loggerinfo.POI, *Precert)
-					if !pass {
-						fmt.Println("Cert logger POI verification failed")
-						computed := Logger.ComputeRoot(treeinfo, loggerinfo.POI, *Precert)
-						fmt.Println("Computed root: ", []byte(computed))
-						fmt.Println("STH root: ", []byte(treeinfo.RootHash))
-						faulty_logger++
-					}
-				}
-
-			}
-		}
+// Catch up on several periods at once with a bundle from /monitor/get-update?since=P.
+// The SRH of every REV is verified in order, then the composed Delta_CRV of each CA is applied at once.
+func (ctx *ClientContext) HandleUpdateBundle(bundle monitor.ClientUpdateBundle, verify bool, newmonitor bool) bool {
+	stage := new_update_stage()
+	ctx.stage_KEYs(stage, bundle.KEYs)
+	if verify && !ctx.verify_bundle_signatures(stage.Crypto, bundle, newmonitor) {
+		return false
 	}
-	if faulty_logger == total {
-		fmt.Println("All loggers are faulty")
+	// the composed deltas are not signed, they have to match the signed REVs
+	deltas, err := monitor.Compose_Delta_CRVs(bundle.REVs)
+	if err != nil {
+		fmt.Println("Failed to compose the Delta_CRVs:", err)
 		return false
-	} else {
-		fmt.Println("total loggers : Faulty logger = ", total, " : ", faulty_logger)
-		fmt.Println("CTng Logger information verification passed, there exists at least one benign logger")
 	}
-
-	RID := CA.GetRIDfromCert(cert)
-	CRV_to_check := ctx.CRV_database[cert.Issuer.CommonName]
-	if CRV_to_check.Test(uint(RID)) {
-		fmt.Println("Certificate has been revoked")
+	if !reflect.DeepEqual(deltas, bundle.Delta_CRVs) && !(len(deltas) == 0 && len(bundle.Delta_CRVs) == 0) {
+		fmt.Println("The composed Delta_CRVs do not match the REVs of the bundle")
+		return false
+	}
+	// the composed deltas matching the REVs, the CRVs staged REV by REV are the CRVs with the deltas applied
+	if !ctx.stage_REVs(stage, bundle.REVs) || !ctx.stage_STHs(stage, bundle.STHs) {
 		return false
-	} else {
-		fmt.Println("Certificate has not been revoked")
-		return true
 	}
+	ctx.stage_PoMs(stage, bundle.ACCs, bundle.CONs)
+	for i := range bundle.NUMs {
+		NUM_FULL := bundle.NUM_FULLs[i]
+		if newmonitor && i == 0 {
+			NUM_FULL = definition.PoM_Counter{}
+		}
+		if !ctx.check_monitor_integrity(stage, bundle.NUMs[i].Period, bundle.NUMs[i], NUM_FULL, verify) {
+			// only the evidence against the monitor is kept, not the counters of the bundle
+			ctx.save()
+			return false
+		}
+	}
+	// the periods of the bundle are the monitor's storage periods, the NUMs carry the actual ones
+	if len(bundle.NUMs) > 0 {
+		stage.Last_update_period = bundle.NUMs[len(bundle.NUMs)-1].Period
+	}
+	ctx.commit(stage)
+	ctx.save()
+	return true
 }
@@ -1,16 +1,38 @@
 package client
 
 import (
+	"CTngV2/CA"
+	"CTngV2/crypto"
+	"CTngV2/definition"
 	"CTngV2/monitor"
-	//"CTngV2/definition"
 	"CTngV2/util"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bits-and-blooms/bitset"
 )
@@ -86,6 +108,7 @@ func TestInit(t *testing.T) {
 		Config_filepath: "client/Client_config.json",
 		Crypto_filepath: "client/Client_crypto_config.json",
 		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
 	}
 	ctx.InitializeClientContext()
 	//fmt.Println(ctx.Crypto.SignPublicMap)
@@ -98,16 +121,730 @@ func TestHandleUpdate(t *testing.T) {
 		Config_filepath: "client/Client_config.json",
 		Crypto_filepath: "client/Client_crypto_config.json",
 		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
 	}
 	ctx.InitializeClientContext()
 	update_1 := ctx.LoadUpdate("monitor_testdata/1/Period_19/ClientUpdate.json")
 	update_2 := ctx.LoadUpdate("monitor_testdata/1/Period_20/ClientUpdate.json")
 	update_3 := ctx.LoadUpdate("monitor_testdata/1/Period_21/ClientUpdate.json")
-	ctx.HandleUpdate(update_1, true, true)
-	ctx.HandleUpdate(update_2, true, false)
+	if !ctx.HandleUpdate(update_1, true, true) || !ctx.HandleUpdate(update_2, true, false) {
+		t.Fatal("Rejected an update signed by the gossipers")
+	}
 	ctx.HandleUpdate(update_3, false, false)
 	fmt.Println("Presenting STH database:")
 	fmt.Println(ctx.STH_database)
 	fmt.Println("Presenting CRV database:")
 	fmt.Println(ctx.CRV_database)
 }
+
+func TestHandleUpdateBundle(t *testing.T) {
+	newctx := func() *ClientContext {
+		ctx := &ClientContext{
+			Status:          "NEW",
+			Config_filepath: "client/Client_config.json",
+			Crypto_filepath: "client/Client_crypto_config.json",
+			Config:          &ClientConfig{},
+			Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+		}
+		ctx.InitializeClientContext()
+		return ctx
+	}
+	mon := &monitor.MonitorContext{StorageDirectory: "monitor_testdata/1", Update_index: monitor.New_update_index()}
+	bundle, err := mon.Generate_update_bundle(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Since != "19" || bundle.Period != "21" || len(bundle.STHs) != 3 || len(bundle.REVs) != 3 || len(bundle.NUMs) != 3 {
+		t.Fatalf("Unexpected bundle from period %s to %s", bundle.Since, bundle.Period)
+	}
+	// one request has to leave the client where the three single updates leave it
+	sequential := newctx()
+	for i, period := range []string{"19", "20", "21"} {
+		update := sequential.LoadUpdate("monitor_testdata/1/Period_" + period + "/ClientUpdate.json")
+		if !sequential.HandleUpdate(update, true, i == 0) {
+			t.Fatalf("Update of period %s rejected", period)
+		}
+	}
+	bundled := newctx()
+	if !bundled.HandleUpdateBundle(*bundle, true, true) {
+		t.Fatal("Bundle rejected")
+	}
+	if !reflect.DeepEqual(sequential.STH_database, bundled.STH_database) {
+		t.Fatalf("STH databases differ: %v %v", sequential.STH_database, bundled.STH_database)
+	}
+	if !reflect.DeepEqual(sequential.Monitor_Interity_database, bundled.Monitor_Interity_database) {
+		t.Fatalf("Monitor integrity databases differ")
+	}
+	// a monitor can not slip a revocation into the composed deltas
+	crv := bitset.New(8).Set(3)
+	bundle.Delta_CRVs["localhost:9100"], _ = crv.MarshalBinary()
+	if newctx().HandleUpdateBundle(*bundle, true, true) {
+		t.Fatal("Bundle with forged Delta_CRVs accepted")
+	}
+}
+
+// The counters of a rejected bundle are not recorded, the evidence found on the way is.
+func TestStagedCounters(t *testing.T) {
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+	}
+	ctx.InitializeClientContext()
+	mon := &monitor.MonitorContext{StorageDirectory: "monitor_testdata/1", Update_index: monitor.New_update_index()}
+	bundle, err := mon.Generate_update_bundle(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unverified counters are not recorded
+	if !ctx.HandleUpdateBundle(*bundle, false, true) || len(ctx.Monitor_NUMs) != 0 || len(ctx.NUM_FULLs) != 0 {
+		t.Fatal("Recorded the counters of an unverified bundle")
+	}
+	ctx = &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+	}
+	ctx.InitializeClientContext()
+	ctx.Config.Monitor_evidence_filepath = t.TempDir() + "/Monitor_evidence.json"
+	// another monitor counted differently for the period of the second NUM_FULL,
+	// and the client knows a NUM_FULL for the period of the last one that the monitor of the bundle contradicts
+	full := bundle.NUM_FULLs[1]
+	liar := definition.PoM_Counter{Signer_Monitor: "X", Period: full.Period, ACC_FULL_Counter: full.ACC_FULL_Counter + "1", CON_FULL_Counter: full.CON_FULL_Counter}
+	conflicting := bundle.NUM_FULLs[2]
+	conflicting.ACC_FULL_Counter += "1"
+	ctx.Monitor_NUMs = map[string]definition.PoM_Counter{"X@" + full.Period: liar}
+	ctx.NUM_FULLs = map[string]definition.PoM_Counter{conflicting.Period: conflicting}
+	if ctx.HandleUpdateBundle(*bundle, true, true) {
+		t.Fatal("Bundle of a dishonest monitor accepted")
+	}
+	if len(ctx.Monitor_NUMs) != 1 || len(ctx.NUM_FULLs) != 1 || ctx.NUM_FULLs[conflicting.Period].Signature != conflicting.Signature {
+		t.Fatalf("A rejected bundle changed the counters: %v %v", ctx.Monitor_NUMs, ctx.NUM_FULLs)
+	}
+	if !ctx.dishonest("X") || !ctx.dishonest(bundle.NUMs[2].Signer_Monitor) || len(ctx.Monitor_evidence) != 2 {
+		t.Fatalf("The evidence found in a rejected bundle was not kept: %+v", ctx.Monitor_evidence)
+	}
+}
+
+// A certificate signed with the RSA key of the CA, with a CTng extension carrying the logger information.
+func testCTngCertificate(t *testing.T, ca *rsa.PrivateKey, issuer string, loggers []CA.LoggerInfo) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext := CA.CTngExtension{SequenceNumber: CA.SequenceNumber{RID: 3}, LoggerInformation: loggers}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: issuer},
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: CA.OIDCTngExtension, Value: CA.EncodeCTngExtension(ext)},
+		},
+	}
+	parent := &x509.Certificate{Subject: pkix.Name{CommonName: issuer}}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ClientContext{
+		Crypto:                 &crypto.CryptoConfig{SignPublicMap: crypto.RSAPublicMap{"localhost:9100": ca.PublicKey}},
+		STH_database:           make(map[string]string),
+		CRV_database:           make(map[string]*bitset.BitSet),
+		D1_Blacklist_database:  make(map[string]bool),
+		D2_Blacklist_database:  make(map[string]string),
+		STH_DB_RWLock:          &sync.RWMutex{},
+		CRV_DB_RWLock:          &sync.RWMutex{},
+		D1_Blacklist_DB_RWLock: &sync.RWMutex{},
+		D2_Blacklist_DB_RWLock: &sync.RWMutex{},
+	}
+	reason := func(err error) string {
+		var verr *Verification_error
+		if !errors.As(err, &verr) {
+			t.Fatalf("Expected a Verification_error, got %v", err)
+		}
+		return verr.Reason
+	}
+	tlscert := testCTngCertificate(t, ca, "localhost:9100", nil)
+	cert, _ := x509.ParseCertificate(tlscert.Certificate[0])
+	if reason(ctx.CheckCertificate(cert)) != CTNG_NO_VALID_LOGGER {
+		t.Error("Certificate without loggers accepted")
+	}
+	// the issuer signature is checked before the CTng extension
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged, _ := x509.ParseCertificate(testCTngCertificate(t, other, "localhost:9100", nil).Certificate[0])
+	if reason(ctx.CheckCertificate(forged)) != CTNG_BAD_SIGNATURE {
+		t.Error("Certificate not signed by its issuer accepted")
+	}
+	unknown, _ := x509.ParseCertificate(testCTngCertificate(t, other, "localhost:9200", nil).Certificate[0])
+	if reason(ctx.CheckCertificate(unknown)) != CTNG_UNKNOWN_ISSUER {
+		t.Error("Certificate of an unknown CA accepted")
+	}
+	if reason(ctx.VerifyConnection()(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, ServerName: "other.com"})) != CTNG_NAME_MISMATCH {
+		t.Error("Certificate of another server accepted")
+	}
+	if reason(ctx.VerifyPeerCertificate()([][]byte{[]byte("not a certificate")}, nil)) != CTNG_MALFORMED {
+		t.Error("Malformed certificate accepted")
+	}
+	if reason(ctx.VerifyConnection()(tls.ConnectionState{})) != CTNG_NO_CERTIFICATE {
+		t.Error("Connection without certificate accepted")
+	}
+	ctx.D2_Blacklist_database["localhost:9100"] = "2"
+	if reason(ctx.CheckCertificate(cert)) != CTNG_BLACKLISTED {
+		t.Error("Certificate of a blacklisted CA accepted")
+	}
+	// the check runs in the handshake of any http client
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{tlscert}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	// the certificate is valid for example.com, which resolves to the test server
+	dialer := &net.Dialer{}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: ctx.TLSConfig(),
+		DialContext: func(c context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(c, network, server.Listener.Addr().String())
+		},
+	}}
+	_, err = client.Get("https://example.com/")
+	if reason(err) != CTNG_BLACKLISTED {
+		t.Error("Handshake with a blacklisted CA succeeded")
+	}
+	// without a name the certificate can not be checked
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ctx.TLSConfig()}}
+	_, err = client.Get(server.URL)
+	if reason(err) != CTNG_NAME_MISMATCH {
+		t.Error("Handshake without a server name succeeded")
+	}
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ctx.TLSConfigFor("127.0.0.1")}}
+	_, err = client.Get(server.URL)
+	if reason(err) != CTNG_BLACKLISTED {
+		t.Error("Handshake with a blacklisted CA by address succeeded")
+	}
+}
+
+func TestVerifyCTngextension(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:9000", "localhost:9100"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ClientContext{
+		Crypto:                 &configs[1],
+		STH_database:           make(map[string]string),
+		CRV_database:           make(map[string]*bitset.BitSet),
+		CRV_Period_database:    make(map[string]string),
+		D1_Blacklist_database:  make(map[string]bool),
+		D2_Blacklist_database:  make(map[string]string),
+		STH_DB_RWLock:          &sync.RWMutex{},
+		CRV_DB_RWLock:          &sync.RWMutex{},
+		D1_Blacklist_DB_RWLock: &sync.RWMutex{},
+		D2_Blacklist_DB_RWLock: &sync.RWMutex{},
+	}
+	sth := func(period string, root string) definition.Gossip_object {
+		tree, _ := json.Marshal(definition.STH{RootHash: root})
+		payload := [3]string{"localhost:9000", string(tree), ""}
+		sig, err := configs[0].Sign([]byte(payload[0] + payload[1] + payload[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return definition.Gossip_object{
+			Application:   definition.CTNG_APPLICATION,
+			Type:          definition.STH_INIT,
+			Period:        period,
+			Signer:        "localhost:9000",
+			Signature:     [2]string{sig.String(), ""},
+			Crypto_Scheme: sig.Scheme,
+			Payload:       payload,
+		}
+	}
+	forged := sth("2", "root")
+	forged.Payload[1] = "{}"
+	ctx.STH_database["localhost:9000@3"] = "other root"
+	ctx.CRV_database["localhost:9100"] = bitset.New(8).Set(3)
+	ctx.CRV_Period_database["localhost:9100"] = "5"
+	tlscert := testCTngCertificate(t, &configs[1].SignSecretKey, "localhost:9100", []CA.LoggerInfo{{STH: sth("1", "root")}, {STH: forged}, {STH: sth("3", "root")}})
+	cert, _ := x509.ParseCertificate(tlscert.Certificate[0])
+	result, err := ctx.VerifyCTngextension(cert)
+	var verr *Verification_error
+	if !errors.As(err, &verr) || verr.Reason != CTNG_NO_VALID_LOGGER || verr.Result != result {
+		t.Fatalf("Expected a rejection for the loggers, got %v", err)
+	}
+	outcomes := []string{}
+	for _, logger := range result.Loggers {
+		outcomes = append(outcomes, logger.Outcome)
+	}
+	if !reflect.DeepEqual(outcomes, []string{LOGGER_UNKNOWN_STH, LOGGER_BAD_SIGNATURE, LOGGER_ROOT_MISMATCH}) {
+		t.Errorf("Unexpected logger outcomes %v", outcomes)
+	}
+	if result.Verdict != VERDICT_REJECT || result.Valid_loggers != 0 {
+		t.Errorf("Unexpected verdict %s with %d valid loggers", result.Verdict, result.Valid_loggers)
+	}
+	expected := Revocation_status{RID: 3, Known: true, Revoked: true, CRV_period: "5"}
+	if result.Revocation != expected {
+		t.Errorf("Unexpected revocation status %+v", result.Revocation)
+	}
+	if result.Blacklist.Accused || result.Blacklist.Convicted {
+		t.Errorf("Unexpected blacklist status %+v", result.Blacklist)
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	newresult := func(loggers ...Logger_result) *Verification_result {
+		return &Verification_result{
+			Issuer:     "localhost:9100",
+			Period:     "10",
+			Loggers:    loggers,
+			Revocation: Revocation_status{RID: 3, Known: true},
+			Monitor:    Monitor_status{Last_update: "10", Reachable: true},
+		}
+	}
+	valid := func(logger string, period string) Logger_result {
+		return Logger_result{Logger: logger, Period: period, Outcome: LOGGER_VALID}
+	}
+	reason := func(verr *Verification_error) string {
+		if verr == nil {
+			return VERDICT_ACCEPT
+		}
+		return verr.Reason
+	}
+	// distinct loggers
+	policy := Client_policy{Min_valid_loggers: 2}
+	result := newresult(valid("localhost:9000", "9"), valid("localhost:9000", "9"))
+	verr := policy.Evaluate(result)
+	if reason(verr) != CTNG_NO_VALID_LOGGER || result.Valid_loggers != 1 {
+		t.Error("Two logger infos of the same logger accepted as two loggers")
+	} else if !reflect.DeepEqual(verr.Details, []string{"1 valid loggers, 2 required"}) {
+		t.Errorf("Wrong details of the rejection: %v", verr.Details)
+	}
+	result = newresult(valid("localhost:9000", "9"), valid("localhost:9001", "9"))
+	if reason(policy.Evaluate(result)) != VERDICT_ACCEPT || result.Verdict != VERDICT_ACCEPT {
+		t.Error("Two valid loggers rejected")
+	}
+	// STH age
+	policy = Client_policy{Max_STH_age: 2}
+	result = newresult(valid("localhost:9000", "5"))
+	verr = policy.Evaluate(result)
+	if reason(verr) != CTNG_NO_VALID_LOGGER || result.Loggers[0].Outcome != LOGGER_STH_TOO_OLD {
+		t.Error("Old STH accepted")
+	} else if !reflect.DeepEqual(verr.Details, []string{"localhost:9000: " + LOGGER_STH_TOO_OLD, "0 valid loggers, 1 required"}) {
+		t.Errorf("Wrong details of the rejection: %v", verr.Details)
+	}
+	if reason(Client_policy{}.Evaluate(newresult(valid("localhost:9000", "5")))) != VERDICT_ACCEPT {
+		t.Error("Old STH rejected without a maximum age")
+	}
+	// blacklists
+	result = newresult(valid("localhost:9000", "9"))
+	result.Blacklist = Blacklist_status{Convicted: true, Since: "4"}
+	if reason(Client_policy{}.Evaluate(result)) != CTNG_BLACKLISTED {
+		t.Error("Convicted issuer accepted")
+	}
+	if reason(Client_policy{Allow_convicted_issuer: true}.Evaluate(result)) != VERDICT_ACCEPT {
+		t.Error("Convicted issuer rejected although allowed")
+	}
+	// monitor unreachable
+	result = newresult(valid("localhost:9000", "9"))
+	result.Revocation = Revocation_status{RID: 3}
+	result.Monitor = Monitor_status{Last_update: "7"}
+	if reason(Client_policy{Hard_fail: true}.Evaluate(result)) != CTNG_MONITOR_UNREACHABLE {
+		t.Error("Hard-fail policy accepted while the monitor is unreachable")
+	}
+	if reason(Client_policy{}.Evaluate(result)) != VERDICT_ACCEPT {
+		t.Error("Soft-fail policy rejected a certificate without CRV while the monitor is unreachable")
+	}
+	result.Monitor = Monitor_status{Last_update: "9", Reachable: true}
+	if reason(Client_policy{}.Evaluate(result)) != CTNG_UNKNOWN_CRV {
+		t.Error("Certificate without CRV accepted")
+	}
+	if !monitor_reachable("9", "10") || monitor_reachable("8", "10") || monitor_reachable("", "10") {
+		t.Error("Wrong monitor reachability")
+	}
+}
+
+func TestLoggerBlacklists(t *testing.T) {
+	ctx := &ClientContext{
+		D1_Blacklist_database:  map[string]bool{"localhost:9000@3": true},
+		D2_Blacklist_database:  map[string]string{"localhost:9001": "5"},
+		D1_Blacklist_DB_RWLock: &sync.RWMutex{},
+		D2_Blacklist_DB_RWLock: &sync.RWMutex{},
+	}
+	cases := []struct {
+		entity    string
+		period    string
+		accused   bool
+		convicted bool
+	}{
+		{"localhost:9000", "3", true, false},
+		{"localhost:9000", "4", false, false},
+		{"localhost:9001", "4", false, false},
+		{"localhost:9001", "5", false, true},
+		{"localhost:9001", "6", false, true},
+	}
+	for _, c := range cases {
+		accused, convicted := ctx.blacklisted(c.entity, c.period)
+		if accused != c.accused || convicted != c.convicted {
+			t.Errorf("%s at period %s: accused %v convicted %v", c.entity, c.period, accused, convicted)
+		}
+	}
+	// the logger infos of blacklisted loggers do not count
+	result := &Verification_result{
+		Period: "6",
+		Loggers: []Logger_result{
+			{Logger: "localhost:9000", Period: "3", Outcome: LOGGER_VALID, Accused: true},
+			{Logger: "localhost:9001", Period: "5", Outcome: LOGGER_VALID, Convicted: true},
+		},
+		Revocation: Revocation_status{Known: true},
+		Monitor:    Monitor_status{Last_update: "6", Reachable: true},
+	}
+	verr := Client_policy{}.Evaluate(result)
+	if verr == nil || verr.Reason != CTNG_NO_VALID_LOGGER {
+		t.Fatal("Certificate logged only by blacklisted loggers accepted")
+	}
+	if result.Loggers[0].Outcome != LOGGER_ACCUSED || result.Loggers[1].Outcome != LOGGER_CONVICTED {
+		t.Errorf("Unexpected outcomes %s %s", result.Loggers[0].Outcome, result.Loggers[1].Outcome)
+	}
+	result.Loggers = append(result.Loggers, Logger_result{Logger: "localhost:9002", Period: "5", Outcome: LOGGER_VALID})
+	if (Client_policy{}).Evaluate(result) != nil {
+		t.Error("Certificate with a benign logger rejected")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ClientContext{
+		Config:                 &ClientConfig{},
+		Crypto:                 &crypto.CryptoConfig{SignPublicMap: crypto.RSAPublicMap{"localhost:9100": ca.PublicKey}},
+		STH_database:           make(map[string]string),
+		CRV_database:           make(map[string]*bitset.BitSet),
+		D1_Blacklist_database:  make(map[string]bool),
+		D2_Blacklist_database:  map[string]string{"localhost:9100": "2"},
+		STH_DB_RWLock:          &sync.RWMutex{},
+		CRV_DB_RWLock:          &sync.RWMutex{},
+		D1_Blacklist_DB_RWLock: &sync.RWMutex{},
+		D2_Blacklist_DB_RWLock: &sync.RWMutex{},
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{testCTngCertificate(t, ca, "localhost:9100", nil)}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	// the applications only trust the CA of the proxy
+	dir := t.TempDir()
+	issuer, err := LoadProxyIssuer(dir+"/proxy_ca.pem", dir+"/proxy_ca_key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(issuer.Leaf)
+	get := func(mode string) (*http.Response, string, error) {
+		proxy := httptest.NewServer(NewProxy(ctx, mode, issuer))
+		defer proxy.Close()
+		proxy_url, _ := url.Parse(proxy.URL)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxy_url),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+	if _, _, err := get(PROXY_ENFORCE); err == nil {
+		t.Error("Proxy opened a tunnel to a server with a rejected certificate")
+	}
+	// the application talks to the upstream server over the connection the proxy checked
+	resp, body, err := get(PROXY_LOG)
+	if err != nil || body != "hello" {
+		t.Fatalf("Proxy in log mode did not relay the connection: %v", err)
+	}
+	if resp.TLS.PeerCertificates[0].Issuer.CommonName != "CTng proxy" {
+		t.Error("The application did not handshake with the proxy")
+	}
+	// a restarted proxy loads its CA
+	loaded, err := LoadProxyIssuer(dir+"/proxy_ca.pem", dir+"/proxy_ca_key.pem")
+	if err != nil || !loaded.Leaf.Equal(issuer.Leaf) {
+		t.Errorf("The CA of the proxy was not loaded: %v", err)
+	}
+}
+
+func TestMonitorFailover(t *testing.T) {
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+	}
+	ctx.InitializeClientContext()
+	mon := &monitor.MonitorContext{StorageDirectory: "monitor_testdata/1", Update_index: monitor.New_update_index()}
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := -1
+		if r.URL.Query().Get("since") != "" {
+			since, _ = strconv.Atoi(r.URL.Query().Get("since"))
+		}
+		bundle, err := mon.Generate_update_bundle(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(bundle)
+	}))
+	defer up.Close()
+	ctx.Config.Monitor_URLs = []string{strings.TrimPrefix(down.URL, PROTOCOL), strings.TrimPrefix(up.URL, PROTOCOL)}
+	err := ctx.Update_from_monitor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.current_monitor() != ctx.Config.Monitor_URLs[1] || len(ctx.STH_database) == 0 {
+		t.Fatal("The client did not switch to the monitor which is up")
+	}
+	if ctx.Monitor_since[ctx.Config.Monitor_URLs[1]] != "22" {
+		t.Errorf("Unexpected next request since period %s", ctx.Monitor_since[ctx.Config.Monitor_URLs[1]])
+	}
+	// a bundle overlapping what the client handled leaves nothing to apply
+	bundle, err := mon.Generate_update_bundle(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, _, err := ctx.trim_bundle(bundle)
+	if err != nil || left != 0 || len(bundle.REVs) != 0 {
+		t.Errorf("%d updates and %d REVs left after trimming", left, len(bundle.REVs))
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	timeout := fetch_client.Timeout
+	fetch_client.Timeout = 100 * time.Millisecond
+	defer func() { fetch_client.Timeout = timeout }()
+	if _, err := FetchClientUpdateBundle(slow.URL, ""); err == nil {
+		t.Fatal("A monitor that does not answer was not given up on")
+	}
+}
+
+func TestRecordCounters(t *testing.T) {
+	ctx := &ClientContext{Config: &ClientConfig{Monitor_evidence_filepath: t.TempDir() + "/evidence.json"}}
+	counter := func(monitor string, period string, acc string, signature string) definition.PoM_Counter {
+		return definition.PoM_Counter{ACC_FULL_Counter: acc, CON_FULL_Counter: "0", Period: period, Signer_Monitor: monitor, Signature: signature}
+	}
+	// the NUMs of two monitors for period 5, then the NUM_FULL of period 5 from the second one
+	if found, err := ctx.Record_counters(counter("A", "5", "1", "a5"), definition.PoM_Counter{}); err != nil || len(found) != 0 {
+		t.Fatal("Evidence without NUM_FULL")
+	}
+	ctx.Record_counters(counter("B", "5", "2", "b5"), definition.PoM_Counter{})
+	// the NUM_FULL has to be the one of the period before the NUM
+	if _, err := ctx.Record_counters(counter("B", "7", "2", "b7"), counter("", "5", "2", "full5")); err == nil {
+		t.Fatal("NUM_FULL of period 5 accepted with the NUM of period 7")
+	}
+	found, err := ctx.Record_counters(counter("B", "6", "2", "b6"), counter("", "5", "2", "full5"))
+	if err != nil || len(found) != 1 || found[0].Monitor != "A" || found[0].NUM.Signature != "a5" || found[0].NUM_FULL.Signature != "full5" {
+		t.Fatalf("Unexpected evidence %+v", found)
+	}
+	if !ctx.dishonest("A") || ctx.dishonest("B") {
+		t.Error("Wrong dishonest monitors")
+	}
+	// two signed NUM_FULLs with different counts for one period are an error
+	if _, err := ctx.Record_counters(counter("C", "6", "1", "c6"), counter("", "5", "1", "other5")); err == nil {
+		t.Fatal("Conflicting NUM_FULL accepted")
+	}
+	if _, ok := ctx.Monitor_NUMs["C@6"]; ok || ctx.NUM_FULLs["5"].Signature != "full5" {
+		t.Fatal("A rejected NUM_FULL changed the counters")
+	}
+	// a NUM arriving after the NUM_FULL of its period is checked too, a dishonest monitor is reported once
+	ctx.Record_counters(counter("C", "5", "3", "c5"), definition.PoM_Counter{})
+	ctx.Record_counters(counter("A", "6", "2", "a6"), counter("", "5", "2", "full5"))
+	var saved []Monitor_evidence
+	data, err := util.ReadByte(ctx.Config.Monitor_evidence_filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(data, &saved)
+	if len(saved) != 2 || saved[1].Monitor != "C" {
+		t.Errorf("Unexpected saved evidence %+v", saved)
+	}
+	// the client does not use dishonest monitors
+	ctx.Config.Monitor_URLs = []string{"A", "B", "C"}
+	if ctx.monitor_url() != "B" || !reflect.DeepEqual(ctx.monitors_after("B"), []string{"B"}) {
+		t.Error("Dishonest monitors still in use")
+	}
+}
+
+func TestClientStore(t *testing.T) {
+	path := t.TempDir() + "/Client_store.json"
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(path),
+	}
+	ctx.InitializeClientContext()
+	update_1 := ctx.LoadUpdate("monitor_testdata/1/Period_19/ClientUpdate.json")
+	update_2 := ctx.LoadUpdate("monitor_testdata/1/Period_20/ClientUpdate.json")
+	if !ctx.HandleUpdate(update_1, true, true) {
+		t.Fatal("Update of period 19 rejected")
+	}
+	before := ctx.Tables()
+	// an update failing after its REVs are verified leaves nothing behind
+	broken := update_2
+	broken.STHs = append([]definition.Gossip_object{}, update_2.STHs...)
+	broken.STHs[len(broken.STHs)-1].Payload[1] = "not an STH"
+	if len(broken.REVs) == 0 || ctx.HandleUpdate(broken, false, false) {
+		t.Fatal("Update with a malformed STH accepted")
+	}
+	if !reflect.DeepEqual(before, ctx.Tables()) {
+		t.Fatal("Rejected update changed the tables")
+	}
+	update_2 = ctx.LoadUpdate("monitor_testdata/1/Period_20/ClientUpdate.json")
+	if !ctx.HandleUpdate(update_2, true, false) {
+		t.Fatal("Update of period 20 rejected")
+	}
+	// a restarted client finds every table in the store
+	restarted := &ClientContext{
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(path),
+	}
+	restarted.InitializeClientContext()
+	if !reflect.DeepEqual(ctx.Tables(), restarted.Tables()) {
+		t.Fatalf("Tables differ after loading the store:\n%+v\n%+v", ctx.Tables(), restarted.Tables())
+	}
+	if len(restarted.CRV_database) == 0 || restarted.Last_update_period != update_2.Period {
+		t.Error("The CRVs or the last update period were not restored")
+	}
+}
+
+// The key rotations of an update reach the key set of the client only with the rest of the update.
+func TestStagedKeyRotation(t *testing.T) {
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+	}
+	ctx.InitializeClientContext()
+	key, err := crypto.NewSigner(crypto.ED25519_SCHEME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(key.Public())
+	// the monitor committed to key for its first rotation, and commits to itself again
+	commitment, _ := crypto.KeyHash(key.Public())
+	ctx.Crypto.NextKeyHashes["localhost:8180"] = commitment
+	rotation := crypto.KeyRotation{ID: "localhost:8180", Version: 1, PublicKey: der, ValidFrom: 1000, NextKeyHash: commitment}
+	KEY_FULL := definition.Gossip_object{Type: definition.KEY_FULL, Payload: [3]string{"localhost:8180", rotation.String(), ""}}
+	update_1 := ctx.LoadUpdate("monitor_testdata/1/Period_19/ClientUpdate.json")
+	if !ctx.HandleUpdate(update_1, true, true) {
+		t.Fatal("Update of period 19 rejected")
+	}
+	update_2 := ctx.LoadUpdate("monitor_testdata/1/Period_20/ClientUpdate.json")
+	update_2.KEYs = []definition.Gossip_object{KEY_FULL}
+	broken := update_2
+	broken.STHs = append([]definition.Gossip_object{}, update_2.STHs...)
+	broken.STHs[len(broken.STHs)-1].Payload[1] = "not an STH"
+	if ctx.HandleUpdate(broken, false, false) {
+		t.Fatal("Update with a malformed STH accepted")
+	}
+	if history, _ := ctx.Crypto.KeyHistory("localhost:8180"); len(history) != 1 {
+		t.Fatal("A rejected update changed the key versions")
+	}
+	if !ctx.HandleUpdate(update_2, false, false) {
+		t.Fatal("Update of period 20 rejected")
+	}
+	if history, _ := ctx.Crypto.KeyHistory("localhost:8180"); len(history) != 2 || history[0].ValidUntil != 999 {
+		t.Fatal("The key rotation of the update was not applied")
+	}
+}
+
+func TestVerificationReport(t *testing.T) {
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+		Store:           NewFileStore(t.TempDir() + "/Client_store.json"),
+	}
+	ctx.InitializeClientContext()
+	updates, err := ReadClientUpdates("monitor_testdata/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 3 || updates[0].Period > updates[2].Period {
+		t.Fatalf("Unexpected client updates read: %d", len(updates))
+	}
+	if rejected := ctx.ReplayUpdates(updates); len(rejected) != 0 {
+		t.Fatalf("Updates of periods %v rejected", rejected)
+	}
+	// the certificate is read as PEM and as DER
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlscert := testCTngCertificate(t, ca, "localhost:9100", nil)
+	dir := t.TempDir()
+	os.WriteFile(dir+"/cert.der", tlscert.Certificate[0], 0644)
+	os.WriteFile(dir+"/cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlscert.Certificate[0]}), 0644)
+	der, err := LoadCertificate(dir + "/cert.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificate(dir + "/cert.pem")
+	if err != nil || !cert.Equal(der) {
+		t.Fatalf("PEM and DER certificates differ: %v", err)
+	}
+	// offline the certificate is judged at the period of the last update, the monitor was reachable then
+	report := ctx.Report(cert, updates[2].Period)
+	if report.Result == nil || report.Result.Verdict != VERDICT_REJECT || !report.Result.Revocation.Known || report.Extension.SequenceNumber.RID != 3 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if report.Result.Period != updates[2].Period || !report.Result.Monitor.Reachable {
+		t.Errorf("Report judged at period %s, reachable %v", report.Result.Period, report.Result.Monitor.Reachable)
+	}
+	var text strings.Builder
+	report.Write_text(&text)
+	if !strings.Contains(text.String(), "Verdict: reject") || !strings.Contains(text.String(), "RID 3") {
+		t.Errorf("Unexpected text report:\n%s", text.String())
+	}
+	var buf strings.Builder
+	if err := report.Write_JSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Verification_report
+	if err := json.Unmarshal([]byte(buf.String()), &decoded); err != nil || decoded.Result.Reason != CTNG_NO_VALID_LOGGER {
+		t.Errorf("Unexpected JSON report %s: %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"CTngV2/definition"
+	"CTngV2/monitor"
+	"CTngV2/util"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The client daemon fetches its updates from one monitor once per MMD and cross-checks it with the others:
+// every period the NUMs of the next monitor in Monitor_URLs are fetched and checked against the NUM_FULLs.
+// When the monitor is unreachable or found dishonest, the client switches to the next honest monitor.
+
+const PROTOCOL = "http://"
+
+func (ctx *ClientContext) dishonest(url string) bool {
+	ctx.Monitor_LOCK.Lock()
+	defer ctx.Monitor_LOCK.Unlock()
+	return ctx.Dishonest_monitors[url] || ctx.Dishonest_monitors[ctx.Monitor_IDs[url]]
+}
+
+// The honest monitors in the order of Monitor_URLs, starting after the monitor given.
+func (ctx *ClientContext) monitors_after(url string) []string {
+	urls := ctx.Config.Monitor_URLs
+	start := 0
+	for i, u := range urls {
+		if u == url {
+			start = i + 1
+		}
+	}
+	honest := []string{}
+	for i := range urls {
+		u := urls[(start+i)%len(urls)]
+		if !ctx.dishonest(u) {
+			honest = append(honest, u)
+		}
+	}
+	return honest
+}
+
+func (ctx *ClientContext) current_monitor() string {
+	ctx.Monitor_LOCK.Lock()
+	defer ctx.Monitor_LOCK.Unlock()
+	return ctx.Current_Monitor_URL
+}
+
+func (ctx *ClientContext) set_current_monitor(url string) {
+	ctx.Monitor_LOCK.Lock()
+	defer ctx.Monitor_LOCK.Unlock()
+	ctx.Current_Monitor_URL = url
+}
+
+// The monitor the client takes its updates from, the first honest one of Monitor_URLs if none was chosen.
+func (ctx *ClientContext) monitor_url() string {
+	url := ctx.current_monitor()
+	if url == "" || ctx.dishonest(url) {
+		url = ""
+		if honest := ctx.monitors_after(""); len(honest) > 0 {
+			url = honest[0]
+		}
+		ctx.set_current_monitor(url)
+	}
+	return url
+}
+
+// Fetch the bundle of the updates of a monitor since the last request to it.
+// newmonitor is true for the first bundle of the monitor, which has no NUM_FULL for its first period.
+func (ctx *ClientContext) fetch_bundle(url string) (bundle monitor.ClientUpdateBundle, newmonitor bool, err error) {
+	ctx.Monitor_LOCK.Lock()
+	since := ctx.Monitor_since[url]
+	ctx.Monitor_LOCK.Unlock()
+	bundle, err = FetchClientUpdateBundle(PROTOCOL+url, since)
+	if err != nil {
+		return bundle, false, err
+	}
+	last, err := strconv.Atoi(bundle.Period)
+	if err != nil {
+		return bundle, false, err
+	}
+	ctx.Monitor_LOCK.Lock()
+	if ctx.Monitor_since == nil {
+		ctx.Monitor_since = make(map[string]string)
+	}
+	ctx.Monitor_since[url] = strconv.Itoa(last + 1)
+	if ctx.Monitor_IDs == nil {
+		ctx.Monitor_IDs = make(map[string]string)
+	}
+	ctx.Monitor_IDs[url] = bundle.MonitorID
+	ctx.Monitor_LOCK.Unlock()
+	return bundle, since == "", nil
+}
+
+// Leaves out of a bundle what the client already handled, from another monitor or an earlier request:
+// the updates of the periods already handled and the REVs already applied to the CRVs.
+// Returns the number of updates left and whether the first one was left out.
+func (ctx *ClientContext) trim_bundle(bundle *monitor.ClientUpdateBundle) (int, bool, error) {
+	ctx.CRV_DB_RWLock.RLock()
+	last, parse_err := strconv.Atoi(ctx.Last_update_period)
+	if parse_err != nil {
+		last = -1
+	}
+	applied := make(map[string]int)
+	for key, period := range ctx.CRV_Period_database {
+		applied[key], _ = strconv.Atoi(period)
+	}
+	ctx.CRV_DB_RWLock.RUnlock()
+	NUMs := []definition.PoM_Counter{}
+	NUM_FULLs := []definition.PoM_Counter{}
+	for i := range bundle.NUMs {
+		period, _ := strconv.Atoi(bundle.NUMs[i].Period)
+		if period > last && i < len(bundle.NUM_FULLs) {
+			NUMs = append(NUMs, bundle.NUMs[i])
+			NUM_FULLs = append(NUM_FULLs, bundle.NUM_FULLs[i])
+		}
+	}
+	first_trimmed := len(NUMs) == 0 || len(bundle.NUMs) == 0 || NUMs[0].Period != bundle.NUMs[0].Period
+	bundle.NUMs, bundle.NUM_FULLs = NUMs, NUM_FULLs
+	REVs := []definition.Gossip_object{}
+	for _, rev := range bundle.REVs {
+		period, _ := strconv.Atoi(rev.Period)
+		if done, ok := applied[rev.Payload[0]]; ok && period <= done {
+			continue
+		}
+		REVs = append(REVs, rev)
+	}
+	var err error
+	if len(REVs) < len(bundle.REVs) {
+		bundle.REVs = REVs
+		bundle.Delta_CRVs, err = monitor.Compose_Delta_CRVs(REVs)
+	}
+	return len(NUMs), first_trimmed, err
+}
+
+// Fetch the updates the client has not handled yet from its monitor and apply them.
+// An unreachable or dishonest monitor is replaced by the next honest one.
+func (ctx *ClientContext) Update_from_monitor() error {
+	url := ctx.monitor_url()
+	if url == "" {
+		return errors.New("No honest monitor left")
+	}
+	err := ctx.update_from(url)
+	if err == nil {
+		return nil
+	}
+	fmt.Println(util.RED+"Update from monitor", url, "failed:", err, util.RESET)
+	for _, next := range ctx.monitors_after(url) {
+		if next == url {
+			continue
+		}
+		fmt.Println(util.BLUE+"Switching to monitor", next, util.RESET)
+		ctx.set_current_monitor(next)
+		if err = ctx.update_from(next); err == nil {
+			return nil
+		}
+		fmt.Println(util.RED+"Update from monitor", next, "failed:", err, util.RESET)
+	}
+	return err
+}
+
+func (ctx *ClientContext) update_from(url string) error {
+	bundle, newmonitor, err := ctx.fetch_bundle(url)
+	if err != nil {
+		return err
+	}
+	left, first_trimmed, err := ctx.trim_bundle(&bundle)
+	if err != nil || left == 0 {
+		return err
+	}
+	if !ctx.HandleUpdateBundle(bundle, true, newmonitor && !first_trimmed) {
+		return fmt.Errorf("The update bundle of monitor %s was rejected", url)
+	}
+	return nil
+}
+
+// Fetch the NUMs of the next monitor other than the current one and check them against the NUM_FULLs,
+// only the counters of the bundle are used. They are recorded if every one of them is valid.
+func (ctx *ClientContext) Cross_check_monitors() error {
+	current := ctx.monitor_url()
+	stage := new_update_stage()
+	ctx.Monitor_LOCK.Lock()
+	last := ctx.Cross_checked_URL
+	ctx.Monitor_LOCK.Unlock()
+	for _, url := range ctx.monitors_after(last) {
+		if url == current {
+			continue
+		}
+		ctx.Monitor_LOCK.Lock()
+		ctx.Cross_checked_URL = url
+		ctx.Monitor_LOCK.Unlock()
+		bundle, newmonitor, err := ctx.fetch_bundle(url)
+		if err != nil {
+			return err
+		}
+		if len(bundle.NUMs) != len(bundle.NUM_FULLs) {
+			return fmt.Errorf("The bundle of monitor %s has %d NUMs but %d NUM_FULLs", url, len(bundle.NUMs), len(bundle.NUM_FULLs))
+		}
+		for i := range bundle.NUMs {
+			if err := bundle.NUMs[i].Verify(ctx.Crypto); err != nil {
+				return err
+			}
+			NUM_FULL := bundle.NUM_FULLs[i]
+			if newmonitor && i == 0 {
+				NUM_FULL = definition.PoM_Counter{}
+			} else if err := NUM_FULL.Verify(ctx.Crypto); err != nil {
+				return err
+			}
+			if _, err := ctx.stage_counters(stage, bundle.NUMs[i], NUM_FULL); err != nil {
+				return err
+			}
+		}
+		ctx.commit_counters(stage)
+		return nil
+	}
+	return nil
+}
+
+// Fetch the updates and cross-check the monitors once, then once per MMD in the background.
+// The later runs happen one after the other in a single goroutine, a run taking longer than an MMD delays the next one.
+func PeriodicUpdate(ctx *ClientContext) {
+	ctx.periodic_update()
+	go func() {
+		ticker := time.NewTicker(time.Duration(ctx.Config.MMD) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx.periodic_update()
+		}
+	}()
+}
+
+func (ctx *ClientContext) periodic_update() {
+	err := ctx.Update_from_monitor()
+	if err != nil {
+		fmt.Println(util.RED+"Client update failed:", err, util.RESET)
+		return
+	}
+	ctx.CRV_DB_RWLock.RLock()
+	period := ctx.Last_update_period
+	ctx.CRV_DB_RWLock.RUnlock()
+	fmt.Println(util.GREEN+"Client updated to period", period, "from monitor", ctx.current_monitor(), util.RESET)
+	err = ctx.Cross_check_monitors()
+	if err != nil {
+		fmt.Println(util.RED+"Cross-check of the monitors failed:", err, util.RESET)
+	}
+}
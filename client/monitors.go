@@ -0,0 +1,133 @@
+package client
+
+import (
+	"CTngV2/definition"
+	"CTngV2/util"
+	"fmt"
+	"strconv"
+)
+
+// Cross-checking of the monitors.
+// The NUM of a monitor counts the PoMs it delivered in a period, the NUM_FULL of the next period is the count
+// threshold signed by the gossipers. The NUM_FULL from any monitor is checked against the NUMs of every monitor,
+// a monitor whose NUM does not match is dishonest: the client records the two signed counters and stops using it.
+
+type Monitor_evidence struct {
+	Monitor  string
+	Period   string
+	NUM      definition.PoM_Counter
+	NUM_FULL definition.PoM_Counter
+	Detected string
+}
+
+func counts(p definition.PoM_Counter) string {
+	return p.ACC_FULL_Counter + "@" + p.CON_FULL_Counter
+}
+
+// Records the NUM of a monitor and the NUM_FULL delivered with it, then checks the NUMs of the period of the NUM_FULL.
+// NUM_FULL is the counter of the previous period, it is skipped if it is not signed (the first period of a monitor).
+// Both counters are expected to be verified. A NUM_FULL of another period than the one before the NUM, or two NUM_FULLs
+// with different counts for one period, are an error and nothing is recorded.
+// Returns the evidence found against the monitors.
+func (ctx *ClientContext) Record_counters(NUM definition.PoM_Counter, NUM_FULL definition.PoM_Counter) ([]Monitor_evidence, error) {
+	stage := new_update_stage()
+	found, err := ctx.stage_counters(stage, NUM, NUM_FULL)
+	if err != nil {
+		return nil, err
+	}
+	ctx.commit_counters(stage)
+	return found, nil
+}
+
+// Same as Record_counters, but the counters are only staged, the client gets them when the stage is committed.
+// The evidence found is recorded at once: it holds two verified counters, whether the stage is committed or not.
+func (ctx *ClientContext) stage_counters(stage *update_stage, NUM definition.PoM_Counter, NUM_FULL definition.PoM_Counter) ([]Monitor_evidence, error) {
+	ctx.Monitor_LOCK.Lock()
+	defer ctx.Monitor_LOCK.Unlock()
+	full_of := func(period string) (definition.PoM_Counter, bool) {
+		if full, ok := stage.NUM_FULLs[period]; ok {
+			return full, true
+		}
+		full, ok := ctx.NUM_FULLs[period]
+		return full, ok
+	}
+	checked := []string{NUM.Period}
+	if NUM_FULL.Signature != "" {
+		period_int, err := strconv.Atoi(NUM.Period)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid period %q in the NUM of %s", NUM.Period, NUM.Signer_Monitor)
+		}
+		if NUM_FULL.Period != strconv.Itoa(period_int-1) {
+			return nil, fmt.Errorf("The NUM_FULL of period %s came with the NUM of period %s", NUM_FULL.Period, NUM.Period)
+		}
+		known, ok := full_of(NUM_FULL.Period)
+		if ok && counts(known) != counts(NUM_FULL) {
+			return nil, fmt.Errorf("Conflicting NUM_FULLs for period %s: %s and %s", NUM_FULL.Period, counts(known), counts(NUM_FULL))
+		}
+		if !ok {
+			stage.NUM_FULLs[NUM_FULL.Period] = NUM_FULL
+		}
+		checked = append(checked, NUM_FULL.Period)
+	}
+	stage.NUMs[NUM.Signer_Monitor+"@"+NUM.Period] = NUM
+	NUMs := make(map[string]definition.PoM_Counter)
+	for key, num := range ctx.Monitor_NUMs {
+		NUMs[key] = num
+	}
+	for key, num := range stage.NUMs {
+		NUMs[key] = num
+	}
+	if ctx.Dishonest_monitors == nil {
+		ctx.Dishonest_monitors = make(map[string]bool)
+	}
+	found := []Monitor_evidence{}
+	for _, period := range checked {
+		full, ok := full_of(period)
+		if !ok {
+			continue
+		}
+		for _, num := range NUMs {
+			if num.Period != period || ctx.Dishonest_monitors[num.Signer_Monitor] || counts(num) == counts(full) {
+				continue
+			}
+			evidence := Monitor_evidence{
+				Monitor:  num.Signer_Monitor,
+				Period:   period,
+				NUM:      num,
+				NUM_FULL: full,
+				Detected: util.GetCurrentTimestamp(),
+			}
+			fmt.Println(util.RED+"Monitor", num.Signer_Monitor, "is not honest: NUM", counts(num), "NUM_FULL", counts(full), "at period", period, util.RESET)
+			ctx.Dishonest_monitors[num.Signer_Monitor] = true
+			ctx.Monitor_evidence = append(ctx.Monitor_evidence, evidence)
+			found = append(found, evidence)
+		}
+	}
+	if len(found) > 0 && ctx.Config != nil && ctx.Config.Monitor_evidence_filepath != "" {
+		err := util.WriteData(ctx.Config.Monitor_evidence_filepath, ctx.Monitor_evidence)
+		if err != nil {
+			fmt.Println(util.RED+"Error writing the monitor evidence:", err, util.RESET)
+		}
+	}
+	return found, nil
+}
+
+// Apply the staged counters, the first NUM_FULL of a period counts.
+func (ctx *ClientContext) commit_counters(stage *update_stage) {
+	ctx.Monitor_LOCK.Lock()
+	defer ctx.Monitor_LOCK.Unlock()
+	if ctx.Monitor_NUMs == nil {
+		ctx.Monitor_NUMs = make(map[string]definition.PoM_Counter)
+	}
+	if ctx.NUM_FULLs == nil {
+		ctx.NUM_FULLs = make(map[string]definition.PoM_Counter)
+	}
+	for key, num := range stage.NUMs {
+		ctx.Monitor_NUMs[key] = num
+	}
+	for period, full := range stage.NUM_FULLs {
+		if _, ok := ctx.NUM_FULLs[period]; !ok {
+			ctx.NUM_FULLs[period] = full
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"strconv"
+)
+
+// When the client accepts a certificate, set in the Policy of the ClientConfig.
+// The zero policy requires one valid logger, rejects certificates of accused or convicted issuers,
+// takes STHs of any age, and soft-fails when the monitor is unreachable.
+type Client_policy struct {
+	// distinct loggers with a valid POI required, 1 if not set
+	Min_valid_loggers int
+	// accept certificates of CAs accused (ACC PoM) in the current period, or convicted (CON PoM)
+	Allow_accused_issuer   bool
+	Allow_convicted_issuer bool
+	// maximum age of the STH of a logger info in periods, older ones do not count; 0 means no limit
+	Max_STH_age int
+	// reject every certificate while the monitor is unreachable,
+	// otherwise the certificate is checked against the data the client has and a missing CRV is tolerated
+	Hard_fail bool
+}
+
+// The policy of the client, the zero policy if the client has no configuration.
+func (ctx *ClientContext) policy() Client_policy {
+	if ctx.Config == nil {
+		return Client_policy{}
+	}
+	return ctx.Config.Policy
+}
+
+// The monitor is considered unreachable when the client has no update of the current or the previous period.
+func monitor_reachable(last_update string, period string) bool {
+	last, err := strconv.Atoi(last_update)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.Atoi(period)
+	if err != nil {
+		return false
+	}
+	return last >= current-1
+}
+
+// Evaluates the policy on the facts gathered by VerifyCTngextension and sets the verdict of the result.
+// Logger infos with a valid POI do not count if the logger was accused or convicted in the period of the STH,
+// or if the STH is older than Max_STH_age.
+func (p Client_policy) Evaluate(result *Verification_result) *Verification_error {
+	var verr *Verification_error
+	current, _ := strconv.Atoi(result.Period)
+	loggers := make(map[string]bool)
+	failures := []string{}
+	for i := range result.Loggers {
+		logger := &result.Loggers[i]
+		if logger.Outcome == LOGGER_VALID && logger.Convicted {
+			logger.Outcome = LOGGER_CONVICTED
+		}
+		if logger.Outcome == LOGGER_VALID && logger.Accused {
+			logger.Outcome = LOGGER_ACCUSED
+		}
+		if logger.Outcome == LOGGER_VALID && p.Max_STH_age > 0 {
+			sth_period, err := strconv.Atoi(logger.Period)
+			if err != nil || current-sth_period > p.Max_STH_age {
+				logger.Outcome = LOGGER_STH_TOO_OLD
+			}
+		}
+		if logger.Outcome == LOGGER_VALID {
+			loggers[logger.Logger] = true
+		} else {
+			failures = append(failures, logger.Logger+": "+logger.Outcome)
+		}
+	}
+	result.Valid_loggers = len(loggers)
+	min_loggers := p.Min_valid_loggers
+	if min_loggers < 1 {
+		min_loggers = 1
+	}
+	if len(result.Loggers) == 0 {
+		failures = append(failures, "the certificate has no logger information")
+	} else if result.Valid_loggers < min_loggers {
+		failures = append(failures, strconv.Itoa(result.Valid_loggers)+" valid loggers, "+strconv.Itoa(min_loggers)+" required")
+	}
+	switch {
+	case p.Hard_fail && !result.Monitor.Reachable:
+		verr = &Verification_error{Reason: CTNG_MONITOR_UNREACHABLE, Details: []string{"last update at period " + result.Monitor.Last_update}}
+	case result.Blacklist.Convicted && !p.Allow_convicted_issuer:
+		verr = &Verification_error{Reason: CTNG_BLACKLISTED, Details: []string{"conflict PoM since period " + result.Blacklist.Since}}
+	case result.Blacklist.Accused && !p.Allow_accused_issuer:
+		verr = &Verification_error{Reason: CTNG_BLACKLISTED, Details: []string{"accused in period " + result.Period}}
+	case result.Valid_loggers < min_loggers:
+		verr = &Verification_error{Reason: CTNG_NO_VALID_LOGGER, Details: failures}
+	case !result.Revocation.Known && result.Monitor.Reachable:
+		verr = &Verification_error{Reason: CTNG_UNKNOWN_CRV}
+	case result.Revocation.Revoked:
+		verr = &Verification_error{Reason: CTNG_REVOKED}
+	}
+	if verr == nil {
+		result.Verdict = VERDICT_ACCEPT
+		result.Reason = ""
+		return nil
+	}
+	result.Verdict = VERDICT_REJECT
+	result.Reason = verr.Reason
+	verr.Entity = result.Issuer
+	verr.Result = result
+	return verr
+}
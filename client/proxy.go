@@ -0,0 +1,272 @@
+package client
+
+import (
+	"CTngV2/util"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An HTTP CONNECT proxy enforcing CTng on the connections of the applications using it.
+// The proxy terminates TLS on both sides: it makes the handshake with the upstream server itself,
+// checking its certificate with VerifyCTngextension and the policy of the client, and relays the traffic
+// of that same connection to the application. A second handshake through a plain tunnel could reach
+// another server than the one checked, and its certificate can not be compared under TLS 1.3.
+// The application handshakes with the proxy, which presents a certificate for the upstream host
+// issued by its own CA: the applications have to trust the certificate of that CA.
+
+const (
+	// refuse the connections whose certificate is rejected
+	PROXY_ENFORCE = "enforce"
+	// only log them
+	PROXY_LOG = "log"
+)
+
+type Proxy struct {
+	Client *ClientContext
+	Mode   string
+	// timeout of the connections to the upstream servers
+	Timeout time.Duration
+	// CA of the proxy, it issues the certificates the applications see
+	Issuer tls.Certificate
+	// certificates issued for each upstream host, protected by certs_lock
+	certs      map[string]*tls.Certificate
+	certs_lock sync.Mutex
+}
+
+func NewProxy(ctx *ClientContext, mode string, issuer tls.Certificate) *Proxy {
+	if mode != PROXY_LOG {
+		mode = PROXY_ENFORCE
+	}
+	return &Proxy{Client: ctx, Mode: mode, Timeout: 10 * time.Second, Issuer: issuer, certs: make(map[string]*tls.Certificate)}
+}
+
+// A new self signed CA for the proxy.
+func NewProxyIssuer() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "CTng proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Load the CA of the proxy from PEM files, a new one is generated and saved if the files do not exist.
+func LoadProxyIssuer(cert_file string, key_file string) (tls.Certificate, error) {
+	_, err := os.Stat(cert_file)
+	if err == nil {
+		issuer, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		issuer.Leaf, err = x509.ParseCertificate(issuer.Certificate[0])
+		return issuer, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, err
+	}
+	issuer, err := NewProxyIssuer()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(issuer.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Certificate[0]}), 0644)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	fmt.Println(util.BLUE+"Generated the CA of the proxy, the applications have to trust", cert_file, util.RESET)
+	return issuer, nil
+}
+
+// The certificate the proxy presents to the applications for host, issued once per host.
+func (p *Proxy) certificate_for(host string) (*tls.Certificate, error) {
+	p.certs_lock.Lock()
+	defer p.certs_lock.Unlock()
+	if cert, ok := p.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.Issuer.Leaf, &key.PublicKey, p.Issuer.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, p.Issuer.Certificate[0]}, PrivateKey: key, Leaf: leaf}
+	p.certs[host] = cert
+	return cert, nil
+}
+
+// Handshake with the upstream server and check its certificate, the connection is the one relayed to the application.
+// The error is a *Verification_error if the certificate is rejected, any other error means the server is unreachable.
+// In log mode a rejected certificate is only logged.
+func (p *Proxy) Dial_upstream(address string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := p.Client.TLSConfigFor(host)
+	config.NextProtos = []string{"http/1.1"}
+	check := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := check(cs)
+		var verr *Verification_error
+		if errors.As(err, &verr) && p.Mode == PROXY_LOG {
+			fmt.Println(util.RED+"Allowed", address, "despite:", verr.Error(), util.RESET)
+			return nil
+		}
+		return err
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: p.Timeout}, "tcp", address, config)
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	address := r.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	upstream, err := p.Dial_upstream(address)
+	var verr *Verification_error
+	switch {
+	case errors.As(err, &verr):
+		fmt.Println(util.RED+"Blocked", address+":", verr.Error(), util.RESET)
+		http.Error(w, verr.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	default:
+		fmt.Println(util.GREEN+"Allowed", address, util.RESET)
+	}
+	cert, err := p.certificate_for(host)
+	if err != nil {
+		upstream.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	// bytes the client sent with the CONNECT request belong to its handshake
+	application := tls.Server(&buffered_conn{Conn: conn, r: buffered}, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"},
+	})
+	err = application.Handshake()
+	if err != nil {
+		fmt.Println(util.RED+"Handshake with the application for", address, "failed:", err, util.RESET)
+		application.Close()
+		upstream.Close()
+		return
+	}
+	tunnel(application, upstream)
+}
+
+// A hijacked connection, read through the buffer of the HTTP server.
+type buffered_conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *buffered_conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Copy both ways until either side closes.
+func tunnel(conn net.Conn, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+	wg.Wait()
+}
+
+// Start the proxy on the port of the client, with the updates from the monitor in the background.
+func StartProxy(ctx *ClientContext, mode string, issuer tls.Certificate) error {
+	PeriodicUpdate(ctx)
+	proxy := NewProxy(ctx, mode, issuer)
+	fmt.Println(util.BLUE+"CTng proxy listening on port", ctx.Config.Port, "in", proxy.Mode, "mode", util.RESET)
+	return http.ListenAndServe(":"+ctx.Config.Port, proxy)
+}
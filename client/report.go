@@ -0,0 +1,179 @@
+package client
+
+import (
+	"CTngV2/CA"
+	"CTngV2/monitor"
+	"CTngV2/util"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Offline verification of a certificate: the saved client updates are replayed into a fresh client,
+// then the certificate is checked against them and the result is reported for people or as JSON.
+
+type Verification_report struct {
+	Subject   string
+	Issuer    string
+	Serial    string
+	Extension CA.CTngExtension
+	// the client updates replayed, and the ones rejected
+	Updates          int
+	Rejected_updates []string `json:",omitempty"`
+	Result           *Verification_result
+	Error            string `json:",omitempty"`
+}
+
+// Read a PEM or DER certificate.
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
+
+// Fetch the certificate a TLS server at host:port presents, it is not verified.
+func FetchPeerCertificate(address string) (*x509.Certificate, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", address)
+	}
+	return certificates[0], nil
+}
+
+// The client updates in a directory, in the layout of the monitor storage (Period_N/ClientUpdate.json)
+// or as separate JSON files, sorted by period.
+func ReadClientUpdates(dir string) ([]monitor.ClientUpdate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "Period_*", "ClientUpdate.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	updates := []monitor.ClientUpdate{}
+	for _, file := range files {
+		data, err := util.ReadByte(file)
+		if err != nil {
+			return nil, err
+		}
+		var update monitor.ClientUpdate
+		err = json.Unmarshal(data, &update)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		updates = append(updates, update)
+	}
+	sort.SliceStable(updates, func(i, j int) bool {
+		pi, _ := strconv.Atoi(updates[i].Period)
+		pj, _ := strconv.Atoi(updates[j].Period)
+		return pi < pj
+	})
+	return updates, nil
+}
+
+// Apply the client updates in order, the first one is from a new monitor and has no NUM_FULL.
+// Returns the periods of the updates that were rejected.
+func (ctx *ClientContext) ReplayUpdates(updates []monitor.ClientUpdate) []string {
+	rejected := []string{}
+	for i, update := range updates {
+		if !ctx.HandleUpdate(update, true, i == 0) {
+			rejected = append(rejected, update.Period)
+		}
+	}
+	return rejected
+}
+
+// Verify a certificate at the given period and report the outcome, a rejected certificate is not an error of the report.
+// Offline, period is the one of the last update replayed, not the current one.
+func (ctx *ClientContext) Report(cert *x509.Certificate, period string) *Verification_report {
+	report := &Verification_report{
+		Subject:   cert.Subject.CommonName,
+		Issuer:    cert.Issuer.CommonName,
+		Serial:    cert.SerialNumber.String(),
+		Extension: CA.ParseCTngextension(cert),
+	}
+	result, err := ctx.VerifyCTngextensionAt(cert, period)
+	report.Result = result
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+func (r *Verification_report) Write_JSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func yes_no(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// The report for people, one line per check.
+func (r *Verification_report) Write_text(w io.Writer) {
+	fmt.Fprintln(w, "Certificate:", r.Subject, "issued by", r.Issuer, "serial", r.Serial)
+	fmt.Fprintln(w, "Client updates replayed:", r.Updates)
+	if len(r.Rejected_updates) > 0 {
+		fmt.Fprintln(w, "Client updates rejected at periods:", r.Rejected_updates)
+	}
+	fmt.Fprintln(w, "CTng extension: RID", r.Extension.SequenceNumber.RID, "with", len(r.Extension.LoggerInformation), "logger infos")
+	if r.Result == nil {
+		fmt.Fprintln(w, "Verdict:", VERDICT_REJECT, "("+r.Error+")")
+		return
+	}
+	for _, logger := range r.Result.Loggers {
+		line := "  logger " + logger.Logger + " STH of period " + logger.Period + ": " + logger.Outcome
+		if logger.Error != "" {
+			line += " (" + logger.Error + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "Valid loggers:", r.Result.Valid_loggers)
+	revocation := r.Result.Revocation
+	if revocation.Known {
+		fmt.Fprintln(w, "Revoked:", yes_no(revocation.Revoked), "(CRV of period "+revocation.CRV_period+")")
+	} else {
+		fmt.Fprintln(w, "Revoked: unknown, no CRV of", r.Issuer)
+	}
+	fmt.Fprintln(w, "Issuer accused:", yes_no(r.Result.Blacklist.Accused), "convicted:", yes_no(r.Result.Blacklist.Convicted))
+	fmt.Fprintln(w, "Last update at period", r.Result.Monitor.Last_update, "checked at period", r.Result.Period)
+	if r.Error != "" {
+		fmt.Fprintln(w, "Verdict:", r.Result.Verdict, "("+r.Error+")")
+	} else {
+		fmt.Fprintln(w, "Verdict:", r.Result.Verdict)
+	}
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/definition"
+	"CTngV2/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bits-and-blooms/bitset"
+)
+
+// The client applies an update in two steps: every object is checked and the changes are staged,
+// then the stage is committed to the databases at once, holding all their locks.
+// A rejected update leaves the databases as they were.
+// After each commit the tables are saved to the store of the client, if it has one.
+
+type update_stage struct {
+	STHs        map[string]string
+	CRVs        map[string]*bitset.BitSet
+	CRV_periods map[string]string
+	D1          map[string]bool
+	D2          map[string]string
+	// key = Period, content = NUM_ACC_FULL + "@" + NUM_CON_FULL
+	Integrity map[string]string
+	// the verified counters of the monitors, checked against the ones of the client, see stage_counters
+	NUMs               map[string]definition.PoM_Counter // key = monitor_ID + "@" + Period
+	NUM_FULLs          map[string]definition.PoM_Counter // key = Period
+	Last_update_period string
+	// key set with the key rotations of the update, the signatures of the update are checked with it
+	Crypto *crypto.CryptoConfig
+	// the rotations applied to Crypto, the client's key set gets them on commit
+	KEYs []definition.Gossip_object
+}
+
+func new_update_stage() *update_stage {
+	return &update_stage{
+		STHs:        make(map[string]string),
+		CRVs:        make(map[string]*bitset.BitSet),
+		CRV_periods: make(map[string]string),
+		D1:          make(map[string]bool),
+		D2:          make(map[string]string),
+		Integrity:   make(map[string]string),
+		NUMs:        make(map[string]definition.PoM_Counter),
+		NUM_FULLs:   make(map[string]definition.PoM_Counter),
+	}
+}
+
+// Apply the key rotations to a copy of the key set of the client.
+func (ctx *ClientContext) stage_KEYs(stage *update_stage, KEYs []definition.Gossip_object) {
+	stage.Crypto = ctx.Crypto
+	if len(KEYs) == 0 {
+		return
+	}
+	stage.Crypto = ctx.Crypto.CopyKeyHistory()
+	for _, key := range KEYs {
+		err := definition.Apply_KEY_FULL(key, stage.Crypto)
+		if err != nil {
+			fmt.Println("Key rotation of", key.Payload[0], "not applied:", err)
+			continue
+		}
+		stage.KEYs = append(stage.KEYs, key)
+	}
+}
+
+// Verify the SRH of every REV in order and stage the CRVs they lead to.
+// The CRVs of the database are cloned, they are only replaced on commit.
+func (ctx *ClientContext) stage_REVs(stage *update_stage, REVs []definition.Gossip_object) bool {
+	ctx.CRV_DB_RWLock.RLock()
+	defer ctx.CRV_DB_RWLock.RUnlock()
+	for _, rev := range REVs {
+		SRH, DCRV := Get_SRH_and_DCRV(rev)
+		key := rev.Payload[0]
+		if _, ok := stage.CRVs[key]; !ok {
+			if crv, ok := ctx.CRV_database[key]; ok {
+				stage.CRVs[key] = crv.Clone()
+			}
+		}
+		if !ctx.verify_SRH(stage.Crypto, SRH, stage.CRVs[key], &DCRV, rev.Period) {
+			fmt.Println("SRH verification failed for", key, "at period", rev.Period)
+			return false
+		}
+		if _, ok := stage.CRVs[key]; !ok {
+			stage.CRVs[key] = DCRV.Clone()
+		} else {
+			stage.CRVs[key].InPlaceSymmetricDifference(&DCRV)
+		}
+		stage.CRV_periods[key] = rev.Period
+	}
+	return true
+}
+
+func (ctx *ClientContext) stage_STHs(stage *update_stage, STHs []definition.Gossip_object) bool {
+	for _, sth := range STHs {
+		var STH_def definition.STH
+		err := json.Unmarshal([]byte(sth.Payload[1]), &STH_def)
+		if err != nil {
+			fmt.Println("sth unmarshal failed")
+			return false
+		}
+		stage.STHs[sth.Payload[0]+"@"+sth.Period] = STH_def.RootHash
+	}
+	return true
+}
+
+// CONs without valid evidence are left out, they do not reject the update.
+func (ctx *ClientContext) stage_PoMs(stage *update_stage, ACCs []definition.Gossip_object, CONs []definition.Gossip_object) {
+	for _, d1pom := range ACCs {
+		stage.D1[d1pom.Payload[0]+"@"+d1pom.Period] = true
+	}
+	for _, d2pom := range CONs {
+		// the conflict is checked against the entity's own signatures, not only the gossipers'
+		if err := definition.Verify_CON_evidence(d2pom, stage.Crypto); err != nil {
+			fmt.Println("Ignored CON without valid evidence against", d2pom.Payload[0]+":", err)
+			continue
+		}
+		// the first conviction counts
+		if _, ok := stage.D2[d2pom.Payload[0]]; !ok {
+			stage.D2[d2pom.Payload[0]] = d2pom.Period
+		}
+	}
+}
+
+// Apply a stage to the databases, the locks are always taken in the same order.
+func (ctx *ClientContext) commit(stage *update_stage) {
+	ctx.STH_DB_RWLock.Lock()
+	ctx.CRV_DB_RWLock.Lock()
+	ctx.D1_Blacklist_DB_RWLock.Lock()
+	ctx.D2_Blacklist_DB_RWLock.Lock()
+	for _, key := range stage.KEYs {
+		err := definition.Apply_KEY_FULL(key, ctx.Crypto)
+		if err != nil {
+			fmt.Println("Key rotation of", key.Payload[0], "not applied:", err)
+		}
+	}
+	for key, roothash := range stage.STHs {
+		ctx.STH_database[key] = roothash
+	}
+	for key, crv := range stage.CRVs {
+		ctx.CRV_database[key] = crv
+	}
+	for key, period := range stage.CRV_periods {
+		ctx.CRV_Period_database[key] = period
+	}
+	for key := range stage.D1 {
+		ctx.D1_Blacklist_database[key] = true
+	}
+	for key, period := range stage.D2 {
+		if _, ok := ctx.D2_Blacklist_database[key]; !ok {
+			ctx.D2_Blacklist_database[key] = period
+		}
+	}
+	for period, counters := range stage.Integrity {
+		ctx.Monitor_Interity_database[period] = counters
+	}
+	if stage.Last_update_period != "" {
+		ctx.Last_update_period = stage.Last_update_period
+	}
+	ctx.commit_counters(stage)
+	ctx.D2_Blacklist_DB_RWLock.Unlock()
+	ctx.D1_Blacklist_DB_RWLock.Unlock()
+	ctx.CRV_DB_RWLock.Unlock()
+	ctx.STH_DB_RWLock.Unlock()
+}
+
+// Everything the client keeps between runs.
+type Client_tables struct {
+	STH_database              map[string]string
+	CRV_database              map[string][]byte
+	CRV_Period_database       map[string]string
+	D1_Blacklist_database     map[string]bool
+	D2_Blacklist_database     map[string]string
+	Monitor_Interity_database map[string]string
+	Last_update_period        string
+	Current_Monitor_URL       string
+	Monitor_since             map[string]string
+	Monitor_NUMs              map[string]definition.PoM_Counter
+	NUM_FULLs                 map[string]definition.PoM_Counter
+	Monitor_IDs               map[string]string
+	Dishonest_monitors        map[string]bool
+	Monitor_evidence          []Monitor_evidence
+}
+
+// Where the tables of the client are saved.
+type Store_backend interface {
+	// nil tables and no error if nothing was saved yet
+	Load() (*Client_tables, error)
+	Save(tables *Client_tables) error
+}
+
+// A store in a single JSON file on disk.
+// The tables are written to a temporary file which then replaces the store,
+// so a crash while saving leaves the previous tables.
+type File_store struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileStore(path string) *File_store {
+	return &File_store{Path: path}
+}
+
+func (s *File_store) Load() (*Client_tables, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tables Client_tables
+	err = json.Unmarshal(data, &tables)
+	if err != nil {
+		return nil, err
+	}
+	return &tables, nil
+}
+
+func (s *File_store) Save(tables *Client_tables) error {
+	data, err := json.MarshalIndent(tables, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func copy_map[V any](m map[string]V) map[string]V {
+	c := make(map[string]V, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+// A copy of the tables of the client.
+func (ctx *ClientContext) Tables() *Client_tables {
+	tables := &Client_tables{CRV_database: make(map[string][]byte)}
+	ctx.STH_DB_RWLock.RLock()
+	tables.STH_database = copy_map(ctx.STH_database)
+	ctx.STH_DB_RWLock.RUnlock()
+	ctx.CRV_DB_RWLock.RLock()
+	for key, crv := range ctx.CRV_database {
+		tables.CRV_database[key], _ = crv.MarshalBinary()
+	}
+	tables.CRV_Period_database = copy_map(ctx.CRV_Period_database)
+	tables.Monitor_Interity_database = copy_map(ctx.Monitor_Interity_database)
+	tables.Last_update_period = ctx.Last_update_period
+	ctx.CRV_DB_RWLock.RUnlock()
+	ctx.D1_Blacklist_DB_RWLock.RLock()
+	tables.D1_Blacklist_database = copy_map(ctx.D1_Blacklist_database)
+	ctx.D1_Blacklist_DB_RWLock.RUnlock()
+	ctx.D2_Blacklist_DB_RWLock.RLock()
+	tables.D2_Blacklist_database = copy_map(ctx.D2_Blacklist_database)
+	ctx.D2_Blacklist_DB_RWLock.RUnlock()
+	ctx.Monitor_LOCK.Lock()
+	tables.Current_Monitor_URL = ctx.Current_Monitor_URL
+	tables.Monitor_since = copy_map(ctx.Monitor_since)
+	tables.Monitor_NUMs = copy_map(ctx.Monitor_NUMs)
+	tables.NUM_FULLs = copy_map(ctx.NUM_FULLs)
+	tables.Monitor_IDs = copy_map(ctx.Monitor_IDs)
+	tables.Dishonest_monitors = copy_map(ctx.Dishonest_monitors)
+	tables.Monitor_evidence = append([]Monitor_evidence{}, ctx.Monitor_evidence...)
+	ctx.Monitor_LOCK.Unlock()
+	return tables
+}
+
+// Replace the tables of the client with the ones given.
+func (ctx *ClientContext) Restore(tables *Client_tables) error {
+	CRVs := make(map[string]*bitset.BitSet)
+	for key, value := range tables.CRV_database {
+		var crv bitset.BitSet
+		err := crv.UnmarshalBinary(value)
+		if err != nil {
+			return fmt.Errorf("CRV of %s: %v", key, err)
+		}
+		CRVs[key] = &crv
+	}
+	ctx.STH_DB_RWLock.Lock()
+	ctx.STH_database = copy_map(tables.STH_database)
+	ctx.STH_DB_RWLock.Unlock()
+	ctx.CRV_DB_RWLock.Lock()
+	ctx.CRV_database = CRVs
+	ctx.CRV_Period_database = copy_map(tables.CRV_Period_database)
+	ctx.Monitor_Interity_database = copy_map(tables.Monitor_Interity_database)
+	ctx.Last_update_period = tables.Last_update_period
+	ctx.CRV_DB_RWLock.Unlock()
+	ctx.D1_Blacklist_DB_RWLock.Lock()
+	ctx.D1_Blacklist_database = copy_map(tables.D1_Blacklist_database)
+	ctx.D1_Blacklist_DB_RWLock.Unlock()
+	ctx.D2_Blacklist_DB_RWLock.Lock()
+	ctx.D2_Blacklist_database = copy_map(tables.D2_Blacklist_database)
+	ctx.D2_Blacklist_DB_RWLock.Unlock()
+	ctx.Monitor_LOCK.Lock()
+	ctx.Current_Monitor_URL = tables.Current_Monitor_URL
+	ctx.Monitor_since = copy_map(tables.Monitor_since)
+	ctx.Monitor_NUMs = copy_map(tables.Monitor_NUMs)
+	ctx.NUM_FULLs = copy_map(tables.NUM_FULLs)
+	ctx.Monitor_IDs = copy_map(tables.Monitor_IDs)
+	ctx.Dishonest_monitors = copy_map(tables.Dishonest_monitors)
+	ctx.Monitor_evidence = tables.Monitor_evidence
+	ctx.Monitor_LOCK.Unlock()
+	return nil
+}
+
+// Save the tables to the store of the client, nothing to do if it has none.
+func (ctx *ClientContext) Save() error {
+	if ctx.Store == nil {
+		return nil
+	}
+	return ctx.Store.Save(ctx.Tables())
+}
+
+func (ctx *ClientContext) save() {
+	err := ctx.Save()
+	if err != nil {
+		fmt.Println(util.RED+"Error saving the client tables:", err, util.RESET)
+	}
+}
+
+// Load the tables from the store of the client.
+// Returns false if the store is empty, the tables are then left as they are.
+func (ctx *ClientContext) Load() (bool, error) {
+	if ctx.Store == nil {
+		return false, nil
+	}
+	tables, err := ctx.Store.Load()
+	if err != nil || tables == nil {
+		return false, err
+	}
+	return true, ctx.Restore(tables)
+}
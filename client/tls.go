@@ -0,0 +1,100 @@
+package client
+
+import (
+	"CTngV2/crypto"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// CTng checks in the TLS handshake.
+// A tls.Config using VerifyPeerCertificate or VerifyConnection of a ClientContext rejects servers whose certificate
+// is not signed by the CA it names as issuer, has no logger POI matching a known STH, is revoked in the CRV of its CA,
+// or was issued by a blacklisted CA, so any Go HTTP client can enforce CTng with the databases kept by the client.
+
+// Check a certificate against the databases of the client, the error is a *Verification_error.
+func (ctx *ClientContext) CheckCertificate(cert *x509.Certificate) error {
+	err := ctx.CheckIssuer(cert)
+	if err != nil {
+		return err
+	}
+	_, err = ctx.VerifyCTngextension(cert)
+	return err
+}
+
+// Check the signature of the certificate with the RSA key of its issuer, the key the CAs issue X.509 certificates with.
+func (ctx *ClientContext) CheckIssuer(cert *x509.Certificate) error {
+	issuer := cert.Issuer.CommonName
+	if ctx.Crypto == nil {
+		return &Verification_error{Reason: CTNG_UNKNOWN_ISSUER, Entity: issuer}
+	}
+	key, ok := ctx.Crypto.SignPublicMap[crypto.CTngID(issuer)]
+	if !ok {
+		return &Verification_error{Reason: CTNG_UNKNOWN_ISSUER, Entity: issuer}
+	}
+	ca := &x509.Certificate{PublicKey: &key, PublicKeyAlgorithm: x509.RSA}
+	err := cert.CheckSignatureFrom(ca)
+	if err != nil {
+		return &Verification_error{Reason: CTNG_BAD_SIGNATURE, Entity: issuer, Details: []string{err.Error()}}
+	}
+	return nil
+}
+
+// A tls.Config VerifyPeerCertificate callback, only the leaf certificate is checked.
+// The callback does not see the server name, use VerifyConnection with InsecureSkipVerify.
+func (ctx *ClientContext) VerifyPeerCertificate() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return &Verification_error{Reason: CTNG_NO_CERTIFICATE}
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return &Verification_error{Reason: CTNG_MALFORMED, Details: []string{err.Error()}}
+		}
+		return ctx.CheckCertificate(cert)
+	}
+}
+
+// A tls.Config VerifyConnection callback, also called on resumed sessions.
+// The certificate has to be valid for the server name the client sent, which is empty for IP addresses:
+// use TLSConfigFor to reach a server by its address.
+func (ctx *ClientContext) VerifyConnection() func(cs tls.ConnectionState) error {
+	return ctx.verify_connection("")
+}
+
+// Check the certificate for host, or for the server name of the connection if host is empty.
+func (ctx *ClientContext) verify_connection(host string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return &Verification_error{Reason: CTNG_NO_CERTIFICATE}
+		}
+		name := cs.ServerName
+		if host != "" {
+			name = host
+		}
+		cert := cs.PeerCertificates[0]
+		err := cert.VerifyHostname(name)
+		if err != nil {
+			return &Verification_error{Reason: CTNG_NAME_MISMATCH, Entity: cert.Issuer.CommonName, Details: []string{err.Error()}}
+		}
+		return ctx.CheckCertificate(cert)
+	}
+}
+
+// A tls.Config enforcing CTng in place of the usual chain verification:
+// CTng certificates are issued by our own CAs and would not pass it,
+// so VerifyConnection checks the server name and the issuer signature itself.
+func (ctx *ClientContext) TLSConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   ctx.VerifyConnection(),
+	}
+}
+
+// Same as TLSConfig for the connections to host, a DNS name or an IP address.
+func (ctx *ClientContext) TLSConfigFor(host string) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         host,
+		VerifyConnection:   ctx.verify_connection(host),
+	}
+}
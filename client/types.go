@@ -2,6 +2,7 @@ package client
 
 import (
 	"CTngV2/crypto"
+	"CTngV2/definition"
 	"CTngV2/monitor"
 	"CTngV2/util"
 	"encoding/json"
@@ -22,15 +23,21 @@ type ClientConfig struct {
 	CRV_Storage_filepath  string
 	D1_Blacklist_filepath string
 	D2_Blacklist_filepath string
+	Policy                Client_policy
+	// where the evidence against dishonest monitors is written, not written if empty
+	Monitor_evidence_filepath string
+	// the file all the tables are saved to after each update, nothing is saved if empty
+	Store_filepath string
 }
 
 type ClientContext struct {
 	Config              *ClientConfig
 	Crypto              *crypto.CryptoConfig
-	Current_Monitor_URL string
+	Current_Monitor_URL string // protected by Monitor_LOCK
 	// the databases are shared resources and should be protected with mutex
 	STH_database              map[string]string         // key = entity_ID + @ + Period, content = RootHash
 	CRV_database              map[string]*bitset.BitSet // key = entity_ID, content = CRV
+	CRV_Period_database       map[string]string         // key = entity_ID, content = Period of the last REV applied, protected by CRV_DB_RWLock
 	D1_Blacklist_database     map[string]bool           // key = entity_ID + "@" + Period. content = bool
 	D2_Blacklist_database     map[string]string         // key = entity_ID, content = Period since
 	Monitor_Interity_database map[string]string         // key = Period, content = NUM_ACC_FULL + "@" + NUM_CON_FULL
@@ -38,10 +45,25 @@ type ClientContext struct {
 	CRV_DB_RWLock             *sync.RWMutex
 	D1_Blacklist_DB_RWLock    *sync.RWMutex
 	D2_Blacklist_DB_RWLock    *sync.RWMutex
-	// Don't need lock for monitor integerity DB because it is only checked once per period
+	// the monitor integrity DB is only written on commit, protected by CRV_DB_RWLock
 	Config_filepath string
 	Crypto_filepath string
 	Status          string
+	// period of the last update handled, to tell whether the monitor is reachable, protected by CRV_DB_RWLock
+	Last_update_period string
+	// the since parameter of the next bundle request to each monitor, in the storage periods of the monitor, protected by Monitor_LOCK
+	Monitor_since map[string]string
+	// cross-checking of the monitors, protected by Monitor_LOCK
+	Monitor_NUMs       map[string]definition.PoM_Counter // key = monitor_ID + "@" + Period, content = NUM of the monitor
+	NUM_FULLs          map[string]definition.PoM_Counter // key = Period of the NUM_FULL, content = the first NUM_FULL received
+	Monitor_IDs        map[string]string                 // key = monitor URL, content = monitor_ID
+	Dishonest_monitors map[string]bool                   // key = monitor_ID
+	Monitor_evidence   []Monitor_evidence
+	Monitor_LOCK       sync.Mutex
+	// the monitor cross-checked last, protected by Monitor_LOCK
+	Cross_checked_URL string
+	// where the tables are saved, nil for a client which does not keep them
+	Store Store_backend
 }
 
 func SaveSTHDatabase(ctx *ClientContext) {
@@ -56,13 +78,21 @@ func SaveCRVDatabase(ctx *ClientContext) {
 	util.WriteData(ctx.Config.CRV_Storage_filepath, crvstorage)
 }
 
+func SaveD1BlacklistDatabase(ctx *ClientContext) {
+	util.WriteData(ctx.Config.D1_Blacklist_filepath, ctx.D1_Blacklist_database)
+}
+
+func SaveD2BlacklistDatabase(ctx *ClientContext) {
+	util.WriteData(ctx.Config.D2_Blacklist_filepath, ctx.D2_Blacklist_database)
+}
+
 func LoadSTHDatabase(ctx *ClientContext) {
 	databyte, err := util.ReadByte(ctx.Config.STH_Storage_filepath)
 	if err != nil {
 		ctx.STH_database = make(map[string]string)
 		return
 	}
-	json.Unmarshal(databyte, &ctx.STH_database)
+	err = json.Unmarshal(databyte, &ctx.STH_database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -74,6 +104,7 @@ func LoadCRVDatabase(ctx *ClientContext) {
 		ctx.CRV_database = make(map[string]*bitset.BitSet)
 		return
 	}
+	ctx.CRV_database = make(map[string]*bitset.BitSet)
 	var crvstorage = make(map[string][]byte)
 	err = json.Unmarshal(databyte, &crvstorage)
 	if err != nil {
@@ -135,17 +166,29 @@ func (ctx *ClientContext) InitializeClientContext() {
 	// initialize the databases
 	ctx.STH_database = make(map[string]string)
 	ctx.CRV_database = make(map[string]*bitset.BitSet)
+	ctx.CRV_Period_database = make(map[string]string)
 	ctx.D1_Blacklist_database = make(map[string]bool)
 	ctx.D2_Blacklist_database = make(map[string]string)
 	ctx.Monitor_Interity_database = make(map[string]string)
+	ctx.Monitor_since = make(map[string]string)
 	// load the databases
 	if err != nil {
 		log.Fatal(err)
 	}
+	if ctx.Store == nil && ctx.Config.Store_filepath != "" {
+		ctx.Store = NewFileStore(ctx.Config.Store_filepath)
+	}
 	if ctx.Status != "NEW" {
-		LoadSTHDatabase(ctx)
-		LoadCRVDatabase(ctx)
-		LoadD1BlacklistDatabase(ctx)
-		LoadD2BlacklistDatabase(ctx)
+		// the store has every table, the separate database files are read if it is empty
+		loaded, err := ctx.Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !loaded {
+			LoadSTHDatabase(ctx)
+			LoadCRVDatabase(ctx)
+			LoadD1BlacklistDatabase(ctx)
+			LoadD2BlacklistDatabase(ctx)
+		}
 	}
 }
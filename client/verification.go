@@ -0,0 +1,218 @@
+package client
+
+import (
+	"CTngV2/CA"
+	"CTngV2/Logger"
+	"CTngV2/definition"
+	"CTngV2/util"
+	"crypto/x509"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Verification of the CTng extension of a certificate against the databases of the client.
+// The result lists the outcome of every logger info, the revocation and blacklist status of the issuer
+// and the verdict, so applications can log and act on the specific failures.
+
+// Reasons a certificate is rejected.
+const (
+	CTNG_NO_CERTIFICATE  = "no_certificate"
+	CTNG_MALFORMED       = "malformed_certificate"
+	CTNG_NO_VALID_LOGGER = "no_valid_logger"
+	CTNG_REVOKED         = "revoked"
+	CTNG_BLACKLISTED     = "blacklisted_issuer"
+	CTNG_UNKNOWN_CRV     = "unknown_crv"
+	// the issuer is not a CA the client knows, or did not sign the certificate
+	CTNG_UNKNOWN_ISSUER = "unknown_issuer"
+	CTNG_BAD_SIGNATURE  = "bad_issuer_signature"
+	// the certificate is not valid for the server name of the connection
+	CTNG_NAME_MISMATCH = "name_mismatch"
+	// the policy requires a hard-fail and the client has no recent update
+	CTNG_MONITOR_UNREACHABLE = "monitor_unreachable"
+)
+
+// Outcomes of a logger info.
+const (
+	LOGGER_VALID         = "valid"
+	LOGGER_BAD_SIGNATURE = "sth_signature_bad"
+	LOGGER_MALFORMED_STH = "sth_malformed"
+	LOGGER_UNKNOWN_STH   = "sth_unknown"
+	LOGGER_ROOT_MISMATCH = "root_mismatch"
+	LOGGER_INVALID_POI   = "poi_invalid"
+	// valid, but older than the Max_STH_age of the policy
+	LOGGER_STH_TOO_OLD = "sth_too_old"
+	// valid, but the logger was accused (ACC PoM) or convicted (CON PoM) in the period of the STH
+	LOGGER_ACCUSED   = "logger_accused"
+	LOGGER_CONVICTED = "logger_convicted"
+)
+
+const (
+	VERDICT_ACCEPT = "accept"
+	VERDICT_REJECT = "reject"
+)
+
+type Logger_result struct {
+	Logger    string
+	Period    string
+	Outcome   string
+	Error     string `json:",omitempty"`
+	Accused   bool   `json:",omitempty"`
+	Convicted bool   `json:",omitempty"`
+}
+
+type Revocation_status struct {
+	RID int
+	// false if the client has no CRV of the issuer
+	Known   bool
+	Revoked bool
+	// period of the last REV of the issuer applied to the CRV
+	CRV_period string `json:",omitempty"`
+}
+
+type Blacklist_status struct {
+	// accused (D1) in the current period
+	Accused bool
+	// convicted (D2) by a conflict PoM
+	Convicted bool
+	Since     string `json:",omitempty"`
+}
+
+type Monitor_status struct {
+	// period of the last update the client handled
+	Last_update string
+	Reachable   bool
+}
+
+type Verification_result struct {
+	Issuer string
+	// the current period, the certificate is checked at
+	Period  string
+	Loggers []Logger_result
+	// distinct loggers with a valid logger info
+	Valid_loggers int
+	Revocation    Revocation_status
+	Blacklist     Blacklist_status
+	Monitor       Monitor_status
+	Verdict       string
+	// one of the CTNG_ reasons if the certificate is rejected
+	Reason string `json:",omitempty"`
+}
+
+type Verification_error struct {
+	Reason string
+	// the issuer of the certificate
+	Entity string
+	// what went wrong, one entry per logger for CTNG_NO_VALID_LOGGER
+	Details []string
+	// nil if the certificate could not be checked at all
+	Result *Verification_result
+}
+
+func (e *Verification_error) Error() string {
+	msg := "CTng verification failed: " + e.Reason
+	if e.Entity != "" {
+		msg += " (" + e.Entity + ")"
+	}
+	if len(e.Details) > 0 {
+		msg += ": " + strings.Join(e.Details, "; ")
+	}
+	return msg
+}
+
+// Check a logger info of the certificate against the STH database, precert is the certificate without its loggers.
+func (ctx *ClientContext) check_logger_info(loggerinfo CA.LoggerInfo, precert *x509.Certificate) Logger_result {
+	result := Logger_result{Logger: loggerinfo.STH.Payload[0], Period: loggerinfo.STH.Period, Outcome: LOGGER_VALID}
+	err := loggerinfo.STH.Verify(ctx.Crypto)
+	if err != nil {
+		result.Outcome, result.Error = LOGGER_BAD_SIGNATURE, err.Error()
+		return result
+	}
+	var treeinfo definition.STH
+	err = json.Unmarshal([]byte(loggerinfo.STH.Payload[1]), &treeinfo)
+	if err != nil {
+		result.Outcome, result.Error = LOGGER_MALFORMED_STH, err.Error()
+		return result
+	}
+	ctx.STH_DB_RWLock.RLock()
+	roothash, ok := ctx.STH_database[loggerinfo.STH.Payload[0]+"@"+loggerinfo.STH.Period]
+	ctx.STH_DB_RWLock.RUnlock()
+	if !ok {
+		result.Outcome = LOGGER_UNKNOWN_STH
+		return result
+	}
+	if roothash != treeinfo.RootHash {
+		result.Outcome = LOGGER_ROOT_MISMATCH
+		return result
+	}
+	if !Logger.VerifyPOI(treeinfo, loggerinfo.POI, *precert) {
+		result.Outcome = LOGGER_INVALID_POI
+	}
+	return result
+}
+
+// Whether the entity was accused in the period, or convicted in or before it.
+func (ctx *ClientContext) blacklisted(entity string, period string) (accused bool, convicted bool) {
+	ctx.D1_Blacklist_DB_RWLock.RLock()
+	accused = ctx.D1_Blacklist_database[entity+"@"+period]
+	ctx.D1_Blacklist_DB_RWLock.RUnlock()
+	ctx.D2_Blacklist_DB_RWLock.RLock()
+	since, ok := ctx.D2_Blacklist_database[entity]
+	ctx.D2_Blacklist_DB_RWLock.RUnlock()
+	if ok {
+		since_int, err1 := strconv.Atoi(since)
+		period_int, err2 := strconv.Atoi(period)
+		// a period that can not be compared is treated as convicted
+		convicted = err1 != nil || err2 != nil || since_int <= period_int
+	}
+	return accused, convicted
+}
+
+// Verify the CTng extension of a certificate and evaluate the policy of the client on the result.
+// If the certificate is rejected, the error is a *Verification_error carrying the result.
+func (ctx *ClientContext) VerifyCTngextension(cert *x509.Certificate) (*Verification_result, error) {
+	return ctx.VerifyCTngextensionAt(cert, util.GetCurrentPeriod())
+}
+
+// Same as VerifyCTngextension, evaluated at the given period instead of the current one:
+// the blacklist of the issuer and the reachability of the monitor are judged for that period.
+func (ctx *ClientContext) VerifyCTngextensionAt(cert *x509.Certificate, period string) (*Verification_result, error) {
+	if cert == nil {
+		return nil, &Verification_error{Reason: CTNG_NO_CERTIFICATE}
+	}
+	issuer := cert.Issuer.CommonName
+	result := &Verification_result{Issuer: issuer, Period: period, Loggers: []Logger_result{}}
+	// blacklists
+	ctx.D1_Blacklist_DB_RWLock.RLock()
+	result.Blacklist.Accused = ctx.D1_Blacklist_database[issuer+"@"+period]
+	ctx.D1_Blacklist_DB_RWLock.RUnlock()
+	ctx.D2_Blacklist_DB_RWLock.RLock()
+	result.Blacklist.Since, result.Blacklist.Convicted = ctx.D2_Blacklist_database[issuer]
+	ctx.D2_Blacklist_DB_RWLock.RUnlock()
+	// loggers
+	CTngext := CA.ParseCTngextension(cert)
+	precert := util.ParseTBSCertificate(cert)
+	for _, loggerinfo := range CTngext.LoggerInformation {
+		logger := ctx.check_logger_info(loggerinfo, precert)
+		logger.Accused, logger.Convicted = ctx.blacklisted(logger.Logger, logger.Period)
+		result.Loggers = append(result.Loggers, logger)
+	}
+	// revocation
+	result.Revocation.RID = CTngext.SequenceNumber.RID
+	ctx.CRV_DB_RWLock.RLock()
+	CRV_to_check, ok := ctx.CRV_database[issuer]
+	if ok {
+		result.Revocation.Known = true
+		result.Revocation.Revoked = CRV_to_check.Test(uint(result.Revocation.RID))
+		result.Revocation.CRV_period = ctx.CRV_Period_database[issuer]
+	}
+	result.Monitor.Last_update = ctx.Last_update_period
+	ctx.CRV_DB_RWLock.RUnlock()
+	result.Monitor.Reachable = monitor_reachable(result.Monitor.Last_update, period)
+	// a nil *Verification_error is not a nil error
+	verr := ctx.policy().Evaluate(result)
+	if verr != nil {
+		return result, verr
+	}
+	return result, nil
+}
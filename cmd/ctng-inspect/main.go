@@ -0,0 +1,62 @@
+package main
+
+import (
+	"CTngV2/CA"
+	"CTngV2/crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Print the CTng extension of a certificate.
+// Usage: go run ./cmd/ctng-inspect -cert cert.pem [-crypto Client_crypto_config.json] [-json]
+// With a crypto config, the signatures over the embedded STHs are verified.
+func main() {
+	certfile := flag.String("cert", "", "PEM or DER certificate file")
+	cryptofile := flag.String("crypto", "", "crypto configuration to verify the STH signatures with")
+	asjson := flag.Bool("json", false, "print the extension as JSON")
+	flag.Parse()
+	if *certfile == "" {
+		fmt.Fprintln(os.Stderr, "-cert is required")
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(*certfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error parsing the certificate:", err)
+		os.Exit(2)
+	}
+	var c *crypto.CryptoConfig
+	if *cryptofile != "" {
+		c, err = crypto.ReadVerifyOnlyCryptoConfig(*cryptofile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading the crypto config:", err)
+			os.Exit(2)
+		}
+	}
+	inspection, err := CA.Inspect_CTngextension(cert, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !*asjson {
+		inspection.Write_text(os.Stdout)
+		return
+	}
+	out, err := json.MarshalIndent(inspection, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"CTngV2/client"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// An HTTP CONNECT proxy enforcing CTng on the connections of the applications behind it.
+// The applications have to trust the CA certificate of the proxy, it is generated on the first start.
+// Usage: go run ./cmd/ctng-proxy -config Client_config.json -crypto Client_crypto_config.json [-mode enforce|log] [-ca-cert proxy_ca.pem -ca-key proxy_ca_key.pem]
+func main() {
+	config := flag.String("config", "client/Client_config.json", "client configuration")
+	crypto := flag.String("crypto", "client/Client_crypto_config.json", "client crypto configuration")
+	mode := flag.String("mode", client.PROXY_ENFORCE, "enforce: refuse rejected certificates, log: only log them")
+	status := flag.String("status", "", "NEW to start with empty databases")
+	ca_cert := flag.String("ca-cert", "client/proxy_ca.pem", "CA certificate of the proxy, the applications have to trust it")
+	ca_key := flag.String("ca-key", "client/proxy_ca_key.pem", "private key of the CA of the proxy")
+	flag.Parse()
+	if *mode != client.PROXY_ENFORCE && *mode != client.PROXY_LOG {
+		fmt.Println("Unknown mode", *mode)
+		os.Exit(1)
+	}
+	ctx := &client.ClientContext{
+		Status:          *status,
+		Config_filepath: *config,
+		Crypto_filepath: *crypto,
+		Config:          &client.ClientConfig{},
+	}
+	issuer, err := client.LoadProxyIssuer(*ca_cert, *ca_key)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ctx.InitializeClientContext()
+	err = client.StartProxy(ctx, *mode, issuer)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
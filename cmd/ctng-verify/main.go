@@ -0,0 +1,84 @@
+package main
+
+import (
+	"CTngV2/client"
+	"CTngV2/util"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Verify a CTng certificate offline against saved client updates.
+// Usage: go run ./cmd/ctng-verify -updates monitor_data/1 [-cert cert.pem | -host example.com:443] [-json]
+// The exit code is 0 if the certificate is accepted, 1 if it is rejected and 2 if it could not be checked.
+func main() {
+	config := flag.String("config", "client/Client_config.json", "client configuration")
+	crypto := flag.String("crypto", "client/Client_crypto_config.json", "client crypto configuration")
+	certfile := flag.String("cert", "", "PEM or DER certificate file")
+	host := flag.String("host", "", "host:port to fetch the certificate from")
+	updates := flag.String("updates", "", "directory of saved client updates")
+	asjson := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+	if (*certfile == "") == (*host == "") {
+		fmt.Fprintln(os.Stderr, "One of -cert or -host is required")
+		os.Exit(2)
+	}
+	var cert *x509.Certificate
+	var err error
+	if *certfile != "" {
+		cert, err = client.LoadCertificate(*certfile)
+	} else {
+		cert, err = client.FetchPeerCertificate(*host)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the certificate:", err)
+		os.Exit(2)
+	}
+	ctx := &client.ClientContext{
+		Status:          "NEW",
+		Config_filepath: *config,
+		Crypto_filepath: *crypto,
+		Config:          &client.ClientConfig{},
+	}
+	ctx.InitializeClientContext()
+	// the replayed updates are not saved
+	ctx.Store = nil
+	var rejected []string
+	n := 0
+	// the certificate is judged at the period of the last update, without updates at the current one
+	period := util.GetCurrentPeriod()
+	if *updates != "" {
+		list, err := client.ReadClientUpdates(*updates)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading the client updates:", err)
+			os.Exit(2)
+		}
+		// the client logs while handling the updates, the report goes to stdout alone
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		rejected = ctx.ReplayUpdates(list)
+		os.Stdout = stdout
+		n = len(list)
+		if n > 0 {
+			period = list[n-1].Period
+		}
+	}
+	report := ctx.Report(cert, period)
+	report.Updates, report.Rejected_updates = n, rejected
+	if *asjson {
+		err = report.Write_JSON(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		report.Write_text(os.Stdout)
+	}
+	if report.Result == nil {
+		os.Exit(2)
+	}
+	if report.Result.Verdict != client.VERDICT_ACCEPT {
+		os.Exit(1)
+	}
+}
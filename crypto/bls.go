@@ -1,7 +1,9 @@
 package crypto
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"sort"
 
 	bls "github.com/herumi/bls-go-binary/bls"
@@ -26,7 +28,8 @@ type BLSThresholdSignatures interface {
 	VerifyAggregate(msg string, fragments []SigFragment, config *CryptoConfig) error
 }
 
-// Generate mappings of IDs to Private Keys and Public Keys Based on a config's parameters
+// Generate mappings of IDs to Private Keys and Public Keys Based on a config's parameters.
+// Keys generated before the shares were dealt from one polynomial can not be reshared, see CheckThresholdPublicMap.
 func GenerateThresholdKeypairs(entities []CTngID, threshold int) ([]bls.ID, BlsPublicMap, BlsPrivateMap, error) {
 	if threshold < 2 {
 		return nil, nil, nil, errors.New("Threshold must be greater than 1")
@@ -34,28 +37,24 @@ func GenerateThresholdKeypairs(entities []CTngID, threshold int) ([]bls.ID, BlsP
 	//ids for n entities
 	n := len(entities)
 	ids := make([]bls.ID, n)
-	mainSecrets := make([]bls.SecretKey, threshold)
 	privs := make(BlsPrivateMap)
 	pubs := make(BlsPublicMap)
+	// A random polynomial of degree threshold-1, the group secret is its constant term.
+	var master bls.SecretKey
+	master.SetByCSPRNG()
+	mainSecrets := master.GetMasterSecretKey(threshold)
 	//Generate all IDs and Keypairs.
 	for i := 0; i < n; i++ {
 		// blsIDs should be derived from the CTngIDs. In this case, we use hex string conversion.
 		// Note that blsIDs are only used when keys are generated, not sure when else.
 		sec := new(bls.SecretKey)
 		ids[i] = *entities[i].BlsID()
-		// For the first "threshold" number of entities, we generate unique secrets.
-		if i < threshold {
-			sec.SetByCSPRNG()
-			privs[entities[i]] = *sec
-			mainSecrets[i] = *sec
-		} else {
-			// The remaining entities are constructed using this threshold amount.
-			// (bls.SecretKey.Set) calls blsSecretKeyShare.
-			sec.Set(mainSecrets, &ids[i])
-			privs[entities[i]] = *sec
-		}
-		pubs[entities[i]] = *sec.GetPublicKey()
+		// Every entity gets the share at its ID, so any threshold of them interpolate to the group key.
+		// (bls.SecretKey.Set) calls blsSecretKeyShare.
+		sec.Set(mainSecrets, &ids[i])
+		privs[entities[i]] = *sec
 		//Generate all the PublicKeys (for distribution to individual entities later)
+		pubs[entities[i]] = *sec.GetPublicKey()
 	}
 	// None of the above functions return errors. Instead they panic.
 	// If cryptography information fails to generate then we cannot proceed.
@@ -72,7 +71,65 @@ func ThresholdSign(msg string, sec *bls.SecretKey, SelfID CTngID) SigFragment {
 	}
 }
 
+// The point the polynomial of the shares is evaluated at for a set of signers, derived from their sorted IDs.
+// Evaluating at zero would give the group signature, the same for every set of signers:
+// a point bound to the set stops a signature from being passed off as one of other signers.
+func signerPoint(ids []CTngID) bls.Fr {
+	var point bls.Fr
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(id.String())
+		buf.WriteByte(0)
+	}
+	point.SetHashOf(buf.Bytes())
+	return point
+}
+
+// The BLS IDs of the signers shifted by the point, so the Lagrange interpolation at zero
+// done by Recover evaluates the polynomial at the point instead.
+func shiftedIDs(ids []CTngID, point *bls.Fr) ([]bls.ID, error) {
+	shifted := make([]bls.ID, len(ids))
+	for i, id := range ids {
+		var x bls.Fr
+		err := x.Deserialize(id.BlsID().Serialize())
+		if err != nil {
+			return nil, err
+		}
+		bls.FrSub(&x, &x, point)
+		if x.IsZero() {
+			return nil, errors.New("The signer point is the ID of a signer")
+		}
+		err = shifted[i].Deserialize(x.Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shifted, nil
+}
+
+// Recover the public key of the signers at their signer point by Lagrange interpolation of their public key shares.
+// The signers must be distinct and in the public map.
+func signersPublicKey(ids []CTngID, pubs *BlsPublicMap) (bls.PublicKey, error) {
+	var key bls.PublicKey
+	keys := make([]bls.PublicKey, len(ids))
+	for i, id := range ids {
+		pub, ok := (*pubs)[id]
+		if !ok {
+			return key, errors.New("Unknown signer " + id.String())
+		}
+		keys[i] = pub
+	}
+	point := signerPoint(ids)
+	shifted, err := shiftedIDs(ids, &point)
+	if err != nil {
+		return key, err
+	}
+	err = key.Recover(keys, shifted)
+	return key, err
+}
+
 // Aggregate signature Fragments into a ThresholdSig.
+// The fragments are interpolated at the signer point of their IDs, see signerPoint.
 func ThresholdAggregate(sigs []SigFragment, threshold int) (ThresholdSig, error) {
 	var aggregate = ThresholdSig{
 		IDs:  make([]CTngID, len(sigs)),
@@ -81,27 +138,61 @@ func ThresholdAggregate(sigs []SigFragment, threshold int) (ThresholdSig, error)
 	if len(sigs) < threshold {
 		return aggregate, errors.New("Not enough signatures to aggregate")
 	}
+	// Fragments from different epochs are signed with unrelated shares.
+	aggregate.Epoch = sigs[0].Epoch
+	// Sort the fragments by ID for consistency.
+	sorted := append([]SigFragment{}, sigs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
 	// create list of []bls.Sign for aggregate.
-	realSigs := make([]bls.Sign, len(sigs))
-	for i := range sigs {
-		aggregate.IDs[i] = sigs[i].ID
-		realSigs[i] = *sigs[i].Sign
-	}
-	// Sort the ordering of IDs for consistency.
-	sort.Sort(CTngIDs(aggregate.IDs))
-	aggregate.Sign.Aggregate(realSigs)
-	return aggregate, nil
+	realSigs := make([]bls.Sign, len(sorted))
+	for i := range sorted {
+		if sorted[i].Epoch != aggregate.Epoch {
+			return aggregate, errors.New("Signature fragments are from different epochs")
+		}
+		aggregate.IDs[i] = sorted[i].ID
+		realSigs[i] = *sorted[i].Sign
+	}
+	point := signerPoint(aggregate.IDs)
+	shifted, err := shiftedIDs(aggregate.IDs, &point)
+	if err != nil {
+		return aggregate, err
+	}
+	// Recover fails if two fragments have the same ID.
+	err = aggregate.Sign.Recover(realSigs, shifted)
+	return aggregate, err
+}
+
+// Check the signers of a threshold signature: at least threshold distinct IDs, all in the public map.
+// A signer listed twice would let one share count for two, and with fewer signers than the threshold
+// the signature does not need the cooperation of enough gossipers.
+func CheckSigners(ids []CTngID, threshold int, pubs *BlsPublicMap) error {
+	if len(ids) < threshold {
+		return fmt.Errorf("%d signers, the threshold is %d", len(ids), threshold)
+	}
+	seen := make(map[CTngID]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return errors.New("Signer " + id.String() + " is listed twice")
+		}
+		seen[id] = true
+		if _, ok := (*pubs)[id]; !ok {
+			return errors.New("Unknown signer " + id.String())
+		}
+	}
+	return nil
 }
 
 // Verify an aggregated threshold signature against the message and the public keys
-func (sig ThresholdSig) Verify(msg string, pubs *BlsPublicMap) bool {
-	// Construct the list of public keys
-	pubList := make([]bls.PublicKey, len(sig.IDs))
-	for i := range sig.IDs {
-		pubList[i] = (*pubs)[sig.IDs[i]]
-	}
-	// FastAggregateVerify agregates the public signatures of the signers of the message and then verifies the message against that aggregated signature.
-	return sig.Sign.FastAggregateVerify(pubList, []byte(msg))
+func (sig ThresholdSig) Verify(msg string, pubs *BlsPublicMap, threshold int) bool {
+	if sig.Sign == nil || CheckSigners(sig.IDs, threshold, pubs) != nil {
+		return false
+	}
+	// The public key of the signers at their signer point, recovered from their shares
+	pub, err := signersPublicKey(sig.IDs, pubs)
+	if err != nil {
+		return false
+	}
+	return sig.Sign.Verify(&pub, msg)
 }
 
 // Given a message and a public key mapping, verify the signature runs.
@@ -115,3 +206,91 @@ func init() {
 	x := bls.BLS12_381
 	bls.Init(x)
 }
+
+// Verify many threshold signatures at once.
+// Each signature i is checked against the public key apk_i its signers' shares interpolate to at their signer point.
+// Instead of checking e(sig_i, Q) == e(H(m_i), apk_i) one by one, random scalars r_i are drawn and
+// e(sum r_i*sig_i, Q) == prod e(r_i*H(m_i), apk_i) is checked with a single final exponentiation.
+// The random scalars stop an attacker from crafting invalid signatures which cancel each other out.
+// Every signature must have at least threshold distinct signers from the public map, see CheckSigners.
+// Returns true only if every signature is valid; it does not say which one failed.
+func ThresholdBatchVerify(msgs []string, sigs []ThresholdSig, pubs *BlsPublicMap, threshold int) bool {
+	n := len(sigs)
+	if n == 0 || len(msgs) != n {
+		return false
+	}
+	g1s := make([]bls.G1, n+1)
+	g2s := make([]bls.G2, n+1)
+	var sigSum bls.G1
+	sigSum.Clear()
+	for i := 0; i < n; i++ {
+		if sigs[i].Sign == nil || CheckSigners(sigs[i].IDs, threshold, pubs) != nil {
+			return false
+		}
+		// The public key of the signers at their signer point
+		apk, err := signersPublicKey(sigs[i].IDs, pubs)
+		if err != nil {
+			return false
+		}
+		hash := bls.HashAndMapToSignature([]byte(msgs[i]))
+		if hash == nil {
+			return false
+		}
+		var r bls.Fr
+		r.SetByCSPRNG()
+		var rsig bls.G1
+		bls.G1Mul(&rsig, bls.CastFromSign(sigs[i].Sign), &r)
+		bls.G1Add(&sigSum, &sigSum, &rsig)
+		bls.G1Mul(&g1s[i], bls.CastFromSign(hash), &r)
+		g2s[i] = *bls.CastFromPublicKey(&apk)
+	}
+	// Move the signature side over: prod e(r_i*H(m_i), apk_i) * e(-sum r_i*sig_i, Q) == 1
+	bls.G1Neg(&g1s[n], &sigSum)
+	var gen bls.PublicKey
+	bls.GetGeneratorOfPublicKey(&gen)
+	g2s[n] = *bls.CastFromPublicKey(&gen)
+	var ml, result bls.GT
+	bls.MillerLoopVec(&ml, g1s, g2s)
+	bls.FinalExp(&result, &ml)
+	return result.IsOne()
+}
+
+// Check that the public key shares lie on one polynomial of degree threshold-1: every share must
+// interpolate to the same group key as the first threshold ones.
+// Older versions of Gen gave the first threshold entities the coefficients instead of shares.
+func CheckThresholdPublicMap(pubs BlsPublicMap, threshold int) error {
+	entities := make([]CTngID, 0, len(pubs))
+	for id := range pubs {
+		entities = append(entities, id)
+	}
+	sort.Sort(CTngIDs(entities))
+	if len(entities) < threshold {
+		return errors.New("Fewer public key shares than the threshold")
+	}
+	interpolate := func(signers []CTngID) (bls.PublicKey, error) {
+		keys := make([]bls.PublicKey, len(signers))
+		ids := make([]bls.ID, len(signers))
+		for i, id := range signers {
+			keys[i] = pubs[id]
+			ids[i] = *id.BlsID()
+		}
+		var group bls.PublicKey
+		err := group.Recover(keys, ids)
+		return group, err
+	}
+	group, err := interpolate(entities[:threshold])
+	if err != nil {
+		return err
+	}
+	for _, id := range entities[threshold:] {
+		signers := append(append([]CTngID{}, entities[:threshold-1]...), id)
+		other, err := interpolate(signers)
+		if err != nil {
+			return err
+		}
+		if !other.IsEqual(&group) {
+			return errors.New("The public key share of " + id.String() + " is not on the polynomial of the others")
+		}
+	}
+	return nil
+}
@@ -16,8 +16,14 @@ type CryptoStorage interface {
 // Generate a list of cryptoconfigs from a list of entity names.
 // The threshold determines the k value in "k-of-n" threshold signing.
 func GenerateEntityCryptoConfigs(entityIDs []CTngID, threshold int) ([]CryptoConfig, error) {
+	return GenerateEntityCryptoConfigsWithScheme(entityIDs, threshold, RSA_SCHEME)
+}
+
+// Same as GenerateEntityCryptoConfigs, but every entity signs with signScheme.
+// RSA keys are always generated as they are still needed for X.509 issuance.
+func GenerateEntityCryptoConfigsWithScheme(entityIDs []CTngID, threshold int, signScheme string) ([]CryptoConfig, error) {
 	ThresholdScheme := "bls"
-	SignScheme := "rsa"
+	SignScheme := signScheme
 	HashScheme := SHA256
 	configs := make([]CryptoConfig, len(entityIDs))
 
@@ -42,6 +48,35 @@ func GenerateEntityCryptoConfigs(entityIDs []CTngID, threshold int) ([]CryptoCon
 		rsaPubMap[entity] = pub
 	}
 
+	// Generate keys for the other sign schemes
+	signers := make(map[CTngID]Signer)
+	signPubMap := make(SignPublicKeyMap)
+	if SignScheme != RSA_SCHEME {
+		for _, entity := range entityIDs {
+			signer, err := NewSigner(SignScheme)
+			if err != nil {
+				return nil, err
+			}
+			signers[entity] = signer
+			signPubMap[entity] = signer.Public()
+		}
+	}
+
+	// Generate the keys committed for the first rotation
+	nextSigners := make(map[CTngID]Signer)
+	nextKeyHashes := make(map[CTngID][]byte)
+	for _, entity := range entityIDs {
+		next, err := NewSigner(SignScheme)
+		if err != nil {
+			return nil, err
+		}
+		nextSigners[entity] = next
+		nextKeyHashes[entity], err = KeyHash(next.Public())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//Generate configs without individual information
 	for i := range configs {
 		configs[i] = CryptoConfig{
@@ -53,6 +88,10 @@ func GenerateEntityCryptoConfigs(entityIDs []CTngID, threshold int) ([]CryptoCon
 			SelfID:             entityIDs[i],
 			SignPublicMap:      rsaPubMap,
 			SignSecretKey:      rsaPrivMap[entityIDs[i]],
+			SignPublicKeys:     signPubMap,
+			SignKey:            signers[entityIDs[i]],
+			NextKeyHashes:      nextKeyHashes,
+			NextSignKey:        nextSigners[entityIDs[i]],
 			ThresholdPublicMap: blsPubMap,
 			ThresholdSecretKey: blsPrivMap[entityIDs[i]],
 		}
@@ -65,10 +104,11 @@ func GenerateEntityCryptoConfigs(entityIDs []CTngID, threshold int) ([]CryptoCon
 func SaveCryptoFiles(directory string, configs []CryptoConfig) error {
 	// check if directory exists, if not create it
 	util.CreateDir(directory)
-	for _, config := range configs {
+	for i := range configs {
+		config := &configs[i]
 		// fmt.Print(config)
 		file := fmt.Sprintf("%s/%s.test.json", directory, config.SelfID)
-		err := util.WriteData(file, *NewStoredCryptoConfig(&config))
+		err := util.WriteData(file, *NewStoredCryptoConfig(config))
 		if err != nil {
 			return err
 		}
@@ -77,6 +117,7 @@ func SaveCryptoFiles(directory string, configs []CryptoConfig) error {
 }
 
 // Read a storedcryptoconfig from a file, convert it to a cryptoconfig and return a pointer to it.
+// The private keys come from the config's key store if it names one.
 func ReadCryptoConfig(file string) (*CryptoConfig, error) {
 	scc := new(StoredCryptoConfig)
 	bytes, err := util.ReadByte(file)
@@ -85,6 +126,10 @@ func ReadCryptoConfig(file string) (*CryptoConfig, error) {
 		return nil, err
 	}
 	cc, err := NewCryptoConfig(scc)
+	if err != nil {
+		return cc, err
+	}
+	err = loadKeyStore(cc, file, scc)
 	return cc, err
 }
 
@@ -108,6 +153,10 @@ func ReadBasicCryptoConfig(file string) (*CryptoConfig, error) {
 		return nil, err
 	}
 	cc, err := NewBasicCryptoConfig(scc)
+	if err != nil {
+		return cc, err
+	}
+	err = loadKeyStore(cc, file, scc)
 	return cc, err
 }
 
@@ -126,6 +175,38 @@ func NewStoredCryptoConfig(c *CryptoConfig) *StoredCryptoConfig {
 	}
 	scc.ThresholdPublicMap = (&c.ThresholdPublicMap).Serialize()
 	scc.ThresholdSecretKey = (&c.ThresholdSecretKey).Serialize()
+	scc.ThresholdEpoch = c.ThresholdEpoch
+	if len(c.PastThresholdKeys) > 0 {
+		scc.PastThresholdKeys = make(map[int]StoredThresholdEpochKeys)
+		for epoch, keys := range c.PastThresholdKeys {
+			scc.PastThresholdKeys[epoch] = StoredThresholdEpochKeys{
+				Threshold: keys.Threshold,
+				N:         keys.N,
+				PublicMap: (&keys.PublicMap).Serialize(),
+			}
+		}
+	}
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	if len(c.SignPublicKeys) > 0 {
+		scc.SignPublicKeys, _ = (&c.SignPublicKeys).Serialize()
+	}
+	if c.SignKey != nil {
+		scc.SignKey, _ = MarshalSigner(c.SignKey)
+	}
+	scc.SignKeyVersion = c.SignKeyVersion
+	if len(c.KeyVersions) > 0 {
+		scc.KeyVersions, _ = serializeKeyVersions(c.KeyVersions)
+	}
+	if len(c.NextKeyHashes) > 0 {
+		scc.NextKeyHashes = make(map[string][]byte)
+		for id, hash := range c.NextKeyHashes {
+			scc.NextKeyHashes[id.String()] = hash
+		}
+	}
+	if c.NextSignKey != nil {
+		scc.NextSignKey, _ = MarshalSigner(c.NextSignKey)
+	}
 	return scc
 }
 
@@ -148,11 +229,71 @@ func NewCryptoConfig(scc *StoredCryptoConfig) (*CryptoConfig, error) {
 	if err != nil {
 		return c, err
 	}
-	err = (&c.ThresholdSecretKey).Deserialize(scc.ThresholdSecretKey)
+	err = loadThresholdEpochs(c, scc)
 	if err != nil {
 		return c, err
 	}
-	return c, nil
+	// Entities other than gossipers, and gossipers waiting for a DKG, have no threshold secret key.
+	if len(scc.ThresholdSecretKey) > 0 {
+		err = (&c.ThresholdSecretKey).Deserialize(scc.ThresholdSecretKey)
+		if err != nil {
+			return c, err
+		}
+	}
+	err = loadSignKeys(c, scc, true)
+	return c, err
+}
+
+// Fills in the epoch and the public keys of the earlier epochs of the threshold keys.
+func loadThresholdEpochs(c *CryptoConfig, scc *StoredCryptoConfig) error {
+	c.ThresholdEpoch = scc.ThresholdEpoch
+	c.PastThresholdKeys = make(map[int]ThresholdEpochKeys)
+	for epoch, stored := range scc.PastThresholdKeys {
+		keys := ThresholdEpochKeys{
+			Threshold: stored.Threshold,
+			N:         stored.N,
+			PublicMap: make(BlsPublicMap),
+		}
+		err := (&keys.PublicMap).Deserialize(stored.PublicMap)
+		if err != nil {
+			return err
+		}
+		c.PastThresholdKeys[epoch] = keys
+	}
+	return nil
+}
+
+// Fills in the keys of the non-RSA sign schemes, the key versions and the key commitments, if the stored config has any.
+func loadSignKeys(c *CryptoConfig, scc *StoredCryptoConfig, withSecret bool) error {
+	c.SignPublicKeys = make(SignPublicKeyMap)
+	err := (&c.SignPublicKeys).Deserialize(scc.SignPublicKeys)
+	if err != nil {
+		return err
+	}
+	c.KeyVersions, err = deserializeKeyVersions(scc.KeyVersions)
+	if err != nil {
+		return err
+	}
+	c.NextKeyHashes = make(map[CTngID][]byte)
+	for id, hash := range scc.NextKeyHashes {
+		c.NextKeyHashes[CTngID(id)] = hash
+	}
+	if withSecret {
+		c.SignKeyVersion = scc.SignKeyVersion
+	}
+	if withSecret && len(scc.SignKey) > 0 {
+		c.SignKey, err = ParseSigner(scc.SignKey)
+		if err != nil {
+			return err
+		}
+	}
+	if withSecret && len(scc.NextSignKey) > 0 {
+		c.NextSignKey, err = ParseSigner(scc.NextSignKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func NewVerifyOnlyCryptoConfig(scc *StoredCryptoConfig) (*CryptoConfig, error) {
@@ -171,7 +312,12 @@ func NewVerifyOnlyCryptoConfig(scc *StoredCryptoConfig) (*CryptoConfig, error) {
 	if err != nil {
 		return c, err
 	}
-	return c, nil
+	err = loadThresholdEpochs(c, scc)
+	if err != nil {
+		return c, err
+	}
+	err = loadSignKeys(c, scc, false)
+	return c, err
 }
 
 // Creates a cryptoconfig from a stored one. This is used for reading a stored file cryptoconfig.
@@ -189,5 +335,6 @@ func NewBasicCryptoConfig(scc *StoredCryptoConfig) (*CryptoConfig, error) {
 		SignPublicMap:      scc.SignPublicMap,
 		ThresholdPublicMap: nil,
 	}
-	return c, nil
+	err := loadSignKeys(c, scc, true)
+	return c, err
 }
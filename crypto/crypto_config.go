@@ -1,6 +1,11 @@
 package crypto
 
-import "errors"
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+)
 
 //import "fmt"
 
@@ -11,12 +16,14 @@ import "errors"
 
 type CryptoConfigInterface interface {
 	Hash([]byte) ([]byte, error)
-	Sign([]byte) (RSASig, error)
-	Verify([]byte, RSASig) error
+	Sign([]byte) (Signature, error)
+	Verify([]byte, Signature) error
+	VerifyForPeriod([]byte, Signature, int) error
 	ThresholdSign(string) (SigFragment, error)
 	ThresholdAggregate([]SigFragment) (ThresholdSig, error)
 	ThresholdVerify(string, ThresholdSig) error
 	FragmentVerify(string, SigFragment) error
+	ThresholdBatchVerify([]string, []ThresholdSig) error
 }
 
 // Hash a message using the configured hash scheme.
@@ -31,27 +38,70 @@ func (c *CryptoConfig) Hash(msg []byte) ([]byte, error) {
 
 // Sign a message using the configured "normal signature" scheme.
 // Note: This is not a threshold signature/threshold signature fragment.
-func (c *CryptoConfig) Sign(msg []byte) (RSASig, error) {
-	if c.SignScheme == "rsa" {
-		return RSASign(msg, &c.SignSecretKey, c.SelfID)
+func (c *CryptoConfig) Sign(msg []byte) (Signature, error) {
+	c.keyLock.RLock()
+	key, scheme, version := c.SignKey, c.SignScheme, c.SignKeyVersion
+	c.keyLock.RUnlock()
+	if key != nil {
+		if key.Scheme() != scheme {
+			return Signature{}, errors.New("Sign Scheme does not match the configured key")
+		}
+		sig, err := key.Sign(msg)
+		return Signature{Scheme: scheme, Sig: sig, ID: c.SelfID, Version: version}, err
+	}
+	if scheme == RSA_SCHEME {
+		sig, err := RSASign(msg, &c.SignSecretKey, c.SelfID)
+		signature := sig.Signature()
+		signature.Version = version
+		return signature, err
+	}
+	return Signature{}, errors.New("Sign Scheme not supported")
+}
+
+// Verify a message using the stored public key of the signer.
+// The scheme is taken from the signature, so entities using different schemes can verify each other.
+// Without a period to check against, only the signer's current key version is accepted;
+// use VerifyForPeriod for anything signed for a period.
+func (c *CryptoConfig) Verify(msg []byte, sig Signature) error {
+	versions, err := c.KeyHistory(sig.ID)
+	if err != nil {
+		return err
+	}
+	current := versions[len(versions)-1]
+	if sig.Version != current.Version {
+		return fmt.Errorf("Key version %d of %s is not the current one", sig.Version, sig.ID.String())
 	}
-	return RSASig{}, errors.New("Sign Scheme not supported")
+	return VerifyWithPublicKey(sig.Scheme, current.Public, msg, sig.Sig)
 }
 
-// Verify a message using the configured "normal signature" scheme, and the stored public keys.
-func (c *CryptoConfig) Verify(msg []byte, sig RSASig) error {
-	if c.SignScheme == "rsa" {
-		pub := c.SignPublicMap[sig.ID]
-		//fmt.Println("PublicKey Found: ",pub)
-		return RSAVerify(msg, sig, &pub)
+// Look up the "normal signature" public key of an entity.
+func (c *CryptoConfig) SignPublicKey(id CTngID) (crypto.PublicKey, error) {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.signPublicKey(id)
+}
+
+func (c *CryptoConfig) signPublicKey(id CTngID) (crypto.PublicKey, error) {
+	if pub, ok := c.SignPublicKeys[id]; ok {
+		return pub, nil
+	}
+	if pub, ok := c.SignPublicMap[id]; ok {
+		return &pub, nil
 	}
-	return errors.New("Sign Scheme not supported")
+	return nil, errors.New("No public key found for " + id.String())
 }
 
 // Sign a message to make a keyfragment using the configured "threshold signature" scheme.
 func (c *CryptoConfig) ThresholdSign(msg string) (SigFragment, error) {
 	if c.ThresholdScheme == "bls" {
-		return ThresholdSign(msg, &c.ThresholdSecretKey, c.SelfID), nil
+		c.thresholdLock.RLock()
+		defer c.thresholdLock.RUnlock()
+		if c.ThresholdSecretKey.IsZero() {
+			return SigFragment{}, errors.New("No threshold secret key")
+		}
+		frag := ThresholdSign(msg, &c.ThresholdSecretKey, c.SelfID)
+		frag.Epoch = c.ThresholdEpoch
+		return frag, nil
 	}
 	// Other threshold schemes could go Here
 	return SigFragment{}, errors.New("Threshold Scheme not supported")
@@ -60,7 +110,10 @@ func (c *CryptoConfig) ThresholdSign(msg string) (SigFragment, error) {
 // Aggregate a list of threshold signature fragments to make a threshold signature.
 func (c *CryptoConfig) ThresholdAggregate(sigs []SigFragment) (ThresholdSig, error) {
 	if c.ThresholdScheme == "bls" {
-		sig, err := ThresholdAggregate(sigs, c.Threshold)
+		c.thresholdLock.RLock()
+		threshold := c.Threshold
+		c.thresholdLock.RUnlock()
+		sig, err := ThresholdAggregate(sigs, threshold)
 		if err != nil {
 			return ThresholdSig{}, err
 		} else {
@@ -70,11 +123,55 @@ func (c *CryptoConfig) ThresholdAggregate(sigs []SigFragment) (ThresholdSig, err
 	return ThresholdSig{}, errors.New("Threshold Scheme not supported")
 }
 
+// The threshold public keys signatures from the given epoch verify against.
+// The maps are replaced rather than modified by a DKG or resharing, so the returned one stays valid.
+func (c *CryptoConfig) ThresholdPublicMapOfEpoch(epoch int) (*BlsPublicMap, error) {
+	pubs, _, err := c.thresholdKeysOfEpoch(epoch)
+	return pubs, err
+}
+
+// The threshold public keys of the epoch and the number of signers a signature of that epoch needs.
+func (c *CryptoConfig) thresholdKeysOfEpoch(epoch int) (*BlsPublicMap, int, error) {
+	c.thresholdLock.RLock()
+	defer c.thresholdLock.RUnlock()
+	if epoch == c.ThresholdEpoch {
+		pubs := c.ThresholdPublicMap
+		return &pubs, c.Threshold, nil
+	}
+	if keys, ok := c.PastThresholdKeys[epoch]; ok {
+		return &keys.PublicMap, keys.Threshold, nil
+	}
+	return nil, 0, fmt.Errorf("No threshold public keys for epoch %d", epoch)
+}
+
+// The current threshold public keys.
+func (c *CryptoConfig) ThresholdPublicKeys() BlsPublicMap {
+	c.thresholdLock.RLock()
+	defer c.thresholdLock.RUnlock()
+	return c.ThresholdPublicMap
+}
+
+// True once the entity holds a threshold key share it can sign fragments with.
+func (c *CryptoConfig) HasThresholdSecretKey() bool {
+	c.thresholdLock.RLock()
+	defer c.thresholdLock.RUnlock()
+	return !c.ThresholdSecretKey.IsZero()
+}
+
 // Verify a threshold signature using the configured "threshold signature" scheme, and the stored public keys.
 // Uses the keys stored in the CryptoConfig struct to verify the signature.
+// Signatures from earlier epochs are verified with the public keys and the threshold of their epoch.
 func (c *CryptoConfig) ThresholdVerify(msg string, sig ThresholdSig) error {
 	if c.ThresholdScheme == "bls" {
-		if sig.Verify(msg, &c.ThresholdPublicMap) {
+		pubs, threshold, err := c.thresholdKeysOfEpoch(sig.Epoch)
+		if err != nil {
+			return err
+		}
+		err = CheckSigners(sig.IDs, threshold, pubs)
+		if err != nil {
+			return err
+		}
+		if sig.Verify(msg, pubs, threshold) {
 			return nil
 		} else {
 			return errors.New("Threshold Signature Verification Failed")
@@ -87,7 +184,11 @@ func (c *CryptoConfig) ThresholdVerify(msg string, sig ThresholdSig) error {
 // Uses the keys stored in the CryptoConfig struct to verify the signature.
 func (c *CryptoConfig) FragmentVerify(msg string, sig SigFragment) error {
 	if c.ThresholdScheme == "bls" {
-		if sig.Verify(msg, &c.ThresholdPublicMap) {
+		pubs, err := c.ThresholdPublicMapOfEpoch(sig.Epoch)
+		if err != nil {
+			return err
+		}
+		if sig.Verify(msg, pubs) {
 			return nil
 		} else {
 			return errors.New("Signature Fragment Verification Failed")
@@ -95,3 +196,82 @@ func (c *CryptoConfig) FragmentVerify(msg string, sig SigFragment) error {
 	}
 	return errors.New("Threshold Scheme not supported")
 }
+
+// Verify a batch of threshold signatures using the configured "threshold signature" scheme.
+// Returns nil if every signature is valid. Otherwise the batch is split in halves until the invalid
+// signatures are found, and their indices are returned in a *BatchVerifyError.
+func (c *CryptoConfig) ThresholdBatchVerify(msgs []string, sigs []ThresholdSig) error {
+	if c.ThresholdScheme != "bls" {
+		return errors.New("Threshold Scheme not supported")
+	}
+	if len(msgs) != len(sigs) {
+		return errors.New("Batch has a different number of messages and signatures")
+	}
+	if len(sigs) == 0 {
+		return nil
+	}
+	// One batch per epoch, as every epoch has its own public keys.
+	batches := make(map[int][]int)
+	epochs := []int{}
+	for i := range sigs {
+		if _, ok := batches[sigs[i].Epoch]; !ok {
+			epochs = append(epochs, sigs[i].Epoch)
+		}
+		batches[sigs[i].Epoch] = append(batches[sigs[i].Epoch], i)
+	}
+	failed := []int{}
+	for _, epoch := range epochs {
+		indices := batches[epoch]
+		pubs, threshold, err := c.thresholdKeysOfEpoch(epoch)
+		if err != nil {
+			failed = append(failed, indices...)
+			continue
+		}
+		// Signatures with too few, repeated or unknown signers fail without entering the batch.
+		checked := []int{}
+		for _, i := range indices {
+			if CheckSigners(sigs[i].IDs, threshold, pubs) != nil {
+				failed = append(failed, i)
+			} else {
+				checked = append(checked, i)
+			}
+		}
+		if len(checked) == 0 {
+			continue
+		}
+		batchMsgs := make([]string, len(checked))
+		batchSigs := make([]ThresholdSig, len(checked))
+		for j, i := range checked {
+			batchMsgs[j], batchSigs[j] = msgs[i], sigs[i]
+		}
+		failed = append(failed, findInvalidThresholdSigs(batchMsgs, batchSigs, checked, pubs, threshold)...)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Ints(failed)
+	return &BatchVerifyError{Failed: failed}
+}
+
+// Bisection fallback of ThresholdBatchVerify: a single batch check per half,
+// so a few bad signatures among many good ones cost O(bad * log n) batch checks.
+func findInvalidThresholdSigs(msgs []string, sigs []ThresholdSig, indices []int, pubs *BlsPublicMap, threshold int) []int {
+	if ThresholdBatchVerify(msgs, sigs, pubs, threshold) {
+		return nil
+	}
+	if len(sigs) == 1 {
+		return indices
+	}
+	mid := len(sigs) / 2
+	failed := findInvalidThresholdSigs(msgs[:mid], sigs[:mid], indices[:mid], pubs, threshold)
+	return append(failed, findInvalidThresholdSigs(msgs[mid:], sigs[mid:], indices[mid:], pubs, threshold)...)
+}
+
+// Returned by ThresholdBatchVerify, Failed holds the indices of the invalid signatures in the batch.
+type BatchVerifyError struct {
+	Failed []int
+}
+
+func (e *BatchVerifyError) Error() string {
+	return fmt.Sprintf("Threshold Signature Verification Failed for %d signature(s) in the batch: %v", len(e.Failed), e.Failed)
+}
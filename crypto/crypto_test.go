@@ -1,11 +1,20 @@
 package crypto
 
 import (
+	"CTngV2/util"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/rand" // for list shuffling
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/herumi/bls-go-binary/bls"
 )
 
 // For randomized signature aggregation testing
@@ -125,18 +134,18 @@ func testBLSFunctionality(T *testing.T) {
 		//Aggregate first, then confirm the aggregates verify'
 		agg, err := ThresholdAggregate(sigs[l:r], threshold)
 		confirmNil(T, err)
-		if agg.Verify(data, &pubs) == false {
+		if agg.Verify(data, &pubs, threshold) == false {
 			T.Errorf("Aggregate failed to verify!")
 		}
 		fmt.Println(agg)
 		// Provide an incorrect signer and confirm that the aggregate fails to verify
 		agg.IDs[0] = sigs[r%n].ID
-		if agg.Verify(data, &pubs) != false {
+		if agg.Verify(data, &pubs, threshold) != false {
 			T.Errorf("Aggregate verified with incorrect signer!")
 		}
 		// Remove a signer and confirm that the aggregate fails to verify
 		agg.IDs = agg.IDs[1:]
-		if agg.Verify(data, &pubs) != false {
+		if agg.Verify(data, &pubs, threshold) != false {
 			T.Errorf("Aggregate verified with insufficient signers!")
 		}
 	}
@@ -193,7 +202,7 @@ func testBLSFunctionality2(T *testing.T) {
 	for l := threshold; l < n; l++ {
 		agg, err := ThresholdAggregate(sigs[0:l], threshold)
 		confirmNil(T, err)
-		if agg.Verify(data, &pubs) == false {
+		if agg.Verify(data, &pubs, threshold) == false {
 			T.Errorf("Aggregate failed to verify!")
 		}
 		fmt.Println(agg)
@@ -305,3 +314,630 @@ func TestMerkleTree(t *testing.T) {
 		fmt.Println(ok)
 	}
 }
+
+// Every sign scheme should sign and verify through the CryptoConfig,
+// and survive a round trip through the stored config format.
+func TestSignSchemes(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	msg := []byte("Test message")
+	for _, scheme := range []string{RSA_SCHEME, ED25519_SCHEME, ECDSA_P256_SCHEME} {
+		configs, err := GenerateEntityCryptoConfigsWithScheme(entities, 2, scheme)
+		confirmNil(t, err)
+		sig, err := configs[0].Sign(msg)
+		confirmNil(t, err)
+		if sig.Scheme != scheme {
+			t.Errorf("%s: signature tagged with scheme %s", scheme, sig.Scheme)
+		}
+		// Convert to and from the string form carried in gossip objects
+		sig, err = SignatureFromString(sig.String())
+		confirmNil(t, err)
+		confirmNil(t, configs[1].Verify(msg, sig))
+		if configs[1].Verify([]byte("Incorrect Information"), sig) == nil {
+			t.Errorf("%s: signature verified incorrect data", scheme)
+		}
+		// A signature claiming another scheme must not verify against the signer's key
+		forged := sig
+		forged.Scheme = RSA_SCHEME
+		if scheme != RSA_SCHEME && configs[1].Verify(msg, forged) == nil {
+			t.Errorf("%s: signature verified under the wrong scheme", scheme)
+		}
+		// Store and reload the signer's config
+		stored, err := json.Marshal(NewStoredCryptoConfig(&configs[0]))
+		confirmNil(t, err)
+		scc := new(StoredCryptoConfig)
+		confirmNil(t, json.Unmarshal(stored, scc))
+		reloaded, err := NewCryptoConfig(scc)
+		confirmNil(t, err)
+		sig, err = reloaded.Sign(msg)
+		confirmNil(t, err)
+		confirmNil(t, configs[2].Verify(msg, sig))
+	}
+}
+
+// Signatures written before the scheme tag existed are read as RSA.
+func TestLegacyRSASignature(t *testing.T) {
+	configs, err := GenerateEntityCryptoConfigs([]CTngID{"a", "b"}, 2)
+	confirmNil(t, err)
+	msg := []byte("Test message")
+	rsasig, err := RSASign(msg, &configs[0].SignSecretKey, configs[0].SelfID)
+	confirmNil(t, err)
+	sig, err := SignatureFromString(rsasig.String())
+	confirmNil(t, err)
+	if sig.Scheme != RSA_SCHEME {
+		t.Errorf("Legacy signature read with scheme %s", sig.Scheme)
+	}
+	confirmNil(t, configs[1].Verify(msg, sig))
+}
+
+// Batch verification must accept a batch of valid threshold signatures,
+// and the fallback must point at exactly the invalid ones.
+func TestThresholdBatchVerify(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082", "localhost:8083"}
+	threshold := 2
+	configs, err := GenerateEntityCryptoConfigs(entities, threshold)
+	confirmNil(t, err)
+	n := 9
+	msgs := make([]string, n)
+	sigs := make([]ThresholdSig, n)
+	for i := 0; i < n; i++ {
+		msgs[i] = fmt.Sprintf("Test information for signing %d", i)
+		// Rotate the signers so the aggregated public keys differ across the batch
+		frags := make([]SigFragment, threshold)
+		for j := 0; j < threshold; j++ {
+			frags[j], err = configs[(i+j)%len(configs)].ThresholdSign(msgs[i])
+			confirmNil(t, err)
+		}
+		sigs[i], err = configs[0].ThresholdAggregate(frags)
+		confirmNil(t, err)
+	}
+	confirmNil(t, configs[1].ThresholdBatchVerify(msgs, sigs))
+
+	// Swap in a wrong message and a wrong signer list
+	msgs[2] = "Incorrect Information"
+	sigs[7].IDs = []CTngID{entities[1], entities[2]}
+	err = configs[1].ThresholdBatchVerify(msgs, sigs)
+	batchErr, ok := err.(*BatchVerifyError)
+	if !ok {
+		t.Fatalf("Expected a BatchVerifyError, got %v", err)
+	}
+	if len(batchErr.Failed) != 2 || batchErr.Failed[0] != 2 || batchErr.Failed[1] != 7 {
+		t.Errorf("Expected signatures 2 and 7 to fail, got %v", batchErr.Failed)
+	}
+	// The fallback agrees with verifying one at a time
+	for i := 0; i < n; i++ {
+		single := configs[1].ThresholdVerify(msgs[i], sigs[i]) == nil
+		if single == (i == 2 || i == 7) {
+			t.Errorf("Signature %d: batch and single verification disagree", i)
+		}
+	}
+}
+
+// A threshold signature needs threshold distinct signers from the public map:
+// one gossiper must not pass off its own fragment as a threshold signature.
+func TestThresholdSigners(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082", "localhost:8083"}
+	configs, err := GenerateEntityCryptoConfigs(entities, 2)
+	confirmNil(t, err)
+	msg := "Test information for signing"
+	frag, err := configs[0].ThresholdSign(msg)
+	confirmNil(t, err)
+	other, err := configs[1].ThresholdSign(msg)
+	confirmNil(t, err)
+	valid, err := configs[0].ThresholdAggregate([]SigFragment{frag, other})
+	confirmNil(t, err)
+	confirmNil(t, configs[2].ThresholdVerify(msg, valid))
+
+	forged := map[string]ThresholdSig{
+		// the fragment alone is a valid signature under the share of its signer
+		"short ID list": {IDs: []CTngID{entities[0]}, Sign: frag.Sign},
+		"duplicate IDs": {IDs: []CTngID{entities[0], entities[0]}, Sign: frag.Sign},
+		"unknown ID":    {IDs: []CTngID{entities[0], "localhost:9999"}, Sign: valid.Sign},
+	}
+	for name, sig := range forged {
+		if configs[2].ThresholdVerify(msg, sig) == nil {
+			t.Errorf("%s: verified", name)
+		}
+		err = configs[2].ThresholdBatchVerify([]string{msg, msg}, []ThresholdSig{valid, sig})
+		batchErr, ok := err.(*BatchVerifyError)
+		if !ok || len(batchErr.Failed) != 1 || batchErr.Failed[0] != 1 {
+			t.Errorf("%s: expected only signature 1 to fail the batch, got %v", name, err)
+		}
+		if ThresholdBatchVerify([]string{msg}, []ThresholdSig{sig}, &configs[2].ThresholdPublicMap, 2) {
+			t.Errorf("%s: verified in a batch", name)
+		}
+	}
+}
+
+// Run a DKG in process: every participant deals to everyone, exchanges statuses and finalizes.
+// One dealer sends a bad share and answers the complaint, it stays qualified.
+// Another withholds a deal and ignores the complaint, it is disqualified without stopping the others.
+func TestDKG(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082", "localhost:8083"}
+	threshold := 2
+	configs, err := GenerateEntityCryptoConfigs(entities, threshold)
+	confirmNil(t, err)
+	participants := make([]*DKGParticipant, len(entities))
+	for i := range entities {
+		participants[i], err = NewDKGParticipant(&configs[i], entities, threshold)
+		confirmNil(t, err)
+	}
+	cheater, silent := 3, 2
+	for i, dealer := range participants {
+		for j, recipient := range participants {
+			deal, err := dealer.Deal(entities[j])
+			confirmNil(t, err)
+			if i == silent && j == 1 {
+				continue
+			}
+			if i == cheater && j == 0 {
+				// Deal someone else's share, correctly signed
+				other, err := dealer.Deal(entities[1])
+				confirmNil(t, err)
+				deal.Share = other.Share
+				sig, err := configs[i].Sign(deal.message())
+				confirmNil(t, err)
+				deal.Signature = sig.String()
+				if recipient.ProcessDeal(deal) == nil {
+					t.Errorf("Bad share was accepted")
+				}
+				continue
+			}
+			confirmNil(t, recipient.ProcessDeal(deal))
+		}
+	}
+	for _, p := range participants {
+		status, err := p.Status()
+		confirmNil(t, err)
+		for _, q := range participants {
+			confirmNil(t, q.ProcessStatus(status))
+		}
+		for i, dealer := range participants {
+			responses, err := dealer.Respond(status)
+			confirmNil(t, err)
+			if i == silent {
+				continue
+			}
+			for _, response := range responses {
+				for _, q := range participants {
+					confirmNil(t, q.ProcessResponse(response))
+				}
+			}
+		}
+	}
+	// Complaints are only answered in signed statuses
+	if _, err := participants[silent].Respond(DKGStatus{Participant: entities[1], Complaints: []CTngID{entities[silent]}}); err == nil {
+		t.Errorf("Answered an unsigned status")
+	}
+	for i, p := range participants {
+		if len(p.Qualified()) != len(entities)-1 || isMember(p.Qualified(), entities[silent]) {
+			t.Errorf("Participant %d qualified %v", i, p.Qualified())
+		}
+		if _, _, _, err := p.Finalize(); err == nil {
+			t.Errorf("Finalized before agreeing on the qualified dealers")
+		}
+	}
+	// One participant announcing a different set is outvoted
+	for i, p := range participants {
+		announcement, err := p.Announce()
+		confirmNil(t, err)
+		if i == cheater {
+			announcement.Qualified = entities
+			sig, err := configs[i].Sign(announcement.message())
+			confirmNil(t, err)
+			announcement.Signature = sig.String()
+		}
+		for _, q := range participants {
+			confirmNil(t, q.ProcessQualified(announcement))
+		}
+	}
+	var pubMaps []BlsPublicMap
+	frags := make([]SigFragment, 0)
+	msg := "Test information for signing"
+	for i, p := range participants {
+		pubs, secret, _, err := p.Finalize()
+		confirmNil(t, err)
+		configs[i].InstallThresholdKeys(pubs, secret, threshold)
+		pubMaps = append(pubMaps, pubs)
+		frag, err := configs[i].ThresholdSign(msg)
+		confirmNil(t, err)
+		frags = append(frags, frag)
+	}
+	// Everyone derived the same public shares
+	for _, id := range entities {
+		for i := range pubMaps {
+			a, b := pubMaps[0][id], pubMaps[i][id]
+			if !a.IsEqual(&b) {
+				t.Errorf("Participants disagree on the public share of %s", id)
+			}
+		}
+	}
+	agg, err := configs[0].ThresholdAggregate(frags[1:3])
+	confirmNil(t, err)
+	confirmNil(t, configs[3].ThresholdVerify(msg, agg))
+	// Any threshold of the new shares recovers the same group secret
+	var group1, group2 bls.SecretKey
+	confirmNil(t, group1.Recover([]bls.SecretKey{configs[0].ThresholdSecretKey, configs[1].ThresholdSecretKey}, []bls.ID{*entities[0].BlsID(), *entities[1].BlsID()}))
+	confirmNil(t, group2.Recover([]bls.SecretKey{configs[2].ThresholdSecretKey, configs[3].ThresholdSecretKey}, []bls.ID{*entities[2].BlsID(), *entities[3].BlsID()}))
+	if !group1.IsEqual(&group2) {
+		t.Errorf("Shares do not lie on one polynomial")
+	}
+}
+
+func TestReshare(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082", "localhost:8083", "localhost:8084"}
+	configs, err := GenerateEntityCryptoConfigs(entities, 2)
+	confirmNil(t, err)
+	// 8080-8082 hand over to 8081-8084 with threshold 3; 8083 and 8084 are joining.
+	old, joining := entities[:3], entities[1:]
+	configs[3].ThresholdSecretKey = bls.SecretKey{}
+	configs[4].ThresholdSecretKey = bls.SecretKey{}
+	msg := "Test information for signing"
+	frags := make([]SigFragment, 2)
+	for i := range frags {
+		frags[i], err = configs[i].ThresholdSign(msg)
+		confirmNil(t, err)
+	}
+	oldSig, err := configs[0].ThresholdAggregate(frags)
+	confirmNil(t, err)
+	oldGroup := recoverGroupKey(t, configs[0].ThresholdPublicMap, entities[:2])
+	if otherGroup := recoverGroupKey(t, configs[0].ThresholdPublicMap, entities[3:]); !otherGroup.IsEqual(&oldGroup) {
+		t.Errorf("Gen dealt shares that are not on one polynomial")
+	}
+	// Keys dealt as coefficients rather than shares are not reshared
+	var coefficient bls.SecretKey
+	coefficient.SetByCSPRNG()
+	legacy := CryptoConfig{SelfID: entities[1], Threshold: 2, ThresholdPublicMap: BlsPublicMap{}}
+	for id, pub := range configs[0].ThresholdPublicMap {
+		legacy.ThresholdPublicMap[id] = pub
+	}
+	legacy.ThresholdPublicMap[entities[0]] = *coefficient.GetPublicKey()
+	if _, err := NewReshareParticipant(&legacy, old, joining, 3); err == nil {
+		t.Errorf("Reshared keys that are not on one polynomial")
+	}
+
+	participants := make([]*DKGParticipant, len(joining))
+	for i := range joining {
+		participants[i], err = NewReshareParticipant(&configs[i+1], old, joining, 3)
+		confirmNil(t, err)
+	}
+	cheater := 2
+	for i := range old {
+		dealer, err := NewReshareDealer(&configs[i], 3)
+		confirmNil(t, err)
+		if i == cheater {
+			// A dealer making up a new secret instead of resharing its own
+			var secret bls.SecretKey
+			secret.SetByCSPRNG()
+			dealer.poly = secret.GetMasterSecretKey(3)
+			dealer.commitments = bls.GetMasterPublicKey(dealer.poly)
+		}
+		for j, recipient := range participants {
+			deal, err := dealer.Deal(joining[j])
+			confirmNil(t, err)
+			err = recipient.ProcessDeal(deal)
+			if (err == nil) == (i == cheater) {
+				t.Errorf("Deal from %s to %s: %v", old[i], joining[j], err)
+			}
+		}
+	}
+	for _, p := range participants {
+		status, err := p.Status()
+		confirmNil(t, err)
+		for _, q := range participants {
+			confirmNil(t, q.ProcessStatus(status))
+		}
+	}
+	for _, p := range participants {
+		announcement, err := p.Announce()
+		confirmNil(t, err)
+		for _, q := range participants {
+			confirmNil(t, q.ProcessQualified(announcement))
+		}
+	}
+	newFrags := make([]SigFragment, 0)
+	for i, p := range participants {
+		pubs, secret, group, err := p.Finalize()
+		confirmNil(t, err)
+		if !group.IsEqual(&oldGroup) {
+			t.Errorf("Resharing changed the group public key")
+		}
+		configs[i+1].AdvanceThresholdEpoch(pubs, secret, 3)
+		frag, err := configs[i+1].ThresholdSign(msg)
+		confirmNil(t, err)
+		newFrags = append(newFrags, frag)
+	}
+	newGroup := recoverGroupKey(t, configs[1].ThresholdPublicMap, joining[1:4])
+	if !newGroup.IsEqual(&oldGroup) {
+		t.Errorf("New public key shares do not interpolate to the group public key")
+	}
+	// Mixing fragments of two epochs fails
+	if _, err := configs[1].ThresholdAggregate([]SigFragment{frags[0], newFrags[0], newFrags[1]}); err == nil {
+		t.Errorf("Aggregated fragments from different epochs")
+	}
+	newSig, err := configs[1].ThresholdAggregate(newFrags[1:])
+	confirmNil(t, err)
+	if newSig.Epoch != 1 {
+		t.Errorf("Expected epoch 1, got %d", newSig.Epoch)
+	}
+	// A verifier only learns the new public map, and still verifies the old signatures after a round trip
+	verifier := &configs[0]
+	verifier.AdvanceThresholdEpoch(configs[1].ThresholdPublicMap, bls.SecretKey{}, 3)
+	stored, err := NewCryptoConfig(NewStoredCryptoConfig(verifier))
+	confirmNil(t, err)
+	for _, sig := range []ThresholdSig{oldSig, newSig} {
+		str, err := sig.String()
+		confirmNil(t, err)
+		parsed, err := ThresholdSigFromString(str)
+		confirmNil(t, err)
+		confirmNil(t, stored.ThresholdVerify(msg, parsed))
+	}
+	confirmNil(t, stored.ThresholdBatchVerify([]string{msg, msg}, []ThresholdSig{oldSig, newSig}))
+	// Old shares don't sign for the new epoch
+	stale := newSig
+	stale.Epoch = 0
+	if stored.ThresholdVerify(msg, stale) == nil {
+		t.Errorf("New signature verified against the old epoch")
+	}
+	unknown := newSig
+	unknown.Epoch = 7
+	if stored.ThresholdVerify(msg, unknown) == nil {
+		t.Errorf("Signature from an unknown epoch verified")
+	}
+}
+
+func recoverGroupKey(t *testing.T, pubs BlsPublicMap, signers []CTngID) bls.PublicKey {
+	keys := make([]bls.PublicKey, len(signers))
+	ids := make([]bls.ID, len(signers))
+	for i, id := range signers {
+		keys[i] = pubs[id]
+		ids[i] = *id.BlsID()
+	}
+	var group bls.PublicKey
+	confirmNil(t, group.Recover(keys, ids))
+	return group
+}
+
+func TestKeyStore(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081"}
+	configs, err := GenerateEntityCryptoConfigsWithScheme(entities, 2, ED25519_SCHEME)
+	confirmNil(t, err)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "crypto_config.json")
+	confirmNil(t, SaveCryptoConfigWithKeyStore(file, &configs[0], "keystore.json", "correct horse"))
+	// No private key is left in the config file
+	stored, err := os.ReadFile(file)
+	confirmNil(t, err)
+	share := hex.EncodeToString(configs[0].ThresholdSecretKey.Serialize())
+	if strings.Contains(hex.EncodeToString(stored), share) || strings.Contains(string(stored), configs[0].SignSecretKey.D.String()) {
+		t.Errorf("Private keys were written to the crypto config")
+	}
+	t.Setenv(util.PASSPHRASE_ENV, "battery staple")
+	if _, err := ReadCryptoConfig(file); err == nil {
+		t.Errorf("Key store opened with the wrong passphrase")
+	}
+	t.Setenv(util.PASSPHRASE_ENV, "correct horse")
+	c, err := ReadCryptoConfig(file)
+	confirmNil(t, err)
+	msg := []byte("Test information for signing")
+	sig, err := c.Sign(msg)
+	confirmNil(t, err)
+	confirmNil(t, configs[1].Verify(msg, sig))
+	rsaSig, err := RSASign(msg, &c.SignSecretKey, c.SelfID)
+	confirmNil(t, err)
+	rsaPub := configs[1].SignPublicMap[c.SelfID]
+	confirmNil(t, RSAVerify(msg, rsaSig, &rsaPub))
+	if !c.ThresholdSecretKey.IsEqual(&configs[0].ThresholdSecretKey) {
+		t.Errorf("Threshold key share was not restored")
+	}
+	if c.CommittedSignKey() == nil {
+		t.Errorf("The key committed for the next rotation was not restored")
+	}
+	// The keys of a DKG go to the key store as well, the config keeps naming it
+	other, err := GenerateEntityCryptoConfigs(entities, 2)
+	confirmNil(t, err)
+	c.InstallThresholdKeys(other[0].ThresholdPublicMap, other[0].ThresholdSecretKey, 2)
+	confirmNil(t, SaveThresholdKeys(file, c))
+	stored, err = os.ReadFile(file)
+	confirmNil(t, err)
+	if strings.Contains(hex.EncodeToString(stored), hex.EncodeToString(other[0].ThresholdSecretKey.Serialize())) {
+		t.Errorf("The new threshold key share was written to the crypto config")
+	}
+	c, err = ReadCryptoConfig(file)
+	confirmNil(t, err)
+	if !c.ThresholdSecretKey.IsEqual(&other[0].ThresholdSecretKey) {
+		t.Errorf("The new threshold key share was not stored")
+	}
+	if c.SignKey == nil {
+		t.Errorf("Saving the threshold keys lost the sign key")
+	}
+}
+
+func TestSoftToken(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081"}
+	configs, err := GenerateEntityCryptoConfigs(entities, 2)
+	confirmNil(t, err)
+	token := NewSoftToken(filepath.Join(t.TempDir(), "token.json"))
+	if _, err := token.FindObjects("signing key"); err != ErrNotLoggedIn {
+		t.Errorf("Token usable without login")
+	}
+	confirmNil(t, token.Login("1234"))
+	signer, err := NewSigner(ECDSA_P256_SCHEME)
+	confirmNil(t, err)
+	priv, err := MarshalSigner(signer)
+	confirmNil(t, err)
+	key, err := x509.ParsePKCS8PrivateKey(priv)
+	confirmNil(t, err)
+	_, err = token.ImportKey("signing key", key)
+	confirmNil(t, err)
+	confirmNil(t, token.Logout())
+	// The key survives a new session
+	confirmNil(t, token.Login("1234"))
+	confirmNil(t, configs[0].UseToken(token, "signing key"))
+	configs[1].SignPublicKeys[configs[0].SelfID] = signer.Public()
+	msg := []byte("Test information for signing")
+	sig, err := configs[0].Sign(msg)
+	confirmNil(t, err)
+	if sig.Scheme != ECDSA_P256_SCHEME {
+		t.Errorf("Expected an %s signature, got %s", ECDSA_P256_SCHEME, sig.Scheme)
+	}
+	confirmNil(t, configs[1].Verify(msg, sig))
+	handles, err := token.FindObjects("signing key")
+	confirmNil(t, err)
+	if _, err := token.Sign(handles[0], RSA_SCHEME, msg); err == nil {
+		t.Errorf("Token signed with the wrong mechanism")
+	}
+	confirmNil(t, token.Logout())
+	if _, err := configs[0].Sign(msg); err == nil {
+		t.Errorf("Signed after logout")
+	}
+}
+
+// Store and reload a config, so it does not share its key maps with the other generated configs.
+func reloadConfig(t *testing.T, c *CryptoConfig) *CryptoConfig {
+	stored, err := json.Marshal(NewStoredCryptoConfig(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scc := new(StoredCryptoConfig)
+	if err := json.Unmarshal(stored, scc); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewCryptoConfig(scc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloaded
+}
+
+func TestKeyRotation(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	configs, err := GenerateEntityCryptoConfigsWithScheme(entities, 2, ED25519_SCHEME)
+	confirmNil(t, err)
+	signer := reloadConfig(t, &configs[0])
+	verifier := reloadConfig(t, &configs[1])
+	msg := []byte("Test information for signing")
+	oldSig, err := signer.Sign(msg)
+	confirmNil(t, err)
+	confirmNil(t, verifier.VerifyForPeriod(msg, oldSig, 5))
+	// Only the key committed to with the configs can be announced
+	key := signer.CommittedSignKey()
+	if key == nil {
+		t.Fatal("No key committed for the first rotation")
+	}
+	next, err := NewSigner(ECDSA_P256_SCHEME)
+	confirmNil(t, err)
+	if _, err := signer.NewKeyRotation(next, next, 10); err == nil {
+		t.Errorf("Announced a key that was not committed to")
+	}
+	// Announce the committed key for period 10
+	rotation, err := signer.NewKeyRotation(key, next, 10)
+	confirmNil(t, err)
+	if rotation.Version != 1 {
+		t.Errorf("Expected key version 1, got %d", rotation.Version)
+	}
+	rotation, err = KeyRotationFromString(rotation.String())
+	confirmNil(t, err)
+	// Whoever holds the current key can not rotate to a key of their own
+	stolen := rotation
+	stolen.PublicKey, err = x509.MarshalPKIXPublicKey(next.Public())
+	confirmNil(t, err)
+	if verifier.ApplyKeyRotation(stolen) == nil {
+		t.Errorf("Applied a rotation to a key that was not committed to")
+	}
+	confirmNil(t, verifier.ApplyKeyRotation(rotation))
+	// Applying the same rotation again is a no-op
+	confirmNil(t, verifier.ApplyKeyRotation(rotation))
+	// The old key is only valid before period 10
+	confirmNil(t, verifier.VerifyForPeriod(msg, oldSig, 9))
+	if verifier.VerifyForPeriod(msg, oldSig, 10) == nil {
+		t.Errorf("Old key verified for a period after the rotation")
+	}
+	if verifier.Verify(msg, oldSig) == nil {
+		t.Errorf("Old key verified without a period")
+	}
+	// Sign with the new key
+	if signer.InstallSignKey(key, key, rotation) == nil {
+		t.Errorf("Installed a next key the rotation does not commit to")
+	}
+	confirmNil(t, signer.InstallSignKey(key, next, rotation))
+	newSig, err := signer.Sign(msg)
+	confirmNil(t, err)
+	newSig, err = SignatureFromString(newSig.String())
+	confirmNil(t, err)
+	if newSig.Version != 1 || newSig.Scheme != ED25519_SCHEME {
+		t.Errorf("Expected an %s signature with key version 1, got %s version %d", ED25519_SCHEME, newSig.Scheme, newSig.Version)
+	}
+	confirmNil(t, verifier.VerifyForPeriod(msg, newSig, 10))
+	confirmNil(t, verifier.Verify(msg, newSig))
+	if verifier.VerifyForPeriod(msg, newSig, 9) == nil {
+		t.Errorf("New key verified for a period before the rotation")
+	}
+	// The key history survives storing the config
+	reloaded := reloadConfig(t, verifier)
+	confirmNil(t, reloaded.VerifyForPeriod(msg, oldSig, 9))
+	confirmNil(t, reloaded.VerifyForPeriod(msg, newSig, 11))
+	// Versions can not be skipped, and a version can not be replaced
+	skipped := rotation
+	skipped.Version = 3
+	skipped.ValidFrom = 20
+	if verifier.ApplyKeyRotation(skipped) == nil {
+		t.Errorf("Applied a rotation skipping a key version")
+	}
+	replaced := rotation
+	replaced.ValidFrom = 12
+	if verifier.ApplyKeyRotation(replaced) == nil {
+		t.Errorf("Replaced an existing key version")
+	}
+	// The key committed to by the rotation is the one for the next rotation, also after reloading
+	signer = reloadConfig(t, signer)
+	if signer.CommittedSignKey() == nil || signer.CommittedSignKey().Scheme() != ECDSA_P256_SCHEME {
+		t.Fatal("The committed key was not kept")
+	}
+	last, err := NewSigner(ED25519_SCHEME)
+	confirmNil(t, err)
+	second, err := signer.NewKeyRotation(signer.CommittedSignKey(), last, 20)
+	confirmNil(t, err)
+	confirmNil(t, verifier.ApplyKeyRotation(second))
+}
+
+// Key rotations are applied while the entity verifies, signs and copies its key history.
+func TestKeyRotationConcurrent(t *testing.T) {
+	entities := []CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	configs, err := GenerateEntityCryptoConfigs(entities, 2)
+	confirmNil(t, err)
+	c := reloadConfig(t, &configs[0])
+	other := reloadConfig(t, &configs[1])
+	msg := []byte("Test information for signing")
+	sig, err := other.Sign(msg)
+	confirmNil(t, err)
+	rotations := 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rotations; i++ {
+			next, err := NewSigner(ED25519_SCHEME)
+			confirmNil(t, err)
+			rotation, err := other.NewKeyRotation(other.CommittedSignKey(), next, i*10)
+			confirmNil(t, err)
+			confirmNil(t, other.InstallSignKey(other.CommittedSignKey(), next, rotation))
+			confirmNil(t, c.ApplyKeyRotation(rotation))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			confirmNil(t, c.VerifyForPeriod(msg, sig, 5))
+			_, err := other.Sign(msg)
+			confirmNil(t, err)
+			c.CopyKeyHistory()
+			NewStoredCryptoConfig(c)
+		}
+	}()
+	wg.Wait()
+	versions, err := c.KeyHistory(other.SelfID)
+	confirmNil(t, err)
+	if len(versions) != rotations+1 {
+		t.Errorf("Expected %d key versions, got %d", rotations+1, len(versions))
+	}
+}
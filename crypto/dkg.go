@@ -0,0 +1,618 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/herumi/bls-go-binary/bls"
+)
+
+/*
+	Distributed key generation for the BLS threshold keys (Joint-Feldman / Pedersen DKG).
+
+	GenerateThresholdKeypairs uses a single dealer which learns every share.
+	Here every participant i acts as a dealer instead:
+	 1. i picks a random polynomial f_i of degree threshold-1 and publishes the
+	    Feldman commitments C_i = [f_i's coefficients]*G.
+	 2. i sends f_i(id_j) to every participant j, encrypted under j's RSA key.
+	 3. j checks f_i(id_j)*G == sum_k C_i[k]*id_j^k, and complains about i if it doesn't.
+	 4. Every participant broadcasts its complaints and a hash of the commitments it received,
+	    dealers with inconsistent commitments are disqualified.
+	 5. A dealer answers every complaint about it by broadcasting the complainer's share in the
+	    clear. Everyone checks it against the commitments, and the complainer takes it as its share.
+	    Dealers with an unanswered complaint or a bad answer are disqualified.
+	 6. Every participant broadcasts the dealers it found qualified. The statuses went point to point,
+	    so participants may disagree; the set announced by a majority of them is used by all.
+	 7. j's secret share is sum_i f_i(id_j) over the qualified dealers. Public shares are derived
+	    from the commitments alone, so everyone ends up with the same ThresholdPublicMap.
+	No single party ever holds the master secret sum_i f_i(0).
+*/
+
+// A deal from one dealer to one recipient.
+type DKGDeal struct {
+	Dealer      CTngID
+	Recipient   CTngID
+	Commitments []string // Feldman commitments, serialized bls.PublicKeys in hex
+	Share       []byte   // f_dealer(id_recipient), RSA-OAEP encrypted for the recipient
+	Epoch       int      // threshold key epoch the deal is for, 0 for a DKG
+	Signature   string   // dealer's signature over the rest of the deal
+}
+
+func (d *DKGDeal) message() []byte {
+	msg := strconv.Itoa(d.Epoch) + d.Dealer.String() + d.Recipient.String()
+	for _, commitment := range d.Commitments {
+		msg += commitment
+	}
+	return []byte(msg + hex.EncodeToString(d.Share))
+}
+
+// Broadcast by every participant once the deals are in.
+type DKGStatus struct {
+	Participant CTngID
+	Complaints  []CTngID          // dealers whose deal was missing or invalid
+	Commitments map[CTngID]string // hash of the commitments received from each dealer
+	Epoch       int
+	Signature   string
+}
+
+func (s *DKGStatus) message() []byte {
+	msg := strconv.Itoa(s.Epoch) + s.Participant.String()
+	complaints := append([]CTngID{}, s.Complaints...)
+	sort.Sort(CTngIDs(complaints))
+	for _, id := range complaints {
+		msg += "!" + id.String()
+	}
+	dealers := make([]CTngID, 0, len(s.Commitments))
+	for id := range s.Commitments {
+		dealers = append(dealers, id)
+	}
+	sort.Sort(CTngIDs(dealers))
+	for _, id := range dealers {
+		msg += id.String() + "=" + s.Commitments[id]
+	}
+	return []byte(msg)
+}
+
+// A dealer's answer to a complaint: the complainer's share in the clear, so everyone can check it.
+type DKGResponse struct {
+	Dealer      CTngID
+	Complainer  CTngID
+	Commitments []string
+	Share       string // f_dealer(id_complainer), serialized bls.SecretKey in hex
+	Epoch       int
+	Signature   string
+}
+
+func (r *DKGResponse) message() []byte {
+	msg := strconv.Itoa(r.Epoch) + r.Dealer.String() + r.Complainer.String()
+	for _, commitment := range r.Commitments {
+		msg += commitment
+	}
+	return []byte(msg + r.Share)
+}
+
+// Broadcast by every participant once the complaints are answered.
+type DKGQualified struct {
+	Participant CTngID
+	Qualified   []CTngID
+	Epoch       int
+	Signature   string
+}
+
+func (q *DKGQualified) message() []byte {
+	return []byte(strconv.Itoa(q.Epoch) + q.Participant.String() + qualifiedKey(q.Qualified))
+}
+
+func qualifiedKey(ids []CTngID) string {
+	sorted := append([]CTngID{}, ids...)
+	sort.Sort(CTngIDs(sorted))
+	key := ""
+	for _, id := range sorted {
+		key += "," + id.String()
+	}
+	return key
+}
+
+// The dealing side of a DKG or resharing run: a DKGParticipant, or a ReshareDealer.
+type DKGDealer interface {
+	Deal(recipient CTngID) (DKGDeal, error)
+	Respond(status DKGStatus) ([]DKGResponse, error)
+}
+
+type dkgReceived struct {
+	share       bls.SecretKey
+	commitments []bls.PublicKey
+	digest      string
+}
+
+// The state of one participant in a DKG or resharing run. Safe for concurrent use by HTTP handlers.
+type DKGParticipant struct {
+	SelfID       CTngID
+	Participants []CTngID // the recipients of the shares
+	Dealers      []CTngID // the same as Participants for a DKG, the old set for a resharing
+	Threshold    int
+	Epoch        int
+	config       *CryptoConfig // used for the RSA transport keys and signatures
+	poly         []bls.SecretKey
+	commitments  []bls.PublicKey
+	oldPublicMap BlsPublicMap // resharing only: the dealers' current public key shares
+	oldThreshold int
+	received     map[CTngID]dkgReceived
+	statuses     map[CTngID]DKGStatus
+	responses    map[CTngID]map[CTngID]string // dealer -> complainer -> digest of the answered commitments
+	qualified    map[CTngID]DKGQualified
+	lock         sync.Mutex
+}
+
+// Start a DKG run for the config's entity. participants must include config.SelfID.
+func NewDKGParticipant(config *CryptoConfig, participants []CTngID, threshold int) (*DKGParticipant, error) {
+	if threshold < 2 {
+		return nil, errors.New("Threshold must be greater than 1")
+	}
+	if threshold > len(participants) {
+		return nil, errors.New("Threshold is larger than the number of participants")
+	}
+	ids := append([]CTngID{}, participants...)
+	sort.Sort(CTngIDs(ids))
+	self := false
+	for _, id := range ids {
+		if id == config.SelfID {
+			self = true
+		}
+	}
+	if !self {
+		return nil, errors.New("The DKG participants must include " + config.SelfID.String())
+	}
+	p := &DKGParticipant{
+		SelfID:       config.SelfID,
+		Participants: ids,
+		Dealers:      ids,
+		Threshold:    threshold,
+		config:       config,
+		received:     make(map[CTngID]dkgReceived),
+		statuses:     make(map[CTngID]DKGStatus),
+		responses:    make(map[CTngID]map[CTngID]string),
+		qualified:    make(map[CTngID]DKGQualified),
+	}
+	var secret bls.SecretKey
+	secret.SetByCSPRNG()
+	p.poly = secret.GetMasterSecretKey(threshold)
+	p.commitments = bls.GetMasterPublicKey(p.poly)
+	return p, nil
+}
+
+// Build the signed deal for one recipient, including ourselves.
+func (p *DKGParticipant) Deal(recipient CTngID) (DKGDeal, error) {
+	if p.poly == nil {
+		return DKGDeal{}, errors.New("Only the old gossipers deal in a resharing, see ReshareDealer")
+	}
+	return makeDeal(p.config, p.poly, p.commitments, recipient, p.Epoch)
+}
+
+func makeDeal(config *CryptoConfig, poly []bls.SecretKey, commitments []bls.PublicKey, recipient CTngID, epoch int) (DKGDeal, error) {
+	var share bls.SecretKey
+	err := share.Set(poly, recipient.BlsID())
+	if err != nil {
+		return DKGDeal{}, err
+	}
+	pub, ok := config.SignPublicMap[recipient]
+	if !ok {
+		return DKGDeal{}, errors.New("No RSA transport key for " + recipient.String())
+	}
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &pub, share.Serialize(), []byte("CTng DKG"))
+	if err != nil {
+		return DKGDeal{}, err
+	}
+	deal := DKGDeal{
+		Dealer:      config.SelfID,
+		Recipient:   recipient,
+		Commitments: make([]string, len(commitments)),
+		Share:       encrypted,
+		Epoch:       epoch,
+	}
+	for i := range commitments {
+		deal.Commitments[i] = commitments[i].SerializeToHexStr()
+	}
+	sig, err := config.Sign(deal.message())
+	if err != nil {
+		return DKGDeal{}, err
+	}
+	deal.Signature = sig.String()
+	return deal, nil
+}
+
+// Check a deal addressed to us and store the share.
+// A dealer without a valid deal becomes a complaint in our status.
+func (p *DKGParticipant) ProcessDeal(deal DKGDeal) error {
+	if !isMember(p.Dealers, deal.Dealer) {
+		return errors.New(deal.Dealer.String() + " is not a DKG dealer")
+	}
+	if deal.Epoch != p.Epoch {
+		return fmt.Errorf("DKG deal is for epoch %d, expected %d", deal.Epoch, p.Epoch)
+	}
+	received, err := openDeal(p.config, deal, p.Threshold)
+	if err != nil {
+		return err
+	}
+	err = p.checkReshareCommitments(deal.Dealer, received.commitments)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.received[deal.Dealer] = received
+	p.lock.Unlock()
+	return nil
+}
+
+// A resharing dealer must deal its current share, or the group public key would change.
+func (p *DKGParticipant) checkReshareCommitments(dealer CTngID, commitments []bls.PublicKey) error {
+	if p.oldPublicMap == nil {
+		return nil
+	}
+	old, ok := p.oldPublicMap[dealer]
+	if !ok || !commitments[0].IsEqual(&old) {
+		return errors.New("Reshare deal from " + dealer.String() + " does not match its current public key share")
+	}
+	return nil
+}
+
+func parseCommitments(commitments []string, threshold int) ([]bls.PublicKey, string, error) {
+	if len(commitments) != threshold {
+		return nil, "", fmt.Errorf("DKG deal has %d commitments, expected %d", len(commitments), threshold)
+	}
+	parsed := make([]bls.PublicKey, threshold)
+	digest := sha256.New()
+	for i, commitment := range commitments {
+		err := parsed[i].DeserializeHexStr(commitment)
+		if err != nil {
+			return nil, "", err
+		}
+		digest.Write([]byte(commitment))
+	}
+	return parsed, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// Feldman check: the share for id must lie on the committed polynomial
+func checkShare(share *bls.SecretKey, commitments []bls.PublicKey, id CTngID) error {
+	var expected bls.PublicKey
+	err := expected.Set(commitments, id.BlsID())
+	if err != nil {
+		return err
+	}
+	if !share.GetPublicKey().IsEqual(&expected) {
+		return errors.New("DKG share for " + id.String() + " does not match the commitments")
+	}
+	return nil
+}
+
+func openDeal(config *CryptoConfig, deal DKGDeal, threshold int) (dkgReceived, error) {
+	if deal.Recipient != config.SelfID {
+		return dkgReceived{}, errors.New("DKG deal is addressed to " + deal.Recipient.String())
+	}
+	sig, err := SignatureFromString(deal.Signature)
+	if err != nil || sig.ID != deal.Dealer || config.Verify(deal.message(), sig) != nil {
+		return dkgReceived{}, errors.New("DKG deal signature verification failed")
+	}
+	var received dkgReceived
+	received.commitments, received.digest, err = parseCommitments(deal.Commitments, threshold)
+	if err != nil {
+		return dkgReceived{}, err
+	}
+	plain, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, &config.SignSecretKey, deal.Share, []byte("CTng DKG"))
+	if err != nil {
+		return dkgReceived{}, err
+	}
+	err = received.share.Deserialize(plain)
+	if err != nil {
+		return dkgReceived{}, err
+	}
+	err = checkShare(&received.share, received.commitments, config.SelfID)
+	if err != nil {
+		return dkgReceived{}, errors.New("DKG share from " + deal.Dealer.String() + " does not match its commitments")
+	}
+	return received, nil
+}
+
+// Our signed status: every dealer we have no valid deal from is a complaint.
+func (p *DKGParticipant) Status() (DKGStatus, error) {
+	p.lock.Lock()
+	status := DKGStatus{
+		Participant: p.SelfID,
+		Commitments: make(map[CTngID]string),
+		Epoch:       p.Epoch,
+	}
+	for _, dealer := range p.Dealers {
+		if received, ok := p.received[dealer]; ok {
+			status.Commitments[dealer] = received.digest
+		} else {
+			status.Complaints = append(status.Complaints, dealer)
+		}
+	}
+	p.lock.Unlock()
+	sig, err := p.config.Sign(status.message())
+	if err != nil {
+		return status, err
+	}
+	status.Signature = sig.String()
+	return status, nil
+}
+
+// Record the status broadcast by another participant (or ourselves).
+func (p *DKGParticipant) ProcessStatus(status DKGStatus) error {
+	if !isMember(p.Participants, status.Participant) {
+		return errors.New(status.Participant.String() + " is not a DKG participant")
+	}
+	if status.Epoch != p.Epoch {
+		return fmt.Errorf("DKG status is for epoch %d, expected %d", status.Epoch, p.Epoch)
+	}
+	err := status.verify(p.config)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.statuses[status.Participant] = status
+	p.lock.Unlock()
+	return nil
+}
+
+func (s *DKGStatus) verify(config *CryptoConfig) error {
+	sig, err := SignatureFromString(s.Signature)
+	if err != nil || sig.ID != s.Participant || config.Verify(s.message(), sig) != nil {
+		return errors.New("DKG status signature verification failed")
+	}
+	return nil
+}
+
+// Answer the complaints about us in a status.
+func (p *DKGParticipant) Respond(status DKGStatus) ([]DKGResponse, error) {
+	if p.poly == nil {
+		return nil, errors.New("Only the old gossipers deal in a resharing, see ReshareDealer")
+	}
+	return respond(p.config, p.poly, p.commitments, status, p.Epoch)
+}
+
+func respond(config *CryptoConfig, poly []bls.SecretKey, commitments []bls.PublicKey, status DKGStatus, epoch int) ([]DKGResponse, error) {
+	if status.Epoch != epoch {
+		return nil, fmt.Errorf("DKG status is for epoch %d, expected %d", status.Epoch, epoch)
+	}
+	err := status.verify(config)
+	if err != nil {
+		return nil, err
+	}
+	responses := []DKGResponse{}
+	for _, dealer := range status.Complaints {
+		if dealer != config.SelfID {
+			continue
+		}
+		var share bls.SecretKey
+		err := share.Set(poly, status.Participant.BlsID())
+		if err != nil {
+			return nil, err
+		}
+		response := DKGResponse{
+			Dealer:      config.SelfID,
+			Complainer:  status.Participant,
+			Commitments: make([]string, len(commitments)),
+			Share:       share.SerializeToHexStr(),
+			Epoch:       epoch,
+		}
+		for i := range commitments {
+			response.Commitments[i] = commitments[i].SerializeToHexStr()
+		}
+		sig, err := config.Sign(response.message())
+		if err != nil {
+			return nil, err
+		}
+		response.Signature = sig.String()
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// Check a dealer's answer to a complaint. An answer to our own complaint gives us our share.
+func (p *DKGParticipant) ProcessResponse(response DKGResponse) error {
+	if !isMember(p.Dealers, response.Dealer) {
+		return errors.New(response.Dealer.String() + " is not a DKG dealer")
+	}
+	if !isMember(p.Participants, response.Complainer) {
+		return errors.New(response.Complainer.String() + " is not a DKG participant")
+	}
+	if response.Epoch != p.Epoch {
+		return fmt.Errorf("DKG response is for epoch %d, expected %d", response.Epoch, p.Epoch)
+	}
+	sig, err := SignatureFromString(response.Signature)
+	if err != nil || sig.ID != response.Dealer || p.config.Verify(response.message(), sig) != nil {
+		return errors.New("DKG response signature verification failed")
+	}
+	var received dkgReceived
+	received.commitments, received.digest, err = parseCommitments(response.Commitments, p.Threshold)
+	if err != nil {
+		return err
+	}
+	err = received.share.DeserializeHexStr(response.Share)
+	if err != nil {
+		return err
+	}
+	err = checkShare(&received.share, received.commitments, response.Complainer)
+	if err != nil {
+		return err
+	}
+	err = p.checkReshareCommitments(response.Dealer, received.commitments)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.responses[response.Dealer] == nil {
+		p.responses[response.Dealer] = make(map[CTngID]string)
+	}
+	p.responses[response.Dealer][response.Complainer] = received.digest
+	if _, ok := p.received[response.Dealer]; !ok && response.Complainer == p.SelfID {
+		p.received[response.Dealer] = received
+	}
+	return nil
+}
+
+// The dealers who answered every complaint about them and whose commitments everyone agrees on.
+func (p *DKGParticipant) Qualified() []CTngID {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	qualified := make([]CTngID, 0, len(p.Dealers))
+	for _, dealer := range p.Dealers {
+		received, ok := p.received[dealer]
+		if !ok {
+			continue
+		}
+		ok = true
+		for _, status := range p.statuses {
+			for _, complaint := range status.Complaints {
+				if complaint == dealer && p.responses[dealer][status.Participant] != received.digest {
+					ok = false
+				}
+			}
+			if status.Commitments[dealer] != "" && status.Commitments[dealer] != received.digest {
+				ok = false
+			}
+		}
+		if ok {
+			qualified = append(qualified, dealer)
+		}
+	}
+	return qualified
+}
+
+// Our signed view of the qualified dealers, broadcast after the complaints are answered.
+func (p *DKGParticipant) Announce() (DKGQualified, error) {
+	announcement := DKGQualified{
+		Participant: p.SelfID,
+		Qualified:   p.Qualified(),
+		Epoch:       p.Epoch,
+	}
+	sig, err := p.config.Sign(announcement.message())
+	if err != nil {
+		return announcement, err
+	}
+	announcement.Signature = sig.String()
+	return announcement, nil
+}
+
+// Record the qualified dealers announced by another participant (or ourselves).
+func (p *DKGParticipant) ProcessQualified(announcement DKGQualified) error {
+	if !isMember(p.Participants, announcement.Participant) {
+		return errors.New(announcement.Participant.String() + " is not a DKG participant")
+	}
+	if announcement.Epoch != p.Epoch {
+		return fmt.Errorf("DKG qualified set is for epoch %d, expected %d", announcement.Epoch, p.Epoch)
+	}
+	sig, err := SignatureFromString(announcement.Signature)
+	if err != nil || sig.ID != announcement.Participant || p.config.Verify(announcement.message(), sig) != nil {
+		return errors.New("DKG qualified set signature verification failed")
+	}
+	p.lock.Lock()
+	p.qualified[announcement.Participant] = announcement
+	p.lock.Unlock()
+	return nil
+}
+
+// The qualified dealers announced by a majority of the participants.
+// Fails if there is no majority, or if we have no valid share from one of the dealers.
+func (p *DKGParticipant) AgreedQualified() ([]CTngID, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	votes := make(map[string]int)
+	for _, announcement := range p.qualified {
+		key := qualifiedKey(announcement.Qualified)
+		votes[key]++
+		if votes[key]*2 <= len(p.Participants) {
+			continue
+		}
+		agreed := append([]CTngID{}, announcement.Qualified...)
+		sort.Sort(CTngIDs(agreed))
+		for _, dealer := range agreed {
+			if _, ok := p.received[dealer]; !ok {
+				return nil, errors.New("No valid share from the agreed dealer " + dealer.String())
+			}
+		}
+		return agreed, nil
+	}
+	return nil, fmt.Errorf("No majority of the %d participants agrees on the qualified dealers", len(p.Participants))
+}
+
+// Combine the shares of the agreed qualified dealers.
+// Returns the public key share of every participant, our own secret share and the group public key.
+func (p *DKGParticipant) Finalize() (BlsPublicMap, bls.SecretKey, bls.PublicKey, error) {
+	if p.oldPublicMap != nil {
+		return p.finalizeReshare()
+	}
+	var secret bls.SecretKey
+	var group bls.PublicKey
+	pubs := make(BlsPublicMap)
+	qualified, err := p.AgreedQualified()
+	if err != nil {
+		return pubs, secret, group, err
+	}
+	if len(qualified) < p.Threshold {
+		return pubs, secret, group, fmt.Errorf("Only %d qualified dealers, need at least %d", len(qualified), p.Threshold)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, dealer := range qualified {
+		received := p.received[dealer]
+		if i == 0 {
+			secret = received.share
+			group = received.commitments[0]
+		} else {
+			secret.Add(&received.share)
+			group.Add(&received.commitments[0])
+		}
+	}
+	for _, participant := range p.Participants {
+		var pub bls.PublicKey
+		for i, dealer := range qualified {
+			var part bls.PublicKey
+			err := part.Set(p.received[dealer].commitments, participant.BlsID())
+			if err != nil {
+				return pubs, secret, group, err
+			}
+			if i == 0 {
+				pub = part
+			} else {
+				pub.Add(&part)
+			}
+		}
+		pubs[participant] = pub
+	}
+	return pubs, secret, group, nil
+}
+
+func isMember(ids []CTngID, id CTngID) bool {
+	for _, member := range ids {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the threshold keys of a config with the result of a DKG (or resharing) run.
+// Safe to call while other goroutines sign and verify with the config.
+func (c *CryptoConfig) InstallThresholdKeys(pubs BlsPublicMap, secret bls.SecretKey, threshold int) {
+	c.thresholdLock.Lock()
+	defer c.thresholdLock.Unlock()
+	c.installThresholdKeys(pubs, secret, threshold)
+}
+
+func (c *CryptoConfig) installThresholdKeys(pubs BlsPublicMap, secret bls.SecretKey, threshold int) {
+	c.ThresholdScheme = "bls"
+	c.ThresholdPublicMap = pubs
+	c.ThresholdSecretKey = secret
+	c.Threshold = threshold
+	c.N = len(pubs)
+}
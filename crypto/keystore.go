@@ -0,0 +1,518 @@
+package crypto
+
+import (
+	"CTngV2/util"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+	Key storage.
+	A stored crypto config that names a KeyStore file holds no private keys itself:
+	the RSA key, the key of a non-RSA sign scheme, the key committed for the next rotation and
+	the BLS threshold key share are kept, encrypted under a passphrase, in the key store and loaded
+	from it by ReadCryptoConfig.
+	Key stores only deal in serialized keys, so the same interface fits a file, a secrets manager
+	or anything else. Keys that must never leave their hardware go through the Token interface instead.
+*/
+
+// Labels of the keys of an entity inside a KeyStore.
+const (
+	RSA_KEY_LABEL       = "rsa"       // PKCS8 DER of CryptoConfig.SignSecretKey
+	SIGN_KEY_LABEL      = "sign"      // PKCS8 DER of CryptoConfig.SignKey
+	NEXT_SIGN_KEY_LABEL = "next-sign" // PKCS8 DER of CryptoConfig.NextSignKey
+	THRESHOLD_KEY_LABEL = "threshold" // serialized CryptoConfig.ThresholdSecretKey
+)
+
+// Additional data of the key store encryption, so other data sealed under the same passphrase can't pass as a key store.
+const KEYSTORE_AD = "CTng key store"
+
+var ErrKeyNotFound = errors.New("Key not found in the key store")
+
+type KeyStore interface {
+	GetKey(label string) ([]byte, error) // returns ErrKeyNotFound for unknown labels
+	PutKey(label string, key []byte) error
+	DeleteKey(label string) error
+	Labels() ([]string, error)
+}
+
+// A KeyStore in a single file, encrypted as a whole with util.SealWithPassphrase.
+// The decrypted keys are only held in memory.
+type FileKeyStore struct {
+	path       string
+	passphrase string
+	keys       map[string][]byte
+	lock       sync.Mutex
+}
+
+// Opens the key store at path, or starts an empty one if the file does not exist yet.
+func OpenFileKeyStore(path string, passphrase string) (*FileKeyStore, error) {
+	ks := &FileKeyStore{path: path, passphrase: passphrase, keys: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sealed util.SealedData
+	err = json.Unmarshal(data, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := util.OpenWithPassphrase(passphrase, &sealed, []byte(KEYSTORE_AD))
+	if err != nil {
+		return nil, err
+	}
+	return ks, json.Unmarshal(plain, &ks.keys)
+}
+
+func (ks *FileKeyStore) GetKey(label string) ([]byte, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	key, ok := ks.keys[label]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, key...), nil
+}
+
+func (ks *FileKeyStore) PutKey(label string, key []byte) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys[label] = append([]byte{}, key...)
+	return ks.save()
+}
+
+func (ks *FileKeyStore) DeleteKey(label string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if _, ok := ks.keys[label]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(ks.keys, label)
+	return ks.save()
+}
+
+func (ks *FileKeyStore) Labels() ([]string, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	labels := make([]string, 0, len(ks.keys))
+	for label := range ks.keys {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+func (ks *FileKeyStore) save() error {
+	plain, err := json.Marshal(ks.keys)
+	if err != nil {
+		return err
+	}
+	sealed, err := util.SealWithPassphrase(ks.passphrase, plain, []byte(KEYSTORE_AD))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	// Write and rename, so a crash never leaves a half written key store behind.
+	err = os.WriteFile(ks.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(ks.path+".tmp", ks.path)
+}
+
+// Move the private keys of a config into a key store.
+func StoreKeys(c *CryptoConfig, ks KeyStore) error {
+	if c.SignSecretKey.N != nil {
+		der, err := x509.MarshalPKCS8PrivateKey(&c.SignSecretKey)
+		if err != nil {
+			return err
+		}
+		err = ks.PutKey(RSA_KEY_LABEL, der)
+		if err != nil {
+			return err
+		}
+	}
+	if c.SignKey != nil {
+		der, err := MarshalSigner(c.SignKey)
+		if err != nil {
+			return err
+		}
+		err = ks.PutKey(SIGN_KEY_LABEL, der)
+		if err != nil {
+			return err
+		}
+	}
+	if c.NextSignKey != nil {
+		der, err := MarshalSigner(c.NextSignKey)
+		if err != nil {
+			return err
+		}
+		err = ks.PutKey(NEXT_SIGN_KEY_LABEL, der)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.ThresholdSecretKey.IsZero() {
+		return ks.PutKey(THRESHOLD_KEY_LABEL, c.ThresholdSecretKey.Serialize())
+	}
+	return nil
+}
+
+// Fill in the private keys of a config from a key store. Missing keys are left as they are.
+func LoadKeys(c *CryptoConfig, ks KeyStore) error {
+	der, err := ks.GetKey(RSA_KEY_LABEL)
+	if err == nil {
+		priv, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		rsaKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return errors.New("The " + RSA_KEY_LABEL + " key is not an RSA key")
+		}
+		c.SignSecretKey = *rsaKey
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	der, err = ks.GetKey(SIGN_KEY_LABEL)
+	if err == nil {
+		c.SignKey, err = ParseSigner(der)
+		if err != nil {
+			return err
+		}
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	der, err = ks.GetKey(NEXT_SIGN_KEY_LABEL)
+	if err == nil {
+		c.NextSignKey, err = ParseSigner(der)
+		if err != nil {
+			return err
+		}
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	share, err := ks.GetKey(THRESHOLD_KEY_LABEL)
+	if err == nil {
+		return c.ThresholdSecretKey.Deserialize(share)
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Write a crypto config whose private keys are kept in the encrypted key store at keystore_path.
+// A relative keystore_path is relative to the directory of the config file.
+// The passphrase is read from util.PASSPHRASE_ENV when the config is read back with ReadCryptoConfig.
+func SaveCryptoConfigWithKeyStore(file string, c *CryptoConfig, keystore_path string, passphrase string) error {
+	ks, err := OpenFileKeyStore(keyStorePath(file, keystore_path), passphrase)
+	if err != nil {
+		return err
+	}
+	err = StoreKeys(c, ks)
+	if err != nil {
+		return err
+	}
+	scc := NewStoredCryptoConfig(c)
+	scc.SignSecretKey = rsa.PrivateKey{}
+	scc.SignKey = nil
+	scc.NextSignKey = nil
+	scc.ThresholdSecretKey = nil
+	scc.KeyStore = keystore_path
+	return util.WriteData(file, *scc)
+}
+
+// Write the threshold keys of c, after a DKG or resharing, into the stored config at file and leave
+// everything else in the file as it is. The secret share goes to the config's key store if it names one.
+func SaveThresholdKeys(file string, c *CryptoConfig) error {
+	scc := new(StoredCryptoConfig)
+	data, err := util.ReadByte(file)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, scc)
+	if err != nil {
+		return err
+	}
+	c.thresholdLock.RLock()
+	current := NewStoredCryptoConfig(c)
+	c.thresholdLock.RUnlock()
+	scc.ThresholdScheme = current.ThresholdScheme
+	scc.Threshold = current.Threshold
+	scc.N = current.N
+	scc.ThresholdPublicMap = current.ThresholdPublicMap
+	scc.ThresholdEpoch = current.ThresholdEpoch
+	scc.PastThresholdKeys = current.PastThresholdKeys
+	scc.ThresholdSecretKey = current.ThresholdSecretKey
+	if scc.KeyStore != "" {
+		passphrase, ok := os.LookupEnv(util.PASSPHRASE_ENV)
+		if !ok {
+			return errors.New("The key store of " + file + " needs a passphrase in " + util.PASSPHRASE_ENV)
+		}
+		ks, err := OpenFileKeyStore(keyStorePath(file, scc.KeyStore), passphrase)
+		if err != nil {
+			return err
+		}
+		if c.HasThresholdSecretKey() {
+			err = ks.PutKey(THRESHOLD_KEY_LABEL, current.ThresholdSecretKey)
+		} else {
+			// A share of an earlier epoch must not be used again
+			err = ks.DeleteKey(THRESHOLD_KEY_LABEL)
+			if err == ErrKeyNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		scc.ThresholdSecretKey = nil
+	}
+	return util.WriteData(file, *scc)
+}
+
+func keyStorePath(config_file string, keystore_path string) string {
+	if filepath.IsAbs(keystore_path) {
+		return keystore_path
+	}
+	return filepath.Join(filepath.Dir(config_file), keystore_path)
+}
+
+// Load the private keys of a stored config that names a key store.
+func loadKeyStore(c *CryptoConfig, config_file string, scc *StoredCryptoConfig) error {
+	if scc.KeyStore == "" {
+		return nil
+	}
+	passphrase, ok := os.LookupEnv(util.PASSPHRASE_ENV)
+	if !ok {
+		return errors.New("The key store of " + config_file + " needs a passphrase in " + util.PASSPHRASE_ENV)
+	}
+	ks, err := OpenFileKeyStore(keyStorePath(config_file, scc.KeyStore), passphrase)
+	if err != nil {
+		return err
+	}
+	return LoadKeys(c, ks)
+}
+
+/*
+The subset of PKCS#11 (Cryptoki) an entity needs to sign with a key held in a token.
+Objects are found by label and addressed by handle (C_FindObjects), signing names the mechanism
+(C_SignInit/C_Sign), and private keys can be imported (C_CreateObject) but never read back.
+The mechanisms are the sign scheme names: "rsa" is CKM_SHA256_RSA_PKCS, "ed25519" is CKM_EDDSA
+and "ecdsa-p256" is CKM_ECDSA_SHA256 with an ASN.1 encoded signature.
+A binding to a real PKCS#11 module can implement this interface; SoftToken is the local software token.
+*/
+type ObjectHandle uint
+
+type Token interface {
+	Login(pin string) error
+	Logout() error
+	FindObjects(label string) ([]ObjectHandle, error)
+	GetPublicKey(handle ObjectHandle) (crypto.PublicKey, error)
+	Sign(handle ObjectHandle, mechanism string, msg []byte) ([]byte, error)
+	ImportKey(label string, priv crypto.PrivateKey) (ObjectHandle, error)
+	DestroyObject(handle ObjectHandle) error
+}
+
+var ErrNotLoggedIn = errors.New("Token: user not logged in")
+
+// A software token keeping its keys in a FileKeyStore, which Login opens with the pin as passphrase.
+type SoftToken struct {
+	path    string
+	store   *FileKeyStore
+	handles map[ObjectHandle]string
+	signers map[ObjectHandle]Signer
+	lock    sync.Mutex
+}
+
+func NewSoftToken(path string) *SoftToken {
+	return &SoftToken{path: path}
+}
+
+func (t *SoftToken) Login(pin string) error {
+	store, err := OpenFileKeyStore(t.path, pin)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.store = store
+	t.handles = make(map[ObjectHandle]string)
+	t.signers = make(map[ObjectHandle]Signer)
+	labels, _ := store.Labels()
+	for _, label := range labels {
+		der, _ := store.GetKey(label)
+		signer, err := ParseSigner(der)
+		if err != nil {
+			// Not a signing key, e.g. a threshold key share stored next to them.
+			continue
+		}
+		t.addObject(label, signer)
+	}
+	return nil
+}
+
+func (t *SoftToken) Logout() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.store, t.handles, t.signers = nil, nil, nil
+	return nil
+}
+
+func (t *SoftToken) FindObjects(label string) ([]ObjectHandle, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.store == nil {
+		return nil, ErrNotLoggedIn
+	}
+	found := []ObjectHandle{}
+	for handle, l := range t.handles {
+		if l == label {
+			found = append(found, handle)
+		}
+	}
+	return found, nil
+}
+
+func (t *SoftToken) GetPublicKey(handle ObjectHandle) (crypto.PublicKey, error) {
+	signer, err := t.object(handle)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
+
+func (t *SoftToken) Sign(handle ObjectHandle, mechanism string, msg []byte) ([]byte, error) {
+	signer, err := t.object(handle)
+	if err != nil {
+		return nil, err
+	}
+	if signer.Scheme() != mechanism {
+		return nil, errors.New("Token: mechanism " + mechanism + " does not match the " + signer.Scheme() + " key")
+	}
+	return signer.Sign(msg)
+}
+
+func (t *SoftToken) ImportKey(label string, priv crypto.PrivateKey) (ObjectHandle, error) {
+	signer, err := SignerFromPrivateKey(priv)
+	if err != nil {
+		return 0, err
+	}
+	der, err := MarshalSigner(signer)
+	if err != nil {
+		return 0, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.store == nil {
+		return 0, ErrNotLoggedIn
+	}
+	err = t.store.PutKey(label, der)
+	if err != nil {
+		return 0, err
+	}
+	// One object per label, as in the key store
+	for handle, l := range t.handles {
+		if l == label {
+			delete(t.handles, handle)
+			delete(t.signers, handle)
+		}
+	}
+	return t.addObject(label, signer), nil
+}
+
+func (t *SoftToken) DestroyObject(handle ObjectHandle) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.store == nil {
+		return ErrNotLoggedIn
+	}
+	label, ok := t.handles[handle]
+	if !ok {
+		return errors.New("Token: invalid object handle")
+	}
+	delete(t.handles, handle)
+	delete(t.signers, handle)
+	return t.store.DeleteKey(label)
+}
+
+func (t *SoftToken) addObject(label string, signer Signer) ObjectHandle {
+	handle := ObjectHandle(1)
+	for ; t.handles[handle] != ""; handle++ {
+	}
+	t.handles[handle] = label
+	t.signers[handle] = signer
+	return handle
+}
+
+func (t *SoftToken) object(handle ObjectHandle) (Signer, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.store == nil {
+		return nil, ErrNotLoggedIn
+	}
+	signer, ok := t.signers[handle]
+	if !ok {
+		return nil, errors.New("Token: invalid object handle")
+	}
+	return signer, nil
+}
+
+// A Signer whose private key stays in a token.
+type tokenSigner struct {
+	token  Token
+	handle ObjectHandle
+	scheme string
+	public crypto.PublicKey
+}
+
+func (s *tokenSigner) Scheme() string           { return s.scheme }
+func (s *tokenSigner) Public() crypto.PublicKey { return s.public }
+func (s *tokenSigner) Sign(msg []byte) ([]byte, error) {
+	return s.token.Sign(s.handle, s.scheme, msg)
+}
+
+// Look up the key with the given label in a (logged in) token.
+func NewTokenSigner(token Token, label string) (Signer, error) {
+	handles, err := token.FindObjects(label)
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) != 1 {
+		return nil, errors.New("Token: expected one key labelled " + label)
+	}
+	public, err := token.GetPublicKey(handles[0])
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := SchemeOfPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenSigner{token: token, handle: handles[0], scheme: scheme, public: public}, nil
+}
+
+// Sign with a key held in a token from now on.
+func (c *CryptoConfig) UseToken(token Token, label string) error {
+	signer, err := NewTokenSigner(token, label)
+	if err != nil {
+		return err
+	}
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	c.SignKey = signer
+	c.SignScheme = signer.Scheme()
+	return nil
+}
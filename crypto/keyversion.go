@@ -0,0 +1,415 @@
+package crypto
+
+import (
+	"CTngV2/util"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+	Versioned signing keys.
+
+	Every entity starts with key version 0, the key in SignPublicMap/SignPublicKeys, valid from period 0 on.
+	To roll its key, the entity announces a KeyRotation signed with its current key (a KEY_INIT gossip object);
+	once the gossipers have threshold signed it, every entity applies it with ApplyKeyRotation.
+	The previous key then stays valid up to the period before ValidFrom, and the new key from ValidFrom on.
+	Signatures carry the key version, so VerifyForPeriod can pick the key that was valid for the signed period.
+
+	Every key version commits to the key of the next one: NextKeyHash is the SHA-256 of its PKIX public key.
+	The commitments of version 0 are handed out with the configs (NextKeyHashes), every rotation carries the
+	commitment for the rotation after it. A rotation is only applied if its key is the committed one, and the
+	KEY_INIT proves possession of that key. The entity keeps the committed key (NextSignKey) unused until then,
+	so whoever leaks the current key can not rotate to a key of their own.
+
+	A leaked key is revoked by rotating with ValidFrom set to the period of the leak:
+	signatures of the old key for that period or any later one no longer verify.
+	The period is taken from the signed payload (see definition.Signed_period), never from the
+	unsigned Gossip_object.Period, so an old period can not be claimed for a new signature.
+
+	Limitations:
+	 - Whoever holds both the current and the committed key can still rotate first.
+	   Keeping the committed key offline until the rotation makes that much harder than leaking the key in use.
+	 - Entities whose config has no commitment for them can not rotate their key.
+	 - The holder of a leaked key can still sign payloads for the periods before the leak.
+	   Those conflict with what the entity really signed for these periods, if anything.
+*/
+
+// One version of the signing key of an entity.
+type KeyVersion struct {
+	Version     int
+	Public      crypto.PublicKey
+	ValidFrom   int    // first period the key is valid for
+	ValidUntil  int    // last period the key is valid for, -1 while it is the current key
+	NextKeyHash []byte // commitment to the key of the next version, see KeyHash
+}
+
+type StoredKeyVersion struct {
+	Version     int
+	Public      []byte // PKIX public key
+	ValidFrom   int
+	ValidUntil  int
+	NextKeyHash []byte `json:",omitempty"`
+}
+
+// The announcement of a new signing key for an entity.
+type KeyRotation struct {
+	ID          CTngID
+	Version     int
+	PublicKey   []byte // PKIX public key
+	ValidFrom   int
+	NextKeyHash []byte // commitment to the key of the rotation after this one
+}
+
+// The commitment to a key: SHA-256 of its PKIX encoding.
+func KeyHash(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(der)
+	return hash[:], nil
+}
+
+// Check that the key of a rotation is the one the current key version committed to,
+// and that the rotation commits to the key after it.
+func CheckCommittedKey(current KeyVersion, r KeyRotation) error {
+	if len(current.NextKeyHash) == 0 {
+		return fmt.Errorf("Key version %d of %s commits to no next key", current.Version, r.ID.String())
+	}
+	hash := sha256.Sum256(r.PublicKey)
+	if !bytes.Equal(hash[:], current.NextKeyHash) {
+		return fmt.Errorf("Key version %d of %s is not the committed key", r.Version, r.ID.String())
+	}
+	if len(r.NextKeyHash) != sha256.Size {
+		return fmt.Errorf("Key version %d of %s commits to no next key", r.Version, r.ID.String())
+	}
+	return nil
+}
+
+func (r KeyRotation) String() string {
+	js, _ := json.Marshal(r)
+	return string(js)
+}
+
+func KeyRotationFromString(str string) (KeyRotation, error) {
+	var r KeyRotation
+	err := json.Unmarshal([]byte(str), &r)
+	return r, err
+}
+
+// Returns all key versions of an entity, oldest first.
+// Entities which never rotated their key only have version 0.
+func (c *CryptoConfig) KeyHistory(id CTngID) ([]KeyVersion, error) {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.keyHistory(id)
+}
+
+// KeyHistory with keyLock held.
+func (c *CryptoConfig) keyHistory(id CTngID) ([]KeyVersion, error) {
+	if versions, ok := c.KeyVersions[id]; ok && len(versions) > 0 {
+		return versions, nil
+	}
+	pub, err := c.signPublicKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []KeyVersion{{Version: 0, Public: pub, ValidFrom: 0, ValidUntil: -1, NextKeyHash: c.NextKeyHashes[id]}}, nil
+}
+
+// Verify a signature made for the given period, using the key version recorded in the signature.
+// Fails if that key version was not valid for the period.
+func (c *CryptoConfig) VerifyForPeriod(msg []byte, sig Signature, period int) error {
+	versions, err := c.KeyHistory(sig.ID)
+	if err != nil {
+		return err
+	}
+	// Versions are contiguous, so the version is also the index.
+	if sig.Version < 0 || sig.Version >= len(versions) {
+		return fmt.Errorf("Unknown key version %d of %s", sig.Version, sig.ID.String())
+	}
+	key := versions[sig.Version]
+	if period < key.ValidFrom || (key.ValidUntil >= 0 && period > key.ValidUntil) {
+		return fmt.Errorf("Key version %d of %s is not valid for period %d", sig.Version, sig.ID.String(), period)
+	}
+	return VerifyWithPublicKey(sig.Scheme, key.Public, msg, sig.Sig)
+}
+
+// Announce key as the next version of this entity's signing key, valid from the given period on.
+// key must be the key the current version committed to, the rotation commits to next for the rotation after it.
+func (c *CryptoConfig) NewKeyRotation(key Signer, next Signer, validFrom int) (KeyRotation, error) {
+	versions, err := c.KeyHistory(c.SelfID)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	current := versions[len(versions)-1]
+	if validFrom <= current.ValidFrom {
+		return KeyRotation{}, fmt.Errorf("The new key must become valid after period %d", current.ValidFrom)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	nextHash, err := KeyHash(next.Public())
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	rotation := KeyRotation{
+		ID:          c.SelfID,
+		Version:     current.Version + 1,
+		PublicKey:   der,
+		ValidFrom:   validFrom,
+		NextKeyHash: nextHash,
+	}
+	return rotation, CheckCommittedKey(current, rotation)
+}
+
+// The key this entity committed to for its next rotation, nil if it has none.
+func (c *CryptoConfig) CommittedSignKey() Signer {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.NextSignKey
+}
+
+// Record a key rotation: the current key of the entity stops being valid at r.ValidFrom
+// and the new key becomes its current one.
+// Applying a rotation a second time is a no-op, so every copy of a KEY_FULL can be applied.
+func (c *CryptoConfig) ApplyKeyRotation(r KeyRotation) error {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	return c.applyKeyRotation(r)
+}
+
+// ApplyKeyRotation with keyLock held.
+func (c *CryptoConfig) applyKeyRotation(r KeyRotation) error {
+	pub, err := x509.ParsePKIXPublicKey(r.PublicKey)
+	if err != nil {
+		return err
+	}
+	if _, err := SchemeOfPublicKey(pub); err != nil {
+		return err
+	}
+	versions, err := c.keyHistory(r.ID)
+	if err != nil {
+		return err
+	}
+	last := versions[len(versions)-1]
+	if r.Version < 0 {
+		return errors.New("Key versions can not be negative")
+	}
+	if r.Version <= last.Version {
+		known := versions[r.Version]
+		der, _ := x509.MarshalPKIXPublicKey(known.Public)
+		if r.Version > 0 && known.ValidFrom == r.ValidFrom && bytes.Equal(der, r.PublicKey) && bytes.Equal(known.NextKeyHash, r.NextKeyHash) {
+			return nil
+		}
+		return fmt.Errorf("Key version %d of %s conflicts with the known one", r.Version, r.ID.String())
+	}
+	if r.Version != last.Version+1 {
+		return fmt.Errorf("Key version %d of %s is missing", last.Version+1, r.ID.String())
+	}
+	if r.ValidFrom <= last.ValidFrom {
+		return errors.New("A new key must become valid after the current one")
+	}
+	err = CheckCommittedKey(last, r)
+	if err != nil {
+		return err
+	}
+	// Copy, so histories handed out by KeyHistory stay untouched.
+	updated := append([]KeyVersion{}, versions...)
+	updated[len(updated)-1].ValidUntil = r.ValidFrom - 1
+	updated = append(updated, KeyVersion{Version: r.Version, Public: pub, ValidFrom: r.ValidFrom, ValidUntil: -1, NextKeyHash: r.NextKeyHash})
+	if c.KeyVersions == nil {
+		c.KeyVersions = make(map[CTngID][]KeyVersion)
+	}
+	c.KeyVersions[r.ID] = updated
+	if c.SignPublicKeys == nil {
+		c.SignPublicKeys = make(SignPublicKeyMap)
+	}
+	c.SignPublicKeys[r.ID] = pub
+	return nil
+}
+
+// A copy of the config with its own key history, so key rotations can be applied to it and dropped.
+// The other keys are shared with c.
+func (c *CryptoConfig) CopyKeyHistory() *CryptoConfig {
+	c.thresholdLock.RLock()
+	defer c.thresholdLock.RUnlock()
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	copied := &CryptoConfig{
+		Threshold:          c.Threshold,
+		N:                  c.N,
+		HashScheme:         c.HashScheme,
+		SignScheme:         c.SignScheme,
+		ThresholdScheme:    c.ThresholdScheme,
+		SelfID:             c.SelfID,
+		SignPublicMap:      c.SignPublicMap,
+		SignSecretKey:      c.SignSecretKey,
+		SignPublicKeys:     make(SignPublicKeyMap),
+		SignKey:            c.SignKey,
+		SignKeyVersion:     c.SignKeyVersion,
+		KeyVersions:        make(map[CTngID][]KeyVersion),
+		NextKeyHashes:      c.NextKeyHashes,
+		NextSignKey:        c.NextSignKey,
+		ThresholdPublicMap: c.ThresholdPublicMap,
+		ThresholdSecretKey: c.ThresholdSecretKey,
+		ThresholdEpoch:     c.ThresholdEpoch,
+		PastThresholdKeys:  c.PastThresholdKeys,
+	}
+	for id, pub := range c.SignPublicKeys {
+		copied.SignPublicKeys[id] = pub
+	}
+	// ApplyKeyRotation replaces the histories, it does not change them in place
+	for id, versions := range c.KeyVersions {
+		copied.KeyVersions[id] = versions
+	}
+	return copied
+}
+
+// Start signing with a rotated key. The entity should do this once it signs for r.ValidFrom,
+// objects for earlier periods still have to be signed with the previous key.
+// next is the key r commits to, it is kept for the next rotation.
+func (c *CryptoConfig) InstallSignKey(key Signer, next Signer, r KeyRotation) error {
+	if r.ID != c.SelfID {
+		return errors.New("The key rotation is not for " + c.SelfID.String())
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(der, r.PublicKey) {
+		return errors.New("The key does not match the key rotation")
+	}
+	nextHash, err := KeyHash(next.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(nextHash, r.NextKeyHash) {
+		return errors.New("The next key does not match the commitment of the key rotation")
+	}
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	err = c.applyKeyRotation(r)
+	if err != nil {
+		return err
+	}
+	c.SignKey = key
+	c.SignScheme = key.Scheme()
+	c.SignKeyVersion = r.Version
+	c.NextSignKey = next
+	return nil
+}
+
+func serializeKeyVersions(versions map[CTngID][]KeyVersion) (map[string][]StoredKeyVersion, error) {
+	serialized := make(map[string][]StoredKeyVersion)
+	for id, history := range versions {
+		for _, v := range history {
+			der, err := x509.MarshalPKIXPublicKey(v.Public)
+			if err != nil {
+				return nil, err
+			}
+			serialized[id.String()] = append(serialized[id.String()], StoredKeyVersion{
+				Version:     v.Version,
+				Public:      der,
+				ValidFrom:   v.ValidFrom,
+				ValidUntil:  v.ValidUntil,
+				NextKeyHash: v.NextKeyHash,
+			})
+		}
+	}
+	return serialized, nil
+}
+
+func deserializeKeyVersions(serialized map[string][]StoredKeyVersion) (map[CTngID][]KeyVersion, error) {
+	versions := make(map[CTngID][]KeyVersion)
+	for id, history := range serialized {
+		for i, v := range history {
+			if v.Version != i {
+				return nil, fmt.Errorf("Key versions of %s are not contiguous", id)
+			}
+			pub, err := x509.ParsePKIXPublicKey(v.Public)
+			if err != nil {
+				return nil, err
+			}
+			versions[CTngID(id)] = append(versions[CTngID(id)], KeyVersion{
+				Version:     v.Version,
+				Public:      pub,
+				ValidFrom:   v.ValidFrom,
+				ValidUntil:  v.ValidUntil,
+				NextKeyHash: v.NextKeyHash,
+			})
+		}
+	}
+	return versions, nil
+}
+
+// Write the key versions of c into the stored config at file, leaving everything else in the file as it is.
+// With withSignKey the rotated private key of c and the key committed for its next rotation are stored too,
+// in the config's key store if it names one.
+func SaveKeyVersions(file string, c *CryptoConfig, withSignKey bool) error {
+	scc := new(StoredCryptoConfig)
+	data, err := util.ReadByte(file)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, scc)
+	if err != nil {
+		return err
+	}
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	scc.KeyVersions, err = serializeKeyVersions(c.KeyVersions)
+	if err != nil {
+		return err
+	}
+	scc.SignPublicKeys, err = (&c.SignPublicKeys).Serialize()
+	if err != nil {
+		return err
+	}
+	if withSignKey && c.SignKey != nil {
+		der, err := MarshalSigner(c.SignKey)
+		if err != nil {
+			return err
+		}
+		var next []byte
+		if c.NextSignKey != nil {
+			next, err = MarshalSigner(c.NextSignKey)
+			if err != nil {
+				return err
+			}
+		}
+		if scc.KeyStore != "" {
+			passphrase, ok := os.LookupEnv(util.PASSPHRASE_ENV)
+			if !ok {
+				return errors.New("The key store of " + file + " needs a passphrase in " + util.PASSPHRASE_ENV)
+			}
+			ks, err := OpenFileKeyStore(keyStorePath(file, scc.KeyStore), passphrase)
+			if err != nil {
+				return err
+			}
+			err = ks.PutKey(SIGN_KEY_LABEL, der)
+			if err != nil {
+				return err
+			}
+			if next != nil {
+				err = ks.PutKey(NEXT_SIGN_KEY_LABEL, next)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			scc.SignKey = der
+			scc.NextSignKey = next
+		}
+		scc.SignScheme = c.SignScheme
+		scc.SignKeyVersion = c.SignKeyVersion
+	}
+	return util.WriteData(file, *scc)
+}
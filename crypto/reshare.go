@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/herumi/bls-go-binary/bls"
+)
+
+/*
+	Proactive resharing of the BLS threshold keys to a new set of gossipers.
+
+	The old set holds shares x_i of the group secret x with threshold t_old,
+	the new set may have a different size n_new and threshold t_new.
+	 1. Every old gossiper i acts as a dealer of its own share: it picks a random polynomial
+	    g_i of degree t_new-1 with g_i(0) = x_i and deals g_i(id_j) to every new gossiper j,
+	    exactly like a DKG deal. Since C_i[0] = x_i*G must equal i's current public key share,
+	    a dealer cannot hand out anything but its real share.
+	 2. The new gossipers exchange statuses, the old ones answer complaints and the new ones
+	    agree on the qualified dealers, all as in the DKG.
+	 3. Any t_old qualified dealers D determine x = sum_{i in D} L_i*x_i (L_i the Lagrange
+	    coefficients at 0), so j's new share is x'_j = sum_{i in D} L_i*g_i(id_j), a point on
+	    the degree t_new-1 polynomial sum_{i in D} L_i*g_i whose constant term is still x.
+	The group public key stays the same while all shares change, so old shares are useless
+	after the handoff. Every resharing increments the epoch, which is recorded in the
+	signatures so objects from earlier epochs can still be verified, see CryptoConfig.PastThresholdKeys.
+*/
+
+// An old gossiper handing its share over to the new set.
+type ReshareDealer struct {
+	SelfID      CTngID
+	Threshold   int // threshold of the new set
+	Epoch       int // epoch of the new keys
+	config      *CryptoConfig
+	poly        []bls.SecretKey
+	commitments []bls.PublicKey
+}
+
+func NewReshareDealer(config *CryptoConfig, threshold int) (*ReshareDealer, error) {
+	if threshold < 2 {
+		return nil, errors.New("Threshold must be greater than 1")
+	}
+	if config.ThresholdSecretKey.IsZero() {
+		return nil, errors.New("No threshold secret key to reshare")
+	}
+	d := &ReshareDealer{
+		SelfID:    config.SelfID,
+		Threshold: threshold,
+		Epoch:     config.ThresholdEpoch + 1,
+		config:    config,
+	}
+	// GetMasterSecretKey keeps the secret key as the constant term.
+	d.poly = config.ThresholdSecretKey.GetMasterSecretKey(threshold)
+	d.commitments = bls.GetMasterPublicKey(d.poly)
+	return d, nil
+}
+
+// Build the signed deal for one gossiper of the new set.
+func (d *ReshareDealer) Deal(recipient CTngID) (DKGDeal, error) {
+	return makeDeal(d.config, d.poly, d.commitments, recipient, d.Epoch)
+}
+
+// Answer the complaints about us in a status of the new set.
+func (d *ReshareDealer) Respond(status DKGStatus) ([]DKGResponse, error) {
+	return respond(d.config, d.poly, d.commitments, status, d.Epoch)
+}
+
+// Start a resharing run for a gossiper of the new set.
+// The config must hold the current public key shares of the old set; newly joining gossipers
+// get those from Gen like everyone else, they only lack a secret share.
+func NewReshareParticipant(config *CryptoConfig, dealers []CTngID, participants []CTngID, threshold int) (*DKGParticipant, error) {
+	if threshold < 2 {
+		return nil, errors.New("Threshold must be greater than 1")
+	}
+	if threshold > len(participants) {
+		return nil, errors.New("Threshold is larger than the number of participants")
+	}
+	if len(dealers) < config.Threshold {
+		return nil, fmt.Errorf("Resharing needs at least %d of the old gossipers", config.Threshold)
+	}
+	ids := append([]CTngID{}, participants...)
+	sort.Sort(CTngIDs(ids))
+	if !isMember(ids, config.SelfID) {
+		return nil, errors.New("The resharing participants must include " + config.SelfID.String())
+	}
+	// Shares that are not points of one polynomial can not be reshared without changing the group key
+	err := CheckThresholdPublicMap(config.ThresholdPublicMap, config.Threshold)
+	if err != nil {
+		return nil, errors.New("Cannot reshare these threshold keys, regenerate them with Gen or a DKG: " + err.Error())
+	}
+	old := append([]CTngID{}, dealers...)
+	sort.Sort(CTngIDs(old))
+	for _, dealer := range old {
+		if _, ok := config.ThresholdPublicMap[dealer]; !ok {
+			return nil, errors.New("No current public key share for " + dealer.String())
+		}
+	}
+	return &DKGParticipant{
+		SelfID:       config.SelfID,
+		Participants: ids,
+		Dealers:      old,
+		Threshold:    threshold,
+		Epoch:        config.ThresholdEpoch + 1,
+		config:       config,
+		oldPublicMap: config.ThresholdPublicMap,
+		oldThreshold: config.Threshold,
+		received:     make(map[CTngID]dkgReceived),
+		statuses:     make(map[CTngID]DKGStatus),
+		responses:    make(map[CTngID]map[CTngID]string),
+		qualified:    make(map[CTngID]DKGQualified),
+	}, nil
+}
+
+// Interpolate the new shares from the first t_old qualified dealers.
+// Every participant picks the same dealers, as they agree on the qualified set.
+func (p *DKGParticipant) finalizeReshare() (BlsPublicMap, bls.SecretKey, bls.PublicKey, error) {
+	var secret bls.SecretKey
+	var group bls.PublicKey
+	pubs := make(BlsPublicMap)
+	qualified, err := p.AgreedQualified()
+	if err != nil {
+		return pubs, secret, group, err
+	}
+	if len(qualified) < p.oldThreshold {
+		return pubs, secret, group, fmt.Errorf("Only %d qualified dealers, need at least %d", len(qualified), p.oldThreshold)
+	}
+	dealers := qualified[:p.oldThreshold]
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ids := make([]bls.ID, len(dealers))
+	shares := make([]bls.SecretKey, len(dealers))
+	constants := make([]bls.PublicKey, len(dealers))
+	for i, dealer := range dealers {
+		ids[i] = *dealer.BlsID()
+		shares[i] = p.received[dealer].share
+		constants[i] = p.received[dealer].commitments[0]
+	}
+	err = secret.Recover(shares, ids)
+	if err != nil {
+		return pubs, secret, group, err
+	}
+	err = group.Recover(constants, ids)
+	if err != nil {
+		return pubs, secret, group, err
+	}
+	for _, participant := range p.Participants {
+		parts := make([]bls.PublicKey, len(dealers))
+		for i, dealer := range dealers {
+			err := parts[i].Set(p.received[dealer].commitments, participant.BlsID())
+			if err != nil {
+				return pubs, secret, group, err
+			}
+		}
+		var pub bls.PublicKey
+		err := pub.Recover(parts, ids)
+		if err != nil {
+			return pubs, secret, group, err
+		}
+		pubs[participant] = pub
+	}
+	return pubs, secret, group, nil
+}
+
+// Move to the next epoch: the current public keys are kept to verify the objects signed so far,
+// and the keys from the resharing are installed. Entities outside the new set pass a zero secret.
+func (c *CryptoConfig) AdvanceThresholdEpoch(pubs BlsPublicMap, secret bls.SecretKey, threshold int) {
+	c.thresholdLock.Lock()
+	defer c.thresholdLock.Unlock()
+	if c.PastThresholdKeys == nil {
+		c.PastThresholdKeys = make(map[int]ThresholdEpochKeys)
+	}
+	c.PastThresholdKeys[c.ThresholdEpoch] = ThresholdEpochKeys{
+		Threshold: c.Threshold,
+		N:         c.N,
+		PublicMap: c.ThresholdPublicMap,
+	}
+	c.ThresholdEpoch++
+	c.installThresholdKeys(pubs, secret, threshold)
+}
@@ -0,0 +1,257 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Names of the "normal signature" schemes an entity may sign with.
+// These are the values of CryptoConfig.SignScheme and of the scheme tag in a Signature.
+const (
+	RSA_SCHEME        = "rsa"
+	ED25519_SCHEME    = "ed25519"
+	ECDSA_P256_SCHEME = "ecdsa-p256"
+)
+
+// A Signer holds the private key of a single entity for one signature scheme.
+// The verifying half of every scheme is VerifyWithPublicKey.
+type Signer interface {
+	Scheme() string
+	Public() crypto.PublicKey
+	Sign(msg []byte) ([]byte, error)
+}
+
+type rsaSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (s *rsaSigner) Scheme() string           { return RSA_SCHEME }
+func (s *rsaSigner) Public() crypto.PublicKey { return &s.key.PublicKey }
+func (s *rsaSigner) Sign(msg []byte) ([]byte, error) {
+	sig, err := RSASign(msg, s.key, "")
+	return sig.Sig, err
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func (s *ed25519Signer) Scheme() string           { return ED25519_SCHEME }
+func (s *ed25519Signer) Public() crypto.PublicKey { return s.key.Public() }
+func (s *ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	// Ed25519 hashes the message internally.
+	return ed25519.Sign(s.key, msg), nil
+}
+
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s *ecdsaSigner) Scheme() string           { return ECDSA_P256_SCHEME }
+func (s *ecdsaSigner) Public() crypto.PublicKey { return &s.key.PublicKey }
+func (s *ecdsaSigner) Sign(msg []byte) ([]byte, error) {
+	// SHA256 to match the RSA signatures, ASN.1 encoded (r,s) pair.
+	hash, err := GenerateSHA256(msg)
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.SignASN1(rand.Reader, s.key, hash)
+}
+
+// Generate a fresh private key for the given scheme.
+func NewSigner(scheme string) (Signer, error) {
+	switch scheme {
+	case RSA_SCHEME:
+		priv, err := NewRSAPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{key: priv}, nil
+	case ED25519_SCHEME:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &ed25519Signer{key: priv}, nil
+	case ECDSA_P256_SCHEME:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{key: priv}, nil
+	}
+	return nil, errors.New("Sign Scheme not supported")
+}
+
+// Wrap an existing private key (as returned by x509.ParsePKCS8PrivateKey) in a Signer.
+func SignerFromPrivateKey(priv crypto.PrivateKey) (Signer, error) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		return &rsaSigner{key: key}, nil
+	case ed25519.PrivateKey:
+		return &ed25519Signer{key: key}, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("Only P-256 ECDSA keys are supported")
+		}
+		return &ecdsaSigner{key: key}, nil
+	}
+	return nil, errors.New("Sign Scheme not supported")
+}
+
+// Returns the scheme a public key can verify.
+func SchemeOfPublicKey(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return RSA_SCHEME, nil
+	case ed25519.PublicKey:
+		return ED25519_SCHEME, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return ECDSA_P256_SCHEME, nil
+		}
+	}
+	return "", errors.New("Sign Scheme not supported")
+}
+
+// Verify a signature made under the given scheme.
+// The public key must belong to the same scheme, so a signature cannot be replayed under another one.
+func VerifyWithPublicKey(scheme string, pub crypto.PublicKey, msg []byte, sig []byte) error {
+	keyScheme, err := SchemeOfPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if keyScheme != scheme {
+		return fmt.Errorf("Signature scheme %s does not match the %s public key", scheme, keyScheme)
+	}
+	switch scheme {
+	case RSA_SCHEME:
+		return RSAVerify(msg, RSASig{Sig: sig}, pub.(*rsa.PublicKey))
+	case ED25519_SCHEME:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), msg, sig) {
+			return errors.New("ed25519: verification error")
+		}
+		return nil
+	case ECDSA_P256_SCHEME:
+		hash, err := GenerateSHA256(msg)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), hash, sig) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	}
+	return errors.New("Sign Scheme not supported")
+}
+
+// Signers and public keys are stored as PKCS8 and PKIX DER, which covers every supported scheme.
+func MarshalSigner(s Signer) ([]byte, error) {
+	switch key := s.(type) {
+	case *rsaSigner:
+		return x509.MarshalPKCS8PrivateKey(key.key)
+	case *ed25519Signer:
+		return x509.MarshalPKCS8PrivateKey(key.key)
+	case *ecdsaSigner:
+		return x509.MarshalPKCS8PrivateKey(key.key)
+	}
+	return nil, errors.New("Sign Scheme not supported")
+}
+
+func ParseSigner(der []byte) (Signer, error) {
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return SignerFromPrivateKey(priv)
+}
+
+// Public key map for the non-RSA schemes. RSA keys stay in the RSAPublicMap for compatibility,
+// CryptoConfig.SignPublicKey checks both.
+type SignPublicKeyMap map[CTngID]crypto.PublicKey
+
+func (p *SignPublicKeyMap) Serialize() (map[string][]byte, error) {
+	serialized := make(map[string][]byte)
+	for id, key := range *p {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		serialized[id.String()] = der
+	}
+	return serialized, nil
+}
+
+// Deserialize takes the serialized version of the public map, deserializes it, and puts it in p.
+// p should be allocated space for the SignPublicKeyMap to be stored.
+func (p *SignPublicKeyMap) Deserialize(serialized map[string][]byte) error {
+	for id, der := range serialized {
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return err
+		}
+		if _, err := SchemeOfPublicKey(pub); err != nil {
+			return err
+		}
+		(*p)[CTngID(id)] = pub
+	}
+	return nil
+}
+
+// Signature is the scheme-tagged envelope for "normal" signatures.
+// Its string form extends the RSASig one with a scheme field; strings without it are read as RSA,
+// so objects signed before the envelope existed still verify.
+// The key version is only written once the signer has rotated its key, see keyversion.go.
+type Signature struct {
+	Scheme  string
+	Sig     []byte
+	ID      CTngID
+	Version int
+}
+
+func (s Signature) String() string {
+	if s.Version != 0 {
+		return fmt.Sprintf(`{"scheme":"%s","sig":"%s","id":"%s","version":"%d"}`, s.Scheme, hex.EncodeToString(s.Sig), s.ID.String(), s.Version)
+	}
+	return fmt.Sprintf(`{"scheme":"%s","sig":"%s","id":"%s"}`, s.Scheme, hex.EncodeToString(s.Sig), s.ID.String())
+}
+
+func SignatureFromString(str string) (Signature, error) {
+	stringmap := make(map[string]string)
+	sig := new(Signature)
+	err := json.Unmarshal([]byte(str), &stringmap)
+	if err != nil {
+		return *sig, err
+	}
+	sig.Sig, err = hex.DecodeString(stringmap["sig"])
+	if err != nil {
+		return *sig, err
+	}
+	sig.ID = CTngID(stringmap["id"])
+	sig.Scheme = stringmap["scheme"]
+	if sig.Scheme == "" {
+		sig.Scheme = RSA_SCHEME
+	}
+	if version, ok := stringmap["version"]; ok {
+		sig.Version, err = strconv.Atoi(version)
+		if err != nil {
+			return *sig, err
+		}
+	}
+	return *sig, nil
+}
+
+// Converts a bare RSA signature into the envelope.
+func (s RSASig) Signature() Signature {
+	return Signature{Scheme: RSA_SCHEME, Sig: s.Sig, ID: s.ID}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/herumi/bls-go-binary/bls"
 )
@@ -186,14 +187,19 @@ type BlsPrivateMap map[CTngID]bls.SecretKey
 // signer(s) from the gossip object, as opposed to having it stored in the signature.
 // Two possible refactors: remove the ID field altogether, or change it to a CTngID.
 type SigFragment struct {
-	Sign *bls.Sign
-	ID   CTngID
+	Sign  *bls.Sign
+	ID    CTngID
+	Epoch int // threshold key epoch the fragment was signed in, see reshare.go
 }
 
 // Convert a SigFragment to a string.
 // Signatures need to be turned into strings to be stored in Gossip Objects.
 // To convert back, use SigFragmentFromString().
+// The epoch is left out while it is 0, so fragments from before resharing existed keep their format.
 func (s SigFragment) String() string {
+	if s.Epoch != 0 {
+		return fmt.Sprintf(`{"sign":"%s","id":"%s","epoch":%d}`, s.Sign.SerializeToHexStr(), s.ID.String(), s.Epoch)
+	}
 	return fmt.Sprintf(`{"sign":"%s","id":"%s"}`, s.Sign.SerializeToHexStr(), s.ID.String())
 }
 
@@ -201,22 +207,28 @@ func (s SigFragment) String() string {
 func SigFragmentFromString(str string) (SigFragment, error) {
 	s := new(SigFragment)
 	s.Sign = new(bls.Sign)
-	stringmap := make(map[string]string)
-	err := json.Unmarshal([]byte(str), &stringmap)
+	fstr := struct {
+		Sign  string
+		ID    string
+		Epoch int
+	}{}
+	err := json.Unmarshal([]byte(str), &fstr)
 	if err != nil {
 		return *s, err
 	}
-	err = s.Sign.DeserializeHexStr(stringmap["sign"])
+	err = s.Sign.DeserializeHexStr(fstr.Sign)
 	if err != nil {
 		return *s, err
 	}
-	s.ID = CTngID(stringmap["id"])
+	s.ID = CTngID(fstr.ID)
+	s.Epoch = fstr.Epoch
 	return *s, err
 }
 
 type ThresholdSig struct {
-	IDs  []CTngID // Users must know the list of IDs that created the theshold signature to verify.
-	Sign *bls.Sign
+	IDs   []CTngID // Users must know the list of IDs that created the theshold signature to verify.
+	Sign  *bls.Sign
+	Epoch int // Users must also know which epoch's public key shares to verify against.
 }
 
 func (t ThresholdSig) String() (string, error) {
@@ -228,6 +240,9 @@ func (t ThresholdSig) String() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if t.Epoch != 0 {
+		return fmt.Sprintf(`{"sign":"%s", "ids":%s, "epoch":%d}`, t.Sign.SerializeToHexStr(), idsStr, t.Epoch), nil
+	}
 	return fmt.Sprintf(`{"sign":"%s", "ids":%s}`, t.Sign.SerializeToHexStr(), idsStr), nil
 }
 
@@ -235,8 +250,9 @@ func ThresholdSigFromString(str string) (ThresholdSig, error) {
 	t := new(ThresholdSig)
 	// Capture the fields in the struct generated below
 	tstr := struct {
-		Sign string
-		IDs  []string
+		Sign  string
+		IDs   []string
+		Epoch int
 	}{}
 	err := json.Unmarshal([]byte(str), &tstr)
 	if err != nil {
@@ -247,6 +263,7 @@ func ThresholdSigFromString(str string) (ThresholdSig, error) {
 	for i, id := range tstr.IDs {
 		t.IDs[i] = CTngID(id)
 	}
+	t.Epoch = tstr.Epoch
 	t.Sign = new(bls.Sign)
 	err = t.Sign.DeserializeHexStr(tstr.Sign)
 	return *t, err
@@ -257,14 +274,33 @@ type CryptoConfig struct {
 	Threshold       int //f+1 is the threshold for signing
 	N               int //n is the number of participants
 	HashScheme      HashAlgorithm
-	SignScheme      string // "rsa" is the only valid value currently.
+	SignScheme      string // "rsa", "ed25519" or "ecdsa-p256": the scheme this entity signs with.
 	ThresholdScheme string // "bls" is the only valid value currently.
 	//entityIDs          []CTngID      // id of each entity (DNS string), should really exist outside of this struct.
-	SelfID             CTngID         // id of the current entity
-	SignPublicMap      RSAPublicMap   // map of entityID to RSA public key
-	SignSecretKey      rsa.PrivateKey // RSA private key
-	ThresholdPublicMap BlsPublicMap   // mapping of BLS IDs to public keys
-	ThresholdSecretKey bls.SecretKey  // secret key for the current entity
+	SelfID             CTngID                     // id of the current entity
+	SignPublicMap      RSAPublicMap               // map of entityID to RSA public key
+	SignSecretKey      rsa.PrivateKey             // RSA private key, still used for X.509 issuance
+	SignPublicKeys     SignPublicKeyMap           // map of entityID to public key of any sign scheme
+	SignKey            Signer                     // private key for SignScheme, nil when signing with SignSecretKey
+	SignKeyVersion     int                        // version of the key this entity signs with, see keyversion.go
+	KeyVersions        map[CTngID][]KeyVersion    // key history of the entities which rotated their key
+	NextKeyHashes      map[CTngID][]byte          // commitment of every entity to its first rotated key, see keyversion.go
+	NextSignKey        Signer                     // private key committed for the next rotation of this entity
+	ThresholdPublicMap BlsPublicMap               // mapping of BLS IDs to public keys
+	ThresholdSecretKey bls.SecretKey              // secret key for the current entity
+	ThresholdEpoch     int                        // incremented by every resharing of the threshold keys
+	PastThresholdKeys  map[int]ThresholdEpochKeys // public keys of earlier epochs, to verify old objects
+	// guards the threshold keys, a DKG or resharing swaps them while the entity is signing
+	thresholdLock sync.RWMutex
+	// guards SignPublicKeys, KeyVersions and the sign keys, key rotations change them while the entity verifies and signs
+	keyLock sync.RWMutex
+}
+
+// The threshold public keys of one epoch.
+type ThresholdEpochKeys struct {
+	Threshold int
+	N         int
+	PublicMap BlsPublicMap
 }
 
 //without threshold scheme
@@ -285,11 +321,26 @@ type StoredCryptoConfig struct {
 	Threshold       int    //f+1 is the threshold for signing
 	N               int    //n is the number of participants
 	HashScheme      int
-	SignScheme      string // "rsa" is the only valid value currently.
+	SignScheme      string // "rsa", "ed25519" or "ecdsa-p256".
 	ThresholdScheme string // "bls" is the only valid value currently.
 	//entityIDs          []CTngID      // id of each entity (DNS string), should really exist outside of this struct.
-	SignPublicMap      RSAPublicMap      // map of entityID to RSA public key
-	SignSecretKey      rsa.PrivateKey    // RSA private key
-	ThresholdPublicMap map[string][]byte // mapping of BLS IDs to public keys
+	SignPublicMap      RSAPublicMap                  // map of entityID to RSA public key
+	SignSecretKey      rsa.PrivateKey                // RSA private key
+	SignPublicKeys     map[string][]byte             `json:",omitempty"` // PKIX public keys of non-RSA signers
+	SignKey            []byte                        `json:",omitempty"` // PKCS8 private key for a non-RSA SignScheme
+	SignKeyVersion     int                           `json:",omitempty"`
+	KeyVersions        map[string][]StoredKeyVersion `json:",omitempty"`
+	NextKeyHashes      map[string][]byte             `json:",omitempty"`
+	NextSignKey        []byte                        `json:",omitempty"` // PKCS8 private key committed for the next rotation
+	ThresholdPublicMap map[string][]byte             // mapping of BLS IDs to public keys
 	ThresholdSecretKey []byte
+	ThresholdEpoch     int                              `json:",omitempty"`
+	PastThresholdKeys  map[int]StoredThresholdEpochKeys `json:",omitempty"`
+	KeyStore           string                           `json:",omitempty"` // key store file holding the private keys, see keystore.go
+}
+
+type StoredThresholdEpochKeys struct {
+	Threshold int
+	N         int
+	PublicMap map[string][]byte
 }
@@ -0,0 +1,193 @@
+package definition
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/util"
+	"encoding/json"
+	"errors"
+)
+
+// Reasons a monitor accuses a logger or CA, carried in Payload[1] of the ACC_INIT.
+// An empty reason is an accusation made before reasons existed.
+const (
+	ACC_UNREACHABLE       = "unreachable"
+	ACC_MALFORMED         = "malformed"
+	ACC_INVALID_SIGNATURE = "invalid_signature"
+	ACC_INVALID_SRH       = "invalid_srh"
+)
+
+// What the monitor saw when it accused the entity, carried as json in Payload[2] of the ACC_INIT.
+type Accusation_evidence struct {
+	// Timestamp of the request that failed
+	Request_time string `json:"request_time"`
+	Error        string `json:"error,omitempty"`
+	// The bad object, if the entity answered with one
+	Object *Gossip_object `json:"object,omitempty"`
+}
+
+func Accusation_reason_valid(reason string) bool {
+	switch reason {
+	case "", ACC_UNREACHABLE, ACC_MALFORMED, ACC_INVALID_SIGNATURE, ACC_INVALID_SRH:
+		return true
+	default:
+		return false
+	}
+}
+
+// An accusation of the entity accused, signed by the accuser.
+func Generate_ACC_INIT(c *crypto.CryptoConfig, accused string, reason string, evidence Accusation_evidence) (Gossip_object, error) {
+	evidence_json, err := json.Marshal(evidence)
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	payload := [3]string{accused, reason, string(evidence_json)}
+	signature, err := c.Sign([]byte(payload[0] + payload[1] + payload[2]))
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	return Gossip_object{
+		Application:   CTNG_APPLICATION,
+		Type:          ACC_INIT,
+		Period:        util.GetCurrentPeriod(),
+		Signer:        c.SelfID.String(),
+		Timestamp:     util.GetCurrentTimestamp(),
+		Signature:     [2]string{signature.String(), ""},
+		Crypto_Scheme: signature.Scheme,
+		Payload:       payload,
+	}, nil
+}
+
+// The evidence of an ACC_INIT, the zero value for accusations without evidence.
+func Get_accusation_evidence(g Gossip_object) (Accusation_evidence, error) {
+	var evidence Accusation_evidence
+	if g.Payload[2] == "" {
+		return evidence, nil
+	}
+	err := json.Unmarshal([]byte(g.Payload[2]), &evidence)
+	return evidence, err
+}
+
+// Gossipers threshold sign only the accused entity, so that accusations of different monitors aggregate.
+// The signed ACC_INIT moves into the evidence of the object.
+func Strip_accusation(g Gossip_object) Gossip_object {
+	accusation := g
+	accusation.Evidence = nil
+	g.Payload = [3]string{g.Payload[0], "", ""}
+	g.Evidence = []Gossip_object{accusation}
+	return g
+}
+
+// The accusations of all the fragments, one per accuser.
+func Merge_accusations(g_list []Gossip_object) []Gossip_object {
+	seen := make(map[string]bool)
+	merged := []Gossip_object{}
+	for _, g := range g_list {
+		for _, accusation := range g.Evidence {
+			if seen[accusation.Signer] {
+				continue
+			}
+			seen[accusation.Signer] = true
+			merged = append(merged, accusation)
+		}
+	}
+	return merged
+}
+
+// Checks the accusations carried by an ACC_FRAG or ACC_FULL.
+// Objects without evidence are accepted, the threshold signature alone makes the PoM.
+func Verify_ACC_evidence(g Gossip_object, c *crypto.CryptoConfig) error {
+	for _, accusation := range g.Evidence {
+		if accusation.Type != ACC_INIT || accusation.Payload[0] != g.Payload[0] {
+			return errors.New("The evidence is not an accusation of " + g.Payload[0])
+		}
+		if !Accusation_reason_valid(accusation.Payload[1]) {
+			return errors.New("Unknown accusation reason " + accusation.Payload[1])
+		}
+		if _, err := Get_accusation_evidence(accusation); err != nil {
+			return err
+		}
+		sig, err := crypto.SignatureFromString(accusation.Signature[0])
+		if err != nil {
+			return errors.New(No_Sig_Match)
+		}
+		if sig.ID.String() != accusation.Signer {
+			return errors.New("The accusation is not signed by " + accusation.Signer)
+		}
+		if err := Verify_SignedPayload(accusation, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The response of an accused entity to the accusations of a period, signed by the entity.
+// response is the object the entity claims to have served, it can be nil.
+func Generate_DIS_INIT(c *crypto.CryptoConfig, period string, statement string, response *Gossip_object) (Gossip_object, error) {
+	var payload [3]string
+	payload[0] = c.SelfID.String()
+	payload[1] = statement
+	if response != nil {
+		response_json, err := json.Marshal(response)
+		if err != nil {
+			return Gossip_object{}, err
+		}
+		payload[2] = string(response_json)
+	}
+	signature, err := c.Sign([]byte(payload[0] + payload[1] + payload[2]))
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	return Gossip_object{
+		Application:   CTNG_APPLICATION,
+		Type:          DIS_INIT,
+		Period:        period,
+		Signer:        c.SelfID.String(),
+		Timestamp:     util.GetCurrentTimestamp(),
+		Signature:     [2]string{signature.String(), ""},
+		Crypto_Scheme: signature.Scheme,
+		Payload:       payload,
+	}, nil
+}
+
+// The object the entity claims to have served, nil if the dispute has none.
+func Get_dispute_response(g Gossip_object) (*Gossip_object, error) {
+	if g.Payload[2] == "" {
+		return nil, nil
+	}
+	var response Gossip_object
+	err := json.Unmarshal([]byte(g.Payload[2]), &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// A dispute must be signed by the entity itself, so must the object it claims to have served.
+func Verify_DIS_INIT(g Gossip_object, c *crypto.CryptoConfig) error {
+	sig, err := crypto.SignatureFromString(g.Signature[0])
+	if err != nil {
+		return errors.New(No_Sig_Match)
+	}
+	if sig.ID.String() != g.Payload[0] {
+		return errors.New("The dispute is not signed by " + g.Payload[0])
+	}
+	err = Verify_SignedPayload(g, c)
+	if err != nil {
+		return err
+	}
+	response, err := Get_dispute_response(g)
+	if err != nil || response == nil {
+		return err
+	}
+	if response.Type != STH_INIT && response.Type != REV_INIT {
+		return errors.New("The response is not an STH or a REV")
+	}
+	if response.Payload[0] != g.Payload[0] || response.Period != g.Period {
+		return errors.New("The response is not the object of " + g.Payload[0] + " for period " + g.Period)
+	}
+	response_sig, err := crypto.SignatureFromString(response.Signature[0])
+	if err != nil || response_sig.ID.String() != g.Payload[0] {
+		return errors.New("The response is not signed by " + g.Payload[0])
+	}
+	return Verify_SignedPayload(*response, c)
+}
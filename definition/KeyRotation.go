@@ -0,0 +1,93 @@
+package definition
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/util"
+	"errors"
+)
+
+// Announces key as the next signing key of the entity, valid from the given period on, and commits to next for the rotation after it.
+// key must be the key the entity committed to before.
+// The announcement is signed with the current key, the new key proves possession by signing the rotation.
+func Generate_KEY_INIT(c *crypto.CryptoConfig, key crypto.Signer, next crypto.Signer, valid_from int) (Gossip_object, error) {
+	rotation, err := c.NewKeyRotation(key, next, valid_from)
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	var payload [3]string
+	payload[0] = c.SelfID.String()
+	payload[1] = rotation.String()
+	proof, err := key.Sign([]byte(payload[0] + payload[1]))
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	payload[2] = crypto.Signature{Scheme: key.Scheme(), Sig: proof, ID: c.SelfID, Version: rotation.Version}.String()
+	signature, err := c.Sign([]byte(payload[0] + payload[1] + payload[2]))
+	if err != nil {
+		return Gossip_object{}, err
+	}
+	return Gossip_object{
+		Application:   CTNG_APPLICATION,
+		Type:          KEY_INIT,
+		Period:        util.GetCurrentPeriod(),
+		Signer:        c.SelfID.String(),
+		Timestamp:     util.GetCurrentTimestamp(),
+		Signature:     [2]string{signature.String(), ""},
+		Crypto_Scheme: signature.Scheme,
+		Payload:       payload,
+	}, nil
+}
+
+// Records the key rotation of a KEY_FULL in the crypto config.
+// The threshold signature of the object must have been verified already.
+func Apply_KEY_FULL(g Gossip_object, c *crypto.CryptoConfig) error {
+	if g.Type != KEY_FULL {
+		return errors.New(Invalid_Type)
+	}
+	rotation, err := crypto.KeyRotationFromString(g.Payload[1])
+	if err != nil {
+		return err
+	}
+	if rotation.ID.String() != g.Payload[0] {
+		return errors.New(Mislabel)
+	}
+	return c.ApplyKeyRotation(rotation)
+}
+
+// A key rotation an entity has announced but does not sign with yet.
+type Pending_key_rotation struct {
+	KEY_INIT Gossip_object
+	Key      crypto.Signer // the key committed to before, announced by KEY_INIT
+	Next     crypto.Signer // the key KEY_INIT commits to for the rotation after it
+	Rotation crypto.KeyRotation
+}
+
+// Announce the key the entity committed to for the given period, and commit to a new key of the given scheme.
+func New_pending_key_rotation(c *crypto.CryptoConfig, scheme string, valid_from int) (*Pending_key_rotation, error) {
+	key := c.CommittedSignKey()
+	if key == nil {
+		return nil, errors.New("No key committed for the next rotation of " + c.SelfID.String())
+	}
+	next, err := crypto.NewSigner(scheme)
+	if err != nil {
+		return nil, err
+	}
+	KEY_INIT, err := Generate_KEY_INIT(c, key, next, valid_from)
+	if err != nil {
+		return nil, err
+	}
+	rotation, err := crypto.KeyRotationFromString(KEY_INIT.Payload[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Pending_key_rotation{KEY_INIT: KEY_INIT, Key: key, Next: next, Rotation: rotation}, nil
+}
+
+// Switch to the new key once the entity signs for its first valid period.
+// Returns true if the key was installed.
+func (p *Pending_key_rotation) Install(c *crypto.CryptoConfig, period int) (bool, error) {
+	if period < p.Rotation.ValidFrom {
+		return false, nil
+	}
+	return true, c.InstallSignKey(p.Key, p.Next, p.Rotation)
+}
@@ -16,6 +16,9 @@ type Gossip_object struct {
 	Timestamp     string    `json:"timestamp"`
 	Crypto_Scheme string    `json:"crypto_scheme"`
 	Payload       [3]string `json:"payload,omitempty"`
+	// CON objects carry the two conflicting objects with their original signatures.
+	// The evidence is not covered by the threshold signature, Verify_CON_evidence checks it against the payload.
+	Evidence []Gossip_object `json:"evidence,omitempty"`
 }
 
 type PoM_Counter struct {
@@ -54,16 +57,20 @@ const (
 	ACC_INIT = "http://ctng.uconn.edu/103"
 	CON_INIT = "http://ctng.uconn.edu/104"
 	NUM_INIT = "http://ctng.uconn.edu/105"
+	KEY_INIT = "http://ctng.uconn.edu/106"
+	DIS_INIT = "http://ctng.uconn.edu/107"
 	STH_FRAG = "http://ctng.uconn.edu/201"
 	REV_FRAG = "http://ctng.uconn.edu/202"
 	ACC_FRAG = "http://ctng.uconn.edu/203"
 	CON_FRAG = "http://ctng.uconn.edu/204"
 	NUM_FRAG = "http://ctng.uconn.edu/205"
+	KEY_FRAG = "http://ctng.uconn.edu/206"
 	STH_FULL = "http://ctng.uconn.edu/301"
 	REV_FULL = "http://ctng.uconn.edu/302"
 	ACC_FULL = "http://ctng.uconn.edu/303"
 	CON_FULL = "http://ctng.uconn.edu/304"
 	NUM_FULL = "http://ctng.uconn.edu/305"
+	KEY_FULL = "http://ctng.uconn.edu/306"
 )
 
 type Gossip_Storage map[Gossip_ID]Gossip_object
@@ -96,6 +103,8 @@ func (g Gossip_object) GetTargetType() string {
 		return ACC_FRAG
 	case CON_INIT:
 		return CON_FRAG
+	case KEY_INIT:
+		return KEY_FRAG
 	case STH_FRAG:
 		return STH_FULL
 	case REV_FRAG:
@@ -104,6 +113,8 @@ func (g Gossip_object) GetTargetType() string {
 		return ACC_FULL
 	case CON_FRAG:
 		return CON_FULL
+	case KEY_FRAG:
+		return KEY_FULL
 	default:
 		return ""
 	}
@@ -134,13 +145,25 @@ func (p PoM_Counter) GetID() string {
 
 // ACC_INIT Payload
 // 0: loggerURL/CAURL
-// 1: empty
-// 2: empty
+// 1: Accusation reason, empty for accusations without one
+// 2: Accusation_evidence json
+// ACC_FRAG and ACC_FULL only sign Payload[0], the signed ACC_INITs are kept in Evidence
 
 // CON_INIT Payload
 // 0: loggerURL/CAURL
 // 1: Conflicting STH/REV 01
 // 2: Conflicting STH/REV 02
+// Evidence: the two conflicting STH_INIT/REV_INIT/KEY_INIT objects, kept in CON_FRAG and CON_FULL
+
+// KEY_INIT Payload
+// 0: loggerURL/CAURL/monitorURL
+// 1: Key rotation
+// 2: Signature of the new key over Payload[0]+Payload[1]
+
+// DIS_INIT Payload, Period is the period of the disputed accusation
+// 0: loggerURL/CAURL
+// 1: Statement of the entity
+// 2: STH_INIT/REV_INIT the entity served in that period, json, can be empty
 
 // This function prints the "name string" of each Gossip object type. It's used when printing this info to console.
 func TypeString(t string) string {
@@ -155,6 +178,10 @@ func TypeString(t string) string {
 		return "CON_INIT"
 	case NUM_INIT:
 		return "NUM_INIT"
+	case KEY_INIT:
+		return "KEY_INIT"
+	case DIS_INIT:
+		return "DIS_INIT"
 	case STH_FRAG:
 		return "STH_FRAG"
 	case REV_FRAG:
@@ -165,6 +192,8 @@ func TypeString(t string) string {
 		return "CON_FRAG"
 	case NUM_FRAG:
 		return "NUM_FRAG"
+	case KEY_FRAG:
+		return "KEY_FRAG"
 	case STH_FULL:
 		return "STH_FULL"
 	case REV_FULL:
@@ -175,6 +204,8 @@ func TypeString(t string) string {
 		return "CON_FULL"
 	case NUM_FULL:
 		return "NUM_FULL"
+	case KEY_FULL:
+		return "KEY_FULL"
 	default:
 		return "UNKNOWN"
 	}
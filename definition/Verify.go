@@ -3,8 +3,13 @@ package definition
 import (
 	"CTngV2/crypto"
 	"CTngV2/util"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	//"strings"
 	//"time"
 )
@@ -17,12 +22,12 @@ const (
 )
 
 func Verify_CON(g Gossip_object, c *crypto.CryptoConfig) error {
-	rsaSig1, sigerr1 := crypto.RSASigFromString(g.Signature[0])
-	rsaSig2, sigerr2 := crypto.RSASigFromString(g.Signature[1])
+	sig1, sigerr1 := crypto.SignatureFromString(g.Signature[0])
+	sig2, sigerr2 := crypto.SignatureFromString(g.Signature[1])
 	// Verify the signatures were made successfully
 	if sigerr1 == nil && sigerr2 == nil {
-		err1 := c.Verify([]byte(g.Payload[1]), rsaSig1)
-		err2 := c.Verify([]byte(g.Payload[2]), rsaSig2)
+		err1 := Verify_SignatureForPeriod(c, []byte(g.Payload[1]), sig1, Signed_period(g.Payload[0], g.Payload[1]))
+		err2 := Verify_SignatureForPeriod(c, []byte(g.Payload[2]), sig2, Signed_period(g.Payload[0], g.Payload[2]))
 		fmt.Print(util.YELLOW, err1, err2, util.RESET)
 		if err1 == nil && err2 == nil {
 			return nil
@@ -30,7 +35,7 @@ func Verify_CON(g Gossip_object, c *crypto.CryptoConfig) error {
 			return errors.New("Message Signature Mismatch" + fmt.Sprint(err1) + fmt.Sprint(err2))
 		}
 	} else {
-		fmt.Println(util.RED, "RSAsigConversionerror", util.RESET)
+		fmt.Println(util.RED, "SignatureConversionerror", util.RESET)
 	}
 	return errors.New("Message Signature Mismatch" + fmt.Sprint(sigerr1) + fmt.Sprint(sigerr2))
 }
@@ -63,35 +68,233 @@ func Verify_PayloadThreshold(g Gossip_object, c *crypto.CryptoConfig) error {
 	}
 }
 
-// Verifies RSAsig matches payload, wait.... i think this just works out of the box with what we have
-func Verify_RSAPayload(g Gossip_object, c *crypto.CryptoConfig) error {
+// Verifies the threshold signatures of many FULL objects in a single batch.
+// Returns the indices of the objects which failed verification, nil if all of them verified.
+func Verify_PayloadThreshold_Batch(objs []Gossip_object, c *crypto.CryptoConfig) []int {
+	var failed []int
+	msgs := make([]string, 0, len(objs))
+	sigs := make([]crypto.ThresholdSig, 0, len(objs))
+	// Position in objs of each entry of the batch
+	positions := make([]int, 0, len(objs))
+	for i, g := range objs {
+		if g.Signature[0] == "" || g.Payload[0] == "" {
+			failed = append(failed, i)
+			continue
+		}
+		sig, err := crypto.ThresholdSigFromString(g.Signature[0])
+		if err != nil {
+			failed = append(failed, i)
+			continue
+		}
+		msgs = append(msgs, g.Payload[0]+g.Payload[1]+g.Payload[2])
+		sigs = append(sigs, sig)
+		positions = append(positions, i)
+	}
+	err := c.ThresholdBatchVerify(msgs, sigs)
+	if batchErr, ok := err.(*crypto.BatchVerifyError); ok {
+		for _, j := range batchErr.Failed {
+			failed = append(failed, positions[j])
+		}
+	} else if err != nil {
+		return all_indices(objs)
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+func all_indices(objs []Gossip_object) []int {
+	indices := make([]int, len(objs))
+	for i := range objs {
+		indices[i] = i
+	}
+	return indices
+}
+
+// Checks that the two objects of a conflict PoM are different objects of the accused entity for the same slot:
+// two STHs or two REVs for the same period, or two key rotations to the same version.
+// The signatures of the two objects are checked by Verify_CON_evidence.
+func Verify_CON_payload(g Gossip_object) error {
+	if g.Payload[0] == "" {
+		return errors.New(Mislabel)
+	}
+	if g.Payload[1] == g.Payload[2] {
+		return errors.New("The objects of the conflict are identical")
+	}
+	slot1, err := conflict_slot(g.Payload[0], g.Payload[1])
+	if err != nil {
+		return err
+	}
+	slot2, err := conflict_slot(g.Payload[0], g.Payload[2])
+	if err != nil {
+		return err
+	}
+	if slot1 != slot2 {
+		return errors.New("The objects of the conflict do not conflict: " + slot1 + " and " + slot2)
+	}
+	return nil
+}
+
+// Checks the evidence of a CON object: the two conflicting objects, each signed by the accused entity
+// with its key for the period of the object, whose payloads are the ones in the CON.
+// Anyone with the entity's public key can verify a conflict this way, without trusting the gossipers.
+func Verify_CON_evidence(g Gossip_object, c *crypto.CryptoConfig) error {
+	if len(g.Evidence) != 2 {
+		return errors.New("A conflict needs the two conflicting objects as evidence")
+	}
+	err := Verify_CON_payload(g)
+	if err != nil {
+		return err
+	}
+	for i, obj := range g.Evidence {
+		if obj.Type != STH_INIT && obj.Type != REV_INIT && obj.Type != KEY_INIT {
+			return errors.New("The evidence is not an STH, a REV or a key rotation")
+		}
+		if obj.Payload[0] != g.Payload[0] || obj.Payload[0]+obj.Payload[1]+obj.Payload[2] != g.Payload[i+1] {
+			return errors.New("The evidence does not match the conflicting objects")
+		}
+		sig, err := crypto.SignatureFromString(obj.Signature[0])
+		if err != nil {
+			return errors.New(No_Sig_Match)
+		}
+		if sig.ID.String() != g.Payload[0] {
+			return errors.New("The evidence is not signed by " + g.Payload[0])
+		}
+		err = Verify_SignedPayload(obj, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The kind and period (or key version) of an object concatenated into a CON payload.
+func conflict_slot(entity string, obj string) (string, error) {
+	if !strings.HasPrefix(obj, entity) {
+		return "", errors.New("The conflicting object is not from " + entity)
+	}
+	rest := strings.TrimPrefix(obj, entity)
+	// REV payload: CAURL, "CRV", revocation
+	if strings.HasPrefix(rest, "CRV") {
+		var rev Revocation
+		err := json.Unmarshal([]byte(strings.TrimPrefix(rest, "CRV")), &rev)
+		if err != nil || rev.Period == "" {
+			return "", errors.New("The conflicting object is not a revocation")
+		}
+		return "REV@" + rev.Period, nil
+	}
+	// STH payload: loggerURL, STH, empty; KEY_INIT payload: URL, rotation, proof
+	var fields struct {
+		Period    string
+		RootHash  *string
+		ValidFrom *int
+		Version   int
+	}
+	err := json.NewDecoder(strings.NewReader(rest)).Decode(&fields)
+	if err != nil {
+		return "", errors.New("The conflicting object can not be parsed")
+	}
+	switch {
+	case fields.RootHash != nil && fields.Period != "":
+		return "STH@" + fields.Period, nil
+	case fields.ValidFrom != nil:
+		return "KEY@" + strconv.Itoa(fields.Version), nil
+	}
+	return "", errors.New("The conflicting object is neither an STH, a REV nor a key rotation")
+}
+
+// Verifies the signer's signature matches payload, for whichever sign scheme the signer uses.
+func Verify_SignedPayload(g Gossip_object, c *crypto.CryptoConfig) error {
 	if g.Signature[0] != "" && g.Payload[0] != "" {
-		sig, err := crypto.RSASigFromString(g.Signature[0])
+		sig, err := crypto.SignatureFromString(g.Signature[0])
 		if err != nil {
 			return errors.New(No_Sig_Match)
 		}
-		return c.Verify([]byte(g.Payload[0]+g.Payload[1]+g.Payload[2]), sig)
+		msg := g.Payload[0] + g.Payload[1] + g.Payload[2]
+		return Verify_SignatureForPeriod(c, []byte(msg), sig, Signed_period(g.Payload[0], msg))
 
 	} else {
 		return errors.New(Mislabel)
 	}
 }
 
+// The period an entity signed a payload for: the period inside its STH or revocation.
+// Gossip_object.Period is not covered by the signature, so it must not pick the key version.
+// Payloads without a period (accusations, disputes, key rotations) give "".
+func Signed_period(entity string, payload string) string {
+	slot, err := conflict_slot(entity, payload)
+	if err != nil || !(strings.HasPrefix(slot, "STH@") || strings.HasPrefix(slot, "REV@")) {
+		return ""
+	}
+	return strings.SplitN(slot, "@", 2)[1]
+}
+
+// Signatures are verified with the signer's key that was valid for their period.
+// Without a numeric period, only the current key is accepted.
+func Verify_SignatureForPeriod(c *crypto.CryptoConfig, msg []byte, sig crypto.Signature, period string) error {
+	period_int, err := strconv.Atoi(period)
+	if err != nil {
+		return c.Verify(msg, sig)
+	}
+	return c.VerifyForPeriod(msg, sig, period_int)
+}
+
+// Verifies a key rotation: the announcement must be signed with the entity's current key,
+// the new key must be the one the current key version committed to, and the proof of possession
+// must be signed with the new key. See crypto/keyversion.go.
+func Verify_KEY_INIT(g Gossip_object, c *crypto.CryptoConfig) error {
+	err := Verify_SignedPayload(g, c)
+	if err != nil {
+		return err
+	}
+	rotation, err := crypto.KeyRotationFromString(g.Payload[1])
+	if err != nil {
+		return err
+	}
+	sig, _ := crypto.SignatureFromString(g.Signature[0])
+	if rotation.ID.String() != g.Payload[0] || sig.ID != rotation.ID {
+		return errors.New(Mislabel)
+	}
+	versions, err := c.KeyHistory(rotation.ID)
+	if err != nil {
+		return err
+	}
+	if rotation.Version != versions[len(versions)-1].Version+1 {
+		return fmt.Errorf("Expected key version %d, got %d", versions[len(versions)-1].Version+1, rotation.Version)
+	}
+	err = crypto.CheckCommittedKey(versions[len(versions)-1], rotation)
+	if err != nil {
+		return err
+	}
+	pub, err := x509.ParsePKIXPublicKey(rotation.PublicKey)
+	if err != nil {
+		return err
+	}
+	proof, err := crypto.SignatureFromString(g.Payload[2])
+	if err != nil {
+		return err
+	}
+	return crypto.VerifyWithPublicKey(proof.Scheme, pub, []byte(g.Payload[0]+g.Payload[1]), proof.Sig)
+}
+
 //Verifies Gossip object based on the type:
-//STH and Revocations use RSA
+//STH and Revocations use the signer's sign scheme, with the key valid for their period
 //Trusted information Fragments use BLS SigFragments
 //PoMs use Threshold signatures
 func (g Gossip_object) Verify(c *crypto.CryptoConfig) error {
 	// If everything Verified correctly, we return nil
 	switch g.Type {
 	case STH_INIT:
-		return Verify_RSAPayload(g, c)
+		return Verify_SignedPayload(g, c)
 	case REV_INIT:
-		return Verify_RSAPayload(g, c)
+		return Verify_SignedPayload(g, c)
 	case ACC_INIT:
-		return Verify_RSAPayload(g, c)
+		return Verify_SignedPayload(g, c)
 	case CON_INIT:
 		return Verify_CON(g, c)
+	case KEY_INIT:
+		return Verify_KEY_INIT(g, c)
+	case DIS_INIT:
+		return Verify_DIS_INIT(g, c)
 	case STH_FRAG:
 		return Verify_PayloadFrag(g, c)
 	case REV_FRAG:
@@ -100,6 +303,8 @@ func (g Gossip_object) Verify(c *crypto.CryptoConfig) error {
 		return Verify_PayloadFrag(g, c)
 	case CON_FRAG:
 		return Verify_PayloadFrag(g, c)
+	case KEY_FRAG:
+		return Verify_PayloadFrag(g, c)
 	case STH_FULL:
 		return Verify_PayloadThreshold(g, c)
 	case REV_FULL:
@@ -108,6 +313,8 @@ func (g Gossip_object) Verify(c *crypto.CryptoConfig) error {
 		return Verify_PayloadThreshold(g, c)
 	case CON_FULL:
 		return Verify_PayloadThreshold(g, c)
+	case KEY_FULL:
+		return Verify_PayloadThreshold(g, c)
 	default:
 		return errors.New(Invalid_Type)
 	}
@@ -128,7 +335,7 @@ func (p PoM_Counter) Verify(c *crypto.CryptoConfig) error {
 
 func Verify_NUM_INIT(n PoM_Counter, c *crypto.CryptoConfig) error {
 	// Verify that the signature is valid
-	sig, _ := crypto.RSASigFromString(n.Signature)
+	sig, _ := crypto.SignatureFromString(n.Signature)
 	return c.Verify([]byte(n.ACC_FULL_Counter+n.CON_FULL_Counter+n.Period+n.Signer_Monitor), sig)
 }
 
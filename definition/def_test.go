@@ -1,9 +1,331 @@
 package definition
 
 import (
+	"CTngV2/crypto"
+	"CTngV2/util"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 func TestVerify(t *testing.T) {
 	// TODO
 }
+
+// Builds a FULL object over the payload, threshold signed by the first threshold configs.
+func threshold_signed_object(t *testing.T, configs []crypto.CryptoConfig, threshold int, payload [3]string) Gossip_object {
+	msg := payload[0] + payload[1] + payload[2]
+	frags := make([]crypto.SigFragment, threshold)
+	for i := 0; i < threshold; i++ {
+		frag, err := configs[i].ThresholdSign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frags[i] = frag
+	}
+	sig, err := configs[0].ThresholdAggregate(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigstr, err := sig.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Gossip_object{
+		Application: "CTng",
+		Type:        STH_FULL,
+		Period:      "0",
+		Signature:   [2]string{sigstr, ""},
+		Payload:     payload,
+	}
+}
+
+func TestVerifyPayloadThresholdBatch(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs := []Gossip_object{
+		threshold_signed_object(t, configs, 2, [3]string{"localhost:9000", "sth 1", ""}),
+		threshold_signed_object(t, configs, 2, [3]string{"localhost:9001", "sth 2", ""}),
+		threshold_signed_object(t, configs, 2, [3]string{"localhost:9002", "sth 3", ""}),
+	}
+	if failed := Verify_PayloadThreshold_Batch(objs, &configs[2]); failed != nil {
+		t.Errorf("Valid batch failed at %v", failed)
+	}
+	// Tamper with a payload and strip a signature
+	objs[0].Payload[1] = "sth 4"
+	objs[2].Signature[0] = ""
+	failed := Verify_PayloadThreshold_Batch(objs, &configs[2])
+	if len(failed) != 2 || failed[0] != 0 || failed[1] != 2 {
+		t.Errorf("Expected objects 0 and 2 to fail, got %v", failed)
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:8080", "localhost:8081", "localhost:8082"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Separate key maps for the rotating entity and the verifier
+	signer, err := crypto.NewCryptoConfig(crypto.NewStoredCryptoConfig(&configs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := crypto.NewCryptoConfig(crypto.NewStoredCryptoConfig(&configs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := crypto.NewSigner(crypto.ECDSA_P256_SCHEME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	period, _ := strconv.Atoi(util.GetCurrentPeriod())
+	key_init, err := Generate_KEY_INIT(signer, signer.CommittedSignKey(), next, period+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key_init.Verify(verifier); err != nil {
+		t.Errorf("Valid KEY_INIT failed: %v", err)
+	}
+	// Whoever holds the current key can not announce a key of their own
+	thief, err := crypto.NewCryptoConfig(crypto.NewStoredCryptoConfig(&configs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thief.NextKeyHashes[thief.SelfID], _ = crypto.KeyHash(next.Public())
+	stolen, err := Generate_KEY_INIT(thief, next, next, period+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stolen.Verify(verifier) == nil {
+		t.Errorf("KEY_INIT of a key that was not committed to verified")
+	}
+	// The new key must prove possession
+	forged := key_init
+	forged.Payload[2] = key_init.Signature[0]
+	if forged.Verify(verifier) == nil {
+		t.Errorf("KEY_INIT without a proof of possession verified")
+	}
+	// Once the gossipers signed it, the rotation is applied and the announcement is outdated
+	key_full := threshold_signed_object(t, configs, 2, key_init.Payload)
+	key_full.Type = KEY_FULL
+	if err := key_full.Verify(verifier); err != nil {
+		t.Errorf("Valid KEY_FULL failed: %v", err)
+	}
+	if err := Apply_KEY_FULL(key_full, verifier); err != nil {
+		t.Fatal(err)
+	}
+	if key_init.Verify(verifier) == nil {
+		t.Errorf("KEY_INIT verified after its rotation was applied")
+	}
+	// The old key is picked by the period inside the signed STH, not by the unsigned object period
+	sth := func(signed_period int, object_period int) Gossip_object {
+		js, _ := json.Marshal(STH{Signer: signer.SelfID.String(), Period: strconv.Itoa(signed_period), RootHash: "root"})
+		payload := [3]string{signer.SelfID.String(), string(js), ""}
+		sig, err := signer.Sign([]byte(payload[0] + payload[1] + payload[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Gossip_object{Type: STH_INIT, Period: strconv.Itoa(object_period), Signer: signer.SelfID.String(), Signature: [2]string{sig.String(), ""}, Payload: payload}
+	}
+	if err := sth(period, period).Verify(verifier); err != nil {
+		t.Errorf("STH of the old key for a period before the rotation failed: %v", err)
+	}
+	if sth(period+1, period).Verify(verifier) == nil {
+		t.Errorf("STH of the old key verified for a period after the rotation")
+	}
+}
+
+func TestVerifyCONPayload(t *testing.T) {
+	sth := func(period string, root string) string {
+		js, _ := json.Marshal(STH{Signer: "localhost:9000", Period: period, RootHash: root, TreeSize: 1})
+		return "localhost:9000" + string(js)
+	}
+	rev := func(period string, delta []byte) string {
+		js, _ := json.Marshal(Revocation{Period: period, Delta_CRV: delta, SRH: "srh"})
+		return "localhost:9100" + "CRV" + string(js)
+	}
+	key := func(version int, valid_from int) string {
+		rotation := crypto.KeyRotation{ID: "localhost:9000", Version: version, PublicKey: []byte{1}, ValidFrom: valid_from}
+		return "localhost:9000" + rotation.String() + `{"sig":"proof"}`
+	}
+	con := func(entity string, obj1 string, obj2 string) Gossip_object {
+		return Gossip_object{Type: CON_FULL, Payload: [3]string{entity, obj1, obj2}}
+	}
+	cases := []struct {
+		name  string
+		con   Gossip_object
+		valid bool
+	}{
+		{"two STHs for one period", con("localhost:9000", sth("1", "a"), sth("1", "b")), true},
+		{"two REVs for one period", con("localhost:9100", rev("1", []byte{1}), rev("1", []byte{2})), true},
+		{"two key rotations to one version", con("localhost:9000", key(1, 5), key(1, 6)), true},
+		{"key rotations to different versions", con("localhost:9000", key(1, 5), key(2, 6)), false},
+		{"identical STHs", con("localhost:9000", sth("1", "a"), sth("1", "a")), false},
+		{"STHs of different periods", con("localhost:9000", sth("1", "a"), sth("2", "b")), false},
+		{"STH of another logger", con("localhost:9001", sth("1", "a"), sth("1", "b")), false},
+		{"an STH and a REV", con("localhost:9000", sth("1", "a"), "localhost:9000"+strings.TrimPrefix(rev("1", nil), "localhost:9100")), false},
+		{"garbage", con("localhost:9000", "localhost:9000x", "localhost:9000y"), false},
+	}
+	for _, test := range cases {
+		err := Verify_CON_payload(test.con)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestVerifyCONEvidence(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:9000", "localhost:9001"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed_sth := func(c *crypto.CryptoConfig, root string) Gossip_object {
+		js, _ := json.Marshal(STH{Signer: c.SelfID.String(), Period: "1", RootHash: root})
+		payload := [3]string{c.SelfID.String(), string(js), ""}
+		sig, err := c.Sign([]byte(payload[0] + payload[1] + payload[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Gossip_object{Type: STH_INIT, Period: "1", Signer: c.SelfID.String(), Signature: [2]string{sig.String(), ""}, Payload: payload}
+	}
+	con := func(obj1 Gossip_object, obj2 Gossip_object) Gossip_object {
+		return Gossip_object{
+			Type:     CON_FULL,
+			Payload:  [3]string{obj1.Payload[0], obj1.Payload[0] + obj1.Payload[1] + obj1.Payload[2], obj2.Payload[0] + obj2.Payload[1] + obj2.Payload[2]},
+			Evidence: []Gossip_object{obj1, obj2},
+		}
+	}
+	sth_a := signed_sth(&configs[0], "a")
+	sth_b := signed_sth(&configs[0], "b")
+	if err := Verify_CON_evidence(con(sth_a, sth_b), &configs[1]); err != nil {
+		t.Errorf("Valid evidence failed: %v", err)
+	}
+	missing := con(sth_a, sth_b)
+	missing.Evidence = nil
+	if Verify_CON_evidence(missing, &configs[1]) == nil {
+		t.Errorf("CON without evidence verified")
+	}
+	// evidence whose payload is not the one in the CON
+	swapped := con(sth_a, sth_b)
+	swapped.Evidence[0], swapped.Evidence[1] = sth_b, sth_a
+	if Verify_CON_evidence(swapped, &configs[1]) == nil {
+		t.Errorf("CON with mismatched evidence verified")
+	}
+	// an STH of the logger signed by someone else
+	forged := sth_b
+	forged.Signature = signed_sth(&configs[1], "b").Signature
+	if Verify_CON_evidence(con(sth_a, forged), &configs[1]) == nil {
+		t.Errorf("CON with evidence signed by another entity verified")
+	}
+	tampered := con(sth_a, sth_b)
+	tampered.Evidence[1].Signature[0] = sth_a.Signature[0]
+	if Verify_CON_evidence(tampered, &configs[1]) == nil {
+		t.Errorf("CON with a wrong signature verified")
+	}
+}
+
+func TestAccusationEvidence(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:9000", "localhost:8000", "localhost:8001"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accuse := func(c *crypto.CryptoConfig, reason string) Gossip_object {
+		acc, err := Generate_ACC_INIT(c, "localhost:9000", reason, Accusation_evidence{Request_time: util.GetCurrentTimestamp(), Error: "connection refused"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc
+	}
+	acc_1 := accuse(&configs[1], ACC_UNREACHABLE)
+	acc_2 := accuse(&configs[2], ACC_INVALID_SIGNATURE)
+	if err := acc_1.Verify(&configs[0]); err != nil {
+		t.Fatalf("Accusation failed to verify: %v", err)
+	}
+	evidence, err := Get_accusation_evidence(acc_1)
+	if err != nil || evidence.Error != "connection refused" {
+		t.Fatalf("Evidence not carried: %+v %v", evidence, err)
+	}
+	// the fragments of both accusations sign the same payload
+	frag_1, frag_2 := Strip_accusation(acc_1), Strip_accusation(acc_2)
+	if frag_1.Payload != frag_2.Payload || frag_1.Payload != [3]string{"localhost:9000", "", ""} {
+		t.Fatalf("Stripped payloads differ: %v %v", frag_1.Payload, frag_2.Payload)
+	}
+	full := Gossip_object{Type: ACC_FULL, Payload: frag_1.Payload, Evidence: Merge_accusations([]Gossip_object{frag_1, frag_2, frag_1})}
+	if len(full.Evidence) != 2 {
+		t.Fatalf("Expected 2 accusations, got %d", len(full.Evidence))
+	}
+	if err := Verify_ACC_evidence(full, &configs[0]); err != nil {
+		t.Errorf("Valid accusations failed: %v", err)
+	}
+	// an accusation signed by another monitor than its signer field claims
+	forged := full
+	forged.Evidence = []Gossip_object{acc_1}
+	forged.Evidence[0].Signer = "localhost:8001"
+	if Verify_ACC_evidence(forged, &configs[0]) == nil {
+		t.Errorf("Accusation with a wrong signer verified")
+	}
+	tampered := full
+	tampered.Evidence = []Gossip_object{acc_1}
+	tampered.Evidence[0].Payload[1] = ACC_INVALID_SRH
+	if Verify_ACC_evidence(tampered, &configs[0]) == nil {
+		t.Errorf("Accusation with a changed reason verified")
+	}
+	other := full
+	other.Payload[0] = "localhost:9001"
+	if Verify_ACC_evidence(other, &configs[0]) == nil {
+		t.Errorf("Accusation of another entity verified")
+	}
+}
+
+func TestVerifyDispute(t *testing.T) {
+	entities := []crypto.CTngID{"localhost:9000", "localhost:9001"}
+	configs, err := crypto.GenerateEntityCryptoConfigs(entities, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sth := func(c *crypto.CryptoConfig, period string) *Gossip_object {
+		js, _ := json.Marshal(STH{Signer: c.SelfID.String(), Period: period, RootHash: "root"})
+		payload := [3]string{c.SelfID.String(), string(js), ""}
+		sig, err := c.Sign([]byte(payload[0] + payload[1] + payload[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Gossip_object{Type: STH_INIT, Period: period, Signer: c.SelfID.String(), Signature: [2]string{sig.String(), ""}, Payload: payload}
+	}
+	dispute := func(c *crypto.CryptoConfig, period string, response *Gossip_object) Gossip_object {
+		dis, err := Generate_DIS_INIT(c, period, "served", response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dis
+	}
+	impersonated := dispute(&configs[1], "1", nil)
+	impersonated.Payload[0] = "localhost:9000"
+	cases := []struct {
+		name  string
+		obj   Gossip_object
+		valid bool
+	}{
+		{"with the served STH", dispute(&configs[0], "1", sth(&configs[0], "1")), true},
+		{"without response", dispute(&configs[0], "1", nil), true},
+		{"with an STH of another period", dispute(&configs[0], "1", sth(&configs[0], "2")), false},
+		{"with an STH of another logger", dispute(&configs[0], "1", sth(&configs[1], "1")), false},
+		{"signed by another entity", impersonated, false},
+	}
+	for _, test := range cases {
+		err := test.obj.Verify(&configs[1])
+		if (err == nil) != test.valid {
+			t.Errorf("Dispute %s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
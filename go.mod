@@ -8,6 +8,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/herumi/bls-go-binary v1.28.2
 	github.com/txaty/go-merkletree v0.1.15
+	golang.org/x/crypto v0.9.0
 )
 
 require (
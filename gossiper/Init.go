@@ -3,6 +3,7 @@ package gossiper
 import (
 	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"CTngV2/util"
 	"net/http"
 	"sync"
@@ -14,26 +15,34 @@ func InitializeGossipObjectStorage() *Gossip_object_storage {
 		REV_INIT:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		ACC_INIT:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		CON_INIT:      make(map[definition.Gossip_ID]definition.Gossip_object),
+		KEY_INIT:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		STH_FRAG:      make(map[definition.Gossip_ID][]definition.Gossip_object),
 		REV_FRAG:      make(map[definition.Gossip_ID][]definition.Gossip_object),
 		ACC_FRAG:      make(map[definition.Gossip_ID][]definition.Gossip_object),
 		CON_FRAG:      make(map[definition.Gossip_ID][]definition.Gossip_object),
+		KEY_FRAG:      make(map[definition.Gossip_ID][]definition.Gossip_object),
 		STH_FULL:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		REV_FULL:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		ACC_FULL:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		CON_FULL:      make(map[definition.Gossip_ID]definition.Gossip_object),
+		KEY_FULL:      make(map[definition.Gossip_ID]definition.Gossip_object),
+		DIS_INIT:      make(map[definition.Gossip_ID]definition.Gossip_object),
 		STH_INIT_LOCK: sync.RWMutex{},
 		REV_INIT_LOCK: sync.RWMutex{},
 		ACC_INIT_LOCK: sync.RWMutex{},
 		CON_INIT_LOCK: sync.RWMutex{},
+		KEY_INIT_LOCK: sync.RWMutex{},
 		STH_FRAG_LOCK: sync.RWMutex{},
 		REV_FRAG_LOCK: sync.RWMutex{},
 		ACC_FRAG_LOCK: sync.RWMutex{},
 		CON_FRAG_LOCK: sync.RWMutex{},
+		KEY_FRAG_LOCK: sync.RWMutex{},
 		STH_FULL_LOCK: sync.RWMutex{},
 		REV_FULL_LOCK: sync.RWMutex{},
 		ACC_FULL_LOCK: sync.RWMutex{},
 		CON_FULL_LOCK: sync.RWMutex{},
+		KEY_FULL_LOCK: sync.RWMutex{},
+		DIS_INIT_LOCK: sync.RWMutex{},
 	}
 }
 
@@ -76,11 +85,26 @@ func InitializeGossiperContext(public_config_path string, private_config_path st
 		Gossip_blacklist:        InitializeGossipBlacklist(),
 		Gossip_PoM_Counter:      InitializeGossipPoMCounter(),
 		Gossiper_log:            InitializeGossiperLog(),
+		Convergence:             New_convergence_tracker(util.GetCurrentPeriod()),
 		StorageID:               storageID,
 		StorageFile:             storageID + ".json",
 		StorageDirectory:        "Gossip_log/",
 		Client:                  &http.Client{},
 		Verbose:                 false,
+		Crypto_config_path:      crypto_config_path,
+		DKG:                     &Gossiper_DKG{},
+		Monitor_outbox:          &Monitor_outbox{},
+		Metrics:                 metrics.New_CTng_metrics(),
 	}
+	ctx.Metrics.Gauge("ctng_gossiper_blacklist_temp", "Entities on the temporary blacklist.", func() float64 {
+		ctx.Gossip_blacklist.BLACKLIST_TEMP_LOCK.RLock()
+		defer ctx.Gossip_blacklist.BLACKLIST_TEMP_LOCK.RUnlock()
+		return float64(len(ctx.Gossip_blacklist.BLACKLIST_TEMP))
+	})
+	ctx.Metrics.Gauge("ctng_gossiper_blacklist_perm", "Entities on the permanent blacklist.", func() float64 {
+		ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.RLock()
+		defer ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.RUnlock()
+		return float64(len(ctx.Gossip_blacklist.BLACKLIST_PERM))
+	})
 	return ctx
 }
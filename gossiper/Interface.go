@@ -92,6 +92,7 @@ func (ctx *GossiperContext) InBlacklistPerm(id string) bool {
 }
 
 func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_object) {
+	ctx.Convergence.Record(gossip_object)
 	switch gossip_object.Type {
 	case definition.STH_INIT:
 		ctx.Gossip_object_storage.STH_INIT_LOCK.Lock()
@@ -115,6 +116,14 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 			ctx.Gossip_blacklist.BLACKLIST_TEMP[gossip_object.Payload[0]] = true
 			ctx.Gossip_blacklist.BLACKLIST_TEMP_LOCK.Unlock()
 		}
+	case definition.KEY_INIT:
+		ctx.Gossip_object_storage.KEY_INIT_LOCK.Lock()
+		ctx.Gossip_object_storage.KEY_INIT[gossip_object.GetID()] = gossip_object
+		ctx.Gossip_object_storage.KEY_INIT_LOCK.Unlock()
+	case definition.DIS_INIT:
+		ctx.Gossip_object_storage.DIS_INIT_LOCK.Lock()
+		ctx.Gossip_object_storage.DIS_INIT[gossip_object.GetID()] = gossip_object
+		ctx.Gossip_object_storage.DIS_INIT_LOCK.Unlock()
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.Lock()
 		ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()], gossip_object)
@@ -137,6 +146,10 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 			ctx.Gossip_blacklist.BLACKLIST_TEMP[gossip_object.Payload[0]] = true
 			ctx.Gossip_blacklist.BLACKLIST_TEMP_LOCK.Unlock()
 		}
+	case definition.KEY_FRAG:
+		ctx.Gossip_object_storage.KEY_FRAG_LOCK.Lock()
+		ctx.Gossip_object_storage.KEY_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.KEY_FRAG[gossip_object.GetID()], gossip_object)
+		ctx.Gossip_object_storage.KEY_FRAG_LOCK.Unlock()
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.Lock()
 		ctx.Gossip_object_storage.STH_FULL[gossip_object.GetID()] = gossip_object
@@ -165,6 +178,10 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 			ctx.Gossip_blacklist.BLACKLIST_PERM[gossip_object.Payload[0]] = true
 			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Unlock()
 		}
+	case definition.KEY_FULL:
+		ctx.Gossip_object_storage.KEY_FULL_LOCK.Lock()
+		ctx.Gossip_object_storage.KEY_FULL[gossip_object.GetID()] = gossip_object
+		ctx.Gossip_object_storage.KEY_FULL_LOCK.Unlock()
 	}
 }
 
@@ -214,6 +231,20 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 			return false
 		}
 		return ctx.Gossip_object_storage.CON_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.KEY_INIT:
+		ctx.Gossip_object_storage.KEY_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.KEY_INIT[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.KEY_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.DIS_INIT:
+		ctx.Gossip_object_storage.DIS_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.DIS_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.DIS_INIT[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.DIS_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FRAG_LOCK.RUnlock()
@@ -259,6 +290,17 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 				return true
 			}
 		}
+	case definition.KEY_FRAG:
+		ctx.Gossip_object_storage.KEY_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FRAG_LOCK.RUnlock()
+		if len(ctx.Gossip_object_storage.KEY_FRAG[gossip_object.GetID()]) == 0 {
+			return false
+		}
+		for _, v := range ctx.Gossip_object_storage.KEY_FRAG[gossip_object.GetID()] {
+			if v.Signature == gossip_object.Signature {
+				return true
+			}
+		}
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -287,6 +329,13 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 			return false
 		}
 		return ctx.Gossip_object_storage.CON_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.KEY_FULL:
+		ctx.Gossip_object_storage.KEY_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FULL_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.KEY_FULL[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.KEY_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
 	}
 	return false
 }
@@ -364,6 +413,10 @@ func (ctx GossiperContext) GetObjectList(GID definition.Gossip_ID, TargetType st
 		ctx.Gossip_object_storage.CON_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.CON_FRAG_LOCK.RUnlock()
 		newlist = ctx.Gossip_object_storage.CON_FRAG[GID]
+	case definition.KEY_FRAG:
+		ctx.Gossip_object_storage.KEY_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FRAG_LOCK.RUnlock()
+		newlist = ctx.Gossip_object_storage.KEY_FRAG[GID]
 	}
 	return newlist
 }
@@ -402,6 +455,22 @@ func (ctx GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Target
 		} else {
 			return 1
 		}
+	case definition.KEY_INIT:
+		ctx.Gossip_object_storage.KEY_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.KEY_INIT[GID]; !ok {
+			return 0
+		} else {
+			return 1
+		}
+	case definition.DIS_INIT:
+		ctx.Gossip_object_storage.DIS_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.DIS_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.DIS_INIT[GID]; !ok {
+			return 0
+		} else {
+			return 1
+		}
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FRAG_LOCK.RUnlock()
@@ -418,6 +487,10 @@ func (ctx GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Target
 		ctx.Gossip_object_storage.CON_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.CON_FRAG_LOCK.RUnlock()
 		return len(ctx.Gossip_object_storage.CON_FRAG[GID])
+	case definition.KEY_FRAG:
+		ctx.Gossip_object_storage.KEY_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FRAG_LOCK.RUnlock()
+		return len(ctx.Gossip_object_storage.KEY_FRAG[GID])
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -450,6 +523,14 @@ func (ctx GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Target
 		} else {
 			return 1
 		}
+	case definition.KEY_FULL:
+		ctx.Gossip_object_storage.KEY_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FULL_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.KEY_FULL[GID]; !ok {
+			return 0
+		} else {
+			return 1
+		}
 	}
 	return 0
 }
@@ -472,6 +553,14 @@ func (ctx GossiperContext) GetObject(GID definition.Gossip_ID, targettype string
 		ctx.Gossip_object_storage.CON_INIT_LOCK.RLock()
 		defer ctx.Gossip_object_storage.CON_INIT_LOCK.RUnlock()
 		return ctx.Gossip_object_storage.CON_INIT[GID]
+	case definition.KEY_INIT:
+		ctx.Gossip_object_storage.KEY_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_INIT_LOCK.RUnlock()
+		return ctx.Gossip_object_storage.KEY_INIT[GID]
+	case definition.DIS_INIT:
+		ctx.Gossip_object_storage.DIS_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.DIS_INIT_LOCK.RUnlock()
+		return ctx.Gossip_object_storage.DIS_INIT[GID]
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -488,6 +577,10 @@ func (ctx GossiperContext) GetObject(GID definition.Gossip_ID, targettype string
 		ctx.Gossip_object_storage.CON_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.CON_FULL_LOCK.RUnlock()
 		return ctx.Gossip_object_storage.CON_FULL[GID]
+	case definition.KEY_FULL:
+		ctx.Gossip_object_storage.KEY_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.KEY_FULL_LOCK.RUnlock()
+		return ctx.Gossip_object_storage.KEY_FULL[GID]
 	}
 	return definition.Gossip_object{}
 }
@@ -558,6 +651,11 @@ func (ctx GossiperContext) IsMalicious(obj definition.Gossip_object) bool {
 		if obj.Signer == obj_2.Signer && obj.Signature != obj_2.Signature {
 			return true
 		}
+	case definition.KEY_INIT:
+		obj_2 := ctx.GetObject(obj.GetID(), definition.KEY_INIT)
+		if obj.Signer == obj_2.Signer && obj.Signature != obj_2.Signature {
+			return true
+		}
 	}
 	return false
 }
@@ -0,0 +1,290 @@
+package gossiper
+
+import (
+	"CTngV2/definition"
+	"CTngV2/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracks how the gossip objects of each period converge to FULL objects.
+// At the end of a period its report is written to StorageDirectory, so threshold failures can be debugged after the fact.
+// Objects of the previous period can still arrive late, so its report is written once more before the tracker forgets it.
+
+type Object_progress struct {
+	Type       string // the FULL type the object converges to
+	Entity     string
+	Period     string // period of the object
+	First_seen time.Time
+	Fragments  []string // signers of the fragments received, in order
+	Full       bool
+	Full_at    time.Time
+}
+
+type Convergence_tracker struct {
+	Period  string                      // the period being tracked
+	Objects map[string]*Object_progress // keyed by period + FULL type + entity
+	// number of posts of the objects of a period that a peer gossiper did not accept, keyed by period and peer
+	Failed_deliveries map[string]map[string]int
+	LOCK              sync.Mutex
+}
+
+type Object_report struct {
+	Type           string
+	Entity         string
+	Period         string
+	Fragment_count int
+	Fragments      []string `json:",omitempty"`
+	// gossipers whose fragment did not arrive, only for stalled objects
+	Missing         []string `json:",omitempty"`
+	Time_to_FULL_ms int64    `json:",omitempty"`
+}
+
+type Convergence_report struct {
+	Gossiper          string
+	Period            string
+	Threshold         int
+	Full              []Object_report
+	Stalled           []Object_report
+	Failed_deliveries map[string]int `json:",omitempty"`
+	Generated         string
+}
+
+func New_convergence_tracker(period string) *Convergence_tracker {
+	return &Convergence_tracker{
+		Period:            period,
+		Objects:           make(map[string]*Object_progress),
+		Failed_deliveries: make(map[string]map[string]int),
+	}
+}
+
+// The FULL type an INIT, FRAG or FULL object converges to.
+func full_type(t string) string {
+	switch t {
+	case definition.STH_INIT, definition.STH_FRAG, definition.STH_FULL:
+		return definition.STH_FULL
+	case definition.REV_INIT, definition.REV_FRAG, definition.REV_FULL:
+		return definition.REV_FULL
+	case definition.ACC_INIT, definition.ACC_FRAG, definition.ACC_FULL:
+		return definition.ACC_FULL
+	case definition.CON_INIT, definition.CON_FRAG, definition.CON_FULL:
+		return definition.CON_FULL
+	case definition.KEY_INIT, definition.KEY_FRAG, definition.KEY_FULL:
+		return definition.KEY_FULL
+	}
+	return ""
+}
+
+// True if the reports of the period are still open, i.e. it is not older than the period before the tracked one.
+func (t *Convergence_tracker) open(period string) bool {
+	p, err := strconv.Atoi(period)
+	if err != nil {
+		return false
+	}
+	tracked, _ := strconv.Atoi(t.Period)
+	return p >= tracked-1
+}
+
+// Records a stored gossip object under its own period. A nil tracker records nothing.
+func (t *Convergence_tracker) Record(g definition.Gossip_object) {
+	target := full_type(g.Type)
+	if t == nil || target == "" {
+		return
+	}
+	t.LOCK.Lock()
+	defer t.LOCK.Unlock()
+	if !t.open(g.Period) {
+		return
+	}
+	key := g.Period + "/" + target + g.Payload[0]
+	progress, ok := t.Objects[key]
+	if !ok {
+		progress = &Object_progress{Type: target, Entity: g.Payload[0], Period: g.Period, First_seen: time.Now()}
+		t.Objects[key] = progress
+	}
+	switch g.Type {
+	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CON_FRAG, definition.KEY_FRAG:
+		progress.Fragments = append(progress.Fragments, g.Signer)
+	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CON_FULL, definition.KEY_FULL:
+		if !progress.Full {
+			progress.Full = true
+			progress.Full_at = time.Now()
+		}
+	}
+}
+
+// Tracks the period and forgets everything older than the period before it.
+func (t *Convergence_tracker) Advance(period string) {
+	t.LOCK.Lock()
+	defer t.LOCK.Unlock()
+	t.Period = period
+	for key, progress := range t.Objects {
+		if !t.open(progress.Period) {
+			delete(t.Objects, key)
+		}
+	}
+	for p := range t.Failed_deliveries {
+		if !t.open(p) {
+			delete(t.Failed_deliveries, p)
+		}
+	}
+}
+
+// Records a post of an object of the period that the peer did not accept, because it failed or was refused.
+func (t *Convergence_tracker) Record_failed_delivery(peer string, period string) {
+	if t == nil {
+		return
+	}
+	t.LOCK.Lock()
+	defer t.LOCK.Unlock()
+	if !t.open(period) {
+		return
+	}
+	if t.Failed_deliveries[period] == nil {
+		t.Failed_deliveries[period] = make(map[string]int)
+	}
+	t.Failed_deliveries[period][peer]++
+}
+
+// True if the tracker still holds the objects of the period.
+func (t *Convergence_tracker) Holds(period string) bool {
+	t.LOCK.Lock()
+	defer t.LOCK.Unlock()
+	p, _ := strconv.Atoi(period)
+	tracked, _ := strconv.Atoi(t.Period)
+	return period == t.Period || t.open(period) && p < tracked
+}
+
+// The report of the tracked objects of a period, gossipers lists the gossipers expected to send fragments.
+func (t *Convergence_tracker) Report(period string, gossiper string, threshold int, gossipers []string) *Convergence_report {
+	t.LOCK.Lock()
+	defer t.LOCK.Unlock()
+	report := &Convergence_report{
+		Gossiper:          gossiper,
+		Period:            period,
+		Threshold:         threshold,
+		Full:              []Object_report{},
+		Stalled:           []Object_report{},
+		Failed_deliveries: make(map[string]int),
+		Generated:         util.GetCurrentTimestamp(),
+	}
+	for peer, count := range t.Failed_deliveries[period] {
+		report.Failed_deliveries[peer] = count
+	}
+	for _, progress := range t.Objects {
+		if progress.Period != period {
+			continue
+		}
+		entry := Object_report{
+			Type:           definition.TypeString(progress.Type),
+			Entity:         progress.Entity,
+			Period:         progress.Period,
+			Fragment_count: len(progress.Fragments),
+			Fragments:      progress.Fragments,
+		}
+		if progress.Full {
+			entry.Time_to_FULL_ms = progress.Full_at.Sub(progress.First_seen).Milliseconds()
+			report.Full = append(report.Full, entry)
+			continue
+		}
+		received := make(map[string]bool)
+		for _, signer := range progress.Fragments {
+			received[signer] = true
+		}
+		for _, peer := range gossipers {
+			if !received[peer] {
+				entry.Missing = append(entry.Missing, peer)
+			}
+		}
+		report.Stalled = append(report.Stalled, entry)
+	}
+	for _, list := range [][]Object_report{report.Full, report.Stalled} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Type != list[j].Type {
+				return list[i].Type < list[j].Type
+			}
+			return list[i].Entity < list[j].Entity
+		})
+	}
+	return report
+}
+
+// The report of the period being tracked.
+func (c *GossiperContext) Convergence_report() *Convergence_report {
+	c.Convergence.LOCK.Lock()
+	period := c.Convergence.Period
+	c.Convergence.LOCK.Unlock()
+	return c.Convergence_report_of(period)
+}
+
+func (c *GossiperContext) Convergence_report_of(period string) *Convergence_report {
+	return c.Convergence.Report(period, c.Gossiper_crypto_config.SelfID.String(), c.Gossiper_crypto_config.Threshold, c.Gossiper_public_config.Gossiper_URLs)
+}
+
+func (c *GossiperContext) convergence_file(period string) string {
+	return c.StorageDirectory + c.StorageID + "_convergence_" + period + ".json"
+}
+
+// Writes the reports of the current and the previous period to disk and starts tracking the next period.
+func (c *GossiperContext) Save_convergence_report() {
+	if c.Convergence == nil {
+		return
+	}
+	c.Convergence.LOCK.Lock()
+	period := c.Convergence.Period
+	c.Convergence.LOCK.Unlock()
+	current, _ := strconv.Atoi(period)
+	util.CreateDir(c.StorageDirectory)
+	for _, p := range []string{strconv.Itoa(current - 1), period} {
+		report := c.Convergence_report_of(p)
+		// the report of the previous period is only rewritten if something arrived for it
+		if p != period && len(report.Full)+len(report.Stalled)+len(report.Failed_deliveries) == 0 {
+			continue
+		}
+		err := util.WriteData(c.convergence_file(p), report)
+		if err != nil {
+			fmt.Println(util.RED+"Error writing the convergence report:", err, util.RESET)
+		}
+	}
+	next, _ := strconv.Atoi(util.GetCurrentPeriod())
+	c.Convergence.Advance(strconv.Itoa(next + 1))
+}
+
+// GET /gossip/convergence?period=P
+// Without a period the live report of the tracked period is returned, the periods the tracker still holds are reported live as well.
+func Convergence_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	if c.Convergence == nil {
+		http.Error(w, "Convergence is not tracked.", http.StatusNotFound)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	var report *Convergence_report
+	if period == "" {
+		report = c.Convergence_report()
+	} else if c.Convergence.Holds(period) {
+		report = c.Convergence_report_of(period)
+	} else {
+		if _, err := strconv.Atoi(period); err != nil {
+			http.Error(w, "Invalid period "+period, http.StatusBadRequest)
+			return
+		}
+		data, err := os.ReadFile(c.convergence_file(period))
+		if err != nil {
+			http.Error(w, "No convergence report for period "+period, http.StatusNotFound)
+			return
+		}
+		report = &Convergence_report{}
+		if err = json.Unmarshal(data, report); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,410 @@
+package gossiper
+
+import (
+	"CTngV2/crypto"
+	"CTngV2/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/herumi/bls-go-binary/bls"
+)
+
+// The gossipers' threshold keys can be generated with a DKG instead of by Gen.
+// A gossiper whose crypto config has no threshold secret key runs the DKG on startup:
+// it deals to every gossiper in Gossiper_URLs, waits Gossip_wait_time, broadcasts its status,
+// waits for the answers to the complaints, broadcasts the dealers it found qualified, waits again
+// and then installs the keys from the agreed dealers and writes them back to its crypto config file.
+// Resharing (RunReshare) hands the keys to a new set of gossipers the same way, see crypto/reshare.go.
+
+func DKG_deal_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var deal crypto.DKGDeal
+	err := json.NewDecoder(r.Body).Decode(&deal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.DKG.LOCK.Lock()
+	participant := c.DKG.Participant
+	if participant == nil {
+		c.DKG.Pending_deals = append(c.DKG.Pending_deals, deal)
+	}
+	c.DKG.LOCK.Unlock()
+	if participant != nil {
+		err = participant.ProcessDeal(deal)
+		if err != nil {
+			fmt.Println(util.RED+"Invalid DKG deal from", deal.Dealer, ":", err, util.RESET)
+			http.Error(w, err.Error(), http.StatusOK)
+			return
+		}
+	}
+	http.Error(w, "DKG deal received.", http.StatusOK)
+}
+
+func DKG_status_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var status crypto.DKGStatus
+	err := json.NewDecoder(r.Body).Decode(&status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.DKG.LOCK.Lock()
+	participant, dealer := c.DKG.Participant, c.DKG.Dealer
+	if participant == nil && dealer == nil {
+		c.DKG.Pending_statuses = append(c.DKG.Pending_statuses, status)
+	}
+	c.DKG.LOCK.Unlock()
+	err = handle_DKG_status(c, participant, dealer, status)
+	if err != nil {
+		fmt.Println(util.RED+"Invalid DKG status from", status.Participant, ":", err, util.RESET)
+		http.Error(w, err.Error(), http.StatusOK)
+		return
+	}
+	http.Error(w, "DKG status received.", http.StatusOK)
+}
+
+func DKG_response_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var response crypto.DKGResponse
+	err := json.NewDecoder(r.Body).Decode(&response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.DKG.LOCK.Lock()
+	participant := c.DKG.Participant
+	if participant == nil {
+		c.DKG.Pending_responses = append(c.DKG.Pending_responses, response)
+	}
+	c.DKG.LOCK.Unlock()
+	if participant != nil {
+		err = participant.ProcessResponse(response)
+		if err != nil {
+			fmt.Println(util.RED+"Invalid DKG response from", response.Dealer, ":", err, util.RESET)
+			http.Error(w, err.Error(), http.StatusOK)
+			return
+		}
+	}
+	http.Error(w, "DKG response received.", http.StatusOK)
+}
+
+func DKG_qualified_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var announcement crypto.DKGQualified
+	err := json.NewDecoder(r.Body).Decode(&announcement)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.DKG.LOCK.Lock()
+	participant := c.DKG.Participant
+	if participant == nil {
+		c.DKG.Pending_qualified = append(c.DKG.Pending_qualified, announcement)
+	}
+	c.DKG.LOCK.Unlock()
+	if participant != nil {
+		err = participant.ProcessQualified(announcement)
+		if err != nil {
+			fmt.Println(util.RED+"Invalid DKG qualified set from", announcement.Participant, ":", err, util.RESET)
+			http.Error(w, err.Error(), http.StatusOK)
+			return
+		}
+	}
+	http.Error(w, "DKG qualified set received.", http.StatusOK)
+}
+
+// Record a status and answer the complaints about our deals in it.
+// The answers go to every gossiper of the new set, they check them against the commitments.
+func handle_DKG_status(c *GossiperContext, participant *crypto.DKGParticipant, dealer crypto.DKGDealer, status crypto.DKGStatus) error {
+	if participant != nil {
+		err := participant.ProcessStatus(status)
+		if err != nil {
+			return err
+		}
+	}
+	if dealer == nil {
+		return nil
+	}
+	responses, err := dealer.Respond(status)
+	if err != nil {
+		return err
+	}
+	for _, response := range responses {
+		fmt.Println(util.BLUE+"Answering the DKG complaint of", response.Complainer, util.RESET)
+		for _, peer := range crypto_ids(c.Gossiper_public_config.Gossiper_URLs) {
+			if peer == c.Gossiper_crypto_config.SelfID {
+				if participant != nil {
+					participant.ProcessResponse(response)
+				}
+				continue
+			}
+			c.Send_DKG_message(peer.String(), "/gossip/dkg/response", response)
+		}
+	}
+	return nil
+}
+
+// The public key shares of a DKG as served by one gossiper, signed by it.
+// The other entities only take a map every gossiper signed, see Gen.Update_threshold_public_map.
+type DKG_public_map struct {
+	Gossiper   string
+	Public_map map[string][]byte
+	Signature  string
+}
+
+func (m DKG_public_map) signed_message() ([]byte, error) {
+	js, err := json.Marshal(m.Public_map)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(m.Gossiper), js...), nil
+}
+
+// Sign the current threshold public keys of the gossiper.
+func New_DKG_public_map(c *crypto.CryptoConfig) (DKG_public_map, error) {
+	pubs := c.ThresholdPublicKeys()
+	m := DKG_public_map{Gossiper: c.SelfID.String(), Public_map: pubs.Serialize()}
+	if len(pubs) == 0 {
+		return m, errors.New("No threshold keys yet.")
+	}
+	msg, err := m.signed_message()
+	if err != nil {
+		return m, err
+	}
+	sig, err := c.Sign(msg)
+	if err != nil {
+		return m, err
+	}
+	m.Signature = sig.String()
+	return m, nil
+}
+
+// Verify that the map was signed by the gossiper it names.
+func (m DKG_public_map) Verify(c *crypto.CryptoConfig) error {
+	sig, err := crypto.SignatureFromString(m.Signature)
+	if err != nil {
+		return err
+	}
+	if sig.ID.String() != m.Gossiper {
+		return errors.New("The public map of " + m.Gossiper + " is signed by " + sig.ID.String())
+	}
+	msg, err := m.signed_message()
+	if err != nil {
+		return err
+	}
+	return c.Verify(msg, sig)
+}
+
+// Serves the public key shares, so the other entities can fill in their ThresholdPublicMap.
+func DKG_public_map_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	m, err := New_DKG_public_map(c.Gossiper_crypto_config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// True if the gossiper has to generate its threshold keys before it can gossip.
+// A gossiper joining through a resharing has the public keys already, but no secret key share.
+func (c *GossiperContext) Needs_DKG() bool {
+	return !c.Gossiper_crypto_config.HasThresholdSecretKey() && len(c.Gossiper_crypto_config.ThresholdPublicKeys()) == 0
+}
+
+func RunDKG(c *GossiperContext) error {
+	participants := crypto_ids(c.Gossiper_public_config.Gossiper_URLs)
+	participant, err := crypto.NewDKGParticipant(c.Gossiper_crypto_config, participants, c.Gossiper_crypto_config.Threshold)
+	if err != nil {
+		return err
+	}
+	fmt.Println(util.BLUE+"Starting DKG with", len(participants), "gossipers, threshold", participant.Threshold, util.RESET)
+	pending_statuses := start_DKG(c, participant, participant)
+	// Phase 1: deals
+	for _, recipient := range participants {
+		deal, err := participant.Deal(recipient)
+		if err != nil {
+			return err
+		}
+		if recipient == participant.SelfID {
+			participant.ProcessDeal(deal)
+			continue
+		}
+		c.Send_DKG_message(recipient.String(), "/gossip/dkg/deal", deal)
+	}
+	return finish_DKG(c, participant, pending_statuses, c.Gossiper_crypto_config.InstallThresholdKeys)
+}
+
+// True if the gossiper still has to take part in the resharing in its public config.
+func (c *GossiperContext) Needs_reshare() bool {
+	reshare := c.Gossiper_public_config.Reshare
+	return reshare != nil && c.Gossiper_crypto_config.ThresholdEpoch < reshare.Epoch
+}
+
+// Hand the threshold keys over from Reshare.Old_gossiper_URLs to Gossiper_URLs.
+// Old gossipers deal their shares, new gossipers collect them; a gossiper in both sets does both.
+// The deals and statuses use the DKG endpoints, they carry the epoch so they cannot be mixed up.
+func RunReshare(c *GossiperContext) error {
+	reshare := c.Gossiper_public_config.Reshare
+	config := c.Gossiper_crypto_config
+	if reshare.Epoch != config.ThresholdEpoch+1 {
+		return fmt.Errorf("Cannot reshare from epoch %d to epoch %d", config.ThresholdEpoch, reshare.Epoch)
+	}
+	dealers := crypto_ids(reshare.Old_gossiper_URLs)
+	participants := crypto_ids(c.Gossiper_public_config.Gossiper_URLs)
+	var participant *crypto.DKGParticipant
+	var dealer crypto.DKGDealer
+	var err error
+	if is_member(participants, config.SelfID) {
+		participant, err = crypto.NewReshareParticipant(config, dealers, participants, reshare.Threshold)
+		if err != nil {
+			return err
+		}
+	}
+	if is_member(dealers, config.SelfID) {
+		dealer, err = crypto.NewReshareDealer(config, reshare.Threshold)
+		if err != nil {
+			return err
+		}
+	}
+	pending_statuses := start_DKG(c, participant, dealer)
+	fmt.Println(util.BLUE+"Resharing from", len(dealers), "to", len(participants), "gossipers, threshold", reshare.Threshold, util.RESET)
+	if dealer != nil {
+		for _, recipient := range participants {
+			deal, err := dealer.Deal(recipient)
+			if err != nil {
+				return err
+			}
+			if recipient == config.SelfID {
+				participant.ProcessDeal(deal)
+				continue
+			}
+			c.Send_DKG_message(recipient.String(), "/gossip/dkg/deal", deal)
+		}
+	}
+	if participant == nil {
+		// Leaving the gossiper set: answer the complaints about our deals, after that our share is of no use.
+		for _, status := range pending_statuses {
+			handle_DKG_status(c, nil, dealer, status)
+		}
+		time.Sleep(2 * time.Duration(c.Gossiper_public_config.Gossip_wait_time) * time.Second)
+		stop_DKG(c)
+		fmt.Println(util.GREEN+"Handed the threshold key share over to the new gossipers", util.RESET)
+		return nil
+	}
+	return finish_DKG(c, participant, pending_statuses, config.AdvanceThresholdEpoch)
+}
+
+// Start accepting messages for this run, then replay the ones that arrived early.
+// The early statuses are returned, they are processed after our own.
+func start_DKG(c *GossiperContext, participant *crypto.DKGParticipant, dealer crypto.DKGDealer) []crypto.DKGStatus {
+	c.DKG.LOCK.Lock()
+	c.DKG.Participant, c.DKG.Dealer = participant, dealer
+	pending_deals, pending_statuses := c.DKG.Pending_deals, c.DKG.Pending_statuses
+	pending_responses, pending_qualified := c.DKG.Pending_responses, c.DKG.Pending_qualified
+	c.DKG.Pending_deals, c.DKG.Pending_statuses = nil, nil
+	c.DKG.Pending_responses, c.DKG.Pending_qualified = nil, nil
+	c.DKG.LOCK.Unlock()
+	if participant == nil {
+		return pending_statuses
+	}
+	for _, deal := range pending_deals {
+		participant.ProcessDeal(deal)
+	}
+	for _, response := range pending_responses {
+		participant.ProcessResponse(response)
+	}
+	for _, announcement := range pending_qualified {
+		participant.ProcessQualified(announcement)
+	}
+	return pending_statuses
+}
+
+func stop_DKG(c *GossiperContext) {
+	c.DKG.LOCK.Lock()
+	c.DKG.Participant, c.DKG.Dealer = nil, nil
+	c.DKG.LOCK.Unlock()
+}
+
+// The phases after the deals are out, shared by the DKG and the resharing.
+func finish_DKG(c *GossiperContext, participant *crypto.DKGParticipant, pending_statuses []crypto.DKGStatus, install func(crypto.BlsPublicMap, bls.SecretKey, int)) error {
+	defer stop_DKG(c)
+	wait := time.Duration(c.Gossiper_public_config.Gossip_wait_time) * time.Second
+	time.Sleep(wait)
+	// Phase 2: complaints and commitment digests, the dealers answer the complaints as the statuses come in
+	status, err := participant.Status()
+	if err != nil {
+		return err
+	}
+	participant.ProcessStatus(status)
+	sent := map[crypto.CTngID]bool{participant.SelfID: true}
+	for _, peer := range append(append([]crypto.CTngID{}, participant.Participants...), participant.Dealers...) {
+		if !sent[peer] {
+			sent[peer] = true
+			c.Send_DKG_message(peer.String(), "/gossip/dkg/status", status)
+		}
+	}
+	c.DKG.LOCK.Lock()
+	dealer := c.DKG.Dealer
+	c.DKG.LOCK.Unlock()
+	for _, status := range pending_statuses {
+		handle_DKG_status(c, participant, dealer, status)
+	}
+	time.Sleep(wait)
+	// Phase 3: agree on the qualified dealers
+	announcement, err := participant.Announce()
+	if err != nil {
+		return err
+	}
+	participant.ProcessQualified(announcement)
+	for _, peer := range participant.Participants {
+		if peer != participant.SelfID {
+			c.Send_DKG_message(peer.String(), "/gossip/dkg/qualified", announcement)
+		}
+	}
+	time.Sleep(wait)
+	// Phase 4: combine the shares of the agreed qualified dealers
+	pubs, secret, _, err := participant.Finalize()
+	if err != nil {
+		return err
+	}
+	install(pubs, secret, participant.Threshold)
+	qualified, _ := participant.AgreedQualified()
+	fmt.Println(util.GREEN+"DKG finished for epoch", participant.Epoch, "with qualified dealers", qualified, util.RESET)
+	if c.Crypto_config_path != "" {
+		return crypto.SaveThresholdKeys(c.Crypto_config_path, c.Gossiper_crypto_config)
+	}
+	return nil
+}
+
+func crypto_ids(urls []string) []crypto.CTngID {
+	ids := make([]crypto.CTngID, len(urls))
+	for i, url := range urls {
+		ids[i] = crypto.CTngID(url)
+	}
+	return ids
+}
+
+func is_member(ids []crypto.CTngID, id crypto.CTngID) bool {
+	for _, member := range ids {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *GossiperContext) Send_DKG_message(url string, endpoint string, obj any) {
+	msg, err := json.Marshal(obj)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp, err := c.Client.Post("http://"+url+endpoint, "application/json", bytes.NewBuffer(msg))
+	if err != nil {
+		fmt.Println(util.RED+"Connection failed to "+url+"."+" Error message: ", err, util.RESET)
+		return
+	}
+	resp.Body.Close()
+}
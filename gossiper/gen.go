@@ -8,6 +8,9 @@ import (
 )
 
 func (ctx GossiperContext) Generate_Gossip_Object_FRAG(g definition.Gossip_object) definition.Gossip_object {
+	if g.Type == definition.ACC_INIT {
+		g = definition.Strip_accusation(g)
+	}
 	sig_frag, err := ctx.Gossiper_crypto_config.ThresholdSign(g.Payload[0] + g.Payload[1] + g.Payload[2])
 	if err != nil {
 		fmt.Println("Error in threshold signing: " + err.Error())
@@ -49,6 +52,10 @@ func (ctx GossiperContext) Generate_Gossip_Object_FULL(g_list []definition.Gossi
 	if err != nil {
 		fmt.Println("Error in converting signature to string: " + err.Error())
 	}
+	evidence := g_list[0].Evidence
+	if TargetType == definition.ACC_FULL {
+		evidence = definition.Merge_accusations(g_list)
+	}
 	// Generate the full gossip object
 	return definition.Gossip_object{
 		Application:   definition.CTNG_APPLICATION,
@@ -60,6 +67,7 @@ func (ctx GossiperContext) Generate_Gossip_Object_FULL(g_list []definition.Gossi
 		Timestamp:     util.GetCurrentTimestamp(),
 		Crypto_Scheme: "bls",
 		Payload:       g_list[0].Payload,
+		Evidence:      evidence,
 	}
 }
 
@@ -119,6 +127,7 @@ func (ctx GossiperContext) Generate_CON_INIT(obj1 definition.Gossip_object, obj2
 		Timestamp:   util.GetCurrentTimestamp(),
 		Signature:   [2]string{obj1.Signature[0], obj2.Signature[0]},
 		Payload:     [3]string{obj1.Payload[0], obj1.Payload[0] + obj1.Payload[1] + obj1.Payload[2], obj2.Payload[0] + obj2.Payload[1] + obj2.Payload[2]},
+		Evidence:    []definition.Gossip_object{obj1, obj2},
 	}
 	return D2_POM
 }
@@ -1,6 +1,7 @@
 package gossiper
 
 import (
+	"CTngV2/crypto"
 	"CTngV2/definition"
 	"CTngV2/util"
 	"bytes"
@@ -39,10 +40,27 @@ func handleRequests(c *GossiperContext) {
 	gorillaRouter.HandleFunc("/gossip/rev_full", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/acc_full", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/con_full", bindContext(c, Gossip_object_handler)).Methods("POST")
+	// Key rotation endpoints
+	gorillaRouter.HandleFunc("/gossip/key_init", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/key_frag", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/key_full", bindContext(c, Gossip_object_handler)).Methods("POST")
+	// Disputes of accused entities
+	gorillaRouter.HandleFunc("/gossip/dis_init", bindContext(c, Gossip_object_handler)).Methods("POST")
 	// POM counter endpoints
 	gorillaRouter.HandleFunc("/gossip/num_init", bindContext(c, PoM_counter_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/num_frag", bindContext(c, PoM_counter_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/num_full", bindContext(c, PoM_counter_handler)).Methods("POST")
+	// Distributed key generation endpoints
+	gorillaRouter.HandleFunc("/gossip/dkg/deal", bindContext(c, DKG_deal_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/dkg/status", bindContext(c, DKG_status_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/dkg/response", bindContext(c, DKG_response_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/dkg/qualified", bindContext(c, DKG_qualified_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/dkg/public-map", bindContext(c, DKG_public_map_handler)).Methods("GET")
+	// Monitors probe their gossipers to fail over
+	gorillaRouter.HandleFunc("/gossip/health", bindContext(c, Health_handler)).Methods("GET")
+	// Convergence report of the current or a past period
+	gorillaRouter.HandleFunc("/gossip/convergence", bindContext(c, Convergence_handler)).Methods("GET")
+	gorillaRouter.HandleFunc("/metrics", c.Metrics.Handler()).Methods("GET")
 	// Start the HTTP server.
 	http.Handle("/", gorillaRouter)
 	fmt.Println(util.BLUE+"Listening on port:", c.Gossiper_private_config.Port, util.RESET)
@@ -52,7 +70,31 @@ func handleRequests(c *GossiperContext) {
 	os.Exit(1)
 }
 
+// A gossiper is healthy once it holds a threshold key share, without one it can not sign fragments.
+func Health_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	if !Threshold_keys_installed(c, w) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"Gossiper": c.Gossiper_crypto_config.SelfID.String(),
+		"Period":   util.GetCurrentPeriod(),
+	})
+}
+
+// Gossip is refused until the threshold keys are installed, without a key share the gossiper would sign with a zero key.
+func Threshold_keys_installed(c *GossiperContext, w http.ResponseWriter) bool {
+	if !c.Gossiper_crypto_config.HasThresholdSecretKey() {
+		http.Error(w, "No threshold key share yet.", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
 func Gossip_object_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	if !Threshold_keys_installed(c, w) {
+		return
+	}
 	var gossip_obj definition.Gossip_object
 	err := json.NewDecoder(r.Body).Decode(&gossip_obj)
 	if err != nil {
@@ -61,7 +103,13 @@ func Gossip_object_handler(c *GossiperContext, w http.ResponseWriter, r *http.Re
 	}
 	// Verify the object is valid, if invalid we just ignore it
 	// CON do not have a signature on it yet
-	err = gossip_obj.Verify(c.Gossiper_crypto_config)
+	err = c.Metrics.Verify(definition.TypeString(gossip_obj.Type), func() error {
+		err := gossip_obj.Verify(c.Gossiper_crypto_config)
+		if err == nil && (gossip_obj.Type == definition.ACC_FRAG || gossip_obj.Type == definition.ACC_FULL) {
+			err = definition.Verify_ACC_evidence(gossip_obj, c.Gossiper_crypto_config)
+		}
+		return err
+	})
 	if err != nil {
 		//fmt.Println("Received invalid object "+TypeString(gossip_obj.Type)+" from " + util.GetSenderURL(r) + ".")
 		fmt.Println(util.RED, "Received invalid object "+definition.TypeString(gossip_obj.Type)+" signed by "+gossip_obj.Signer+".", util.RESET)
@@ -94,14 +142,21 @@ func Handle_Gossip_object(c *GossiperContext, gossip_obj definition.Gossip_objec
 		Handle_ACC_INIT(c, gossip_obj)
 	case definition.CON_INIT:
 		Handle_CON_INIT(c, gossip_obj)
-	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CON_FRAG:
+	case definition.KEY_INIT:
+		Handle_KEY_INIT(c, gossip_obj)
+	case definition.DIS_INIT:
+		Handle_DIS_INIT(c, gossip_obj)
+	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CON_FRAG, definition.KEY_FRAG:
 		Handle_OBJ_FRAG(c, gossip_obj)
-	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CON_FULL:
+	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CON_FULL, definition.KEY_FULL:
 		Handle_OBJ_FULL(c, gossip_obj)
 	}
 }
 
 func PoM_counter_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	if !Threshold_keys_installed(c, w) {
+		return
+	}
 	var pom_counter definition.PoM_Counter
 	err := json.NewDecoder(r.Body).Decode(&pom_counter)
 	if err != nil {
@@ -109,7 +164,9 @@ func PoM_counter_handler(c *GossiperContext, w http.ResponseWriter, r *http.Requ
 		return
 	}
 	// Verify the object is valid, if invalid we just ignore it
-	err = pom_counter.Verify(c.Gossiper_crypto_config)
+	err = c.Metrics.Verify(definition.TypeString(pom_counter.Type), func() error {
+		return pom_counter.Verify(c.Gossiper_crypto_config)
+	})
 	if err != nil {
 		switch pom_counter.Type {
 		case definition.NUM_INIT:
@@ -278,6 +335,49 @@ func Handle_CON_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	return
 }
 
+// Disputes are not signed by the gossipers, they are recorded and passed on to the other gossipers and the monitors.
+func Handle_DIS_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
+	fmt.Println(util.BLUE, "Received a dispute of "+gossip_obj.Payload[0]+" for period "+gossip_obj.Period+".", util.RESET)
+	c.Store(gossip_obj)
+	c.Send_to_Gossipers(gossip_obj)
+	c.Send_to_Monitor(gossip_obj)
+}
+
+// Key rotations are handled like revocations: two different announcements for the same period are a conflict.
+func Handle_KEY_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
+	icount, _ := c.GetItemCount(gossip_obj.GetID(), definition.KEY_FULL)
+	if icount > 0 {
+		// we already have the full object, we just ignore the init
+		return
+	}
+	icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.KEY_FRAG)
+	if icount >= c.Gossiper_crypto_config.Threshold {
+		// we already have enough fragments, we just ignore the init
+		return
+	}
+	//check Malicious
+	if c.IsMalicious(gossip_obj) {
+		fmt.Println(util.RED, "Received conflicting key rotations signed by "+gossip_obj.Signer+".", util.RESET)
+		obj_1 := c.GetObject(gossip_obj.GetID(), gossip_obj.Type)
+		obj_2 := gossip_obj
+		CON := c.Generate_CON_INIT(obj_1, obj_2)
+		Handle_Gossip_object(c, CON)
+		return
+	}
+	c.Store(gossip_obj)
+	c.Send_to_Gossipers(gossip_obj)
+	// wait and sign the object
+	f := func() {
+		if c.InBlacklist(gossip_obj.Payload[0]) {
+			return
+		}
+		KEY_FRAG := c.Generate_Gossip_Object_FRAG(gossip_obj)
+		Handle_Gossip_object(c, KEY_FRAG)
+	}
+	time.AfterFunc(time.Duration(c.Gossiper_public_config.Gossip_wait_time)*time.Second, f)
+	return
+}
+
 func Handle_OBJ_FRAG(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	icount := 0
 	switch gossip_obj.Type {
@@ -289,6 +389,8 @@ func Handle_OBJ_FRAG(c *GossiperContext, gossip_obj definition.Gossip_object) {
 		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.ACC_FULL)
 	case definition.CON_FRAG:
 		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.CON_FULL)
+	case definition.KEY_FRAG:
+		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.KEY_FULL)
 	}
 	if icount > 0 {
 		// we already have the full object, we just ignore the init
@@ -318,12 +420,51 @@ func Handle_OBJ_FULL(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	icount, _ := c.GetItemCount(gossip_obj.GetID(), gossip_obj.Type)
 	if icount == 0 {
 		c.Store(gossip_obj)
+		if gossip_obj.Type == definition.KEY_FULL {
+			Apply_KEY_FULL(c, gossip_obj)
+		}
 		c.Send_to_Gossipers(gossip_obj)
-		c.Send_to_Monitor(gossip_obj)
+		c.Queue_for_Monitor(gossip_obj)
+		if gossip_obj.Type == definition.ACC_FULL {
+			go Send_to_accused(c, gossip_obj)
+		}
 	}
 	return
 }
 
+// The accused entity learns of the ACC_FULL from the gossipers, so it can dispute it with a DIS_INIT.
+func Send_to_accused(c *GossiperContext, gossip_obj definition.Gossip_object) {
+	msg, err := json.Marshal(gossip_obj)
+	if err != nil {
+		fmt.Println(util.RED, err, util.RESET)
+		return
+	}
+	accused := gossip_obj.Payload[0]
+	resp, err := c.Client.Post("http://"+accused+"/ctng/v2/accusation", "application/json", bytes.NewBuffer(msg))
+	if err != nil {
+		fmt.Println(util.RED, "Failed to send the accusation to "+accused+".", util.RESET)
+		c.Metrics.Send_failed(accused, definition.TypeString(gossip_obj.Type))
+		return
+	}
+	resp.Body.Close()
+}
+
+// Start verifying the rotating entity's objects with its new key, and keep the key history across restarts.
+func Apply_KEY_FULL(c *GossiperContext, gossip_obj definition.Gossip_object) {
+	err := definition.Apply_KEY_FULL(gossip_obj, c.Gossiper_crypto_config)
+	if err != nil {
+		fmt.Println(util.RED, "Key rotation of "+gossip_obj.Payload[0]+" not applied:", err, util.RESET)
+		return
+	}
+	fmt.Println(util.GREEN, "Applied key rotation of "+gossip_obj.Payload[0]+".", util.RESET)
+	if c.Crypto_config_path != "" {
+		err = crypto.SaveKeyVersions(c.Crypto_config_path, c.Gossiper_crypto_config, false)
+		if err != nil {
+			fmt.Println(util.RED, "Failed to save the key versions:", err, util.RESET)
+		}
+	}
+}
+
 func Handle_NUM_INIT(c *GossiperContext, pom_counter definition.PoM_Counter) {
 	icount, _ := c.GetItemCount(pom_counter.GetID(), definition.NUM_FULL)
 	if icount > 0 {
@@ -409,6 +550,14 @@ func Send_obj_to_Gossipers(c *GossiperContext, gossip_obj definition.Gossip_obje
 		dstendpoint = "/gossip/acc_full"
 	case definition.CON_FULL:
 		dstendpoint = "/gossip/con_full"
+	case definition.KEY_INIT:
+		dstendpoint = "/gossip/key_init"
+	case definition.KEY_FRAG:
+		dstendpoint = "/gossip/key_frag"
+	case definition.KEY_FULL:
+		dstendpoint = "/gossip/key_full"
+	case definition.DIS_INIT:
+		dstendpoint = "/gossip/dis_init"
 	}
 	for _, url := range c.Gossiper_private_config.Connected_Gossipers {
 		// HTTP POST the data to the url or IP address.
@@ -426,8 +575,14 @@ func Send_obj_to_Gossipers(c *GossiperContext, gossip_obj definition.Gossip_obje
 			} else {
 				fmt.Println(util.RED+err.Error(), "sending to "+url+".", util.RESET)
 			}
+			c.Convergence.Record_failed_delivery(url, gossip_obj.Period)
+			c.Metrics.Send_failed(url, definition.TypeString(gossip_obj.Type))
 			continue
 		}
+		if resp.StatusCode >= 400 {
+			fmt.Println(util.RED+url+" refused the object:", resp.Status, util.RESET)
+			c.Convergence.Record_failed_delivery(url, gossip_obj.Period)
+		}
 		defer func() {
 			if resp != nil && resp.Body != nil {
 				resp.Body.Close()
@@ -468,6 +623,7 @@ func Send_pom_counter_to_Gossipers(c *GossiperContext, pom_counter definition.Po
 			} else {
 				fmt.Println(util.RED+err.Error(), "sending to "+url+".", util.RESET)
 			}
+			c.Metrics.Send_failed(url, definition.TypeString(pom_counter.Type))
 			continue
 		}
 		// Close the response, mentioned by http.Post
@@ -482,6 +638,19 @@ func Send_pom_counter_to_Gossipers(c *GossiperContext, pom_counter definition.Po
 	return nil
 }
 
+// The monitors the gossiper delivers to: Owner_URL followed by Owner_URLs, each once.
+func (c *GossiperContext) Owner_URLs() []string {
+	owners := []string{}
+	seen := make(map[string]bool)
+	for _, owner := range append([]string{c.Gossiper_private_config.Owner_URL}, c.Gossiper_private_config.Owner_URLs...) {
+		if owner != "" && !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
 func (c *GossiperContext) Send_to_Monitor(obj any) {
 	// Convert gossip object to JSON
 	msg, err := json.Marshal(obj)
@@ -489,29 +658,82 @@ func (c *GossiperContext) Send_to_Monitor(obj any) {
 		fmt.Println(err)
 	}
 	endpoint := ""
+	sent := ""
 	objtype := reflect.TypeOf(obj)
 	fmt.Println(util.BLUE+"Sending ", objtype, " to owner", util.RESET)
 	switch obj.(type) {
 	case definition.Gossip_object:
 		endpoint = "/monitor/recieve-gossip-from-gossiper"
+		sent = definition.TypeString(obj.(definition.Gossip_object).Type)
 	case definition.PoM_Counter:
 		endpoint = "/monitor/num_full"
-	}
-	// Send the gossip object to the owner.
-	resp, postErr := c.Client.Post("http://"+c.Gossiper_private_config.Owner_URL+endpoint, "application/json", bytes.NewBuffer(msg))
-	if postErr != nil {
-		fmt.Println("Error sending object to owner: " + postErr.Error())
-	} else {
+		sent = definition.TypeString(obj.(definition.PoM_Counter).Type)
+	}
+	// Send the gossip object to every owner.
+	for _, owner := range c.Owner_URLs() {
+		resp, postErr := c.Client.Post("http://"+owner+endpoint, "application/json", bytes.NewBuffer(msg))
+		if postErr != nil {
+			fmt.Println("Error sending object to owner " + owner + ": " + postErr.Error())
+			c.Metrics.Send_failed(owner, sent)
+			continue
+		}
 		// Close the response, mentioned by http.Post
 		// Alernatively, we could return the response from this function.
-		defer resp.Body.Close()
+		resp.Body.Close()
 		if c.Verbose {
-			fmt.Println("Owner responded with " + resp.Status)
+			fmt.Println("Owner " + owner + " responded with " + resp.Status)
 		}
 	}
 
 }
 
+// How long FULL objects are collected before they are sent to the monitors as one batch.
+const MONITOR_BATCH_WAIT = time.Second
+
+// Queue a FULL object for the monitors, which verify the threshold signatures of a batch at once.
+// The first object queued schedules the batch.
+func (c *GossiperContext) Queue_for_Monitor(gossip_obj definition.Gossip_object) {
+	outbox := c.Monitor_outbox
+	outbox.LOCK.Lock()
+	defer outbox.LOCK.Unlock()
+	outbox.Objects = append(outbox.Objects, gossip_obj)
+	if len(outbox.Objects) == 1 {
+		time.AfterFunc(MONITOR_BATCH_WAIT, c.Flush_monitor_outbox)
+	}
+}
+
+// Send the queued FULL objects to every owner in one post.
+func (c *GossiperContext) Flush_monitor_outbox() {
+	outbox := c.Monitor_outbox
+	outbox.LOCK.Lock()
+	batch := outbox.Objects
+	outbox.Objects = nil
+	outbox.LOCK.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	msg, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(util.BLUE+"Sending", len(batch), "FULL objects to owner", util.RESET)
+	for _, owner := range c.Owner_URLs() {
+		resp, postErr := c.Client.Post("http://"+owner+"/monitor/recieve-gossip-batch", "application/json", bytes.NewBuffer(msg))
+		if postErr != nil {
+			fmt.Println("Error sending objects to owner " + owner + ": " + postErr.Error())
+			for _, gossip_obj := range batch {
+				c.Metrics.Send_failed(owner, definition.TypeString(gossip_obj.Type))
+			}
+			continue
+		}
+		resp.Body.Close()
+		if c.Verbose {
+			fmt.Println("Owner " + owner + " responded with " + resp.Status)
+		}
+	}
+}
+
 func PeriodicTasks(c *GossiperContext) {
 	// Immediately queue up the next task to run at next MMD.
 	// Doing this first means: no matter how long the rest of the function takes,
@@ -522,8 +744,11 @@ func PeriodicTasks(c *GossiperContext) {
 	time.AfterFunc(time.Duration(c.Gossiper_public_config.MMD)*time.Second, f)
 	// Run the periodic tasks.
 	f1 := func() {
-		c.Save()
-		c.WipeStorage()
+		c.Metrics.Phase("save", func() {
+			c.Save()
+			c.Save_convergence_report()
+		})
+		c.Metrics.Phase("wipe", c.WipeStorage)
 	}
 	time.AfterFunc(time.Duration(c.Gossiper_public_config.MMD-20)*time.Second, f1)
 }
@@ -536,6 +761,24 @@ func StartGossiperServer(c *GossiperContext) {
 	c.Client = &http.Client{
 		Transport: tr,
 	}
+	// Generate the threshold keys first if Gen did not hand them out.
+	// The other gossipers need the server to be up, so the DKG runs next to it;
+	// gossip is refused until the keys are installed, see Threshold_keys_installed.
+	if c.Needs_DKG() {
+		go func() {
+			err := RunDKG(c)
+			if err != nil {
+				fmt.Println(util.RED+"DKG failed: ", err, util.RESET)
+			}
+		}()
+	} else if c.Needs_reshare() {
+		go func() {
+			err := RunReshare(c)
+			if err != nil {
+				fmt.Println(util.RED+"Resharing failed: ", err, util.RESET)
+			}
+		}()
+	}
 	// HTTP Server Loop
 	go PeriodicTasks(c)
 	handleRequests(c)
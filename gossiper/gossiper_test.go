@@ -1,8 +1,15 @@
 package gossiper
 
 import (
+	"CTngV2/crypto"
 	"CTngV2/definition"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -328,3 +335,129 @@ func testNUMHandler(t *testing.T) {
 	fmt.Println(ctx_g1.Gossiper_log)
 
 }
+
+func TestConvergenceReport(t *testing.T) {
+	c := &GossiperContext{
+		Gossiper_public_config: &Gossiper_public_config{Gossiper_URLs: []string{"localhost:8080", "localhost:8081", "localhost:8082"}},
+		Gossiper_crypto_config: &crypto.CryptoConfig{SelfID: "localhost:8080", Threshold: 2},
+		Convergence:            New_convergence_tracker("7"),
+		StorageDirectory:       t.TempDir() + "/",
+		StorageID:              "1",
+	}
+	object := func(objtype string, entity string, signer string) definition.Gossip_object {
+		return definition.Gossip_object{Type: objtype, Period: "7", Signer: signer, Payload: [3]string{entity, "", ""}}
+	}
+	// the STH converges, the REV stalls with the fragment of one gossiper
+	c.Convergence.Record(object(definition.STH_INIT, "localhost:9000", "localhost:9000"))
+	c.Convergence.Record(object(definition.STH_FRAG, "localhost:9000", "localhost:8080"))
+	c.Convergence.Record(object(definition.STH_FRAG, "localhost:9000", "localhost:8082"))
+	c.Convergence.Record(object(definition.STH_FULL, "localhost:9000", ""))
+	c.Convergence.Record(object(definition.REV_INIT, "localhost:9100", "localhost:9100"))
+	c.Convergence.Record(object(definition.REV_FRAG, "localhost:9100", "localhost:8080"))
+	c.Convergence.Record_failed_delivery("localhost:8081", "7")
+	// a late object of the previous period lands in its report, not in the report of period 7
+	late := object(definition.ACC_INIT, "localhost:9200", "localhost:9200")
+	late.Period = "6"
+	c.Convergence.Record(late)
+	report := c.Convergence_report()
+	if len(report.Full) != 1 || report.Full[0].Type != "STH_FULL" || report.Full[0].Fragment_count != 2 {
+		t.Fatalf("Expected the STH to reach FULL: %+v", report.Full)
+	}
+	if len(report.Stalled) != 1 || report.Stalled[0].Type != "REV_FULL" || !reflect.DeepEqual(report.Stalled[0].Missing, []string{"localhost:8081", "localhost:8082"}) {
+		t.Fatalf("Expected the REV to stall without 8081 and 8082: %+v", report.Stalled)
+	}
+	if report.Failed_deliveries["localhost:8081"] != 1 {
+		t.Fatalf("Failed delivery not reported: %v", report.Failed_deliveries)
+	}
+	previous := c.Convergence_report_of("6")
+	if len(previous.Stalled) != 1 || previous.Stalled[0].Entity != "localhost:9200" || len(previous.Failed_deliveries) != 0 {
+		t.Fatalf("Expected the late ACC in the report of period 6: %+v", previous)
+	}
+	// the saved report is served for its period, the live one for the next
+	c.Save_convergence_report()
+	if len(c.Convergence.Objects) != 0 {
+		t.Fatal("The tracker was not reset")
+	}
+	w := httptest.NewRecorder()
+	Convergence_handler(c, w, httptest.NewRequest("GET", "/gossip/convergence?period=7", nil))
+	var saved Convergence_report
+	if err := json.Unmarshal(w.Body.Bytes(), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Stalled, report.Stalled) || saved.Period != "7" {
+		t.Fatalf("Saved report differs: %+v", saved)
+	}
+	w = httptest.NewRecorder()
+	Convergence_handler(c, w, httptest.NewRequest("GET", "/gossip/convergence?period=6", nil))
+	var saved_previous Convergence_report
+	if err := json.Unmarshal(w.Body.Bytes(), &saved_previous); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved_previous.Stalled, previous.Stalled) || saved_previous.Period != "6" {
+		t.Fatalf("Saved report of the previous period differs: %+v", saved_previous)
+	}
+	w = httptest.NewRecorder()
+	Convergence_handler(c, w, httptest.NewRequest("GET", "/gossip/convergence?period=3", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for a period without report, got %d", w.Code)
+	}
+}
+
+func TestMonitorBatch(t *testing.T) {
+	var lock sync.Mutex
+	batches := [][]definition.Gossip_object{}
+	monitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/monitor/recieve-gossip-batch" {
+			t.Errorf("FULL object posted to %s", r.URL.Path)
+			return
+		}
+		var batch []definition.Gossip_object
+		json.NewDecoder(r.Body).Decode(&batch)
+		lock.Lock()
+		batches = append(batches, batch)
+		lock.Unlock()
+	}))
+	defer monitor.Close()
+	c := &GossiperContext{
+		Gossiper_private_config: &Gossiper_private_config{Owner_URL: strings.TrimPrefix(monitor.URL, "http://")},
+		Client:                  monitor.Client(),
+		Monitor_outbox:          &Monitor_outbox{},
+	}
+	c.Queue_for_Monitor(definition.Gossip_object{Type: definition.STH_FULL, Period: "1", Payload: [3]string{"localhost:9000", "", ""}})
+	c.Queue_for_Monitor(definition.Gossip_object{Type: definition.REV_FULL, Period: "1", Payload: [3]string{"localhost:9100", "", ""}})
+	time.Sleep(MONITOR_BATCH_WAIT + 500*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(batches) != 1 || len(batches[0]) != 2 || batches[0][1].Type != definition.REV_FULL {
+		t.Fatalf("Expected one batch of the two FULL objects, got %v", batches)
+	}
+	if len(c.Monitor_outbox.Objects) != 0 {
+		t.Error("The outbox was not emptied")
+	}
+}
+
+// Gossip is refused while a DKG is still running, and accepted once the keys are installed.
+func TestGossipWaitsForThresholdKeys(t *testing.T) {
+	configs, err := crypto.GenerateEntityCryptoConfigs([]crypto.CTngID{"localhost:8080", "localhost:8081"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := configs[0].ThresholdSecretKey
+	c := &GossiperContext{Gossiper_crypto_config: &crypto.CryptoConfig{SelfID: "localhost:8080"}}
+	w := httptest.NewRecorder()
+	Gossip_object_handler(c, w, httptest.NewRequest("POST", "/gossip/sth_init", strings.NewReader("{}")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected gossip to be refused without a key share, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	PoM_counter_handler(c, w, httptest.NewRequest("POST", "/gossip/num_init", strings.NewReader("{}")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected PoM counters to be refused without a key share, got %d", w.Code)
+	}
+	c.Gossiper_crypto_config.InstallThresholdKeys(configs[0].ThresholdPublicMap, keys, 2)
+	w = httptest.NewRecorder()
+	Health_handler(c, w, httptest.NewRequest("GET", "/gossip/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the gossiper to be healthy once the keys are installed, got %d", w.Code)
+	}
+}
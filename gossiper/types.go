@@ -3,6 +3,7 @@ package gossiper
 import (
 	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"net/http"
 	"sync"
 )
@@ -12,12 +13,22 @@ type Gossiper_public_config struct {
 	MMD              int
 	MRD              int
 	Gossiper_URLs    []string
-	Signer_URLs      []string // List of all potential signers' DNS names.
+	Signer_URLs      []string        // List of all potential signers' DNS names.
+	Reshare          *Reshare_config `json:",omitempty"`
+}
+
+// Hands the threshold keys over from Old_gossiper_URLs to Gossiper_URLs.
+// Runs on startup while the crypto config is still in an earlier epoch.
+type Reshare_config struct {
+	Old_gossiper_URLs []string
+	Threshold         int // threshold of the new gossiper set
+	Epoch             int // the epoch the resharing produces
 }
 
 type Gossiper_private_config struct {
 	Connected_Gossipers []string
 	Owner_URL           string
+	Owner_URLs          []string `json:",omitempty"` // further monitors attached to this gossiper
 	Port                string
 }
 
@@ -26,26 +37,34 @@ type Gossip_object_storage struct {
 	REV_INIT      map[definition.Gossip_ID]definition.Gossip_object
 	ACC_INIT      map[definition.Gossip_ID]definition.Gossip_object
 	CON_INIT      map[definition.Gossip_ID]definition.Gossip_object
+	KEY_INIT      map[definition.Gossip_ID]definition.Gossip_object
 	STH_FRAG      map[definition.Gossip_ID][]definition.Gossip_object
 	REV_FRAG      map[definition.Gossip_ID][]definition.Gossip_object
 	ACC_FRAG      map[definition.Gossip_ID][]definition.Gossip_object
 	CON_FRAG      map[definition.Gossip_ID][]definition.Gossip_object
+	KEY_FRAG      map[definition.Gossip_ID][]definition.Gossip_object
 	STH_FULL      map[definition.Gossip_ID]definition.Gossip_object
 	REV_FULL      map[definition.Gossip_ID]definition.Gossip_object
 	ACC_FULL      map[definition.Gossip_ID]definition.Gossip_object
 	CON_FULL      map[definition.Gossip_ID]definition.Gossip_object
+	KEY_FULL      map[definition.Gossip_ID]definition.Gossip_object
+	DIS_INIT      map[definition.Gossip_ID]definition.Gossip_object
 	STH_INIT_LOCK sync.RWMutex
 	REV_INIT_LOCK sync.RWMutex
 	ACC_INIT_LOCK sync.RWMutex
 	CON_INIT_LOCK sync.RWMutex
+	KEY_INIT_LOCK sync.RWMutex
 	STH_FRAG_LOCK sync.RWMutex
 	REV_FRAG_LOCK sync.RWMutex
 	ACC_FRAG_LOCK sync.RWMutex
 	CON_FRAG_LOCK sync.RWMutex
+	KEY_FRAG_LOCK sync.RWMutex
 	STH_FULL_LOCK sync.RWMutex
 	REV_FULL_LOCK sync.RWMutex
 	ACC_FULL_LOCK sync.RWMutex
 	CON_FULL_LOCK sync.RWMutex
+	KEY_FULL_LOCK sync.RWMutex
+	DIS_INIT_LOCK sync.RWMutex
 }
 
 type Gossip_blacklist struct {
@@ -73,12 +92,36 @@ type GossiperContext struct {
 	Gossip_blacklist      *Gossip_blacklist
 	Gossip_PoM_Counter    *Gossip_PoM_Counter
 	Gossiper_log          *Gossiper_log
+	Convergence           *Convergence_tracker
+	Metrics               *metrics.CTng_metrics
 	//File I/O
 	StorageID        string
 	StorageFile      string
 	StorageDirectory string
 	Client           *http.Client
 	Verbose          bool
+	// Distributed key generation
+	Crypto_config_path string
+	DKG                *Gossiper_DKG
+	Monitor_outbox     *Monitor_outbox
+}
+
+// FULL objects waiting to be sent to the monitors in one batch.
+type Monitor_outbox struct {
+	Objects []definition.Gossip_object
+	LOCK    sync.Mutex
+}
+
+// State of a distributed key generation run.
+// Messages from faster gossipers are kept until our own run starts.
+type Gossiper_DKG struct {
+	Participant       *crypto.DKGParticipant
+	Dealer            crypto.DKGDealer // answers the complaints about our deals
+	Pending_deals     []crypto.DKGDeal
+	Pending_statuses  []crypto.DKGStatus
+	Pending_responses []crypto.DKGResponse
+	Pending_qualified []crypto.DKGQualified
+	LOCK              sync.Mutex
 }
 
 type Gossiper_log_entry struct {
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// The metrics every CTng entity exposes on /metrics, named ctng_<metric> and labelled with the object type.
+// Entities add their own gauges, like the blacklist sizes of the gossiper, to Registry.
+type CTng_metrics struct {
+	Registry *Registry
+	// gossip objects, PoM counters, STHs, POIs ... by type
+	Objects_received *CounterVec
+	Objects_verified *CounterVec
+	Objects_rejected *CounterVec
+	// seconds spent verifying the signatures of an object, by type
+	Verify_seconds *HistogramVec
+	// failed posts, by destination and what was sent
+	Send_failures *CounterVec
+	// seconds spent in each phase of the periodic tasks, by phase
+	Phase_seconds *HistogramVec
+}
+
+func New_CTng_metrics() *CTng_metrics {
+	r := NewRegistry()
+	m := &CTng_metrics{
+		Registry:         r,
+		Objects_received: r.NewCounterVec("ctng_objects_received_total", "Objects received, by type.", "type"),
+		Objects_verified: r.NewCounterVec("ctng_objects_verified_total", "Objects whose verification succeeded, by type.", "type"),
+		Objects_rejected: r.NewCounterVec("ctng_objects_rejected_total", "Objects rejected, by type.", "type"),
+		Verify_seconds:   r.NewHistogramVec("ctng_signature_verify_seconds", "Time spent verifying the signatures of an object, by type.", nil, "type"),
+		Send_failures:    r.NewCounterVec("ctng_send_failures_total", "Outbound posts that failed, by destination and type.", "destination", "type"),
+		Phase_seconds:    r.NewHistogramVec("ctng_period_phase_seconds", "Duration of the phases of the periodic tasks.", nil, "phase"),
+	}
+	return m
+}
+
+// Counts a received object and the outcome of its verification.
+// The verification is timed, its error is returned.
+func (m *CTng_metrics) Verify(objtype string, verify func() error) error {
+	if m == nil {
+		return verify()
+	}
+	m.Objects_received.Inc(objtype)
+	start := time.Now()
+	err := verify()
+	m.Verify_seconds.Since(start, objtype)
+	if err != nil {
+		m.Objects_rejected.Inc(objtype)
+	} else {
+		m.Objects_verified.Inc(objtype)
+	}
+	return err
+}
+
+// Times a phase of the periodic tasks.
+func (m *CTng_metrics) Phase(phase string, f func()) {
+	start := time.Now()
+	f()
+	if m != nil {
+		m.Phase_seconds.Since(start, phase)
+	}
+}
+
+// Counts for objects verified elsewhere, like the batches of FULL objects.
+func (m *CTng_metrics) Count_received(objtype string) {
+	if m != nil {
+		m.Objects_received.Inc(objtype)
+	}
+}
+
+func (m *CTng_metrics) Count_verified(objtype string) {
+	if m != nil {
+		m.Objects_verified.Inc(objtype)
+	}
+}
+
+func (m *CTng_metrics) Count_rejected(objtype string) {
+	if m != nil {
+		m.Objects_rejected.Inc(objtype)
+	}
+}
+
+func (m *CTng_metrics) Send_failed(destination string, objtype string) {
+	if m == nil {
+		return
+	}
+	m.Send_failures.Inc(destination, objtype)
+}
+
+// GET /metrics, an entity without metrics answers with an empty body.
+func (m *CTng_metrics) Handler() http.HandlerFunc {
+	if m == nil {
+		return (*Registry)(nil).Handler()
+	}
+	return m.Registry.Handler()
+}
+
+func (m *CTng_metrics) Gauge(name string, help string, value func() float64) {
+	if m == nil {
+		return
+	}
+	m.Registry.NewGaugeFunc(name, help, value)
+}
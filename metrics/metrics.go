@@ -0,0 +1,282 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters, gauges and histograms exposed in the Prometheus text format.
+// All the methods are safe to call on nil values, so contexts built without metrics (as in the tests) need no checks.
+
+type Registry struct {
+	families []family
+	LOCK     sync.RWMutex
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	if r == nil {
+		return
+	}
+	r.LOCK.Lock()
+	defer r.LOCK.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Writes every registered metric in the Prometheus text format, in registration order.
+func (r *Registry) Expose(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.LOCK.RLock()
+	defer r.LOCK.RUnlock()
+	for _, f := range r.families {
+		f.write(w)
+	}
+}
+
+// GET /metrics
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Expose(w)
+	}
+}
+
+// One child per combination of label values, keyed by the values joined with \xff.
+type vec struct {
+	Name   string
+	Help   string
+	Labels []string
+	values map[string][]string
+	LOCK   sync.Mutex
+}
+
+func new_vec(name string, help string, labels []string) vec {
+	return vec{Name: name, Help: help, Labels: labels, values: make(map[string][]string)}
+}
+
+// Returns the key of the label values, padding or cutting them to the number of labels.
+func (v *vec) key(values []string) string {
+	fixed := make([]string, len(v.Labels))
+	copy(fixed, values)
+	return strings.Join(fixed, "\xff")
+}
+
+// Like key, and records the label values of a new child.
+func (v *vec) child(values []string) string {
+	key := v.key(values)
+	if _, ok := v.values[key]; !ok {
+		fixed := make([]string, len(v.Labels))
+		copy(fixed, values)
+		v.values[key] = fixed
+	}
+	return key
+}
+
+func (v *vec) sorted_keys() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.Name, escape_help(v.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.Name, kind)
+}
+
+// Formats the labels of a child, with an extra label pair (like le) if extra is not empty.
+func (v *vec) label_string(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, label := range v.Labels {
+		pairs = append(pairs, label+"=\""+escape_label(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escape_label(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: new_vec(name, help, labels), counts: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if c == nil || delta < 0 {
+		return
+	}
+	c.LOCK.Lock()
+	defer c.LOCK.Unlock()
+	c.counts[c.child(values)] += delta
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Value(values ...string) float64 {
+	if c == nil {
+		return 0
+	}
+	c.LOCK.Lock()
+	defer c.LOCK.Unlock()
+	return c.counts[c.key(values)]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.LOCK.Lock()
+	defer c.LOCK.Unlock()
+	c.header(w, "counter")
+	for _, key := range c.sorted_keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, c.label_string(c.values[key]), format_float(c.counts[key]))
+	}
+}
+
+// A gauge read when the metrics are written, for sizes kept elsewhere like the blacklists.
+type GaugeFunc struct {
+	vec
+	Value func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{vec: new_vec(name, help, nil), Value: value}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	if g.Value == nil {
+		return
+	}
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.Name, format_float(g.Value()))
+}
+
+// Buckets in seconds, from 1ms to 60s.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+type HistogramVec struct {
+	vec
+	Buckets []float64
+	counts  map[string][]uint64 // cumulative per bucket
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		vec:     new_vec(name, help, labels),
+		Buckets: sorted,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.LOCK.Lock()
+	defer h.LOCK.Unlock()
+	key := h.child(values)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.Buckets))
+		h.counts[key] = counts
+	}
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			counts[i]++
+		}
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+// Observes the seconds elapsed since start.
+func (h *HistogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) Count(values ...string) uint64 {
+	if h == nil {
+		return 0
+	}
+	h.LOCK.Lock()
+	defer h.LOCK.Unlock()
+	return h.totals[h.key(values)]
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.LOCK.Lock()
+	defer h.LOCK.Unlock()
+	h.header(w, "histogram")
+	for _, key := range h.sorted_keys() {
+		values := h.values[key]
+		counts, ok := h.counts[key]
+		if !ok {
+			continue
+		}
+		for i, bound := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.label_string(values, "le", format_float(bound)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.label_string(values, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, h.label_string(values), format_float(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, h.label_string(values), h.totals[key])
+	}
+}
+
+func format_float(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escape_label(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(s)
+}
+
+func escape_help(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(s)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpose(t *testing.T) {
+	r := NewRegistry()
+	received := r.NewCounterVec("ctng_test_total", "Test counter.", "type")
+	received.Inc("STH_INIT")
+	received.Add(2, "STH_INIT")
+	received.Inc("REV \"INIT\"\n")
+	// negative deltas are ignored
+	received.Add(-1, "STH_INIT")
+	r.NewGaugeFunc("ctng_test_size", "Test gauge.", func() float64 { return 7 })
+	seconds := r.NewHistogramVec("ctng_test_seconds", "Test histogram.", []float64{1, 0.1}, "phase")
+	seconds.Observe(0.05, "save")
+	seconds.Observe(0.5, "save")
+	seconds.Observe(2, "save")
+	if received.Value("STH_INIT") != 3 || received.Value("KEY_INIT") != 0 {
+		t.Fatal("Wrong counter values")
+	}
+	if seconds.Count("save") != 3 {
+		t.Fatal("Wrong histogram count")
+	}
+	var out bytes.Buffer
+	r.Expose(&out)
+	expected := []string{
+		"# HELP ctng_test_total Test counter.",
+		"# TYPE ctng_test_total counter",
+		"ctng_test_total{type=\"REV \\\"INIT\\\"\\n\"} 1",
+		"ctng_test_total{type=\"STH_INIT\"} 3",
+		"# TYPE ctng_test_size gauge",
+		"ctng_test_size 7",
+		"# TYPE ctng_test_seconds histogram",
+		"ctng_test_seconds_bucket{phase=\"save\",le=\"0.1\"} 1",
+		"ctng_test_seconds_bucket{phase=\"save\",le=\"1\"} 2",
+		"ctng_test_seconds_bucket{phase=\"save\",le=\"+Inf\"} 3",
+		"ctng_test_seconds_sum{phase=\"save\"} 2.55",
+		"ctng_test_seconds_count{phase=\"save\"} 3",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing %q in\n%s", line, out.String())
+		}
+	}
+	// reading a counter does not create a series
+	if strings.Contains(out.String(), "KEY_INIT") {
+		t.Error("Reading a counter exposed a new series")
+	}
+}
+
+func TestCTngMetrics(t *testing.T) {
+	m := New_CTng_metrics()
+	m.Verify("STH_INIT", func() error { return nil })
+	m.Verify("STH_INIT", func() error { return errors.New("bad signature") })
+	m.Send_failed("localhost:8080", "STH_FRAG")
+	m.Phase("save", func() {})
+	if m.Objects_received.Value("STH_INIT") != 2 || m.Objects_verified.Value("STH_INIT") != 1 || m.Objects_rejected.Value("STH_INIT") != 1 {
+		t.Fatal("Wrong verification counts")
+	}
+	if m.Verify_seconds.Count("STH_INIT") != 2 || m.Phase_seconds.Count("save") != 1 {
+		t.Fatal("Wrong histogram counts")
+	}
+	w := httptest.NewRecorder()
+	m.Handler()(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Error("Wrong content type", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "ctng_send_failures_total{destination=\"localhost:8080\",type=\"STH_FRAG\"} 1") {
+		t.Error("Missing send failure in\n" + w.Body.String())
+	}
+	// contexts without metrics
+	var none *CTng_metrics
+	if none.Verify("STH_INIT", func() error { return errors.New("bad") }) == nil {
+		t.Error("The error of the verification was lost")
+	}
+	none.Send_failed("localhost:8080", "STH_FRAG")
+	none.Count_received("FULL")
+	none.Gauge("ctng_none", "None.", func() float64 { return 1 })
+	w = httptest.NewRecorder()
+	none.Handler()(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Body.Len() != 0 {
+		t.Error("Expected an empty body")
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	//"CTng/crypto"
 	//"bytes"
 	//"time"
 	//"strings"
-	//"strconv"
 	//"github.com/gorilla/mux"
+
+	"github.com/bits-and-blooms/bitset"
 )
 
 type ClientUpdate struct {
@@ -19,6 +22,8 @@ type ClientUpdate struct {
 	REVs      []definition.Gossip_object
 	ACCs      []definition.Gossip_object
 	CONs      []definition.Gossip_object
+	KEYs      []definition.Gossip_object `json:",omitempty"` // key rotations of this period
+	DISs      []definition.Gossip_object `json:",omitempty"` // disputes of the accused entities
 	NUM       definition.PoM_Counter
 	NUM_FULL  definition.PoM_Counter
 	MonitorID string
@@ -27,6 +32,113 @@ type ClientUpdate struct {
 	// PoMsig string
 }
 
+// The client updates of several periods merged into one, so a client can catch up in one request.
+// Every object keeps its own signature and is carried once; the NUMs and NUM_FULLs of the merged updates are kept in order.
+// Delta_CRVs composes the Delta_CRVs of the REVs of each CA, the client checks it against the REVs.
+type ClientUpdateBundle struct {
+	STHs       []definition.Gossip_object
+	REVs       []definition.Gossip_object // oldest first
+	ACCs       []definition.Gossip_object
+	CONs       []definition.Gossip_object
+	KEYs       []definition.Gossip_object `json:",omitempty"`
+	DISs       []definition.Gossip_object `json:",omitempty"`
+	NUMs       []definition.PoM_Counter
+	NUM_FULLs  []definition.PoM_Counter
+	Delta_CRVs map[string][]byte // key = CA URL, content = XOR of the Delta_CRVs of its REVs
+	MonitorID  string
+	// first and last period of the merged updates
+	Since  string
+	Period string
+}
+
+// XOR of the Delta_CRVs of the REVs per CA. Composition does not depend on the order of the REVs.
+func Compose_Delta_CRVs(revs []definition.Gossip_object) (map[string][]byte, error) {
+	composed := make(map[string]*bitset.BitSet)
+	for _, rev := range revs {
+		var revocation definition.Revocation
+		err := json.Unmarshal([]byte(rev.Payload[2]), &revocation)
+		if err != nil {
+			return nil, err
+		}
+		var delta bitset.BitSet
+		err = delta.UnmarshalBinary(revocation.Delta_CRV)
+		if err != nil {
+			return nil, err
+		}
+		if crv, ok := composed[rev.Payload[0]]; ok {
+			crv.InPlaceSymmetricDifference(&delta)
+		} else {
+			composed[rev.Payload[0]] = &delta
+		}
+	}
+	deltas := make(map[string][]byte)
+	for key, crv := range composed {
+		bytes, err := crv.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		deltas[key] = bytes
+	}
+	return deltas, nil
+}
+
+// Merge the stored client updates from period since on (as in Period_N) into one bundle.
+func (c *MonitorContext) Generate_update_bundle(since int) (*ClientUpdateBundle, error) {
+	idx, err := c.Get_update_index()
+	if err != nil {
+		return nil, err
+	}
+	idx.LOCK.RLock()
+	defer idx.LOCK.RUnlock()
+	periods := []int{}
+	for period := range idx.Updates {
+		if period >= since {
+			periods = append(periods, period)
+		}
+	}
+	if len(periods) == 0 {
+		return nil, fmt.Errorf("No client update since period %d", since)
+	}
+	sort.Ints(periods)
+	bundle := &ClientUpdateBundle{
+		MonitorID: idx.Updates[periods[0]].MonitorID,
+		Since:     strconv.Itoa(periods[0]),
+		Period:    strconv.Itoa(periods[len(periods)-1]),
+	}
+	seen := make(map[definition.Gossip_ID]bool)
+	merge := func(list []definition.Gossip_object, objs []definition.Gossip_object) []definition.Gossip_object {
+		for _, obj := range objs {
+			if !seen[obj.GetID()] {
+				seen[obj.GetID()] = true
+				list = append(list, obj)
+			}
+		}
+		return list
+	}
+	for _, period := range periods {
+		update := idx.Updates[period]
+		bundle.STHs = merge(bundle.STHs, update.STHs)
+		bundle.REVs = merge(bundle.REVs, update.REVs)
+		bundle.ACCs = merge(bundle.ACCs, update.ACCs)
+		bundle.CONs = merge(bundle.CONs, update.CONs)
+		bundle.KEYs = merge(bundle.KEYs, update.KEYs)
+		bundle.DISs = merge(bundle.DISs, update.DISs)
+		bundle.NUMs = append(bundle.NUMs, update.NUM)
+		bundle.NUM_FULLs = append(bundle.NUM_FULLs, update.NUM_FULL)
+	}
+	// the SRHs chain from one period to the next, so the client has to process the REVs in order
+	sort.SliceStable(bundle.REVs, func(i, j int) bool {
+		pi, _ := strconv.Atoi(bundle.REVs[i].Period)
+		pj, _ := strconv.Atoi(bundle.REVs[j].Period)
+		return pi < pj
+	})
+	bundle.Delta_CRVs, err = Compose_Delta_CRVs(bundle.REVs)
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
 func PrepareClientUpdate(context *MonitorContext, filepath string) (*ClientUpdate, error) {
 	var clientupdate ClientUpdate
 	// read from filepath
@@ -41,7 +153,39 @@ func PrepareClientUpdate(context *MonitorContext, filepath string) (*ClientUpdat
 	return &clientupdate, nil
 }
 
+// GET /monitor/get-update?since=P returns the bundle of all updates from P on,
+// ?period=P the update of period P. Without parameters the period is read from the request body.
 func requestupdate(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("since") {
+		since, err := period_param(r, "since")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bundle, err := c.Generate_update_bundle(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		write_json(w, bundle)
+		fmt.Println("Update request since period", bundle.Since, "Processed")
+		return
+	}
+	if r.URL.Query().Has("period") {
+		period, err := period_param(r, "period")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctupdate, err := PrepareClientUpdate(c, c.StorageDirectory+"/Period_"+strconv.Itoa(period)+"/ClientUpdate.json")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		write_json(w, ctupdate)
+		fmt.Println("Update request Processed")
+		return
+	}
 	var periodnum string
 	err := json.NewDecoder(r.Body).Decode(&periodnum)
 	if err != nil {
@@ -0,0 +1,126 @@
+package monitor
+
+import (
+	"CTngV2/util"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A monitor can attach to several gossipers.
+// Every object is posted to the first Gossiper_fanout gossipers of Gossiper_URLs that accept it, healthy ones first.
+// A gossiper that fails a post or a health check is marked down until it answers a health check again,
+// gossipers which are down are still tried as a last resort.
+
+type Gossiper_health struct {
+	Down map[string]bool
+	LOCK sync.RWMutex
+}
+
+func New_gossiper_health() *Gossiper_health {
+	return &Gossiper_health{Down: make(map[string]bool)}
+}
+
+// A nil Gossiper_health considers every gossiper healthy.
+func (h *Gossiper_health) IsDown(url string) bool {
+	if h == nil {
+		return false
+	}
+	h.LOCK.RLock()
+	defer h.LOCK.RUnlock()
+	return h.Down[url]
+}
+
+func (h *Gossiper_health) Mark(url string, down bool) {
+	if h == nil {
+		return
+	}
+	h.LOCK.Lock()
+	defer h.LOCK.Unlock()
+	if down && !h.Down[url] {
+		fmt.Println(util.RED+"Gossiper", url, "is down", util.RESET)
+	} else if !down && h.Down[url] {
+		fmt.Println(util.GREEN+"Gossiper", url, "is back up", util.RESET)
+	}
+	h.Down[url] = down
+}
+
+// The gossipers of the monitor, Gossiper_URL is used if the list is empty.
+func (c *MonitorContext) Gossiper_URLs() []string {
+	if len(c.Monitor_private_config.Gossiper_URLs) > 0 {
+		return c.Monitor_private_config.Gossiper_URLs
+	}
+	return []string{c.Monitor_private_config.Gossiper_URL}
+}
+
+// The gossipers in the order they are tried: healthy ones first, each group in configuration order.
+func (c *MonitorContext) gossiper_order() []string {
+	healthy := []string{}
+	down := []string{}
+	for _, url := range c.Gossiper_URLs() {
+		if c.Gossiper_health.IsDown(url) {
+			down = append(down, url)
+		} else {
+			healthy = append(healthy, url)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func (c *MonitorContext) gossiper_fanout() int {
+	if c.Monitor_private_config.Gossiper_fanout > 0 {
+		return c.Monitor_private_config.Gossiper_fanout
+	}
+	return 1
+}
+
+// Post msg to the endpoint of the gossipers until Gossiper_fanout of them accepted it.
+// Returns the gossipers that accepted it.
+func Post_to_gossipers(c *MonitorContext, endpoint string, msg []byte) []string {
+	delivered := []string{}
+	for _, url := range c.gossiper_order() {
+		if len(delivered) >= c.gossiper_fanout() {
+			break
+		}
+		resp, err := c.Client.Post(PROTOCOL+url+endpoint, "application/json", bytes.NewBuffer(msg))
+		if err != nil {
+			fmt.Println(util.RED+"Error sending object to Gossiper "+url+": ", err.Error(), util.RESET)
+			c.Metrics.Send_failed(url, endpoint_type(endpoint))
+			c.Gossiper_health.Mark(url, true)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			fmt.Println(util.RED+"Gossiper "+url+" responded with "+resp.Status, util.RESET)
+			c.Metrics.Send_failed(url, endpoint_type(endpoint))
+			c.Gossiper_health.Mark(url, true)
+			continue
+		}
+		c.Gossiper_health.Mark(url, false)
+		delivered = append(delivered, url)
+	}
+	return delivered
+}
+
+// The object type posted to a gossiper endpoint, /gossip/sth_init is STH_INIT.
+func endpoint_type(endpoint string) string {
+	return strings.ToUpper(path.Base(endpoint))
+}
+
+// Probe /gossip/health of every gossiper of the monitor.
+func Check_gossipers(c *MonitorContext) {
+	client := &http.Client{Transport: c.Client.Transport, Timeout: 5 * time.Second}
+	for _, url := range c.Gossiper_URLs() {
+		resp, err := client.Get(PROTOCOL + url + "/gossip/health")
+		if err != nil {
+			c.Gossiper_health.Mark(url, true)
+			continue
+		}
+		resp.Body.Close()
+		c.Gossiper_health.Mark(url, resp.StatusCode != http.StatusOK)
+	}
+}
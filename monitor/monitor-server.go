@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"CTngV2/definition"
 	"CTngV2/util"
 	"fmt"
 	"log"
@@ -25,7 +26,14 @@ func handleMonitorRequests(c *MonitorContext) {
 	gorillaRouter.HandleFunc("/monitor/get-update", bindMonitorContext(c, requestupdate)).Methods("GET")
 	gorillaRouter.HandleFunc("/monitor/recieve-gossip", bindMonitorContext(c, handle_gossip)).Methods("POST")
 	gorillaRouter.HandleFunc("/monitor/recieve-gossip-from-gossiper", bindMonitorContext(c, handle_gossip_from_gossiper)).Methods("POST")
+	gorillaRouter.HandleFunc("/monitor/recieve-gossip-batch", bindMonitorContext(c, handle_gossip_batch_from_gossiper)).Methods("POST")
 	gorillaRouter.HandleFunc("/monitor/num_full", bindMonitorContext(c, handle_num_full)).Methods("POST")
+	// Queries over the stored client updates
+	gorillaRouter.HandleFunc("/monitor/poms", bindMonitorContext(c, requestPoMs)).Methods("GET")
+	gorillaRouter.HandleFunc("/monitor/sth", bindMonitorContext(c, requestFULL(definition.STH_FULL))).Methods("GET")
+	gorillaRouter.HandleFunc("/monitor/rev", bindMonitorContext(c, requestFULL(definition.REV_FULL))).Methods("GET")
+	gorillaRouter.HandleFunc("/monitor/status", bindMonitorContext(c, requestStatus)).Methods("GET")
+	gorillaRouter.HandleFunc("/metrics", c.Metrics.Handler()).Methods("GET")
 	// Start the HTTP server.
 	http.Handle("/", gorillaRouter)
 	// Listen on port set by config until server is stopped.
@@ -42,6 +50,11 @@ func StartMonitorServer(c *MonitorContext) {
 	c.Client = &http.Client{
 		Transport: tr,
 	}
+	// pick up where the monitor left off before a restart
+	err := c.LoadStorage()
+	if err != nil {
+		fmt.Println(util.RED+"Failed to restore the monitor storage:", err, util.RESET)
+	}
 	fmt.Println("Monitor ", c.StorageID, " running on Period ", util.GetCurrentPeriod())
 	// Run a go routine to handle tasks that must occur every MMD
 	go PeriodicTasks(c)
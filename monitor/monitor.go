@@ -6,6 +6,7 @@ import (
 	"CTngV2/util"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -43,6 +44,7 @@ func handle_gossip_from_gossiper(c *MonitorContext, w http.ResponseWriter, r *ht
 	err := json.NewDecoder(r.Body).Decode(&gossip_obj)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	if c.IsDuplicate(gossip_obj) {
 		// If the object is already stored, still return OK.{
@@ -50,11 +52,97 @@ func handle_gossip_from_gossiper(c *MonitorContext, w http.ResponseWriter, r *ht
 		http.Error(w, "Gossip object already stored.", http.StatusOK)
 		// processDuplicateObject(c, gossip_obj, stored_obj)
 		return
-	} else {
-		fmt.Println("Recieved new, valid", definition.TypeString(gossip_obj.Type), "from gossiper.")
-		Process_valid_object(c, gossip_obj)
 	}
+	// the gossiper is not trusted, its objects are verified like those of anyone else
+	err = c.Metrics.Verify(definition.TypeString(gossip_obj.Type), func() error {
+		err := gossip_obj.Verify(c.Monitor_crypto_config)
+		if err == nil {
+			err = Check_gossiper_object(c, gossip_obj)
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Println(util.RED+"Rejected", definition.TypeString(gossip_obj.Type), "about", gossip_obj.Payload[0], "from gossiper "+util.GetSenderURL(r)+":", err, util.RESET)
+		http.Error(w, err.Error(), http.StatusOK)
+		return
+	}
+	fmt.Println("Recieved new, valid", definition.TypeString(gossip_obj.Type), "from gossiper.")
+	Process_valid_object(c, gossip_obj)
+}
+
+// Batched intake: the gossiper (or anyone catching the monitor up) posts a list of gossip objects.
+// The threshold signatures of the FULL objects are verified in a single batch.
+func handle_gossip_batch_from_gossiper(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	var gossip_objs []definition.Gossip_object
+	err := json.NewDecoder(r.Body).Decode(&gossip_objs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rejected := Process_gossip_batch(c, gossip_objs)
+	if len(rejected) > 0 {
+		http.Error(w, fmt.Sprint(len(rejected), " of ", len(gossip_objs), " gossip objects rejected."), http.StatusOK)
+		return
+	}
+	http.Error(w, "Gossip objects Processed.", http.StatusOK)
+}
+
+// Verifies a batch of gossip objects and processes the valid, non duplicate ones.
+// FULL objects are verified with one batched threshold signature check, everything else one by one.
+// Returns the objects which failed verification.
+func Process_gossip_batch(c *MonitorContext, gossip_objs []definition.Gossip_object) []definition.Gossip_object {
+	var fulls []definition.Gossip_object
+	var rejected []definition.Gossip_object
+	for _, gossip_obj := range gossip_objs {
+		switch gossip_obj.Type {
+		case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CON_FULL, definition.KEY_FULL:
+			fulls = append(fulls, gossip_obj)
+		default:
+			err := c.Metrics.Verify(definition.TypeString(gossip_obj.Type), func() error {
+				return gossip_obj.Verify(c.Monitor_crypto_config)
+			})
+			if err != nil {
+				rejected = append(rejected, gossip_obj)
+				continue
+			}
+			Process_if_new(c, gossip_obj)
+		}
+	}
+	start := time.Now()
+	failed := definition.Verify_PayloadThreshold_Batch(fulls, c.Monitor_crypto_config)
+	if c.Metrics != nil && len(fulls) > 0 {
+		c.Metrics.Verify_seconds.Since(start, "FULL_BATCH")
+	}
+	next := 0
+	for i, gossip_obj := range fulls {
+		c.Metrics.Count_received(definition.TypeString(gossip_obj.Type))
+		if next < len(failed) && failed[next] == i {
+			next++
+			fmt.Println(util.RED+"Rejected invalid", definition.TypeString(gossip_obj.Type), "about", gossip_obj.Payload[0], "for period", gossip_obj.Period, util.RESET)
+			c.Metrics.Count_rejected(definition.TypeString(gossip_obj.Type))
+			rejected = append(rejected, gossip_obj)
+			continue
+		}
+		if err := Check_gossiper_object(c, gossip_obj); err != nil {
+			fmt.Println(util.RED+"Rejected", definition.TypeString(gossip_obj.Type), "about", gossip_obj.Payload[0], "for period", gossip_obj.Period+":", err, util.RESET)
+			c.Metrics.Count_rejected(definition.TypeString(gossip_obj.Type))
+			rejected = append(rejected, gossip_obj)
+			continue
+		}
+		c.Metrics.Count_verified(definition.TypeString(gossip_obj.Type))
+		Process_if_new(c, gossip_obj)
+	}
+	return rejected
 }
+
+func Process_if_new(c *MonitorContext, gossip_obj definition.Gossip_object) {
+	if c.IsDuplicate(gossip_obj) {
+		return
+	}
+	fmt.Println("Recieved new, valid", definition.TypeString(gossip_obj.Type), ".")
+	Process_valid_object(c, gossip_obj)
+}
+
 func handle_gossip(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
 	// Parse sent object.
 	// Converts JSON passed in the body of a POST to a Gossip_object.
@@ -64,10 +152,16 @@ func handle_gossip(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 	// Verify the object is valid.
-	err = gossip_obj.Verify(c.Monitor_crypto_config)
+	err = c.Metrics.Verify(definition.TypeString(gossip_obj.Type), func() error {
+		return gossip_obj.Verify(c.Monitor_crypto_config)
+	})
 	if err != nil {
 		fmt.Println("Recieved invalid object from " + util.GetSenderURL(r) + ".")
-		AccuseEntity(c, gossip_obj.Signer)
+		AccuseEntity(c, gossip_obj.Signer, definition.ACC_INVALID_SIGNATURE, definition.Accusation_evidence{
+			Request_time: util.GetCurrentTimestamp(),
+			Error:        err.Error(),
+			Object:       &gossip_obj,
+		})
 		http.Error(w, err.Error(), http.StatusOK)
 		return
 	}
@@ -91,16 +185,17 @@ func handle_num_full(c *MonitorContext, w http.ResponseWriter, r *http.Request)
 	err := json.NewDecoder(r.Body).Decode(&num_full)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Verify the object is valid, the NUM_FULL goes into the client updates.
+	err = c.Metrics.Verify(definition.TypeString(num_full.Type), func() error {
+		return num_full.Verify(c.Monitor_crypto_config)
+	})
+	if err != nil {
+		fmt.Println(util.RED + "Recieved invalid NUM_FULL from " + util.GetSenderURL(r) + "." + util.RESET)
+		http.Error(w, err.Error(), http.StatusOK)
+		return
 	}
-	// Verify the object is valid.
-	/*
-		err = num_full.Verify(c.Monitor_crypto_config)
-		if err != nil {
-			fmt.Println("Recieved invalid NUM_FULL from " + util.GetSenderURL(r) + ".")
-			http.Error(w, err.Error(), http.StatusOK)
-			return
-		}
-	*/
 	// Check for duplicate object.
 	c.Storage_NUM_FULL = &num_full
 	http.Error(w, "NUM_FULL Processed.", http.StatusOK)
@@ -113,11 +208,12 @@ func QueryLoggers(c *MonitorContext) {
 			fmt.Println(util.RED, "There is a PoM against this Logger. Query will not be initiated", util.RESET)
 		} else {
 			fmt.Println(util.GREEN + "Querying Logger Initiated" + util.RESET)
+			request_time := util.GetCurrentTimestamp()
 			sthResp, err := http.Get(PROTOCOL + logger + "/ctng/v2/get-sth/")
 			if err != nil {
 				//log.Println(util.RED+"Query Logger Failed: "+err.Error(), util.RESET)
 				log.Println(util.RED+"Query Logger Failed, connection refused.", util.RESET)
-				//AccuseEntity(c, logger)
+				//AccuseEntity(c, logger, definition.ACC_UNREACHABLE, definition.Accusation_evidence{Request_time: request_time, Error: err.Error()})
 				continue
 			}
 
@@ -126,20 +222,22 @@ func QueryLoggers(c *MonitorContext) {
 			err = json.Unmarshal(sthBody, &STH)
 			if err != nil {
 				log.Println(util.RED+err.Error(), util.RESET)
-				//AccuseEntity(c, logger)
+				//AccuseEntity(c, logger, definition.ACC_MALFORMED, definition.Accusation_evidence{Request_time: request_time, Error: err.Error()})
 				continue
 			}
-			err = STH.Verify(c.Monitor_crypto_config)
+			err = c.Metrics.Verify(definition.TypeString(STH.Type), func() error {
+				return STH.Verify(c.Monitor_crypto_config)
+			})
 			if err != nil {
 				log.Println(util.RED+"STH signature verification failed", err.Error(), util.RESET)
+				evidence := definition.Accusation_evidence{Request_time: request_time, Error: err.Error(), Object: &STH}
 				f := func() {
 					_, ok := (*c.Storage_STH_FULL)[STH.GetID()]
 					if !Check_entity_pom(c, logger) && !ok {
-						AccuseEntity(c, logger)
+						AccuseEntity(c, logger, definition.ACC_INVALID_SIGNATURE, evidence)
 					}
 				}
 				time.AfterFunc(time.Duration(2*c.Monitor_public_config.Gossip_wait_time)*time.Second, f)
-				//AccuseEntity(c, logger)
 			} else {
 
 				Process_valid_object(c, STH)
@@ -161,6 +259,7 @@ func QueryAuthorities(c *MonitorContext) {
 			fmt.Println(util.RED, "There is a PoM against this CA. Query will not be initiated", util.RESET)
 		} else {
 			fmt.Println(util.GREEN + "Querying CA Initiated" + util.RESET)
+			request_time := util.GetCurrentTimestamp()
 			revResp, err := http.Get(PROTOCOL + CA + "/ctng/v2/get-revocation/")
 			if err != nil {
 				//log.Println(util.RED+"Query CA failed: "+err.Error(), util.RESET)
@@ -181,7 +280,9 @@ func QueryAuthorities(c *MonitorContext) {
 				continue
 			}
 			//fmt.Println(c.Monitor_private_configPublic)
-			err = REV.Verify(c.Monitor_crypto_config)
+			err = c.Metrics.Verify(definition.TypeString(REV.Type), func() error {
+				return REV.Verify(c.Monitor_crypto_config)
+			})
 			if err != nil {
 				log.Println(util.RED+"Revocation information signature verification failed", err.Error(), util.RESET)
 				continue
@@ -190,10 +291,11 @@ func QueryAuthorities(c *MonitorContext) {
 			key := REV.Payload[0]
 			if !c.VerifySRH(SRH, &DCRV, key, REV.Period) {
 				fmt.Println("SRH verification failed")
+				evidence := definition.Accusation_evidence{Request_time: request_time, Error: "SRH verification failed", Object: &REV}
 				f := func() {
 					_, ok := (*c.Storage_REV_FULL)[REV.GetID()]
 					if !Check_entity_pom(c, CA) && !ok {
-						AccuseEntity(c, CA)
+						AccuseEntity(c, CA, definition.ACC_INVALID_SRH, evidence)
 					}
 				}
 				time.AfterFunc(time.Duration(2*c.Monitor_public_config.Gossip_wait_time)*time.Second, f)
@@ -205,31 +307,55 @@ func QueryAuthorities(c *MonitorContext) {
 
 }
 
+// Queries loggers and CAs for a pending rotation of their signing key.
+// Entities which are not rotating their key answer with an empty body.
+func QueryKeyRotations(c *MonitorContext) {
+	entities := append(append([]string{}, c.Monitor_private_config.Logger_URLs...), c.Monitor_private_config.CA_URLs...)
+	for _, entity := range entities {
+		resp, err := http.Get(PROTOCOL + entity + "/ctng/v2/get-key-rotation/")
+		if err != nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || len(bytes.TrimSpace(body)) == 0 {
+			continue
+		}
+		var KEY definition.Gossip_object
+		err = json.Unmarshal(body, &KEY)
+		if err != nil {
+			log.Println(util.RED+err.Error(), util.RESET)
+			continue
+		}
+		if KEY.Payload[0] != entity {
+			continue
+		}
+		err = c.Metrics.Verify(definition.TypeString(KEY.Type), func() error {
+			return KEY.Verify(c.Monitor_crypto_config)
+		})
+		if err != nil {
+			log.Println(util.RED+"Key rotation verification failed for "+entity, err.Error(), util.RESET)
+			continue
+		}
+		if !c.IsDuplicate(KEY) {
+			c.StoreObject(KEY)
+			Process_valid_object(c, KEY)
+		}
+	}
+}
+
 // This function accuses the entity if the domain name is provided
 // It is called when the gossip object received is not valid, or the monitor didn't get response when querying the logger or the CA
 // Accused = Domain name of the accused entity (logger etc.)
-func AccuseEntity(c *MonitorContext, Accused string) {
+// reason = one of the definition.ACC_ reasons, evidence = what the monitor saw, both are signed with the accusation
+func AccuseEntity(c *MonitorContext, Accused string, reason string, evidence definition.Accusation_evidence) {
 	if Check_entity_pom(c, Accused) {
 		return
 	}
-	msg := Accused
-	var payloadarray [3]string
-	payloadarray[0] = msg
-	payloadarray[1] = ""
-	payloadarray[2] = ""
-	signature, _ := c.Monitor_crypto_config.Sign([]byte(payloadarray[0] + payloadarray[1] + payloadarray[2]))
-	var sigarray [2]string
-	sigarray[0] = signature.String()
-	sigarray[1] = ""
-	accusation := definition.Gossip_object{
-		Application:   "CTng",
-		Type:          definition.ACC_INIT,
-		Period:        util.GetCurrentPeriod(),
-		Signer:        c.Monitor_crypto_config.SelfID.String(),
-		Timestamp:     util.GetCurrentTimestamp(),
-		Signature:     sigarray,
-		Crypto_Scheme: "RSA",
-		Payload:       payloadarray,
+	accusation, err := definition.Generate_ACC_INIT(c.Monitor_crypto_config, Accused, reason, evidence)
+	if err != nil {
+		fmt.Println(util.RED+"Failed to accuse "+Accused+":", err, util.RESET)
+		return
 	}
 	//fmt.Println(util.BLUE+"New accusation from ",accusation.Signer, c.Monitor_crypto_Monitor_private_configSignaturePublicMap[signature.ID], "generated, Sending to gossiper"+util.RESET)
 	Send_to_gossiper(c, accusation)
@@ -251,15 +377,14 @@ func Send_to_gossiper(c *MonitorContext, g definition.Gossip_object) {
 		gossiperendpoint = "/gossip/sth_init"
 	case definition.REV_INIT:
 		gossiperendpoint = "/gossip/rev_init"
+	case definition.KEY_INIT:
+		gossiperendpoint = "/gossip/key_init"
 	}
-	resp, postErr := c.Client.Post(PROTOCOL+c.Monitor_private_config.Gossiper_URL+gossiperendpoint, "application/json", bytes.NewBuffer(msg))
-	if postErr != nil {
-		fmt.Println(util.RED+"Error sending object to Gossiper: ", postErr.Error(), util.RESET)
+	delivered := Post_to_gossipers(c, gossiperendpoint, msg)
+	if len(delivered) == 0 {
+		fmt.Println(util.RED+"No gossiper accepted", definition.TypeString(g.Type), util.RESET)
 	} else {
-		// Close the response, mentioned by http.Post
-		// Alernatively, we could return the response from this function.
-		defer resp.Body.Close()
-		fmt.Println(util.BLUE+"Sent", definition.TypeString(g.Type), "to Gossiper, Recieved "+resp.Status, util.RESET)
+		fmt.Println(util.BLUE+"Sent", definition.TypeString(g.Type), "to Gossipers", delivered, util.RESET)
 	}
 
 }
@@ -271,14 +396,11 @@ func Send_POM_NUM_to_gossiper(c *MonitorContext, num definition.PoM_Counter) {
 		fmt.Println(err)
 	}
 	// Send the gossip object to the gossiper.
-	resp, postErr := c.Client.Post(PROTOCOL+c.Monitor_private_config.Gossiper_URL+"/gossip/num_init", "application/json", bytes.NewBuffer(msg))
-	if postErr != nil {
-		fmt.Println(util.RED+"Error sending object to Gossiper: ", postErr.Error(), util.RESET)
+	delivered := Post_to_gossipers(c, "/gossip/num_init", msg)
+	if len(delivered) == 0 {
+		fmt.Println(util.RED+"No gossiper accepted PoM_NUM", util.RESET)
 	} else {
-		// Close the response, mentioned by http.Post
-		// Alernatively, we could return the response from this function.
-		defer resp.Body.Close()
-		fmt.Println(util.BLUE+"Sent PoM_NUM to Gossiper, Recieved "+resp.Status, util.RESET)
+		fmt.Println(util.BLUE+"Sent PoM_NUM to Gossipers", delivered, util.RESET)
 	}
 
 }
@@ -325,11 +447,46 @@ func IsAuthority(c *MonitorContext, authURL string) bool {
 	return false
 }
 
+// Checks the content of a threshold signed object, so a compromised gossiper can not get false PoMs into client updates:
+// STH_FULLs have to be about a known logger, REV_FULLs about a known CA, ACC_FULLs, CON_FULLs and disputes about either,
+// the accusations carried by an ACC_FULL have to be signed by their accusers,
+// and a CON_FULL has to carry the two conflicting objects signed by the entity.
+func Check_gossiper_object(c *MonitorContext, g definition.Gossip_object) error {
+	entity := g.Payload[0]
+	switch g.Type {
+	case definition.STH_FULL:
+		if !IsLogger(c, entity) {
+			return errors.New(entity + " is not a known logger")
+		}
+	case definition.REV_FULL:
+		if !IsAuthority(c, entity) {
+			return errors.New(entity + " is not a known CA")
+		}
+	case definition.ACC_FULL:
+		if !IsLogger(c, entity) && !IsAuthority(c, entity) {
+			return errors.New(entity + " is neither a known logger nor a known CA")
+		}
+		return definition.Verify_ACC_evidence(g, c.Monitor_crypto_config)
+	case definition.DIS_INIT:
+		if !IsLogger(c, entity) && !IsAuthority(c, entity) {
+			return errors.New(entity + " is neither a known logger nor a known CA")
+		}
+	case definition.CON_FULL:
+		if !IsLogger(c, entity) && !IsAuthority(c, entity) {
+			return errors.New(entity + " is neither a known logger nor a known CA")
+		}
+		return definition.Verify_CON_evidence(g, c.Monitor_crypto_config)
+	}
+	return nil
+}
+
 func GenerateUpdate(c *MonitorContext) (ClientUpdate, definition.PoM_Counter) {
 	storageList_conflict_pom := []definition.Gossip_object{}
 	storageList_accusation_pom := []definition.Gossip_object{}
 	storageList_sth_full := []definition.Gossip_object{}
 	storageList_rev_full := []definition.Gossip_object{}
+	storageList_key_full := []definition.Gossip_object{}
+	storageList_dispute := []definition.Gossip_object{}
 	for _, gossipObject := range *c.Storage_CONFLICT_POM_DELTA {
 		storageList_conflict_pom = append(storageList_conflict_pom, gossipObject)
 	}
@@ -342,6 +499,12 @@ func GenerateUpdate(c *MonitorContext) (ClientUpdate, definition.PoM_Counter) {
 	for _, gossipObject := range *c.Storage_REV_FULL {
 		storageList_rev_full = append(storageList_rev_full, gossipObject)
 	}
+	for _, gossipObject := range *c.Storage_KEY_FULL {
+		storageList_key_full = append(storageList_key_full, gossipObject)
+	}
+	for _, gossipObject := range *c.Storage_DISPUTE {
+		storageList_dispute = append(storageList_dispute, gossipObject)
+	}
 	num_acc_full := strconv.Itoa(len(storageList_accusation_pom))
 	num_com_full := strconv.Itoa(len(storageList_conflict_pom))
 	NUM := definition.PoM_Counter{
@@ -350,15 +513,17 @@ func GenerateUpdate(c *MonitorContext) (ClientUpdate, definition.PoM_Counter) {
 		CON_FULL_Counter: num_com_full,
 		Period:           util.GetCurrentPeriod(),
 		Signer_Monitor:   c.Monitor_crypto_config.SelfID.String(),
-		Crypto_Scheme:    "rsa",
 	}
 	signature, _ := c.Monitor_crypto_config.Sign([]byte(NUM.ACC_FULL_Counter + NUM.CON_FULL_Counter + NUM.Period + NUM.Signer_Monitor))
+	NUM.Crypto_Scheme = signature.Scheme
 	NUM.Signature = signature.String()
 	CTupdate := ClientUpdate{
 		STHs:      storageList_sth_full,
 		REVs:      storageList_rev_full,
 		ACCs:      storageList_accusation_pom,
 		CONs:      storageList_conflict_pom,
+		KEYs:      storageList_key_full,
+		DISs:      storageList_dispute,
 		MonitorID: c.Monitor_crypto_config.SelfID.String(),
 		NUM:       NUM,
 		NUM_FULL:  *c.Storage_NUM_FULL,
@@ -376,16 +541,22 @@ func PeriodicTasks(c *MonitorContext) {
 	}
 	time.AfterFunc(time.Duration(c.Monitor_public_config.MMD)*time.Second, f)
 	// Run the periodic tasks.
-	QueryLoggers(c)
-	QueryAuthorities(c)
+	c.Metrics.Phase("check_gossipers", func() { Check_gossipers(c) })
+	c.Metrics.Phase("query_loggers", func() { QueryLoggers(c) })
+	c.Metrics.Phase("query_authorities", func() { QueryAuthorities(c) })
+	c.Metrics.Phase("query_key_rotations", func() { QueryKeyRotations(c) })
 	f1 := func() {
-		c.Clean_Conflicting_Object()
-		c.WipeStorage()
-		update, NUM := GenerateUpdate(c)
-		current, _ := strconv.Atoi(util.GetCurrentPeriod())
-		offsetint, _ := strconv.Atoi(c.Period_Offset)
-		PeriodIO := strconv.Itoa(current - offsetint)
-		c.SaveStorage(PeriodIO, update)
+		var NUM definition.PoM_Counter
+		c.Metrics.Phase("update", func() {
+			c.Clean_Conflicting_Object()
+			c.WipeStorage()
+			var update ClientUpdate
+			update, NUM = GenerateUpdate(c)
+			current, _ := strconv.Atoi(util.GetCurrentPeriod())
+			offsetint, _ := strconv.Atoi(c.Period_Offset)
+			PeriodIO := strconv.Itoa(current - offsetint)
+			c.SaveStorage(PeriodIO, update)
+		})
 		f2 := func() {
 			Send_POM_NUM_to_gossiper(c, NUM)
 		}
@@ -408,8 +579,42 @@ func Process_valid_object(c *MonitorContext, g definition.Gossip_object) {
 		// Send an unsigned copy to the gossiper if the REV is received from a CA
 		Send_to_gossiper(c, g)
 	}
-	//this handles processed gossip object from the gossiper, verfications will be added when if needed
+	//this handles key rotations announced by loggers and CAs
+	if g.Type == definition.KEY_INIT && (IsLogger(c, g.Signer) || IsAuthority(c, g.Signer)) {
+		Send_to_gossiper(c, g)
+	}
+	if g.Type == definition.KEY_FULL {
+		// the key history decides which signatures are accepted, so never apply an unverified rotation
+		err := g.Verify(c.Monitor_crypto_config)
+		if err == nil {
+			err = definition.Apply_KEY_FULL(g, c.Monitor_crypto_config)
+		}
+		if err != nil {
+			fmt.Println(util.RED+"Key rotation of "+g.Payload[0]+" not applied:", err, util.RESET)
+			return
+		}
+		if c.Crypto_config_path != "" {
+			err = crypto.SaveKeyVersions(c.Crypto_config_path, c.Monitor_crypto_config, false)
+			if err != nil {
+				fmt.Println(util.RED+"Failed to save the key versions:", err, util.RESET)
+			}
+		}
+		c.StoreObject(g)
+	}
+	//this handles processed gossip object from the gossiper, their threshold signatures are verified on receipt
 	if g.Type == definition.ACC_FULL || g.Type == definition.CON_FULL || g.Type == definition.STH_FULL || g.Type == definition.REV_FULL {
+		if err := Check_gossiper_object(c, g); err != nil {
+			fmt.Println(util.RED+"Not storing", definition.TypeString(g.Type), "about", g.Payload[0]+":", err, util.RESET)
+			return
+		}
+		c.StoreObject(g)
+	}
+	//this handles disputes of accused entities relayed by the gossiper
+	if g.Type == definition.DIS_INIT {
+		if err := Check_gossiper_object(c, g); err != nil {
+			fmt.Println(util.RED+"Not storing dispute of", g.Payload[0]+":", err, util.RESET)
+			return
+		}
 		c.StoreObject(g)
 	}
 	return
@@ -430,12 +635,12 @@ func (ctx *MonitorContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID strin
 	localhash, _ := crypto.GenerateSHA256([]byte(Period + string(hash1) + string(hash2)))
 	// the localhash will be te message we used to verify the Signature on the SRH
 	// verify the signature
-	rsasig, err := crypto.RSASigFromString(srh)
+	sig, err := crypto.SignatureFromString(srh)
 	if err != nil {
-		fmt.Println("Fail to convert the signature from the SRH to RSA signature")
+		fmt.Println("Fail to convert the signature from the SRH")
 	}
-	ca_publickey := ctx.Monitor_crypto_config.SignPublicMap[rsasig.ID]
-	err = crypto.RSAVerify(localhash, rsasig, &ca_publickey)
+	// the SRH is signed with the CA's key valid for the period of the revocation
+	err = definition.Verify_SignatureForPeriod(ctx.Monitor_crypto_config, localhash, sig, Period)
 	if err != nil {
 		fmt.Println("Fail to verify the signature on the SRH")
 		return false
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"CTngV2/crypto"
 	"CTngV2/definition"
 	"bytes"
 	"encoding/json"
@@ -8,7 +9,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/bits-and-blooms/bitset"
 )
 
 type ClientMock struct{}
@@ -100,6 +108,60 @@ func testMonitorServer(t *testing.T) {
 	StartMonitorServer(ctx_monitor_1)
 }
 
+func queryObject(objtype string, entity string, period string) definition.Gossip_object {
+	g := dummyGossipObject()
+	g.Type = objtype
+	g.Period = period
+	g.Payload[0] = entity
+	return g
+}
+
+func TestQueryIndex(t *testing.T) {
+	dir := t.TempDir()
+	c := &MonitorContext{StorageID: "1", Storage_CRV: map[string]*bitset.BitSet{}, Update_index: New_update_index()}
+	c.InitializeMonitorStorage(dir)
+	c.SaveStorage("1", ClientUpdate{
+		STHs: []definition.Gossip_object{queryObject(definition.STH_FULL, "logger1", "1")},
+		ACCs: []definition.Gossip_object{queryObject(definition.ACC_FULL, "logger1", "1")},
+	})
+	c.SaveStorage("2", ClientUpdate{
+		STHs: []definition.Gossip_object{queryObject(definition.STH_FULL, "logger1", "2")},
+		// the accusation is carried again in the next update
+		ACCs: []definition.Gossip_object{queryObject(definition.ACC_FULL, "logger1", "1"), queryObject(definition.ACC_FULL, "ca1", "2")},
+		CONs: []definition.Gossip_object{queryObject(definition.CON_FULL, "logger1", "2")},
+	})
+	// A restarted monitor rebuilds the index from disk.
+	restarted := &MonitorContext{StorageID: "1", Update_index: New_update_index()}
+	restarted.InitializeMonitorStorage(dir)
+	for _, ctx := range []*MonitorContext{c, restarted} {
+		accs, err := ctx.Query_PoMs(definition.ACC_FULL, "logger1", -1, -1)
+		if err != nil || len(accs) != 1 {
+			t.Fatalf("Expected 1 accusation against logger1, got %d (%v)", len(accs), err)
+		}
+		accs, _ = ctx.Query_PoMs(definition.ACC_FULL, "", 2, 2)
+		if len(accs) != 1 || accs[0].Payload[0] != "ca1" {
+			t.Fatalf("Expected the accusation against ca1 in period 2, got %v", accs)
+		}
+		sth, found, err := ctx.Query_FULL(definition.STH_FULL, "logger1", "2")
+		if err != nil || !found || sth.Period != "2" {
+			t.Fatalf("STH_FULL of logger1 for period 2 not found: %v", err)
+		}
+		if _, found, _ = ctx.Query_FULL(definition.REV_FULL, "logger1", "2"); found {
+			t.Fatal("Found a REV_FULL that was never stored")
+		}
+		status, err := ctx.Query_status("logger1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Latest_STH_period != "2" || status.ACC_FULL_count != 1 || status.CON_FULL_count != 1 || !status.Has_CON {
+			t.Fatalf("Unexpected status %+v", status)
+		}
+	}
+	if _, err := c.Query_PoMs(definition.STH_FULL, "", -1, -1); err == nil {
+		t.Fatal("Queried STH_FULL as a PoM type")
+	}
+}
+
 /*
 func TestNUM(t *testing.T) {
 	ctx_monitor_1 := InitializeMonitorContext("../network/monitor_testconfig/1/Monitor_public_config.json", "../network/monitor_testconfig/1/Monitor_private_config.json", "../Gen/monitor_testconfig/1/Monitor_crypto_config.json", "1")
@@ -137,3 +199,161 @@ func TestNUM(t *testing.T) {
 }
 
 */
+
+func TestLoadStorage(t *testing.T) {
+	dir := t.TempDir()
+	c := &MonitorContext{StorageID: "1", Update_index: New_update_index()}
+	c.InitializeMonitorStorage(dir)
+	// the stored updates of periods 19 to 21, written to Period_1 to Period_3
+	updates := []ClientUpdate{}
+	for _, period := range []string{"19", "20", "21"} {
+		update, err := PrepareClientUpdate(c, "../client/monitor_testdata/1/Period_"+period+"/ClientUpdate.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates = append(updates, *update)
+	}
+	// a conflict PoM nobody threshold signed
+	forged := queryObject(definition.CON_FULL, "localhost:9000", "20")
+	forged.Signature[0] = updates[1].STHs[0].Signature[0]
+	updates[1].CONs = append(updates[1].CONs, forged)
+	writer := &MonitorContext{StorageID: "1", Storage_CRV: map[string]*bitset.BitSet{"localhost:9100": bitset.New(8).Set(5)}}
+	writer.InitializeMonitorStorage(dir)
+	for i, update := range updates {
+		writer.SaveStorage(strconv.Itoa(i+1), update)
+	}
+
+	crypto_config, err := crypto.ReadCryptoConfig("../client/client/Client_crypto_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Monitor_crypto_config = crypto_config
+	c.Storage_CONFLICT_POM = &definition.Gossip_Storage{}
+	c.Storage_ACCUSATION_POM = &definition.Gossip_Storage{}
+	c.Storage_NUM_FULL = &definition.PoM_Counter{}
+	err = c.LoadStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GetObjectNumber(definition.CON_FULL) != 0 {
+		t.Fatal("Restored a CON_FULL that does not verify")
+	}
+	if !reflect.DeepEqual(*c.Storage_NUM_FULL, updates[2].NUM_FULL) {
+		t.Fatalf("NUM_FULL not restored: %+v", *c.Storage_NUM_FULL)
+	}
+	if crv, ok := c.Storage_CRV["localhost:9100"]; !ok || !crv.Test(5) {
+		t.Fatal("CRV not restored")
+	}
+	// Period_3 holds the update of period 21
+	if c.Period_Offset != "18" {
+		t.Fatalf("Expected Period_Offset 18, got %s", c.Period_Offset)
+	}
+}
+
+func TestGossiperFailover(t *testing.T) {
+	received := make(map[string]int)
+	var lock sync.Mutex
+	gossiper := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			received[name+" "+r.URL.Path]++
+			lock.Unlock()
+			w.WriteHeader(status)
+		}))
+	}
+	dead := gossiper("dead", http.StatusOK)
+	dead.Close()
+	g1 := gossiper("g1", http.StatusOK)
+	defer g1.Close()
+	g2 := gossiper("g2", http.StatusOK)
+	defer g2.Close()
+	host := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+	c := &MonitorContext{
+		Monitor_private_config: &Monitor_private_config{Gossiper_URLs: []string{host(dead), host(g1), host(g2)}},
+		Client:                 &http.Client{},
+		Gossiper_health:        New_gossiper_health(),
+	}
+	// the first gossiper is down, the object fails over to the next one
+	delivered := Post_to_gossipers(c, "/gossip/sth_init", []byte("{}"))
+	if len(delivered) != 1 || delivered[0] != host(g1) || !c.Gossiper_health.IsDown(host(dead)) {
+		t.Fatalf("Expected delivery to g1 only, got %v", delivered)
+	}
+	c.Monitor_private_config.Gossiper_fanout = 2
+	delivered = Post_to_gossipers(c, "/gossip/num_init", []byte("{}"))
+	if len(delivered) != 2 || received["g1 /gossip/num_init"] != 1 || received["g2 /gossip/num_init"] != 1 {
+		t.Fatalf("Expected delivery to g1 and g2, got %v", delivered)
+	}
+	Check_gossipers(c)
+	if received["g1 /gossip/health"] != 1 || c.Gossiper_health.IsDown(host(g2)) || !c.Gossiper_health.IsDown(host(dead)) {
+		t.Fatal("Health check did not probe every gossiper")
+	}
+}
+
+func TestCheckGossiperObject(t *testing.T) {
+	configs, err := crypto.GenerateEntityCryptoConfigs([]crypto.CTngID{"localhost:9000", "localhost:9100", "localhost:8000"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &MonitorContext{
+		Monitor_public_config: &Monitor_public_config{
+			All_Logger_URLs: []string{"localhost:9000"},
+			All_CA_URLs:     []string{"localhost:9100"},
+		},
+		Monitor_crypto_config: &configs[1],
+	}
+	sth := func(root string) definition.Gossip_object {
+		js, _ := json.Marshal(definition.STH{Signer: "localhost:9000", Period: "1", RootHash: root})
+		g := queryObject(definition.STH_INIT, "localhost:9000", "1")
+		g.Payload[1] = string(js)
+		sig, _ := configs[0].Sign([]byte(g.Payload[0] + g.Payload[1] + g.Payload[2]))
+		g.Signature[0] = sig.String()
+		return g
+	}
+	sth_a, sth_b := sth("a"), sth("b")
+	con := queryObject(definition.CON_FULL, "localhost:9000", "1")
+	con.Payload[1] = sth_a.Payload[0] + sth_a.Payload[1]
+	con.Payload[2] = sth_b.Payload[0] + sth_b.Payload[1]
+	con.Evidence = []definition.Gossip_object{sth_a, sth_b}
+	// the gossipers signed a conflict without evidence
+	fake_con := con
+	fake_con.Evidence = nil
+	// an accusation carried by the ACC_FULL, and one whose evidence was changed after signing
+	accusation, err := definition.Generate_ACC_INIT(&configs[2], "localhost:9000", definition.ACC_INVALID_SIGNATURE, definition.Accusation_evidence{Error: "bad STH", Object: &sth_a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := queryObject(definition.ACC_FULL, "localhost:9000", "1")
+	acc.Evidence = []definition.Gossip_object{accusation}
+	fake_acc := acc
+	fake_acc.Evidence = []definition.Gossip_object{accusation}
+	fake_acc.Evidence[0].Payload[2] = "{}"
+	dis, err := definition.Generate_DIS_INIT(&configs[0], "1", "served", &sth_a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown_dis := dis
+	unknown_dis.Payload[0] = "localhost:9999"
+	cases := []struct {
+		obj   definition.Gossip_object
+		valid bool
+	}{
+		{queryObject(definition.STH_FULL, "localhost:9000", "1"), true},
+		{queryObject(definition.STH_FULL, "localhost:9100", "1"), false},
+		{queryObject(definition.REV_FULL, "localhost:9100", "1"), true},
+		{queryObject(definition.REV_FULL, "localhost:9000", "1"), false},
+		{queryObject(definition.ACC_FULL, "localhost:9100", "1"), true},
+		{queryObject(definition.ACC_FULL, "localhost:9999", "1"), false},
+		{con, true},
+		{fake_con, false},
+		{acc, true},
+		{fake_acc, false},
+		{dis, true},
+		{unknown_dis, false},
+	}
+	for _, test := range cases {
+		err := Check_gossiper_object(c, test.obj)
+		if (err == nil) != test.valid {
+			t.Errorf("%s about %s: expected valid %v, got %v", definition.TypeString(test.obj.Type), test.obj.Payload[0], test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package monitor
+
+import (
+	"CTngV2/definition"
+	"CTngV2/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Read APIs over the client updates the monitor stored in its Period_N directories.
+// The index is loaded from disk on the first query and kept up to date by SaveStorage,
+// so the queries do not touch the live storage of the current period.
+
+type Update_index struct {
+	// keyed by the N of the Period_N directory the update is stored in
+	Updates map[int]*ClientUpdate
+	Loaded  bool
+	LOCK    sync.RWMutex
+}
+
+// The state of a logger or CA as seen in the stored client updates.
+type Entity_status struct {
+	Entity            string
+	Latest_STH_period string `json:",omitempty"`
+	Latest_REV_period string `json:",omitempty"`
+	ACC_FULL_count    int
+	CON_FULL_count    int
+	// A conflict PoM never expires, the entity is not trusted anymore once it has one.
+	Has_CON bool
+}
+
+func New_update_index() *Update_index {
+	return &Update_index{Updates: make(map[int]*ClientUpdate)}
+}
+
+// Read all the Period_N/ClientUpdate.json files under dir.
+// Updates added before the index was loaded take precedence over the files.
+func (idx *Update_index) Load(dir string) error {
+	idx.LOCK.Lock()
+	defer idx.LOCK.Unlock()
+	if idx.Loaded {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "Period_") {
+			continue
+		}
+		period, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "Period_"))
+		if err != nil {
+			continue
+		}
+		if _, ok := idx.Updates[period]; ok {
+			continue
+		}
+		update, err := PrepareClientUpdate(nil, dir+"/"+entry.Name()+"/ClientUpdate.json")
+		if err != nil {
+			fmt.Println(util.RED+"Skipped the client update of", entry.Name()+":", err, util.RESET)
+			continue
+		}
+		idx.Updates[period] = update
+	}
+	idx.Loaded = true
+	return nil
+}
+
+func (idx *Update_index) Add(period int, update ClientUpdate) {
+	idx.LOCK.Lock()
+	defer idx.LOCK.Unlock()
+	idx.Updates[period] = &update
+}
+
+// The indexed updates, oldest first.
+func (idx *Update_index) sorted() []*ClientUpdate {
+	periods := make([]int, 0, len(idx.Updates))
+	for period := range idx.Updates {
+		periods = append(periods, period)
+	}
+	sort.Ints(periods)
+	updates := make([]*ClientUpdate, len(periods))
+	for i, period := range periods {
+		updates[i] = idx.Updates[period]
+	}
+	return updates
+}
+
+// Returns the index, loading it from the storage directory on first use.
+func (c *MonitorContext) Get_update_index() (*Update_index, error) {
+	if c.Update_index == nil {
+		return nil, fmt.Errorf("Monitor %s has no update index", c.StorageID)
+	}
+	err := c.Update_index.Load(c.StorageDirectory)
+	return c.Update_index, err
+}
+
+// Period filter of the queries, -1 leaves the range open on that side.
+func in_range(period string, from int, to int) bool {
+	p, err := strconv.Atoi(period)
+	if err != nil {
+		return false
+	}
+	return (from < 0 || p >= from) && (to < 0 || p <= to)
+}
+
+// All the PoMs of the given type (ACC_FULL or CON_FULL) against entity made between the periods from and to.
+// An empty entity matches every entity. Every PoM is returned once even if several updates carry it.
+func (c *MonitorContext) Query_PoMs(pomtype string, entity string, from int, to int) ([]definition.Gossip_object, error) {
+	if pomtype != definition.ACC_FULL && pomtype != definition.CON_FULL {
+		return nil, fmt.Errorf("%s is not a PoM type", pomtype)
+	}
+	idx, err := c.Get_update_index()
+	if err != nil {
+		return nil, err
+	}
+	idx.LOCK.RLock()
+	defer idx.LOCK.RUnlock()
+	seen := make(map[definition.Gossip_ID]bool)
+	poms := []definition.Gossip_object{}
+	for _, update := range idx.sorted() {
+		list := update.ACCs
+		if pomtype == definition.CON_FULL {
+			list = update.CONs
+		}
+		for _, pom := range list {
+			if (entity != "" && pom.Payload[0] != entity) || !in_range(pom.Period, from, to) || seen[pom.GetID()] {
+				continue
+			}
+			seen[pom.GetID()] = true
+			poms = append(poms, pom)
+		}
+	}
+	return poms, nil
+}
+
+// The STH_FULL or REV_FULL of entity for the given period.
+func (c *MonitorContext) Query_FULL(objtype string, entity string, period string) (definition.Gossip_object, bool, error) {
+	if objtype != definition.STH_FULL && objtype != definition.REV_FULL {
+		return definition.Gossip_object{}, false, fmt.Errorf("%s can not be queried", objtype)
+	}
+	idx, err := c.Get_update_index()
+	if err != nil {
+		return definition.Gossip_object{}, false, err
+	}
+	idx.LOCK.RLock()
+	defer idx.LOCK.RUnlock()
+	for _, update := range idx.sorted() {
+		list := update.STHs
+		if objtype == definition.REV_FULL {
+			list = update.REVs
+		}
+		for _, obj := range list {
+			if obj.Payload[0] == entity && obj.Period == period {
+				return obj, true, nil
+			}
+		}
+	}
+	return definition.Gossip_object{}, false, nil
+}
+
+func latest_period(current string, period string) string {
+	c, err := strconv.Atoi(current)
+	if err != nil {
+		return period
+	}
+	if p, err := strconv.Atoi(period); err == nil && p > c {
+		return period
+	}
+	return current
+}
+
+func (c *MonitorContext) Query_status(entity string) (Entity_status, error) {
+	status := Entity_status{Entity: entity}
+	idx, err := c.Get_update_index()
+	if err != nil {
+		return status, err
+	}
+	idx.LOCK.RLock()
+	for _, update := range idx.sorted() {
+		for _, sth := range update.STHs {
+			if sth.Payload[0] == entity {
+				status.Latest_STH_period = latest_period(status.Latest_STH_period, sth.Period)
+			}
+		}
+		for _, rev := range update.REVs {
+			if rev.Payload[0] == entity {
+				status.Latest_REV_period = latest_period(status.Latest_REV_period, rev.Period)
+			}
+		}
+	}
+	idx.LOCK.RUnlock()
+	accs, err := c.Query_PoMs(definition.ACC_FULL, entity, -1, -1)
+	if err != nil {
+		return status, err
+	}
+	cons, err := c.Query_PoMs(definition.CON_FULL, entity, -1, -1)
+	if err != nil {
+		return status, err
+	}
+	status.ACC_FULL_count = len(accs)
+	status.CON_FULL_count = len(cons)
+	status.Has_CON = len(cons) > 0
+	return status, nil
+}
+
+// Parses an optional period parameter, returns -1 if it is missing.
+func period_param(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return -1, nil
+	}
+	period, err := strconv.Atoi(value)
+	if err != nil || period < 0 {
+		return -1, fmt.Errorf("Invalid period %q for %s", value, name)
+	}
+	return period, nil
+}
+
+func write_json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /monitor/poms?entity=URL&from=P&to=P&type=ACC_FULL|CON_FULL
+// Without type both kinds of PoMs are returned, accusations first.
+func requestPoMs(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	from, err := period_param(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := period_param(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	types := []string{definition.ACC_FULL, definition.CON_FULL}
+	switch r.URL.Query().Get("type") {
+	case "":
+	case "ACC_FULL":
+		types = []string{definition.ACC_FULL}
+	case "CON_FULL":
+		types = []string{definition.CON_FULL}
+	default:
+		http.Error(w, "type must be ACC_FULL or CON_FULL", http.StatusBadRequest)
+		return
+	}
+	poms := []definition.Gossip_object{}
+	for _, pomtype := range types {
+		list, err := c.Query_PoMs(pomtype, r.URL.Query().Get("entity"), from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		poms = append(poms, list...)
+	}
+	write_json(w, poms)
+}
+
+// GET /monitor/sth?entity=URL&period=P and /monitor/rev?entity=URL&period=P
+func requestFULL(objtype string) func(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	return func(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+		entity := r.URL.Query().Get("entity")
+		period, err := period_param(r, "period")
+		if err != nil || period < 0 || entity == "" {
+			http.Error(w, "entity and period are required", http.StatusBadRequest)
+			return
+		}
+		obj, found, err := c.Query_FULL(objtype, entity, strconv.Itoa(period))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, definition.TypeString(objtype)+" not found", http.StatusNotFound)
+			return
+		}
+		write_json(w, obj)
+	}
+}
+
+// GET /monitor/status?entity=URL
+func requestStatus(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	entity := r.URL.Query().Get("entity")
+	if entity == "" {
+		http.Error(w, "entity is required", http.StatusBadRequest)
+		return
+	}
+	status, err := c.Query_status(entity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	write_json(w, status)
+}
@@ -3,12 +3,15 @@ package monitor
 import (
 	"CTngV2/crypto"
 	"CTngV2/definition"
+	"CTngV2/metrics"
 	"CTngV2/util"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"reflect"
+	"strconv"
 
 	"github.com/bits-and-blooms/bitset"
 )
@@ -24,6 +27,8 @@ type MonitorContext struct {
 	Storage_ACCUSATION_POM     *definition.Gossip_Storage
 	Storage_STH_FULL           *definition.Gossip_Storage
 	Storage_REV_FULL           *definition.Gossip_Storage
+	Storage_KEY_FULL           *definition.Gossip_Storage
+	Storage_DISPUTE            *definition.Gossip_Storage // responses of accused entities, kept as long as the accusation they answer
 	Storage_NUM_FULL           *definition.PoM_Counter
 	Storage_CRV                map[string]*bitset.BitSet
 	// Utilize Storage directory: A folder for the files of each MMD.
@@ -38,6 +43,13 @@ type MonitorContext struct {
 	Client        *http.Client
 	Mode          int
 	Period_Offset string
+	// Key rotations are written back to the crypto config
+	Crypto_config_path string
+	// Index over the client updates in StorageDirectory for the query endpoints
+	Update_index *Update_index
+	// Gossipers which failed to answer, see gossipers.go
+	Gossiper_health *Gossiper_health
+	Metrics         *metrics.CTng_metrics
 }
 
 type Monitor_private_config struct {
@@ -45,6 +57,8 @@ type Monitor_private_config struct {
 	Logger_URLs           []string
 	Signer                string
 	Gossiper_URL          string
+	Gossiper_URLs         []string `json:",omitempty"` // replaces Gossiper_URL, tried in order
+	Gossiper_fanout       int      `json:",omitempty"` // number of gossipers every object is sent to, 1 if not set
 	Inbound_gossiper_port string
 	Port                  string
 }
@@ -67,6 +81,8 @@ func (c *MonitorContext) GetObjectNumber(objtype string) int {
 		return len(*c.Storage_STH_FULL)
 	case definition.REV_FULL:
 		return len(*c.Storage_REV_FULL)
+	case definition.KEY_FULL:
+		return len(*c.Storage_KEY_FULL)
 	}
 	return 0
 }
@@ -124,6 +140,9 @@ func (c *MonitorContext) SaveStorage(Period string, update ClientUpdate) error {
 		util.WriteData(accusation_path, storageList_accusation_pom)
 	*/
 	util.WriteData(clientUpdate_path, update)
+	if period, err := strconv.Atoi(Period); err == nil && c.Update_index != nil {
+		c.Update_index.Add(period, update)
+	}
 	//save CRV
 	var crvstorage = make(map[string][]byte)
 	for key, value := range c.Storage_CRV {
@@ -161,8 +180,104 @@ func (c *MonitorContext) LoadOneStorage(name string, filepath string) error {
 		for _, gossipObject := range storageList {
 			(*c.Storage_REV_FULL)[gossipObject.GetID()] = gossipObject
 		}
+	default:
+		return errors.New("Mismatch")
 	}
-	return errors.New("Mismatch")
+	return nil
+}
+
+// Restore the state of the monitor from its storage directory after a restart:
+// the CRVs, the conflict PoMs of every stored update and the accusations and NUM_FULL of the latest one.
+// The PoMs are verified again in one batch, so a tampered storage directory can not blacklist an entity.
+// Period_Offset is restored as well, the monitor keeps writing to the Period_N it would have used without the restart.
+func (c *MonitorContext) LoadStorage() error {
+	if c.Storage_CRV == nil {
+		c.Storage_CRV = make(map[string]*bitset.BitSet)
+	}
+	if _, err := os.Stat(c.StorageFile_CRV); err == nil {
+		var crvstorage = make(map[string][]byte)
+		bytes, err := util.ReadByte(c.StorageFile_CRV)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(bytes, &crvstorage)
+		if err != nil {
+			return err
+		}
+		for key, value := range crvstorage {
+			crv := new(bitset.BitSet)
+			err = crv.UnmarshalBinary(value)
+			if err != nil {
+				return err
+			}
+			c.Storage_CRV[key] = crv
+		}
+	}
+	idx, err := c.Get_update_index()
+	if err != nil {
+		return err
+	}
+	idx.LOCK.RLock()
+	updates := idx.sorted()
+	latest_period := -1
+	for period := range idx.Updates {
+		if period > latest_period {
+			latest_period = period
+		}
+	}
+	idx.LOCK.RUnlock()
+	if len(updates) == 0 {
+		return nil
+	}
+	latest := updates[len(updates)-1]
+	// the CONs of an update are only the new ones, the ACCs are all the monitor had on file
+	poms := []definition.Gossip_object{}
+	for _, update := range updates {
+		poms = append(poms, update.CONs...)
+	}
+	poms = append(poms, latest.ACCs...)
+	failed := make(map[int]bool)
+	for _, i := range definition.Verify_PayloadThreshold_Batch(poms, c.Monitor_crypto_config) {
+		fmt.Println(util.RED+"Dropped the stored", definition.TypeString(poms[i].Type), "against", poms[i].Payload[0], "for period", poms[i].Period+": verification failed", util.RESET)
+		failed[i] = true
+	}
+	for i, pom := range poms {
+		if failed[i] {
+			continue
+		}
+		if pom.Type == definition.CON_FULL {
+			if err := definition.Verify_CON_evidence(pom, c.Monitor_crypto_config); err != nil {
+				fmt.Println(util.RED+"Dropped the stored CON_FULL against", pom.Payload[0]+":", err, util.RESET)
+				continue
+			}
+		}
+		switch pom.Type {
+		case definition.CON_FULL:
+			(*c.Storage_CONFLICT_POM)[pom.GetID()] = pom
+		case definition.ACC_FULL:
+			(*c.Storage_ACCUSATION_POM)[pom.GetID()] = pom
+		}
+	}
+	// like the ACCs, the disputes of the latest update are all the monitor had on file
+	for _, dis := range latest.DISs {
+		if err := dis.Verify(c.Monitor_crypto_config); err != nil {
+			fmt.Println(util.RED+"Dropped the stored dispute of", dis.Payload[0]+":", err, util.RESET)
+			continue
+		}
+		(*c.Storage_DISPUTE)[dis.GetID()] = dis
+	}
+	if latest.NUM_FULL.Signature != "" {
+		if err := latest.NUM_FULL.Verify(c.Monitor_crypto_config); err == nil {
+			*c.Storage_NUM_FULL = latest.NUM_FULL
+		} else {
+			fmt.Println(util.RED+"Dropped the stored NUM_FULL:", err, util.RESET)
+		}
+	}
+	if period, err := strconv.Atoi(latest.Period); err == nil {
+		c.Period_Offset = strconv.Itoa(period - latest_period)
+	}
+	fmt.Println(util.BLUE, "Restored", c.GetObjectNumber(definition.CON_FULL), "CON_FULL,", c.GetObjectNumber(definition.ACC_FULL), "ACC_FULL and", len(c.Storage_CRV), "CRVs from Period", latest_period, util.RESET)
+	return nil
 }
 
 func (c *MonitorContext) GetObject(id definition.Gossip_ID) definition.Gossip_object {
@@ -180,12 +295,21 @@ func (c *MonitorContext) GetObject(id definition.Gossip_ID) definition.Gossip_ob
 	case definition.REV_FULL:
 		obj := (*c.Storage_REV_FULL)[id]
 		return obj
+	case definition.KEY_FULL:
+		obj := (*c.Storage_KEY_FULL)[id]
+		return obj
+	case definition.DIS_INIT:
+		obj := (*c.Storage_DISPUTE)[id]
+		return obj
 	case definition.STH_INIT:
 		obj := (*c.Storage_TEMP)[id]
 		return obj
 	case definition.REV_INIT:
 		obj := (*c.Storage_TEMP)[id]
 		return obj
+	case definition.KEY_INIT:
+		obj := (*c.Storage_TEMP)[id]
+		return obj
 	}
 	return definition.Gossip_object{}
 
@@ -214,6 +338,12 @@ func (c *MonitorContext) StoreObject(o definition.Gossip_object) {
 		(*c.Storage_REV_FULL)[o.GetID()] = o
 
 		fmt.Println(util.BLUE, "REV_FULL Stored", util.RESET)
+	case definition.KEY_FULL:
+		(*c.Storage_KEY_FULL)[o.GetID()] = o
+		fmt.Println(util.BLUE, "KEY_FULL Stored", util.RESET)
+	case definition.DIS_INIT:
+		(*c.Storage_DISPUTE)[o.GetID()] = o
+		fmt.Println(util.BLUE, "DISPUTE Stored", util.RESET)
 	default:
 		(*c.Storage_TEMP)[o.GetID()] = o
 	}
@@ -243,6 +373,19 @@ func (c *MonitorContext) WipeStorage() {
 			delete(*c.Storage_REV_FULL, key)
 		}
 	}
+	// the key rotations are already applied to the crypto config
+	for key := range *c.Storage_KEY_FULL {
+		if key.Period != util.GetCurrentPeriod() {
+			delete(*c.Storage_KEY_FULL, key)
+		}
+	}
+	// a dispute goes once the accusation it answers is gone
+	for key := range *c.Storage_DISPUTE {
+		acc := definition.Gossip_ID{Period: key.Period, Type: definition.ACC_FULL, Entity_URL: key.Entity_URL}
+		if _, ok := (*c.Storage_ACCUSATION_POM)[acc]; !ok {
+			delete(*c.Storage_DISPUTE, key)
+		}
+	}
 	fmt.Println(util.BLUE, "Temp storage has been wiped.", util.RESET)
 }
 
@@ -278,6 +421,10 @@ func InitializeMonitorContext(public_config_path string, private_config_path str
 	*storage_sth_full = make(definition.Gossip_Storage)
 	storage_rev_full := new(definition.Gossip_Storage)
 	*storage_rev_full = make(definition.Gossip_Storage)
+	storage_key_full := new(definition.Gossip_Storage)
+	*storage_key_full = make(definition.Gossip_Storage)
+	storage_dispute := new(definition.Gossip_Storage)
+	*storage_dispute = make(definition.Gossip_Storage)
 	ctx := MonitorContext{
 		Monitor_private_config:     priv,
 		Monitor_public_config:      pub,
@@ -288,9 +435,16 @@ func InitializeMonitorContext(public_config_path string, private_config_path str
 		Storage_ACCUSATION_POM:     storage_accusation_pom,
 		Storage_STH_FULL:           storage_sth_full,
 		Storage_REV_FULL:           storage_rev_full,
+		Storage_KEY_FULL:           storage_key_full,
+		Storage_DISPUTE:            storage_dispute,
 		Storage_NUM_FULL:           &definition.PoM_Counter{},
+		Storage_CRV:                make(map[string]*bitset.BitSet),
 		StorageID:                  storageID,
 		Mode:                       0,
+		Crypto_config_path:         crypto_config_path,
+		Update_index:               New_update_index(),
+		Gossiper_health:            New_gossiper_health(),
+		Metrics:                    metrics.New_CTng_metrics(),
 	}
 	return &ctx
 }
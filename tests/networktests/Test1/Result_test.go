@@ -122,8 +122,8 @@ func TestCertificateResult(t *testing.T) {
 	ctx.HandleUpdate(update_1, true, true)
 	ctx.HandleUpdate(update_2, true, true)
 	ctx.HandleUpdate(update_3, true, true)
-	if !ctx.VerifyCTngextension(cert) {
-		fmt.Println("Certificate verification failed")
+	if _, err := ctx.VerifyCTngextension(cert); err != nil {
+		fmt.Println("Certificate verification failed:", err)
 		//t.Fail()
 	}
 
@@ -45,7 +45,7 @@ func main() {
 	}
 }
 
-func GenerateRootCA(ID string, ctx crypto.CryptoConfig) *x509.Certificate {
+func GenerateRootCA(ID string, ctx *crypto.CryptoConfig) *x509.Certificate {
 	// set up our CA certificate
 	ID_int, _ := strconv.Atoi(ID)
 	ca := &x509.Certificate{
@@ -13,7 +13,7 @@ func testCreatecerts(t *testing.T) {
 	path := path_prefix + "/CA_crypto_config.json"
 	cryptoconf, _ := crypto.ReadCryptoConfig(path)
 	privK := cryptoconf.SignSecretKey
-	root := GenerateRootCA("1", *cryptoconf)
+	root := GenerateRootCA("1", cryptoconf)
 	util.SaveCertificateToDisk(root.Raw, "ca_cert.crt")
 	cert, key := GenerateDummyCert("1", root, privK)
 	util.SaveCertificateToDisk(cert.Raw, "subject_cert.crt")
@@ -24,7 +24,7 @@ func testCreateRoot(t *testing.T) {
 	path_prefix := "../ca_testconfig/1"
 	path := path_prefix + "/CA_crypto_config.json"
 	cryptoconf, _ := crypto.ReadCryptoConfig(path)
-	root := GenerateRootCA("1", *cryptoconf)
+	root := GenerateRootCA("1", cryptoconf)
 	util.SaveCertificateToDisk(root.Raw, "ca_cert.crt")
 }
 
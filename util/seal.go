@@ -0,0 +1,154 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase based encryption of private keys at rest.
+// scrypt derives an AES-256 key from the passphrase and a random salt, AES-GCM encrypts and authenticates the data.
+
+// Interactive login parameters recommended by the scrypt paper (about 100ms and 32MB).
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+// The environment variable the entities read the passphrase of their key files from.
+const PASSPHRASE_ENV = "CTNG_KEY_PASSPHRASE"
+
+// PEM block type of the keys written by SaveEncryptedKeyToDisk.
+const ENCRYPTED_KEY_PEM = "CTNG ENCRYPTED PRIVATE KEY"
+
+type SealedData struct {
+	KDF        string // "scrypt" is the only valid value currently.
+	Salt       []byte
+	N          int
+	R          int
+	P          int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func SealWithPassphrase(passphrase string, plaintext []byte, additional []byte) (*SealedData, error) {
+	sealed := &SealedData{KDF: "scrypt", Salt: make([]byte, 16), N: SCRYPT_N, R: SCRYPT_R, P: SCRYPT_P}
+	_, err := rand.Read(sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealed.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(sealed.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plaintext, additional)
+	return sealed, nil
+}
+
+// Returns an error if the passphrase is wrong or the data was tampered with.
+func OpenWithPassphrase(passphrase string, sealed *SealedData, additional []byte) ([]byte, error) {
+	aead, err := sealed.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, additional)
+	if err != nil {
+		return nil, errors.New("Wrong passphrase or corrupted key data")
+	}
+	return plaintext, nil
+}
+
+func (s *SealedData) aead(passphrase string) (cipher.AEAD, error) {
+	if s.KDF != "scrypt" {
+		return nil, errors.New("Key derivation function not supported: " + s.KDF)
+	}
+	key, err := scrypt.Key([]byte(passphrase), s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The encrypted counterpart of SaveKeyToDisk. The PKCS8 key is the ciphertext of the PEM block,
+// the scrypt parameters and the nonce are stored in its headers.
+func SaveEncryptedKeyToDisk(privKey *rsa.PrivateKey, filePath string, passphrase string) error {
+	privBytes, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := SealWithPassphrase(passphrase, privBytes, []byte(ENCRYPTED_KEY_PEM))
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{
+		Type: ENCRYPTED_KEY_PEM,
+		Headers: map[string]string{
+			"KDF":   sealed.KDF,
+			"Salt":  hex.EncodeToString(sealed.Salt),
+			"N":     strconv.Itoa(sealed.N),
+			"R":     strconv.Itoa(sealed.R),
+			"P":     strconv.Itoa(sealed.P),
+			"Nonce": hex.EncodeToString(sealed.Nonce),
+		},
+		Bytes: sealed.Ciphertext,
+	}
+	return os.WriteFile(filePath, pem.EncodeToMemory(block), 0600)
+}
+
+func ReadEncryptedKeyFromDisk(filePath string, passphrase string) (*rsa.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil || block.Type != ENCRYPTED_KEY_PEM {
+		return nil, errors.New("failed to decode encrypted private key PEM data")
+	}
+	sealed := &SealedData{KDF: block.Headers["KDF"], Ciphertext: block.Bytes}
+	sealed.Salt, err = hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce, err = hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+	for name, param := range map[string]*int{"N": &sealed.N, "R": &sealed.R, "P": &sealed.P} {
+		*param, err = strconv.Atoi(block.Headers[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	privBytes, err := OpenWithPassphrase(passphrase, sealed, []byte(ENCRYPTED_KEY_PEM))
+	if err != nil {
+		return nil, err
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(privBytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}